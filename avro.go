@@ -0,0 +1,303 @@
+package cdskit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// avroBlockSize is the number of records of a block of the container file
+const avroBlockSize = 1000
+
+// avroExportWriter writes an Avro object container file without compression, every
+// field is nullable, embedded entities are records and arrays array fields
+type avroExportWriter struct {
+	w    io.Writer
+	kind string
+	// schema is given by --columnar-schema or inferred from the first records
+	schema  *columnSchema
+	sample  []*dynamicEntity
+	started bool
+	sync    [16]byte
+	block   bytes.Buffer
+	record  bytes.Buffer
+	count   int
+}
+
+// avroRecord and avroField are the JSON schema of a record
+type avroRecord struct {
+	Type      string      `json:"type"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace,omitempty"`
+	Fields    []avroField `json:"fields"`
+}
+
+type avroField struct {
+	Name    string      `json:"name"`
+	Type    interface{} `json:"type"`
+	Default interface{} `json:"default"`
+}
+
+func (format *avroExportWriter) WriteHeader() error {
+	if format.schema != nil {
+		return format.start()
+	}
+	return nil
+}
+
+func (format *avroExportWriter) WriterRecord(de *dynamicEntity) error {
+	if format.schema == nil {
+		format.sample = append(format.sample, de)
+		if len(format.sample) < columnarSampleSize {
+			return nil
+		}
+		if err := format.inferSchema(); err != nil {
+			return &outputError{err}
+		}
+		return nil
+	}
+
+	if err := format.appendRecord(de); err != nil {
+		return err
+	}
+	if format.count == avroBlockSize {
+		if err := format.flushBlock(); err != nil {
+			return &outputError{err}
+		}
+	}
+	return nil
+}
+
+func (format *avroExportWriter) WriteFooter() error {
+	if format.schema == nil {
+		if err := format.inferSchema(); err != nil {
+			return err
+		}
+	}
+	if !format.started {
+		if err := format.start(); err != nil {
+			return err
+		}
+	}
+	return format.flushBlock()
+}
+
+// inferSchema writes the header with the schema of the sampled records and adds the records
+func (format *avroExportWriter) inferSchema() error {
+	schema, err := inferColumnSchema(format.sample)
+	if err != nil {
+		return err
+	}
+	format.schema = schema
+	if err := format.start(); err != nil {
+		return err
+	}
+
+	for _, de := range format.sample {
+		if err := format.appendRecord(de); err != nil {
+			return fmt.Errorf("Unable to convert entity %s: %w", de.key, err)
+		}
+		if format.count == avroBlockSize {
+			if err := format.flushBlock(); err != nil {
+				return err
+			}
+		}
+	}
+	format.sample = nil
+	return nil
+}
+
+// start writes the magic, the metadata with the schema and the sync marker
+func (format *avroExportWriter) start() error {
+	record, err := avroSchema(&format.schema.columnField, bqColumnName(format.kind))
+	if err != nil {
+		return err
+	}
+	record.Namespace = "cdskit"
+	schema, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := rand.Read(format.sync[:]); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Obj\x01")
+	avroLong(&buf, 2)
+	avroBytes(&buf, []byte("avro.schema"))
+	avroBytes(&buf, schema)
+	avroBytes(&buf, []byte("avro.codec"))
+	avroBytes(&buf, []byte("null"))
+	avroLong(&buf, 0)
+	buf.Write(format.sync[:])
+
+	format.started = true
+	_, err = format.w.Write(buf.Bytes())
+	return err
+}
+
+// avroSchema returns the record of the fields, names are made valid Avro names the
+// way BigQuery column names are and nested records are named after their path
+func avroSchema(f *columnField, name string) (avroRecord, error) {
+	record := avroRecord{Type: "record", Name: name, Fields: make([]avroField, 0, len(f.fields))}
+	names := make(map[string]string)
+	for _, c := range f.fields {
+		fieldName := bqColumnName(c.name)
+		if prev, ok := names[fieldName]; ok {
+			return record, fmt.Errorf("Properties %s and %s of %s are both named %s in Avro", prev, c.name, name, fieldName)
+		}
+		names[fieldName] = c.name
+
+		var typ interface{}
+		switch c.kind {
+		case "record":
+			nested, err := avroSchema(c, name+"_"+fieldName)
+			if err != nil {
+				return record, err
+			}
+			typ = nested
+		case "int64":
+			typ = "long"
+		case "double":
+			typ = "double"
+		case "bool":
+			typ = "boolean"
+		case "bytes":
+			typ = "bytes"
+		case "timestamp":
+			typ = map[string]string{"type": "long", "logicalType": "timestamp-micros"}
+		default:
+			typ = "string"
+		}
+		if c.repeated {
+			typ = map[string]interface{}{"type": "array", "items": typ}
+		}
+		record.Fields = append(record.Fields, avroField{Name: fieldName, Type: []interface{}{"null", typ}})
+	}
+	return record, nil
+}
+
+// appendRecord adds the record to the block, nothing is added when a value doesn't fit
+func (format *avroExportWriter) appendRecord(de *dynamicEntity) error {
+	if err := format.schema.checkRecord(&format.schema.columnField, de.value); err != nil {
+		return err
+	}
+
+	format.record.Reset()
+	if err := encodeAvroRecord(&format.record, &format.schema.columnField, de.value); err != nil {
+		return err
+	}
+	format.block.Write(format.record.Bytes())
+	format.count++
+	return nil
+}
+
+func encodeAvroRecord(buf *bytes.Buffer, record *columnField, m map[string]interface{}) error {
+	for _, f := range record.fields {
+		v := m[f.name]
+		if v == nil {
+			avroLong(buf, 0)
+			continue
+		}
+		avroLong(buf, 1)
+
+		if !f.repeated {
+			if _, ok := v.([]interface{}); ok && f.kind != "json" {
+				return fmt.Errorf("Property %s is an array, the field isn't", f.name)
+			}
+			if err := encodeAvroValue(buf, f, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		if len(values) > 0 {
+			avroLong(buf, int64(len(values)))
+			for _, e := range values {
+				if err := encodeAvroValue(buf, f, e); err != nil {
+					return err
+				}
+			}
+		}
+		avroLong(buf, 0)
+	}
+	return nil
+}
+
+func encodeAvroValue(buf *bytes.Buffer, f *columnField, v interface{}) error {
+	if f.kind == "record" {
+		nested, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Property %s: %T value in a record field", f.name, v)
+		}
+		if err := encodeAvroRecord(buf, f, nested); err != nil {
+			return fmt.Errorf("%s.%w", f.name, err)
+		}
+		return nil
+	}
+
+	pv, err := convertLeaf(f.kind, v)
+	if err != nil {
+		return fmt.Errorf("Property %s: %w", f.name, err)
+	}
+	switch tv := pv.(type) {
+	case int64:
+		avroLong(buf, tv)
+	case float64:
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(tv))
+	case bool:
+		if tv {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case []byte:
+		avroBytes(buf, tv)
+	}
+	return nil
+}
+
+// flushBlock writes the buffered records as a block
+func (format *avroExportWriter) flushBlock() error {
+	if format.count == 0 {
+		return nil
+	}
+
+	var header bytes.Buffer
+	avroLong(&header, int64(format.count))
+	avroLong(&header, int64(format.block.Len()))
+	if _, err := format.w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := format.w.Write(format.block.Bytes()); err != nil {
+		return err
+	}
+	if _, err := format.w.Write(format.sync[:]); err != nil {
+		return err
+	}
+
+	format.block.Reset()
+	format.count = 0
+	return nil
+}
+
+// avroLong writes a zigzag encoded variable-length integer, as binary.PutVarint does
+func avroLong(buf *bytes.Buffer, v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutVarint(b, v)])
+}
+
+func avroBytes(buf *bytes.Buffer, b []byte) {
+	avroLong(buf, int64(len(b)))
+	buf.Write(b)
+}
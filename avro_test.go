@@ -0,0 +1,207 @@
+package cdskit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// avroReader decodes the records of an Avro object container file by its schema
+type avroReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *avroReader) long() int64 {
+	v, n := binary.Varint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *avroReader) bytes() []byte {
+	n := int(r.long())
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// value decodes a value of the schema given as parsed JSON
+func (r *avroReader) value(t *testing.T, schema interface{}) interface{} {
+	switch s := schema.(type) {
+	case string:
+		switch s {
+		case "null":
+			return nil
+		case "boolean":
+			r.pos++
+			return r.b[r.pos-1] == 1
+		case "long":
+			return r.long()
+		case "double":
+			v := math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.pos:]))
+			r.pos += 8
+			return v
+		case "bytes":
+			return append([]byte{}, r.bytes()...)
+		case "string":
+			return string(r.bytes())
+		}
+	case []interface{}:
+		return r.value(t, s[r.long()])
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record":
+			m := make(map[string]interface{})
+			for _, f := range s["fields"].([]interface{}) {
+				field := f.(map[string]interface{})
+				if v := r.value(t, field["type"]); v != nil {
+					m[field["name"].(string)] = v
+				}
+			}
+			return m
+		case "array":
+			var values []interface{}
+			for {
+				n := r.long()
+				if n == 0 {
+					return values
+				}
+				if n < 0 {
+					n = -n
+					r.long()
+				}
+				for i := int64(0); i < n; i++ {
+					values = append(values, r.value(t, s["items"]))
+				}
+			}
+		default:
+			// a primitive with a logical type
+			return r.value(t, s["type"])
+		}
+	}
+	t.Fatalf("unsupported schema %v", schema)
+	return nil
+}
+
+// readAvro decodes an uncompressed Avro object container file into its schema and records
+func readAvro(t *testing.T, b []byte) (map[string]interface{}, []interface{}) {
+	t.Helper()
+
+	if string(b[:4]) != "Obj\x01" {
+		t.Fatalf("no Avro magic")
+	}
+	r := &avroReader{b: b, pos: 4}
+	meta := make(map[string]string)
+	for {
+		n := r.long()
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			n = -n
+			r.long()
+		}
+		for i := int64(0); i < n; i++ {
+			key := string(r.bytes())
+			meta[key] = string(r.bytes())
+		}
+	}
+	if codec := meta["avro.codec"]; codec != "" && codec != "null" {
+		t.Fatalf("codec %s, want null", codec)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal([]byte(meta["avro.schema"]), &schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	sync := r.b[r.pos : r.pos+16]
+	r.pos += 16
+
+	var records []interface{}
+	for r.pos < len(r.b) {
+		count, size := r.long(), int(r.long())
+		end := r.pos + size
+		for i := int64(0); i < count; i++ {
+			records = append(records, r.value(t, schema))
+		}
+		if r.pos != end {
+			t.Fatalf("block of %d bytes, records read %d", size, r.pos-(end-size))
+		}
+		if !bytes.Equal(r.b[r.pos:r.pos+16], sync) {
+			t.Fatalf("block not followed by the sync marker")
+		}
+		r.pos += 16
+	}
+	return schema, records
+}
+
+func TestExportAvro(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 30, 0, 250000000, time.UTC)
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{
+			"name":    "a",
+			"n":       1,
+			"price":   1.5,
+			"ok":      true,
+			"created": created,
+			"data":    []byte{0, 1},
+			"tags":    []interface{}{1, 2},
+			"address": map[string]interface{}{"city": "Berlin"},
+		}),
+		fakeEntity("Item", 2, map[string]interface{}{
+			"name":    "b",
+			"n":       2,
+			"price":   2.0,
+			"ok":      false,
+			"created": created.Add(time.Hour),
+			"data":    []byte{9},
+		}),
+	}
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "avro", "no-key": true})
+
+	schema, records := readAvro(t, []byte(out))
+	if schema["name"] != "Item" || schema["namespace"] != "cdskit" {
+		t.Errorf("schema is named %v.%v, want cdskit.Item", schema["namespace"], schema["name"])
+	}
+
+	for _, f := range schema["fields"].([]interface{}) {
+		field := f.(map[string]interface{})
+		if field["name"] != "created" {
+			continue
+		}
+		want := []interface{}{"null", map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}}
+		if !reflect.DeepEqual(field["type"], want) {
+			t.Errorf("created has type %v, want %v", field["type"], want)
+		}
+	}
+
+	micros := created.UnixNano() / 1000
+	want := []interface{}{
+		map[string]interface{}{
+			"name":    "a",
+			"n":       int64(1),
+			"price":   1.5,
+			"ok":      true,
+			"created": micros,
+			"data":    []byte{0, 1},
+			"tags":    []interface{}{int64(1), int64(2)},
+			"address": map[string]interface{}{"city": "Berlin"},
+		},
+		map[string]interface{}{
+			"name":    "b",
+			"n":       int64(2),
+			"price":   2.0,
+			"ok":      false,
+			"created": micros + 3600e6,
+			"data":    []byte{9},
+		},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("file has records %v, want %v", records, want)
+	}
+}
@@ -0,0 +1,284 @@
+package cdskit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupManifest describes a backup directory, it's written after all kinds are exported.
+// Format is the format given by --format, every kind records the format of its file.
+type backupManifest struct {
+	Project   string       `json:"project"`
+	Namespace string       `json:"namespace"`
+	Format    string       `json:"format"`
+	Started   time.Time    `json:"started"`
+	Finished  time.Time    `json:"finished"`
+	Kinds     []backupKind `json:"kinds"`
+}
+
+// backupKind is an exported kind of a backup
+type backupKind struct {
+	Kind     string    `json:"kind"`
+	File     string    `json:"file"`
+	Format   string    `json:"format,omitempty"`
+	Entities int       `json:"entities"`
+	SHA256   string    `json:"sha256"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+const backupManifestFile = "manifest.json"
+
+// kindFormat returns the format of the file of the kind, manifests written before
+// per-kind formats have the format of the backup only
+func (manifest *backupManifest) kindFormat(k backupKind) string {
+	if k.Format != "" {
+		return k.Format
+	}
+	return manifest.Format
+}
+
+// backupConfig is the file given by backup --config
+type backupConfig struct {
+	Kinds map[string]struct {
+		Format string `json:"format"`
+	} `json:"kinds"`
+}
+
+// backupExtensions are the file extensions of the formats a backup can be written in
+var backupExtensions = map[string]string{
+	"typed-json": ".json",
+	"json":       ".json",
+	"jsonl":      ".jsonl",
+	"csv":        ".csv",
+	"msgpack":    ".msgpack",
+}
+
+// BackupCmd exports every kind of a namespace into a directory with a manifest
+type BackupCmd struct {
+	ProjectID string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace string `short:"n" long:"namespace" description:"Namespace to back up"`
+	Kinds     string `short:"k" long:"kinds" description:"Comma separated kinds to back up, all kinds of the namespace by default"`
+	SkipKinds string `long:"skip-kinds" description:"Kinds not to back up, comma separated glob patterns, e.g. Session,Log*"`
+	Dir       string `short:"d" long:"dir" description:"Directory to write the backup to, one file per kind and manifest.json" required:"true"`
+	Format    string `long:"format" default:"typed-json" choice:"typed-json" choice:"json" choice:"jsonl" choice:"csv" choice:"msgpack" description:"Format of the files of kinds without a format in --config, typed-json keeps every value type for restore"`
+	Config    string `long:"config" description:"JSON file with formats of kinds, e.g. {\"kinds\": {\"Event\": {\"format\": \"jsonl\"}, \"Country\": {\"format\": \"csv\"}}}"`
+}
+
+// kindFormats reads the formats of kinds given by --config
+func (cmd *BackupCmd) kindFormats() (map[string]string, error) {
+	formats := make(map[string]string)
+	if cmd.Config == "" {
+		return formats, nil
+	}
+
+	b, err := ioutil.ReadFile(cmd.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config backupConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", cmd.Config, err)
+	}
+
+	for kind, c := range config.Kinds {
+		if _, ok := backupExtensions[c.Format]; !ok {
+			return nil, fmt.Errorf("Unsupported format '%s' of kind %s in %s, expected typed-json, json, jsonl, csv or msgpack", c.Format, kind, cmd.Config)
+		}
+		formats[kind] = c.Format
+	}
+	return formats, nil
+}
+
+// Execute is called by go-flags
+func (cmd *BackupCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(true)
+	defer cancel()
+
+	manifestPath := filepath.Join(cmd.Dir, backupManifestFile)
+	if _, err := os.Stat(manifestPath); err == nil {
+		return fmt.Errorf("%s already contains a backup", cmd.Dir)
+	}
+	formats, err := cmd.kindFormats()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cmd.Dir, 0755); err != nil {
+		return err
+	}
+
+	manifest := &backupManifest{Project: cmd.ProjectID, Namespace: cmd.Namespace, Format: cmd.Format, Started: time.Now().UTC()}
+
+	kinds := strings.Split(cmd.Kinds, ",")
+	if cmd.Kinds == "" {
+		dsClient, err := newClient(ctx, cmd.ProjectID)
+		if err != nil {
+			return err
+		}
+
+		kinds, err = metadataKinds(ctx, dsClient, cmd.Namespace)
+		dsClient.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to load list of kinds: %w", err)
+		}
+	}
+	kinds, err = skipKinds(kinds, cmd.SkipKinds)
+	if err != nil {
+		return err
+	}
+	if len(kinds) == 0 {
+		return fmt.Errorf("No kinds left to back up after --skip-kinds %s", cmd.SkipKinds)
+	}
+
+	for i, kind := range kinds {
+		infof("Backing up %s (%d/%d)", kind, i+1, len(kinds))
+
+		format, ok := formats[kind]
+		if !ok {
+			format = cmd.Format
+		}
+		file := url.PathEscape(kind) + backupExtensions[format]
+		job, err := parseExportJob(map[string]interface{}{
+			"project":   cmd.ProjectID,
+			"namespace": cmd.Namespace,
+			"kind":      kind,
+			"format":    format,
+			"output":    filepath.Join(cmd.Dir, file),
+		})
+		if err != nil {
+			return err
+		}
+
+		started := time.Now().UTC()
+		if err := job.run(ctx); err != nil {
+			return fmt.Errorf("Backup of %s failed: %w", kind, err)
+		}
+
+		sum, err := fileSHA256(filepath.Join(cmd.Dir, file))
+		if err != nil {
+			return err
+		}
+
+		manifest.Kinds = append(manifest.Kinds, backupKind{
+			Kind:     kind,
+			File:     file,
+			Format:   format,
+			Entities: job.stats.Records,
+			SHA256:   sum,
+			Started:  started,
+			Finished: time.Now().UTC(),
+		})
+	}
+
+	manifest.Finished = time.Now().UTC()
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	infof("Backed up %d kinds to %s", len(manifest.Kinds), cmd.Dir)
+	return nil
+}
+
+// RestoreCmd imports a directory written by backup into a project
+type RestoreCmd struct {
+	ProjectID string `short:"p" long:"project" description:"Project to restore into." required:"true"`
+	Namespace string `short:"n" long:"namespace" description:"Namespace to restore into, the namespace of the backup by default"`
+	Kinds     string `short:"k" long:"kinds" description:"Comma separated kinds to restore, all kinds of the backup by default"`
+	Dir       string `short:"d" long:"dir" description:"Directory of the backup" required:"true"`
+	DryRun    bool   `long:"dry-run" description:"Verify and read the backup and print how many entities would be restored without writing them"`
+}
+
+// Execute is called by go-flags
+func (cmd *RestoreCmd) Execute(args []string) error {
+	manifestPath := filepath.Join(cmd.Dir, backupManifestFile)
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read the backup manifest: %w", err)
+	}
+
+	var manifest backupManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("Invalid backup manifest %s: %w", manifestPath, err)
+	}
+
+	namespace := cmd.Namespace
+	if namespace == "" {
+		namespace = manifest.Namespace
+	}
+
+	kinds := manifest.Kinds
+	if cmd.Kinds != "" {
+		selected := make(map[string]bool)
+		for _, kind := range strings.Split(cmd.Kinds, ",") {
+			selected[kind] = true
+		}
+
+		kinds = nil
+		for _, k := range manifest.Kinds {
+			if selected[k.Kind] {
+				kinds = append(kinds, k)
+			}
+		}
+	}
+
+	// all files are verified first so a damaged backup isn't restored partly
+	for _, k := range kinds {
+		sum, err := fileSHA256(filepath.Join(cmd.Dir, k.File))
+		if err != nil {
+			return err
+		}
+		if sum != k.SHA256 {
+			return fmt.Errorf("Checksum of %s doesn't match the manifest, the backup is damaged", k.File)
+		}
+	}
+
+	for i, k := range kinds {
+		infof("Restoring %s, %d entities (%d/%d)", k.Kind, k.Entities, i+1, len(kinds))
+
+		// parsed as options so the defaults of import-kind, e.g. the CSV delimiter, apply
+		imp := &ImportKindCmd{}
+		err := parseOptions(imp, map[string]interface{}{
+			"project":   cmd.ProjectID,
+			"namespace": namespace,
+			"kind":      k.Kind,
+			"file":      filepath.Join(cmd.Dir, k.File),
+			"format":    manifest.kindFormat(k),
+			"dry-run":   cmd.DryRun,
+		})
+		if err != nil {
+			return err
+		}
+		if err := imp.Execute(nil); err != nil {
+			return fmt.Errorf("Restore of %s failed: %w", k.Kind, err)
+		}
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
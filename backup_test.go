@@ -0,0 +1,95 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestBackupKindFormats(t *testing.T) {
+	startFakeDatastore(t, []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{"name": "a"}),
+		fakeEntity("Event", 1, map[string]interface{}{"type": "click"}),
+		fakeEntity("Country", 1, map[string]interface{}{"code": "DE"}),
+	})
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(config, []byte(`{"kinds": {"Event": {"format": "jsonl"}, "Country": {"format": "csv"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := &BackupCmd{ProjectID: "test", Kinds: "Item,Event,Country", Dir: filepath.Join(dir, "backup"), Format: "typed-json", Config: config}
+	if err := backup.Execute(nil); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(backup.Dir, backupManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]string{
+		"Item":    {"Item.json", "typed-json"},
+		"Event":   {"Event.jsonl", "jsonl"},
+		"Country": {"Country.csv", "csv"},
+	}
+	if len(manifest.Kinds) != len(want) {
+		t.Fatalf("manifest has %d kinds, want %d", len(manifest.Kinds), len(want))
+	}
+	for _, k := range manifest.Kinds {
+		if got := [2]string{k.File, manifest.kindFormat(k)}; got != want[k.Kind] || k.Entities != 1 {
+			t.Errorf("kind %s has file and format %v and %d entities, want %v and 1", k.Kind, got, k.Entities, want[k.Kind])
+		}
+	}
+
+	// the reader of every kind is picked by the format of the kind
+	restore := &RestoreCmd{ProjectID: "test", Dir: backup.Dir, DryRun: true}
+	if err := restore.Execute(nil); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+}
+
+func TestBackupSkipKinds(t *testing.T) {
+	startFakeDatastore(t, []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{"name": "a"}),
+		fakeEntity("Session", 1, map[string]interface{}{"user": "u"}),
+		fakeEntity("LogEntry", 1, map[string]interface{}{"msg": "m"}),
+	})
+
+	backup := &BackupCmd{ProjectID: "test", SkipKinds: "Session, Log*", Dir: filepath.Join(t.TempDir(), "backup"), Format: "typed-json"}
+	if err := backup.Execute(nil); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(backup.Dir, backupManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest backupManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Kinds) != 1 || manifest.Kinds[0].Kind != "Item" {
+		t.Errorf("manifest has kinds %+v, want only Item", manifest.Kinds)
+	}
+}
+
+func TestBackupConfigUnsupportedFormat(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(config, []byte(`{"kinds": {"Event": {"format": "yaml"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &BackupCmd{Format: "typed-json", Config: config}
+	if _, err := cmd.kindFormats(); err == nil {
+		t.Error("kindFormats accepted the yaml format")
+	}
+}
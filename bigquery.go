@@ -0,0 +1,354 @@
+package cdskit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// bqTimestamp is a timestamp rendered with the microsecond precision of BigQuery
+type bqTimestamp time.Time
+
+func (t bqTimestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).UTC().Format("2006-01-02T15:04:05.999999Z"))
+}
+
+// bqGeography is a geo point in the WKT form BigQuery loads into GEOGRAPHY columns
+type bqGeography string
+
+// bqField is a column of a BigQuery table schema in the JSON form used by bq and the API
+type bqField struct {
+	Name   string     `json:"name"`
+	Type   string     `json:"type"`
+	Mode   string     `json:"mode"`
+	Fields []*bqField `json:"fields,omitempty"`
+}
+
+// bqSchema is inferred from all exported records, it's shared by the parts of a split export
+type bqSchema struct {
+	fields []*bqField
+	// conflicts are reported once per column
+	conflicts map[string]bool
+}
+
+func newBigQuerySchema() *bqSchema {
+	return &bqSchema{conflicts: make(map[string]bool)}
+}
+
+// bigQueryExportWriter writes JSON lines with values and names BigQuery can load
+// into the inferred schema: embedded entities become records and arrays repeated fields
+type bigQueryExportWriter struct {
+	writer io.Writer
+	schema *bqSchema
+}
+
+func (format bigQueryExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *bigQueryExportWriter) WriterRecord(de *dynamicEntity) error {
+	rec := bqRecord(de.value)
+	format.schema.fields = format.schema.merge(format.schema.fields, rec, "")
+
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal entry: %w", err)
+	}
+	if _, err := format.writer.Write(append(v, '\n')); err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
+	}
+	return nil
+}
+
+func (format bigQueryExportWriter) WriteFooter() error {
+	return nil
+}
+
+// bqRecord renames fields to valid BigQuery column names at all levels of nesting
+func bqRecord(m map[string]interface{}) map[string]interface{} {
+	rec := make(map[string]interface{}, len(m))
+	for name, v := range m {
+		rec[bqColumnName(name)] = bqValue(v)
+	}
+	return rec
+}
+
+func bqValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return bqRecord(v)
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			values = append(values, bqValue(e))
+		}
+		return values
+	default:
+		return v
+	}
+}
+
+// bqColumnName replaces characters other than letters, digits and underscores,
+// a leading digit is prefixed with an underscore
+func bqColumnName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		b = append([]byte("_"), b...)
+	}
+	return string(b)
+}
+
+// bqType returns the column type of a value, empty for values which don't tell
+func bqType(v interface{}) string {
+	switch v.(type) {
+	case int64, int:
+		return "INTEGER"
+	case float64:
+		return "FLOAT"
+	case bool:
+		return "BOOLEAN"
+	case string:
+		return "STRING"
+	case bqTimestamp:
+		return "TIMESTAMP"
+	case bqGeography:
+		return "GEOGRAPHY"
+	case []byte:
+		return "BYTES"
+	case map[string]interface{}:
+		return "RECORD"
+	default:
+		return ""
+	}
+}
+
+// merge adds the columns of the record to fields, integers and floats in the same
+// column make it a FLOAT column, other conflicts keep the first type
+func (s *bqSchema) merge(fields []*bqField, rec map[string]interface{}, prefix string) []*bqField {
+	for name, v := range rec {
+		mode := "NULLABLE"
+		values := []interface{}{v}
+		if arr, ok := v.([]interface{}); ok {
+			mode, values = "REPEATED", arr
+		}
+
+		var f *bqField
+		for _, existing := range fields {
+			if existing.Name == name {
+				f = existing
+				break
+			}
+		}
+		if f == nil {
+			f = &bqField{Name: name, Mode: mode}
+			fields = append(fields, f)
+		}
+		if mode == "REPEATED" {
+			f.Mode = mode
+		}
+
+		for _, e := range values {
+			typ := bqType(e)
+			switch {
+			case typ == "" || typ == f.Type:
+			case f.Type == "":
+				f.Type = typ
+			case typ == "FLOAT" && f.Type == "INTEGER":
+				f.Type = typ
+			case typ == "INTEGER" && f.Type == "FLOAT":
+			default:
+				if !s.conflicts[prefix+name] {
+					s.conflicts[prefix+name] = true
+					warnf("column %s%s has values of types %s and %s, keeping %s", prefix, name, f.Type, typ, f.Type)
+				}
+			}
+
+			if m, ok := e.(map[string]interface{}); ok && f.Type == "RECORD" {
+				f.Fields = s.merge(f.Fields, m, prefix+name+".")
+			}
+		}
+	}
+	return fields
+}
+
+// columns returns the schema sorted by names, columns without a known type are strings
+func (s *bqSchema) columns() []*bqField {
+	var sortFields func([]*bqField) []*bqField
+	sortFields = func(fields []*bqField) []*bqField {
+		sorted := append([]*bqField{}, fields...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		for _, f := range sorted {
+			if f.Type == "" || f.Type == "RECORD" && len(f.Fields) == 0 {
+				f.Type, f.Fields = "STRING", nil
+			}
+			f.Fields = sortFields(f.Fields)
+		}
+		return sorted
+	}
+	return sortFields(s.fields)
+}
+
+// write stores the schema as a JSON array of columns accepted by bq load --schema
+func (s *bqSchema) write(path string) error {
+	b, err := json.MarshalIndent(s.columns(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("Unable to write BigQuery schema: %w", err)
+	}
+	infof("BigQuery schema written to %s", path)
+	return nil
+}
+
+// finishBigQuery writes the inferred schema and runs the --bq-load job, fileName is
+// the written export file
+func (cmd *ExportKindCmd) finishBigQuery(ctx context.Context, fileName string) error {
+	path := cmd.BigQuerySchema
+	if path == "" && cmd.Output != "-" && !strings.Contains(cmd.Output, "://") {
+		base := strings.TrimSuffix(fileName, ".gz")
+		path = strings.TrimSuffix(base, filepath.Ext(base)) + ".schema.json"
+	}
+	if path != "" {
+		if err := cmd.bqSchema.write(path); err != nil {
+			return err
+		}
+	}
+
+	if cmd.BigQueryLoad != "" {
+		return cmd.loadIntoBigQuery(ctx, cmd.uploaded)
+	}
+	return nil
+}
+
+// loadIntoBigQuery runs a load job of the uploaded objects into the table given as
+// [project:]dataset.table and waits for it to finish
+func (cmd *ExportKindCmd) loadIntoBigQuery(ctx context.Context, uris []string) error {
+	project, table := cmd.ProjectID, cmd.BigQueryLoad
+	if n := strings.Index(table, ":"); n >= 0 {
+		project, table = table[:n], table[n+1:]
+	}
+	parts := strings.SplitN(table, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Invalid BigQuery table %s, expected [project:]dataset.table", cmd.BigQueryLoad)
+	}
+
+	opts := append([]option.ClientOption{option.WithScopes("https://www.googleapis.com/auth/bigquery")}, clientOptions...)
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	disposition := "WRITE_APPEND"
+	if cmd.BigQueryReplace {
+		disposition = "WRITE_TRUNCATE"
+	}
+
+	job := map[string]interface{}{
+		"configuration": map[string]interface{}{
+			"load": map[string]interface{}{
+				"sourceUris":       uris,
+				"sourceFormat":     "NEWLINE_DELIMITED_JSON",
+				"destinationTable": map[string]string{"projectId": project, "datasetId": parts[0], "tableId": parts[1]},
+				"schema":           map[string]interface{}{"fields": cmd.bqSchema.columns()},
+				"writeDisposition": disposition,
+			},
+		},
+	}
+
+	endpoint := "https://bigquery.googleapis.com/bigquery/v2/projects/" + url.PathEscape(project) + "/jobs"
+	var status bqJob
+	if err := bqCall(ctx, client, "POST", endpoint, job, &status); err != nil {
+		return fmt.Errorf("Unable to start BigQuery load job: %w", err)
+	}
+	infof("Loading into %s:%s with BigQuery job %s", project, table, status.JobReference.JobID)
+
+	for status.Status.State != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+
+		u := endpoint + "/" + url.PathEscape(status.JobReference.JobID) + "?location=" + url.QueryEscape(status.JobReference.Location)
+		if err := bqCall(ctx, client, "GET", u, nil, &status); err != nil {
+			return fmt.Errorf("Unable to check BigQuery load job: %w", err)
+		}
+	}
+
+	if e := status.Status.ErrorResult; e != nil {
+		for _, detail := range status.Status.Errors {
+			warnf("BigQuery: %s", detail.Message)
+		}
+		return fmt.Errorf("BigQuery load job failed: %s", e.Message)
+	}
+	infof("Loaded into %s:%s", project, table)
+	return nil
+}
+
+// bqJob is the part of a BigQuery job resource used to follow a load job
+type bqJob struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string     `json:"state"`
+		ErrorResult *bqError   `json:"errorResult"`
+		Errors      []*bqError `json:"errors"`
+	} `json:"status"`
+}
+
+type bqError struct {
+	Message string `json:"message"`
+}
+
+// bqCall sends the request body as JSON and decodes the response into out
+func bqCall(ctx context.Context, client *http.Client, method string, endpoint string, body interface{}, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, endpoint, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,161 @@
+package cdskit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// canonicalJSON serializes the value following RFC 8785: object keys sorted by their
+// UTF-16 code units at all levels, no whitespace, minimal string escaping and numbers
+// formatted like ECMAScript does. Integers are kept exact instead of being converted
+// to doubles, so int64 values above 2^53 don't lose precision.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	// values with custom marshalers (times, keys) are normalized through encoding/json first
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeCanonicalString(buf, v)
+	case json.Number:
+		s, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return lessUTF16(names[i], names[j]) })
+
+		buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, name)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[name]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("Unsupported JSON value %T", v)
+	}
+	return nil
+}
+
+// canonicalNumber keeps integers as they are and formats other numbers like
+// ECMAScript Number.prototype.toString
+func canonicalNumber(n json.Number) (string, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if s == "-0" {
+			return "0", nil
+		}
+		return s, nil
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return "", err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("Invalid JSON number %s", s)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+
+	if abs := math.Abs(f); abs >= 1e-6 && abs < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+
+	// ECMAScript writes exponents without leading zeros and with an explicit sign
+	s = strconv.FormatFloat(f, 'e', -1, 64)
+	i := strings.IndexByte(s, 'e')
+	mantissa, sign, exp := s[:i], s[i+1], strings.TrimLeft(s[i+2:], "0")
+	return mantissa + "e" + string(sign) + exp, nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// lessUTF16 compares strings by UTF-16 code units as required for object keys
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
@@ -0,0 +1,76 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// exportCheckpoint is the progress of an export with --resume, stored next to the output
+// after every written batch
+type exportCheckpoint struct {
+	Cursor   string `json:"cursor"`
+	Entities int    `json:"entities"`
+	// Size is the length of the output with the entities written, anything after it
+	// is a partial batch dropped on resume
+	Size int64 `json:"size"`
+}
+
+// checkResumable rejects outputs an export can't be appended to
+func (cmd *ExportKindCmd) checkResumable() error {
+	if cmd.Format != "jsonl" && cmd.Format != "ndjson" {
+		return fmt.Errorf("--resume requires --format jsonl or ndjson, other formats can't be appended to")
+	}
+	if cmd.Output == "" || cmd.Output == "-" || strings.Contains(cmd.Output, "://") {
+		return fmt.Errorf("--resume requires --output with a file path")
+	}
+	if cmd.Gzip || cmd.Split > 0 || cmd.Workers > 1 || cmd.KeysFile != "" || cmd.SinceCursorFile != "" || cmd.IdempotentName {
+		return fmt.Errorf("--resume can't be combined with --gzip, --split, --workers, --keys-file, --since-cursor-file or --idempotent-name")
+	}
+	return nil
+}
+
+// readCheckpoint reads the checkpoint of the output and truncates the output to the
+// checkpoint size, a missing checkpoint means the export starts from the beginning.
+func readCheckpoint(fileName string) (*exportCheckpoint, error) {
+	b, err := ioutil.ReadFile(fileName + ".checkpoint")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c exportCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint %s.checkpoint: %w", fileName, err)
+	}
+
+	if err := os.Truncate(fileName, c.Size); err != nil {
+		return nil, fmt.Errorf("Unable to resume %s: %w", fileName, err)
+	}
+	return &c, nil
+}
+
+// writeCheckpoint replaces the checkpoint of the output, the file is renamed into
+// place so a crash doesn't leave a partial checkpoint
+func writeCheckpoint(fileName string, c exportCheckpoint) error {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	c.Size = fi.Size()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	path := fileName + ".checkpoint"
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,31 @@
+package cdskit
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+)
+
+// clientOptions are passed to every Google Cloud client, they are set by global flags
+var clientOptions []option.ClientOption
+
+// databaseID is the named database given by --database, the default database if empty
+var databaseID string
+
+// AddClientOptions adds options, e.g. credentials, to every Google Cloud client created afterwards
+func AddClientOptions(opts ...option.ClientOption) {
+	clientOptions = append(clientOptions, opts...)
+}
+
+// SetDatabase selects the named database of Datastore clients created afterwards
+func SetDatabase(id string) {
+	databaseID = id
+}
+
+// newClient connects to Datastore of the project with the credentials given by
+// --credentials-file, with application default credentials otherwise, impersonating
+// --impersonate-service-account if given, calls are bounded by --rpc-timeout
+func newClient(ctx context.Context, projectID string) (*datastore.Client, error) {
+	return datastore.NewClientWithDatabase(ctx, projectID, databaseID, append(rpcOptions(), clientOptions...)...)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dpfg/cdskit"
+	"github.com/jessevdk/go-flags"
+	"google.golang.org/api/option"
+)
+
+// Opts represent all available commands supported by utility
+type Opts struct {
+	Version         func()              `long:"version" description:"Show version and exit"`
+	CredentialsFile func(string)        `long:"credentials-file" description:"Service account key file to authenticate with instead of application default credentials"`
+	Credentials     func(string)        `long:"credentials" hidden:"true" description:"Alias of --credentials-file"`
+	Impersonate     func(string)        `long:"impersonate-service-account" description:"Service account email to impersonate, the base credentials need the Service Account Token Creator role on it"`
+	Database        func(string)        `long:"database" description:"Named database of the project, e.g. a Firestore database in Datastore mode, the default database otherwise"`
+	EmulatorHost    func(string)        `long:"emulator-host" description:"Datastore emulator to connect to without credentials, e.g. localhost:8081, instead of DATASTORE_EMULATOR_HOST"`
+	MaxRPS          func(float64)       `long:"max-rps" description:"Maximum number of Datastore calls per second, to leave capacity to production traffic"`
+	Timeout         func(time.Duration) `long:"timeout" description:"Stop the command after the duration, e.g. 2h, exports write out the entities fetched until then"`
+	RPCTimeout      func(time.Duration) `long:"rpc-timeout" description:"Fail Datastore calls taking longer than the duration, e.g. 30s, they're retried like other transient errors"`
+	MaxBandwidth    func(string) error  `long:"max-bandwidth" description:"Maximum rate of Cloud Storage uploads and downloads, e.g. 20MB/s"`
+	Verbose         func()              `short:"v" long:"verbose" description:"Log debug messages, e.g. the timing of every batch"`
+	Quiet           func()              `short:"q" long:"quiet" description:"Log only warnings and errors"`
+	LogFormat       func(string)        `long:"log-format" choice:"text" choice:"json" description:"Format of the messages written to stderr, json writes a JSON object per line"`
+	Profile         string              `long:"profile" env:"CDSKIT_PROFILE" description:"Profile of the config file whose options are the defaults, e.g. project, namespace, credentials-file, emulator-host and output-dir"`
+	Config          string              `long:"config" env:"CDSKIT_CONFIG" default:"~/.cdskit.yaml" description:"Config file with the profiles"`
+
+	BackupCmd         cdskit.BackupCmd         `command:"backup" description:"Export every kind of a namespace into a directory with a manifest"`
+	ConvertBackupCmd  cdskit.ConvertBackupCmd  `command:"convert-backup" description:"Convert the files of a managed export to JSON or CSV without restoring them"`
+	CopyKindCmd       cdskit.CopyKindCmd       `command:"copy-kind" description:"Copy entities of a kind to another namespace, project or kind"`
+	CountKindCmd      cdskit.CountKindCmd      `command:"count" description:"Count entities of a kind or of every kind"`
+	DecryptCmd        cdskit.DecryptCmd        `command:"decrypt" description:"Decrypt a file written by export-kind --encrypt"`
+	DeleteAllCmd      cdskit.DeleteAllCmd      `command:"delete-all" description:"Delete all entities"`
+	DeleteKeysCmd     cdskit.DeleteKeysCmd     `command:"delete-keys" description:"Delete the entities listed in a file of keys or an export"`
+	DedupeCmd         cdskit.DedupeCmd         `command:"dedupe" description:"Find entities of a kind with the same values of properties and delete the duplicates"`
+	DiffCmd           cdskit.DiffCmd           `command:"diff" description:"Compare entities of a kind with another namespace, project or kind, or with an export file"`
+	ExportAllCmd      cdskit.ExportAllCmd      `command:"export-all" description:"Run the export-kind jobs of a config file in sequence"`
+	ExportKindCmd     cdskit.ExportKindCmd     `command:"export-kind" description:"Export all entities to a JSON or CSV"`
+	ImportKindCmd     cdskit.ImportKindCmd     `command:"import-kind" description:"Import entities from a CSV or JSON export"`
+	InferSchemaCmd    cdskit.InferSchemaCmd    `command:"infer-schema" description:"Report property types, nullability and list sizes observed in a kind"`
+	ListKindsCmd      cdskit.ListKindsCmd      `command:"list-kinds" description:"List kinds of a namespace"`
+	ListNamespacesCmd cdskit.ListNamespacesCmd `command:"list-namespaces" description:"List namespaces of a project"`
+	ManagedExportCmd  cdskit.ManagedExportCmd  `command:"managed-export" description:"Export entities to Cloud Storage using the Datastore Admin API"`
+	MigrateCmd        cdskit.MigrateCmd        `command:"migrate" description:"Copy kinds to another namespace or project, renaming kinds and allocating new IDs"`
+	QueryCmd          cdskit.QueryCmd          `command:"query" description:"Run a GQL query and export its results"`
+	RestoreCmd        cdskit.RestoreCmd        `command:"restore" description:"Import a backup directory into a project"`
+	ServeCmd          cdskit.ServeCmd          `command:"serve" description:"Run export, import and delete jobs submitted over an HTTP API"`
+	StatsCmd          cdskit.StatsCmd          `command:"stats" description:"Print entity counts and sizes of kinds from the Datastore statistics"`
+	TouchCmd          cdskit.TouchCmd          `command:"touch" description:"Write entities of a kind back unchanged to reindex them"`
+	UpdateFieldCmd    cdskit.UpdateFieldCmd    `command:"update-field" description:"Set, rename or delete properties of entities of a kind"`
+	VerifyCmd         cdskit.VerifyCmd         `command:"verify" description:"Check that the entities of an export file or a backup exist in a project"`
+	VerifyManifestCmd cdskit.VerifyManifestCmd `command:"verify-manifest" description:"Check the files of an export against the checksums of its manifest"`
+	VersionCmd        cdskit.VersionCmd        `command:"version" description:"Show version of the build"`
+}
+
+func main() {
+
+	var opts Opts
+	opts.Version = func() {
+		opts.VersionCmd.Execute(nil)
+		os.Exit(0)
+	}
+	opts.CredentialsFile = func(path string) {
+		cdskit.AddClientOptions(option.WithCredentialsFile(path))
+	}
+	opts.Credentials = opts.CredentialsFile
+	opts.Impersonate = func(email string) {
+		cdskit.AddClientOptions(option.ImpersonateCredentials(email))
+	}
+	// the datastore client connects to the emulator without credentials when the variable is set
+	opts.EmulatorHost = func(host string) {
+		os.Setenv("DATASTORE_EMULATOR_HOST", host)
+		fmt.Fprintf(os.Stderr, "Using Datastore emulator at %s\n", host)
+	}
+
+	opts.Database = cdskit.SetDatabase
+	opts.MaxRPS = cdskit.SetMaxRPS
+	opts.MaxBandwidth = cdskit.SetMaxBandwidth
+	opts.Timeout = cdskit.SetTimeout
+	opts.RPCTimeout = cdskit.SetRPCTimeout
+	opts.Verbose = cdskit.SetVerbose
+	opts.Quiet = cdskit.SetQuiet
+	opts.LogFormat = func(format string) {
+		cdskit.SetLogFormat(format)
+	}
+
+	// errors are logged, so they're JSON lines as well with --log-format json
+	p := flags.NewParser(&opts, flags.Default&^flags.PrintErrors)
+
+	args, err := applyProfile(p, os.Args[1:])
+	if err != nil {
+		cdskit.LogError(err)
+		os.Exit(1)
+	}
+
+	if _, err := p.ParseArgs(args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			fmt.Println(err)
+			os.Exit(0)
+		} else if errors.Is(err, cdskit.ErrInterrupted) {
+			cdskit.LogError(err)
+			os.Exit(130)
+		} else if errors.Is(err, cdskit.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+			cdskit.LogError(err)
+			os.Exit(124)
+		} else if errors.Is(err, cdskit.ErrIncomplete) {
+			cdskit.LogError(err)
+			os.Exit(2)
+		} else {
+			cdskit.LogError(err)
+			os.Exit(1)
+		}
+	}
+}
+
+// applyProfile makes the options of the --profile the defaults of the commands, global
+// options of the profile go ahead of the given arguments, so the given ones still win
+func applyProfile(p *flags.Parser, args []string) ([]string, error) {
+	// --config is only global ahead of the command, export-all has one of its own
+	global := args
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "-") && p.Find(arg) != nil {
+			global = args[:i]
+			break
+		}
+	}
+
+	var profile struct {
+		Profile string `long:"profile" env:"CDSKIT_PROFILE"`
+	}
+	var config struct {
+		Config string `long:"config" env:"CDSKIT_CONFIG" default:"~/.cdskit.yaml"`
+	}
+	if _, err := flags.NewParser(&profile, flags.IgnoreUnknown).ParseArgs(args); err != nil {
+		return nil, err
+	}
+	if profile.Profile == "" {
+		return args, nil
+	}
+	if _, err := flags.NewParser(&config, flags.IgnoreUnknown).ParseArgs(global); err != nil {
+		return nil, err
+	}
+
+	options, err := cdskit.LoadProfile(config.Config, profile.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var prepend []string
+	for _, name := range names {
+		if p.Command.FindOptionByLongName(name) != nil {
+			prepend = append(prepend, fmt.Sprintf("--%s=%s", name, options[name]))
+			continue
+		}
+
+		found := false
+		for _, cmd := range p.Commands() {
+			opt := cmd.FindOptionByLongName(name)
+			if opt == nil {
+				continue
+			}
+			if opt.Field().Type.Kind() == reflect.Bool {
+				return nil, fmt.Errorf("Option %s of profile %s is a switch, profiles can only give values", name, profile.Profile)
+			}
+			opt.Default = []string{options[name]}
+			opt.Required = false
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown option %s in profile %s", name, profile.Profile)
+		}
+	}
+	return append(prepend, args...), nil
+}
@@ -0,0 +1,277 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// columnarSampleSize is the number of records the Parquet and Avro schemas are
+// inferred from, they're buffered until then
+const columnarSampleSize = 10000
+
+// columnField is a column of the Parquet and Avro formats, embedded entities become
+// records and arrays repeated fields
+type columnField struct {
+	name string
+	// kind is one of int64, double, bool, string, bytes, timestamp, json or record
+	kind     string
+	repeated bool
+	fields   []*columnField
+}
+
+func (f *columnField) field(name string) *columnField {
+	for _, c := range f.fields {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// columnSchema is the record of the exported entities, explicit schemas given by
+// --columnar-schema leave out other properties
+type columnSchema struct {
+	columnField
+	explicit bool
+}
+
+// inferColumnSchema merges the types of the values of the records, properties
+// without a value in any of them are left out
+func inferColumnSchema(sample []*dynamicEntity) (*columnSchema, error) {
+	schema := &columnSchema{columnField: columnField{kind: "record"}}
+	for _, de := range sample {
+		if err := schema.merge(de.value, ""); err != nil {
+			return nil, err
+		}
+	}
+	schema.finish()
+	return schema, nil
+}
+
+// merge adds the properties of the record to the fields, path names nested properties in errors
+func (f *columnField) merge(m map[string]interface{}, path string) error {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		v := m[name]
+		if v == nil {
+			continue
+		}
+
+		c := f.field(name)
+		if c == nil {
+			c = &columnField{name: name}
+		}
+		values := []interface{}{v}
+		if a, ok := v.([]interface{}); ok {
+			c.repeated, values = true, a
+		}
+		for _, e := range values {
+			if err := c.mergeValue(e, path+name); err != nil {
+				return err
+			}
+		}
+		if c.kind != "" && f.field(name) == nil {
+			f.fields = append(f.fields, c)
+		}
+	}
+	return nil
+}
+
+func (f *columnField) mergeValue(v interface{}, path string) error {
+	kind := columnKind(v)
+	switch {
+	case kind == "":
+		return nil
+	case f.kind == "" || f.kind == kind:
+		f.kind = kind
+	case f.kind == "int64" && kind == "double" || f.kind == "double" && kind == "int64":
+		f.kind = "double"
+	default:
+		return fmt.Errorf("Property %s has %s and %s values, columns need a single type", path, f.kind, kind)
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		return f.merge(m, path+".")
+	}
+	return nil
+}
+
+// finish orders the fields by name and turns records without fields into JSON
+// columns, they'd be invalid groups
+func (f *columnField) finish() {
+	sort.Slice(f.fields, func(i, j int) bool { return f.fields[i].name < f.fields[j].name })
+	for _, c := range f.fields {
+		if c.kind == "record" && len(c.fields) == 0 {
+			c.kind = "json"
+		}
+		c.finish()
+	}
+}
+
+// columnKind returns the column kind of an exported value, arrays within arrays are JSON
+func columnKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return "int64"
+	case float64:
+		return "double"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case time.Time:
+		return "timestamp"
+	case []byte:
+		return "bytes"
+	case map[string]interface{}:
+		return "record"
+	default:
+		return "json"
+	}
+}
+
+// loadColumnSchema reads a BigQuery JSON schema, e.g. one written by --bq-schema
+func loadColumnSchema(path string) (*columnSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the schema: %w", err)
+	}
+
+	var fields []*bqField
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("Invalid schema %s, expected a JSON array of BigQuery fields: %w", path, err)
+	}
+
+	schema := &columnSchema{columnField: columnField{kind: "record"}, explicit: true}
+	if schema.fields, err = columnFields(fields); err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+func columnFields(fields []*bqField) ([]*columnField, error) {
+	columns := make([]*columnField, 0, len(fields))
+	for _, f := range fields {
+		c := &columnField{name: f.Name, repeated: strings.EqualFold(f.Mode, "REPEATED")}
+		switch strings.ToUpper(f.Type) {
+		case "STRING", "GEOGRAPHY":
+			c.kind = "string"
+		case "INTEGER", "INT64":
+			c.kind = "int64"
+		case "FLOAT", "FLOAT64", "NUMERIC":
+			c.kind = "double"
+		case "BOOLEAN", "BOOL":
+			c.kind = "bool"
+		case "TIMESTAMP", "DATETIME":
+			c.kind = "timestamp"
+		case "BYTES":
+			c.kind = "bytes"
+		case "JSON":
+			c.kind = "json"
+		case "RECORD", "STRUCT":
+			c.kind = "record"
+			if len(f.Fields) == 0 {
+				return nil, fmt.Errorf("Record %s has no fields", f.Name)
+			}
+			var err error
+			if c.fields, err = columnFields(f.Fields); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported type %s of %s", f.Type, f.Name)
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// checkRecord fails on properties of the record missing from an inferred schema
+func (schema *columnSchema) checkRecord(f *columnField, m map[string]interface{}) error {
+	if schema.explicit {
+		return nil
+	}
+	for name, v := range m {
+		if v == nil {
+			continue
+		}
+		c := f.field(name)
+		if c == nil {
+			return fmt.Errorf("Property %s is not in the schema inferred from the first %d records", name, columnarSampleSize)
+		}
+		if c.kind != "record" {
+			continue
+		}
+		values := []interface{}{v}
+		if a, ok := v.([]interface{}); ok {
+			values = a
+		}
+		for _, e := range values {
+			if nested, ok := e.(map[string]interface{}); ok {
+				if err := schema.checkRecord(c, nested); err != nil {
+					return fmt.Errorf("%s.%w", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// convertLeaf turns an exported value into the Go value of a column kind other than record
+func convertLeaf(kind string, v interface{}) (interface{}, error) {
+	switch kind {
+	case "int64", "bool":
+		if columnKind(v) != kind {
+			return nil, fmt.Errorf("%T value in a %s column", v, kind)
+		}
+		return v, nil
+	case "double":
+		if i, ok := v.(int64); ok {
+			return float64(i), nil
+		}
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+		return nil, fmt.Errorf("%T value in a double column", v)
+	case "timestamp":
+		switch t := v.(type) {
+		case time.Time:
+			return t.UnixNano() / 1000, nil
+		case string:
+			parsed, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return nil, err
+			}
+			return parsed.UnixNano() / 1000, nil
+		}
+		return nil, fmt.Errorf("%T value in a timestamp column", v)
+	case "bytes":
+		switch b := v.(type) {
+		case []byte:
+			return b, nil
+		case string:
+			return []byte(b), nil
+		}
+		return nil, fmt.Errorf("%T value in a bytes column", v)
+	case "string":
+		switch s := v.(type) {
+		case string:
+			return []byte(s), nil
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%T value in a string column", v)
+		}
+		return []byte(fmt.Sprint(v)), nil
+	default:
+		return json.Marshal(v)
+	}
+}
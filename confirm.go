@@ -0,0 +1,40 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/Songmu/prompter"
+)
+
+// confirmProject prints what is about to change and asks to type the project ID, a
+// habitual "y" is not enough. Without a terminal nothing is read, so automation has
+// to pass --yes.
+func confirmProject(project string, lines []string) error {
+	fmt.Printf("Project: %s\n", project)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	if prompter.Prompt(fmt.Sprintf("Type the project ID %s to confirm", project), "") != project {
+		return fmt.Errorf("Not confirmed, pass --yes to run without confirmation")
+	}
+	return nil
+}
+
+// estimateCounts returns the entity counts of the kinds of the namespace from the
+// Datastore statistics, which are up to a couple of days old and missing for new
+// kinds. It returns nil when the statistics can't be loaded.
+func estimateCounts(ctx context.Context, client *datastore.Client, ns string) map[string]entityStat {
+	statKind := "__Stat_Kind__"
+	if ns != "" {
+		statKind = "__Stat_Ns_Kind__"
+	}
+
+	stats, err := loadStats(ctx, client, datastore.NewQuery(statKind).Namespace(ns), "kind_name")
+	if err != nil {
+		return nil
+	}
+	return stats
+}
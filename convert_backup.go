@@ -0,0 +1,581 @@
+package cdskit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ConvertBackupCmd converts the output files of a managed export into export files
+// without restoring them into a project
+type ConvertBackupCmd struct {
+	Input     string `short:"i" long:"input" description:"Managed export to read: a local directory or output-N file, or a gs://bucket/prefix" required:"true"`
+	Kinds     string `short:"k" long:"kinds" description:"Comma separated kinds to convert, all kinds of the export by default"`
+	Format    string `long:"format" default:"jsonl" choice:"csv" choice:"json" choice:"jsonl" choice:"ndjson" choice:"typed-json" description:"Format of the converted files"`
+	OutputDir string `short:"o" long:"output-dir" default:"exports" description:"Folder to write a file per kind to"`
+	NoKey     bool   `long:"no-key" description:"Do not add the __key__ field to the records"`
+}
+
+// convertedKind is the open output of a kind
+type convertedKind struct {
+	job     *ExportKindCmd
+	opts    *valueOptions
+	file    *os.File
+	writer  exportWriter
+	records int
+}
+
+// Execute is called by go-flags
+func (cmd *ConvertBackupCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	kinds := make(map[string]bool)
+	if cmd.Kinds != "" {
+		for _, k := range strings.Split(cmd.Kinds, ",") {
+			kinds[k] = true
+		}
+	}
+
+	files, open, err := cmd.listFiles(ctx)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No output-* files of a managed export in %s", cmd.Input)
+	}
+
+	if err := os.MkdirAll(cmd.OutputDir, 0755); err != nil {
+		return err
+	}
+
+	outputs := make(map[string]*convertedKind)
+	defer func() {
+		for _, o := range outputs {
+			o.file.Close()
+		}
+	}()
+
+	for i, name := range files {
+		// managed exports keep every kind in a kind_<name> directory
+		if dir := path.Base(path.Dir(filepath.ToSlash(name))); len(kinds) > 0 && strings.HasPrefix(dir, "kind_") && !kinds[strings.TrimPrefix(dir, "kind_")] {
+			continue
+		}
+		infof("Converting %s (%d/%d)", name, i+1, len(files))
+
+		if err := cmd.convertFile(open, name, kinds, outputs); err != nil {
+			return fmt.Errorf("Unable to convert %s: %w", name, err)
+		}
+	}
+
+	names := make([]string, 0, len(outputs))
+	for kind := range outputs {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+
+	for _, kind := range names {
+		o := outputs[kind]
+		if err := o.writer.WriteFooter(); err != nil {
+			return err
+		}
+		if err := o.file.Close(); err != nil {
+			return err
+		}
+		infof("Converted %d entities of %s to %s", o.records, kind, o.file.Name())
+	}
+	return nil
+}
+
+// listFiles returns the output-N files of the input sorted by name and the function to open them
+func (cmd *ConvertBackupCmd) listFiles(ctx context.Context) ([]string, func(string) (io.ReadCloser, error), error) {
+	isOutput := func(name string) bool {
+		return strings.HasPrefix(path.Base(name), "output-")
+	}
+
+	if !strings.HasPrefix(cmd.Input, "gs://") {
+		var files []string
+		err := filepath.Walk(cmd.Input, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() && (isOutput(name) || name == cmd.Input) {
+				files = append(files, name)
+			}
+			return nil
+		})
+		sort.Strings(files)
+
+		open := func(name string) (io.ReadCloser, error) {
+			return os.Open(name)
+		}
+		return files, open, err
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(cmd.Input, "gs://"), "/", 2)
+	if parts[0] == "" {
+		return nil, nil, fmt.Errorf("Invalid Cloud Storage input, expected gs://bucket/prefix: %s", cmd.Input)
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+
+	client, err := storage.NewClient(ctx, clientOptions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	bucket := client.Bucket(parts[0])
+
+	var files []string
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to list %s: %w", cmd.Input, err)
+		}
+		if isOutput(attrs.Name) {
+			files = append(files, attrs.Name)
+		}
+	}
+	sort.Strings(files)
+
+	open := func(name string) (io.ReadCloser, error) {
+		return bucket.Object(name).NewReader(ctx)
+	}
+	return files, open, nil
+}
+
+// convertFile writes the entities of the file to the outputs of their kinds
+func (cmd *ConvertBackupCmd) convertFile(open func(string) (io.ReadCloser, error), name string, kinds map[string]bool, outputs map[string]*convertedKind) error {
+	r, err := open(name)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	lr := &leveldbReader{r: bufio.NewReader(r)}
+	for {
+		rec, err := lr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		key, props, err := decodeEntityProto(rec)
+		if err != nil {
+			return err
+		}
+		if key == nil || (len(kinds) > 0 && !kinds[key.Kind]) {
+			continue
+		}
+
+		o, err := cmd.output(key.Kind, outputs)
+		if err != nil {
+			return err
+		}
+
+		de := &dynamicEntity{key: key, opts: o.opts}
+		if err := de.Load(props); err != nil {
+			return err
+		}
+		if err := o.job.prepare(de); err != nil {
+			return err
+		}
+		if err := o.writer.WriterRecord(de); err != nil {
+			return fmt.Errorf("Unable to write entity %s: %w", key, err)
+		}
+		o.records++
+	}
+}
+
+// output returns the output of the kind, opening it for the first entity
+func (cmd *ConvertBackupCmd) output(kind string, outputs map[string]*convertedKind) (*convertedKind, error) {
+	if o, ok := outputs[kind]; ok {
+		return o, nil
+	}
+
+	job, err := parseExportJob(map[string]interface{}{
+		"project": "-",
+		"kind":    kind,
+		"format":  cmd.Format,
+		"no-key":  cmd.NoKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(filepath.Join(cmd.OutputDir, url.PathEscape(kind)+"."+job.fileExtension()))
+	if err != nil {
+		return nil, err
+	}
+
+	o := &convertedKind{job: job, opts: job.valueOptions(), file: f, writer: job.newExportWriter(f)}
+	outputs[kind] = o
+	if err := o.writer.WriteHeader(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// leveldbReader reads the records of a LevelDB log file, the format of the output
+// files of managed exports: 32 KiB blocks of chunks with a checksum, length and type
+type leveldbReader struct {
+	r     io.Reader
+	block []byte
+	pos   int
+}
+
+const (
+	leveldbBlockSize  = 32768
+	leveldbHeaderSize = 7
+
+	leveldbFull   = 1
+	leveldbFirst  = 2
+	leveldbMiddle = 3
+	leveldbLast   = 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Next returns the next record or io.EOF
+func (lr *leveldbReader) Next() ([]byte, error) {
+	var rec []byte
+	fragmented := false
+
+	for {
+		if lr.pos+leveldbHeaderSize > len(lr.block) {
+			if lr.block == nil {
+				lr.block = make([]byte, leveldbBlockSize)
+			}
+			n, err := io.ReadFull(lr.r, lr.block[:leveldbBlockSize])
+			if err == io.EOF || (err == io.ErrUnexpectedEOF && n < leveldbHeaderSize) {
+				if fragmented {
+					return nil, fmt.Errorf("Truncated record at the end of the file")
+				}
+				return nil, io.EOF
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			lr.block, lr.pos = lr.block[:n], 0
+		}
+
+		header := lr.block[lr.pos : lr.pos+leveldbHeaderSize]
+		length := int(binary.LittleEndian.Uint16(header[4:6]))
+		typ := header[6]
+
+		// zero padding at the end of a block
+		if typ == 0 && length == 0 {
+			lr.pos = len(lr.block)
+			continue
+		}
+
+		start := lr.pos + leveldbHeaderSize
+		if start+length > len(lr.block) {
+			return nil, fmt.Errorf("Corrupt record, length %d exceeds the block", length)
+		}
+		data := lr.block[start : start+length]
+		lr.pos = start + length
+
+		crc := crc32.Update(crc32.Checksum([]byte{typ}, crc32c), crc32c, data)
+		if masked := ((crc >> 15) | (crc << 17)) + 0xa282ead8; masked != binary.LittleEndian.Uint32(header[0:4]) {
+			return nil, fmt.Errorf("Corrupt record, checksum mismatch")
+		}
+
+		switch typ {
+		case leveldbFull:
+			return append([]byte{}, data...), nil
+		case leveldbFirst:
+			rec, fragmented = append([]byte{}, data...), true
+		case leveldbMiddle, leveldbLast:
+			if !fragmented {
+				return nil, fmt.Errorf("Corrupt record, fragment without a first one")
+			}
+			rec = append(rec, data...)
+			if typ == leveldbLast {
+				return rec, nil
+			}
+		default:
+			return nil, fmt.Errorf("Corrupt record, unknown type %d", typ)
+		}
+	}
+}
+
+// meanings of the properties of the datastore_v3 EntityProto
+const (
+	meaningTimestamp  = 7
+	meaningBlob       = 14
+	meaningByteString = 16
+	meaningEntity     = 19
+	meaningEmptyList  = 24
+)
+
+// protoField is a field of an encoded protocol buffer message
+type protoField struct {
+	num protowire.Number
+	typ protowire.Type
+	// varint is set for varint and fixed fields, bytes for bytes and groups
+	varint uint64
+	bytes  []byte
+}
+
+// protoFields splits the message into its fields, groups are returned with their content
+// without the end group tag
+func protoFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.varint, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.varint = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		case protowire.StartGroupType:
+			f.bytes, n = protowire.ConsumeGroup(num, b)
+		default:
+			return nil, fmt.Errorf("Unexpected wire type %d of field %d", typ, num)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeEntityProto decodes a datastore_v3 EntityProto into its key and properties,
+// values of multiple properties are collected into lists
+func decodeEntityProto(b []byte) (*datastore.Key, []datastore.Property, error) {
+	fields, err := protoFields(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key *datastore.Key
+	var props []datastore.Property
+	lists := make(map[string]int)
+	for _, f := range fields {
+		switch f.num {
+		case 13:
+			if key, err = decodeReference(f.bytes, 14, false); err != nil {
+				return nil, nil, err
+			}
+		case 14, 15:
+			name, value, multiple, err := decodeProperty(f.bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !multiple {
+				props = append(props, datastore.Property{Name: name, Value: value, NoIndex: f.num == 15})
+				continue
+			}
+
+			i, ok := lists[name]
+			if !ok {
+				i = len(props)
+				lists[name] = i
+				props = append(props, datastore.Property{Name: name, Value: []interface{}{}, NoIndex: f.num == 15})
+			}
+			if value != emptyList {
+				props[i].Value = append(props[i].Value.([]interface{}), value)
+			}
+		}
+	}
+	return key, props, nil
+}
+
+// emptyList is the value of a property stored as an empty list
+var emptyList = &struct{}{}
+
+// decodeProperty decodes a Property message
+func decodeProperty(b []byte) (string, interface{}, bool, error) {
+	fields, err := protoFields(b)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var name string
+	var meaning uint64
+	var multiple bool
+	var value []byte
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			meaning = f.varint
+		case 3:
+			name = string(f.bytes)
+		case 4:
+			multiple = f.varint != 0
+		case 5:
+			value = f.bytes
+		}
+	}
+
+	if meaning == meaningEmptyList {
+		return name, emptyList, true, nil
+	}
+	v, err := decodePropertyValue(value, meaning)
+	return name, v, multiple, err
+}
+
+// decodePropertyValue converts a PropertyValue message into a value as loaded by the
+// datastore client
+func decodePropertyValue(b []byte, meaning uint64) (interface{}, error) {
+	fields, err := protoFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			if meaning == meaningTimestamp {
+				// microseconds since the epoch
+				us := int64(f.varint)
+				return time.Unix(us/1e6, (us%1e6)*1e3), nil
+			}
+			return int64(f.varint), nil
+		case 2:
+			return f.varint != 0, nil
+		case 3:
+			switch meaning {
+			case meaningBlob, meaningByteString:
+				return append([]byte{}, f.bytes...), nil
+			case meaningEntity:
+				key, props, err := decodeEntityProto(f.bytes)
+				if err != nil {
+					return nil, err
+				}
+				return &datastore.Entity{Key: key, Properties: props}, nil
+			default:
+				return string(f.bytes), nil
+			}
+		case 4:
+			return math.Float64frombits(f.varint), nil
+		case 5:
+			var p datastore.GeoPoint
+			sub, err := protoFields(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				switch s.num {
+				case 6:
+					p.Lat = math.Float64frombits(s.varint)
+				case 7:
+					p.Lng = math.Float64frombits(s.varint)
+				}
+			}
+			return p, nil
+		case 8:
+			// users aren't supported by Cloud Datastore, the email is kept
+			sub, err := protoFields(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				if s.num == 9 {
+					return string(s.bytes), nil
+				}
+			}
+			return nil, nil
+		case 12:
+			return decodeReference(f.bytes, 14, true)
+		}
+	}
+	return nil, nil
+}
+
+// decodeReference decodes the key of a Reference message or ReferenceValue group,
+// path is the field of the path, a Path message or, in values, a group of elements
+func decodeReference(b []byte, path protowire.Number, value bool) (*datastore.Key, error) {
+	fields, err := protoFields(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var namespace string
+	var elements [][]byte
+	for _, f := range fields {
+		switch {
+		case f.num == 20:
+			namespace = string(f.bytes)
+		case f.num == path && value:
+			elements = append(elements, f.bytes)
+		case f.num == path:
+			sub, err := protoFields(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sub {
+				if s.num == 1 {
+					elements = append(elements, s.bytes)
+				}
+			}
+		}
+	}
+
+	// elements of values are numbered 15-17, of keys 2-4
+	first := protowire.Number(2)
+	if value {
+		first = 15
+	}
+
+	var key *datastore.Key
+	for _, e := range elements {
+		sub, err := protoFields(e)
+		if err != nil {
+			return nil, err
+		}
+
+		k := &datastore.Key{Parent: key, Namespace: namespace}
+		for _, s := range sub {
+			switch s.num {
+			case first:
+				k.Kind = string(s.bytes)
+			case first + 1:
+				k.ID = int64(s.varint)
+			case first + 2:
+				k.Name = string(s.bytes)
+			}
+		}
+		key = k
+	}
+	return key, nil
+}
@@ -0,0 +1,286 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// CopyKindCmd copies entities of a kind to another namespace or project without an intermediate file
+type CopyKindCmd struct {
+	SrcProjectID  string   `long:"src-project" description:"Project to copy from" required:"true"`
+	SrcNamespace  string   `long:"src-namespace" description:"Namespace to copy from"`
+	DstProjectID  string   `long:"dst-project" description:"Project to copy to, the source project by default"`
+	DstNamespace  string   `long:"dst-namespace" description:"Namespace to copy to"`
+	Kind          string   `short:"k" long:"kind" description:"Kind to copy" required:"true"`
+	DstKind       string   `long:"dst-kind" description:"Kind to copy to, the source kind by default"`
+	DeleteSource  bool     `long:"delete-source" description:"Delete the copied entities from the source after checking that all of them exist in the destination, e.g. to rename a kind with --dst-kind"`
+	Ancestor      string   `long:"ancestor" description:"Copy only the entity group below the key given as a Kind:id/Kind:name path, e.g. Customer:42, a Kind/id path or an encoded key"`
+	DryRun        bool     `long:"dry-run" description:"Print how many entities would be copied without copying them"`
+	Yes           bool     `long:"yes" description:"Delete the source with --delete-source without asking to type the project ID"`
+	Force         bool     `long:"force" description:"Same as --yes"`
+	MaxRetries    int      `long:"max-retries" default:"5" description:"Attempts to repeat a failed read or write on contention or quota errors"`
+	Transforms    []string `long:"transform" description:"Change entities before they're written, as export-kind --transform does, values keep their Datastore types"`
+	Transactional bool     `long:"transactional" description:"Copy entity group by group, reading the entities of the kind below a root in a read-only transaction and writing them in one transaction, retried on contention, so a group never appears half-copied"`
+
+	ancestor *datastore.Key
+}
+
+// Execute is called by go-flags
+func (cmd *CopyKindCmd) Execute(args []string) error {
+	dstProject, dstKind := cmd.DstProjectID, cmd.DstKind
+	if dstProject == "" {
+		dstProject = cmd.SrcProjectID
+	}
+	if dstKind == "" {
+		dstKind = cmd.Kind
+	}
+
+	if dstProject == cmd.SrcProjectID && cmd.DstNamespace == cmd.SrcNamespace && dstKind == cmd.Kind {
+		return fmt.Errorf("Source and destination are the same: %s/%s/%s", dstProject, cmd.DstNamespace, dstKind)
+	}
+
+	if cmd.Ancestor != "" {
+		var err error
+		cmd.ancestor, err = parseAncestor(cmd.Ancestor, cmd.SrcNamespace)
+		if err != nil {
+			return fmt.Errorf("Invalid --ancestor %s: %w", cmd.Ancestor, err)
+		}
+	}
+
+	ts, err := parseTransforms(cmd.Transforms)
+	if err != nil {
+		return err
+	}
+	if cmd.DeleteSource && ts.drops() {
+		return fmt.Errorf("--delete-source can't be combined with drop-if or keep-if transforms, dropped entities would be missing in the destination")
+	}
+
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	srcClient, err := newClient(ctx, cmd.SrcProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer srcClient.Close()
+
+	if cmd.DryRun {
+		n, err := countQuery(ctx, srcClient, cmd.newQuery(), cmd.Kind)
+		if err != nil {
+			return err
+		}
+		infof("%d entities would be copied to '%s/%s'", n, dstProject, cmd.DstNamespace)
+		return nil
+	}
+
+	if cmd.DeleteSource && !cmd.Yes && !cmd.Force {
+		estimate := "count unknown"
+		if stat, ok := estimateCounts(ctx, srcClient, cmd.SrcNamespace)[cmd.Kind]; ok {
+			estimate = fmt.Sprintf("about %d entities", stat.Count)
+			if cmd.ancestor != nil {
+				estimate = fmt.Sprintf("entities below %s of about %d", keyPath(cmd.ancestor), stat.Count)
+			}
+		}
+		lines := []string{fmt.Sprintf("Will copy %s/%s to %s/%s/%s and delete the source - %s", cmd.SrcNamespace, cmd.Kind, dstProject, cmd.DstNamespace, dstKind, estimate)}
+		if err := confirmProject(cmd.SrcProjectID, lines); err != nil {
+			return err
+		}
+	}
+
+	dstClient, err := newClient(ctx, dstProject)
+	if err != nil {
+		return err
+	}
+
+	defer dstClient.Close()
+
+	infof("Copying '%s' from '%s/%s' to '%s/%s'", cmd.Kind, cmd.SrcProjectID, cmd.SrcNamespace, dstProject, cmd.DstNamespace)
+
+	opts := &valueOptions{raw: true, includeNulls: true}
+	copied, read := 0, 0
+	started := time.Now()
+	if cmd.Transactional {
+		if read, copied, err = cmd.copyGroups(ctx, srcClient, dstClient, dstKind, ts); err != nil {
+			return err
+		}
+	}
+	var start datastore.Cursor
+	for !cmd.Transactional {
+		batchStarted := time.Now()
+		q := cmd.newQuery().Start(start).Limit(500)
+
+		var batch []*dynamicEntity
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, start, err = fetchPage(ctx, srcClient, q, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", cmd.Kind, err)
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+		read += len(batch)
+
+		if batch, err = ts.applyBatch(batch); err != nil {
+			return err
+		}
+
+		keys := make([]*datastore.Key, len(batch))
+		for i, de := range batch {
+			keys[i] = remapKey(de.key, dstKind, cmd.DstNamespace)
+		}
+
+		err = withRetries(ctx, cmd.MaxRetries, func() error {
+			_, err := dstClient.PutMulti(ctx, keys, batch)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to write %s: %w", dstKind, err)
+		}
+
+		copied += len(batch)
+		logEvent(logDebug, logFields{"event": "batch", "entities": len(batch), "seconds": time.Since(batchStarted).Seconds()},
+			"Batch of %d entities in %s", len(batch), time.Since(batchStarted).Round(time.Millisecond))
+		infof("Copying %s - %d", cmd.Kind, copied)
+	}
+
+	logEvent(logInfo, logFields{"event": "summary", "kind": cmd.Kind, "namespace": cmd.SrcNamespace, "read": read, "written": copied, "elapsed_seconds": time.Since(started).Seconds()},
+		"Copied %d entities", copied)
+
+	if cmd.DeleteSource {
+		return cmd.deleteSource(ctx, srcClient, dstClient, dstKind)
+	}
+	return nil
+}
+
+// copyGroups copies the entity groups having entities of the kind in transactions, the
+// group below --ancestor is copied in a single one
+func (cmd *CopyKindCmd) copyGroups(ctx context.Context, srcClient, dstClient *datastore.Client, dstKind string, ts transforms) (int, int, error) {
+	gc := &groupCopy{
+		src:     srcClient,
+		dst:     dstClient,
+		retries: cmd.MaxRetries,
+		query: func(root *datastore.Key) *datastore.Query {
+			return datastore.NewQuery(cmd.Kind).Namespace(cmd.SrcNamespace).Ancestor(root)
+		},
+		prepare: func(batch []*dynamicEntity) ([]*datastore.Key, []*dynamicEntity, error) {
+			batch, err := ts.applyBatch(batch)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys := make([]*datastore.Key, len(batch))
+			for i, de := range batch {
+				keys[i] = remapKey(de.key, dstKind, cmd.DstNamespace)
+			}
+			return keys, batch, nil
+		},
+	}
+
+	read, copied, groups := 0, 0, 0
+	copyGroup := func(root *datastore.Key) error {
+		r, w, err := gc.copy(ctx, root)
+		read, copied, groups = read+r, copied+w, groups+1
+		if err != nil {
+			return fmt.Errorf("%w, %d entities of %d groups were copied", err, copied, groups-1)
+		}
+		if groups%100 == 0 {
+			infof("Copying %s - %d entities of %d groups", cmd.Kind, copied, groups)
+		}
+		return nil
+	}
+
+	var err error
+	if cmd.ancestor != nil {
+		err = copyGroup(cmd.ancestor)
+	} else {
+		err = forEachRoot(ctx, srcClient, cmd.newQuery(), cmd.MaxRetries, copyGroup)
+	}
+	if err == nil {
+		infof("Copied %d entity groups", groups)
+	}
+	return read, copied, err
+}
+
+// newQuery selects the source entities of the kind, of the --ancestor group if given
+func (cmd *CopyKindCmd) newQuery() *datastore.Query {
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.SrcNamespace)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(cmd.ancestor)
+	}
+	return q
+}
+
+// deleteSource checks that every source entity has a copy and deletes the source
+// entities then, nothing is deleted when a copy is missing
+func (cmd *CopyKindCmd) deleteSource(ctx context.Context, srcClient, dstClient *datastore.Client, dstKind string) error {
+	var keys []*datastore.Key
+	err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+		keys, err = srcClient.GetAll(ctx, cmd.newQuery().KeysOnly(), nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to read keys of %s: %w", cmd.Kind, err)
+	}
+
+	for i := 0; i < len(keys); i += 500 {
+		batch := keys[i:min(i+500, len(keys))]
+		dstKeys := make([]*datastore.Key, len(batch))
+		for j, k := range batch {
+			dstKeys[j] = remapKey(k, dstKind, cmd.DstNamespace)
+		}
+
+		entities := make([]datastore.PropertyList, len(dstKeys))
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			return dstClient.GetMulti(ctx, dstKeys, entities)
+		})
+		if merr, ok := err.(datastore.MultiError); ok {
+			for j, e := range merr {
+				if e == datastore.ErrNoSuchEntity {
+					return fmt.Errorf("%s has no copy, no source entity was deleted", keyPath(batch[j]))
+				}
+			}
+			err = nil
+			for _, e := range merr {
+				if e != nil {
+					err = e
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to verify copies of %s: %w", cmd.Kind, err)
+		}
+		infof("Verifying %s - %d", dstKind, i+len(batch))
+	}
+
+	for i := 0; i < len(keys); i += 500 {
+		batch := keys[i:min(i+500, len(keys))]
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			return srcClient.DeleteMulti(ctx, batch)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to delete %s: %w", cmd.Kind, err)
+		}
+		infof("Deleting %s - %d", cmd.Kind, i+len(batch))
+	}
+
+	infof("Deleted %d source entities", len(keys))
+	return nil
+}
+
+// remapKey returns the key moved to the namespace with the entity itself renamed to kind,
+// the IDs, names and kinds of ancestors are kept
+func remapKey(k *datastore.Key, kind string, namespace string) *datastore.Key {
+	var parent *datastore.Key
+	if k.Parent != nil {
+		parent = remapKey(k.Parent, k.Parent.Kind, namespace)
+	}
+
+	return &datastore.Key{Kind: kind, ID: k.ID, Name: k.Name, Parent: parent, Namespace: namespace}
+}
@@ -0,0 +1,129 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// CountKindCmd prints the number of entities of a kind or of every kind
+type CountKindCmd struct {
+	ProjectID string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace string   `short:"n" long:"namespace" description:"Namespace to count entities in"`
+	Kind      string   `short:"k" long:"kind" description:"Kind to count, all kinds by default"`
+	Filters   []string `long:"filter" description:"Count only entities matching field OP value with OP one of =, >, >=, <, <=, e.g. status=active (repeatable, all must match)"`
+	Ancestor  string   `long:"ancestor" description:"Count only the entity group below the key given as a Kind:id/Kind:name path, e.g. Customer:42, a Kind/id path or an encoded key"`
+
+	filters  []queryFilter
+	ancestor *datastore.Key
+}
+
+// Execute is called by go-flags
+func (cmd *CountKindCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	for _, s := range cmd.Filters {
+		f, err := parseFilter(s)
+		if err != nil {
+			return err
+		}
+		cmd.filters = append(cmd.filters, f)
+	}
+
+	if cmd.Ancestor != "" {
+		var err error
+		cmd.ancestor, err = parseAncestor(cmd.Ancestor, cmd.Namespace)
+		if err != nil {
+			return fmt.Errorf("Invalid --ancestor %s: %w", cmd.Ancestor, err)
+		}
+	}
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	if cmd.Kind != "" {
+		n, err := countQuery(ctx, dsClient, cmd.newQuery(cmd.Kind), cmd.Kind)
+		if err != nil {
+			return err
+		}
+		fmt.Println(n)
+		return nil
+	}
+
+	kinds, err := metadataKinds(ctx, dsClient, cmd.Namespace)
+	if err != nil {
+		return fmt.Errorf("Unable to load list of kinds: %w", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tCOUNT")
+	for _, kind := range kinds {
+		n, err := countQuery(ctx, dsClient, cmd.newQuery(kind), kind)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", kind, n)
+	}
+	return tw.Flush()
+}
+
+// newQuery selects entities of the kind matching --filter and --ancestor
+func (cmd *CountKindCmd) newQuery(kind string) *datastore.Query {
+	q := datastore.NewQuery(kind).Namespace(cmd.Namespace)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(cmd.ancestor)
+	}
+	for _, f := range cmd.filters {
+		q = q.Filter(f.field+" "+f.op, f.value)
+	}
+	return q
+}
+
+// countKind counts entities with keys-only queries paged by cursors,
+// so no entity is loaded.
+func countKind(ctx context.Context, client *datastore.Client, namespace string, kind string) (int, error) {
+	return countQuery(ctx, client, datastore.NewQuery(kind).Namespace(namespace), kind)
+}
+
+// countQuery counts entities matching the query the same way as countKind
+func countQuery(ctx context.Context, client *datastore.Client, query *datastore.Query, kind string) (int, error) {
+	var start datastore.Cursor
+	count := 0
+	for {
+		q := query.KeysOnly().Start(start).Limit(1000)
+
+		read := 0
+		it := client.Run(ctx, q)
+		for {
+			_, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return 0, fmt.Errorf("Unable to count %s: %w", kind, err)
+			}
+			read++
+		}
+
+		count += read
+		if read < 1000 {
+			return count, nil
+		}
+
+		infof("Counting %s - %d", kind, count)
+		cursor, err := it.Cursor()
+		if err != nil {
+			return 0, err
+		}
+		start = cursor
+	}
+}
@@ -0,0 +1,236 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DedupeCmd finds entities of a kind with the same values of a set of properties and
+// deletes all but one of every group
+type DedupeCmd struct {
+	ProjectID  string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace  string `short:"n" long:"namespace" description:"Namespace of the kind"`
+	Kind       string `short:"k" long:"kind" description:"Kind to deduplicate" required:"true"`
+	By         string `long:"by" description:"Comma separated properties identifying duplicates, e.g. email,tenantId" required:"true"`
+	TimeField  string `long:"time-field" description:"Property ordering the entities of a group, e.g. createdAt, required with --delete"`
+	Keep       string `long:"keep" default:"newest" choice:"newest" choice:"oldest" description:"Entity of a group left by --delete"`
+	Delete     bool   `long:"delete" description:"Delete all but the kept entity of every group, only duplicate groups are reported otherwise"`
+	DryRun     bool   `long:"dry-run" description:"Print how many entities --delete would delete without deleting them"`
+	JSON       bool   `long:"json" description:"Write a JSON line per duplicate group"`
+	Yes        bool   `long:"yes" description:"Delete without asking to type the project ID"`
+	Force      bool   `long:"force" description:"Same as --yes"`
+	MaxRetries int    `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// dedupeMember is an entity of a group with the value of --time-field
+type dedupeMember struct {
+	key  *datastore.Key
+	time interface{}
+}
+
+// dedupeSet are the entities with the same values
+type dedupeSet struct {
+	values  map[string]interface{}
+	members []dedupeMember
+}
+
+// dedupeGroup is reported for every set of duplicates
+type dedupeGroup struct {
+	Values map[string]interface{} `json:"values"`
+	Count  int                    `json:"count"`
+	Keep   string                 `json:"keep,omitempty"`
+	Delete []string               `json:"delete,omitempty"`
+}
+
+// Execute is called by go-flags
+func (cmd *DedupeCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	by := strings.Split(cmd.By, ",")
+	if cmd.Delete && cmd.TimeField == "" {
+		return fmt.Errorf("--time-field is required with --delete to pick the entity to keep")
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	sets, scanned, incomplete, err := cmd.scan(ctx, client, by)
+	if err != nil {
+		return err
+	}
+	if incomplete > 0 {
+		infof("%d entities lack one of the --by properties and are left out", incomplete)
+	}
+
+	var remove []*datastore.Key
+	duplicates, extra := 0, 0
+	for _, set := range sets {
+		members := set.members
+		if len(members) < 2 {
+			continue
+		}
+		duplicates++
+		extra += len(members) - 1
+
+		g := dedupeGroup{Values: set.values, Count: len(members)}
+
+		if cmd.TimeField != "" {
+			cmd.sortMembers(members)
+			g.Keep = keyPath(members[0].key)
+			for _, m := range members[1:] {
+				g.Delete = append(g.Delete, keyPath(m.key))
+				remove = append(remove, m.key)
+			}
+		}
+
+		if err := cmd.report(g); err != nil {
+			return err
+		}
+	}
+
+	infof("Scanned %d entities of %s, found %d duplicate groups with %d extra entities", scanned, cmd.Kind, duplicates, extra)
+	if !cmd.Delete || len(remove) == 0 {
+		return nil
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would delete %d duplicate entities of %s/%s\n", len(remove), cmd.Namespace, cmd.Kind)
+		return nil
+	}
+
+	if !cmd.Yes && !cmd.Force {
+		if err := confirmProject(cmd.ProjectID, []string{fmt.Sprintf("Will delete %d duplicate entities of %s/%s, keeping the %s of every group", len(remove), cmd.Namespace, cmd.Kind, cmd.Keep)}); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(remove); i += 500 {
+		batch := remove[i:min(i+500, len(remove))]
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			return client.DeleteMulti(ctx, batch)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to delete duplicates of %s: %w", cmd.Kind, err)
+		}
+		infof("Deleting duplicates - %d", i+len(batch))
+	}
+
+	fmt.Printf("Deleted %d duplicate entities of %s/%s\n", len(remove), cmd.Namespace, cmd.Kind)
+	return nil
+}
+
+// scan reads the kind and groups its keys by the JSON of the --by values, the groups
+// are returned in the order they were found
+func (cmd *DedupeCmd) scan(ctx context.Context, client *datastore.Client, by []string) ([]*dedupeSet, int, int, error) {
+	groups := make(map[string]*dedupeSet)
+	var sets []*dedupeSet
+	scanned, incomplete := 0, 0
+
+	// raw values, so timestamps compare as times
+	opts := &valueOptions{raw: true}
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace)
+
+	var start datastore.Cursor
+	for {
+		var batch []*dynamicEntity
+		var next datastore.Cursor
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, next, err = fetchPage(ctx, client, q.Start(start).Limit(500), opts)
+			return err
+		})
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("Unable to read %s: %w", cmd.Kind, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		start = next
+
+		for _, de := range batch {
+			scanned++
+
+			values := make(map[string]interface{})
+			complete := true
+			for _, name := range by {
+				v, ok := de.value[name]
+				if !ok {
+					complete = false
+					break
+				}
+				values[name] = defaultValueOptions.toExportValue(v)
+			}
+			if !complete {
+				incomplete++
+				continue
+			}
+
+			b, err := json.Marshal(values)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			set, ok := groups[string(b)]
+			if !ok {
+				set = &dedupeSet{values: values}
+				groups[string(b)] = set
+				sets = append(sets, set)
+			}
+			set.members = append(set.members, dedupeMember{key: de.key, time: de.value[cmd.TimeField]})
+		}
+		infof("Scanning %s - %d", cmd.Kind, scanned)
+	}
+	return sets, scanned, incomplete, nil
+}
+
+// sortMembers puts the kept entity first, entities without the time field go last
+// and ties are broken by key
+func (cmd *DedupeCmd) sortMembers(members []dedupeMember) {
+	sort.SliceStable(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if (a.time == nil) != (b.time == nil) {
+			return b.time == nil
+		}
+		if c, ok := compareFilterValue(a.time, b.time); ok && c != 0 {
+			if cmd.Keep == "newest" {
+				return c > 0
+			}
+			return c < 0
+		}
+		return keyPath(a.key) < keyPath(b.key)
+	})
+}
+
+func (cmd *DedupeCmd) report(g dedupeGroup) error {
+	if cmd.JSON {
+		return json.NewEncoder(os.Stdout).Encode(g)
+	}
+
+	names := make([]string, 0, len(g.Values))
+	for name := range g.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, name := range names {
+		b, _ := json.Marshal(g.Values[name])
+		values[i] = name + "=" + string(b)
+	}
+
+	line := fmt.Sprintf("%s: %d entities", strings.Join(values, " "), g.Count)
+	if g.Keep != "" {
+		line += fmt.Sprintf(", keep %s, remove %s", g.Keep, strings.Join(g.Delete, " "))
+	}
+	fmt.Println(line)
+	return nil
+}
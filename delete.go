@@ -1,27 +1,107 @@
-package main
+package cdskit
 
 import (
 	"context"
 	"fmt"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/Songmu/prompter"
+	"google.golang.org/api/iterator"
 )
 
 // DeleteAllCmd is a command to delete all entities inside namespaces and a certain kind of
 type DeleteAllCmd struct {
-	ProjectID  string `short:"p" long:"project" description:"Project to be used." required:"true"`
-	Namespaces string `short:"n" long:"namespaces" description:"Namespaces to clean up"`
-	Kinds      string `short:"k" long:"kinds" description:"Kinds to clean up"`
+	ProjectID  string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespaces string   `short:"n" long:"namespaces" description:"Namespaces to clean up"`
+	Kinds      string   `short:"k" long:"kinds" description:"Kinds to clean up"`
+	Filters    []string `long:"filter" description:"Delete only entities matching field OP value with OP one of =, >, >=, <, <=, e.g. status=archived (repeatable, all must match)"`
+	OlderThan  string   `long:"older-than" description:"Delete only entities with --timestamp-field older than the duration, e.g. 90d or 12h"`
+	TimeField  string   `long:"timestamp-field" description:"Time property compared by --older-than, e.g. createdAt"`
+	Ancestor   string   `long:"ancestor" description:"Delete only the entity group below the key given as a Kind:id/Kind:name path, e.g. Customer:42, a Kind/id path or an encoded key, the ancestor itself included"`
+	DryRun     bool     `long:"dry-run" description:"Print how many entities would be deleted without deleting them"`
+	Yes        bool     `long:"yes" description:"Delete without asking to type the project ID"`
+	Force      bool     `long:"force" description:"Same as --yes"`
+	Workers    int      `long:"workers" default:"8" description:"Number of concurrent delete calls"`
+	BatchSize  int      `long:"batch-size" default:"500" description:"Number of keys deleted per call, at most 500"`
+	MaxRetries int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+
+	filters  []queryFilter
+	ancestor *datastore.Key
+	// progress counts the deleted entities of all kinds for the jobs of serve
+	progress *int64
+	// deleted is the number of entities deleted by run, of entities that would be with --dry-run
+	deleted int
 }
 
 // Execute is called by go-flags
 func (cmd *DeleteAllCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+	if err := cmd.run(ctx); err != nil {
+		return err
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would delete %d entities in total\n", cmd.deleted)
+		return nil
+	}
+	fmt.Println("-------------------------------------------------------------------")
+	fmt.Println("All entities have been successfully deleted!")
+	fmt.Println("Namespaces itself will be cleaned up automatically within 48 hours.")
+	return nil
+}
+
+func (cmd *DeleteAllCmd) run(ctx context.Context) error {
+
+	// DeleteMulti accepts at most 500 keys
+	if cmd.BatchSize < 1 || cmd.BatchSize > 500 {
+		return fmt.Errorf("--batch-size must be between 1 and 500")
+	}
+	if cmd.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+
+	for _, s := range cmd.Filters {
+		f, err := parseFilter(s)
+		if err != nil {
+			return err
+		}
+		cmd.filters = append(cmd.filters, f)
+	}
+
+	if cmd.Ancestor != "" {
+		var err error
+		cmd.ancestor, err = parseAncestor(cmd.Ancestor, "")
+		if err != nil {
+			return fmt.Errorf("Invalid --ancestor %s: %w", cmd.Ancestor, err)
+		}
+		// listed with the other filters in the confirmation
+		cmd.Filters = append(cmd.Filters, "__key__ HAS ANCESTOR "+keyPath(cmd.ancestor))
+	}
 
-	ctx := context.Background()
+	if (cmd.OlderThan == "") != (cmd.TimeField == "") {
+		return fmt.Errorf("--older-than and --timestamp-field have to be given together")
+	}
+	if cmd.OlderThan != "" {
+		age, err := parseAge(cmd.OlderThan)
+		if err != nil {
+			return err
+		}
 
-	dsClient, err := datastore.NewClient(ctx, cmd.ProjectID)
+		cutoff := time.Now().Add(-age).UTC()
+		infof("Deleting entities with %s before %s", cmd.TimeField, cutoff.Format(time.RFC3339))
+		cmd.filters = append(cmd.filters, queryFilter{field: cmd.TimeField, op: "<", value: cutoff})
+		// listed with the other filters in the confirmation
+		cmd.Filters = append(cmd.Filters, fmt.Sprintf("%s<%s", cmd.TimeField, cutoff.Format(time.RFC3339)))
+	}
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
 	if err != nil {
 		return err
 	}
@@ -36,12 +116,13 @@ func (cmd *DeleteAllCmd) Execute(args []string) error {
 			return fmt.Errorf("Unable to load list of namespaces: %w", err)
 		}
 
-		if len(metadatNS) > 0 {
+		// --yes doesn't ask anything, all namespaces are cleaned up then
+		if len(metadatNS) > 0 && (cmd.Yes || cmd.Force) {
+			namespaces = metadatNS
+		} else if len(metadatNS) > 0 {
 			query := fmt.Sprintf("Entities from the following namespaces will be deleted: %s\n", strings.Join(metadatNS, "\n"))
 
-			var choices []string
-			copy(choices, metadatNS)
-			choices = append(choices, "all")
+			choices := append(append([]string{}, metadatNS...), "all")
 			choice := prompter.Choose(query, choices, "all")
 
 			if choice == "all" {
@@ -52,6 +133,9 @@ func (cmd *DeleteAllCmd) Execute(args []string) error {
 		}
 	}
 
+	type target struct{ ns, kind string }
+
+	var targets []target
 	for _, ns := range namespaces {
 
 		kinds := strings.Split(cmd.Kinds, ",")
@@ -63,32 +147,162 @@ func (cmd *DeleteAllCmd) Execute(args []string) error {
 		}
 
 		for _, kind := range kinds {
+			targets = append(targets, target{ns, kind})
+		}
+	}
 
-			fmt.Printf("Deleting %s/%s ... ", ns, kind)
-
-			keys, err := dsClient.GetAll(ctx, datastore.NewQuery(kind).Namespace(ns).KeysOnly(), nil)
+	if cmd.DryRun {
+		total := 0
+		for _, t := range targets {
+			n, err := countQuery(ctx, dsClient, cmd.newQuery(t.ns, t.kind), t.kind)
 			if err != nil {
 				return err
 			}
+			infof("Would delete %s/%s - %d", t.ns, t.kind, n)
+			total += n
+		}
+		cmd.deleted = total
+		return nil
+	}
+
+	if !cmd.Yes && !cmd.Force {
+		var lines []string
+		if len(cmd.Filters) > 0 {
+			lines = append(lines, "Filters: "+strings.Join(cmd.Filters, " and "))
+		}
+
+		counts := make(map[string]map[string]entityStat)
+		for _, t := range targets {
+			if _, ok := counts[t.ns]; !ok {
+				counts[t.ns] = estimateCounts(ctx, dsClient, t.ns)
+			}
 
-			fmt.Printf("Keys: %d\n", len(keys))
+			estimate := "count unknown"
+			if stat, ok := counts[t.ns][t.kind]; ok {
+				estimate = fmt.Sprintf("about %d entities", stat.Count)
+				if len(cmd.Filters) > 0 {
+					estimate = fmt.Sprintf("matching entities of about %d", stat.Count)
+				}
+			}
+			lines = append(lines, fmt.Sprintf("Will delete %s/%s - %s", t.ns, t.kind, estimate))
+		}
 
-			for i := 0; i < len(keys); i += 500 {
-				batch := keys[i:min(i+500, len(keys))]
-				err = dsClient.DeleteMulti(ctx, batch)
+		if err := confirmProject(cmd.ProjectID, lines); err != nil {
+			return err
+		}
+	}
+
+	total, started := 0, time.Now()
+	for _, t := range targets {
+		n, err := cmd.deleteKind(ctx, dsClient, t.ns, t.kind)
+		total += n
+		cmd.deleted = total
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("%w, %d entities were deleted, %d of %s/%s", interruption(), total, n, t.ns, t.kind)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to delete %s/%s after %d entities: %w", t.ns, t.kind, n, err)
+		}
+		infof("Deleted %s/%s - %d", t.ns, t.kind, n)
+	}
+	logEvent(logInfo, logFields{"event": "summary", "deleted": total, "elapsed_seconds": time.Since(started).Seconds()},
+		"Deleted %d entities in %s", total, time.Since(started).Round(time.Second))
+	return nil
+}
+
+// deleteKind lists the keys of the kind page by page and deletes them by --workers
+// in batches of --batch-size, it returns the number of deleted entities
+func (cmd *DeleteAllCmd) deleteKind(ctx context.Context, client *datastore.Client, ns string, kind string) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan []*datastore.Key, cmd.Workers)
+	// every worker stops at its first error
+	errs := make(chan error, cmd.Workers)
+	var deleted int64
+	started := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cmd.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				err := withRetries(ctx, cmd.MaxRetries, func() error {
+					return client.DeleteMulti(ctx, batch)
+				})
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+
+				n := atomic.AddInt64(&deleted, int64(len(batch)))
+				if cmd.progress != nil {
+					atomic.AddInt64(cmd.progress, int64(len(batch)))
+				}
+				infof("Deleting %s/%s - %d, %.0f/s", ns, kind, n, float64(n)/time.Since(started).Seconds())
+			}
+		}()
+	}
+
+	// a page keeps every worker busy, the cursor stays valid while its entities are deleted
+	var start datastore.Cursor
+	var listErr error
+	for listing := true; listing; {
+		var keys []*datastore.Key
+		listErr = withRetries(ctx, cmd.MaxRetries, func() error {
+			keys = keys[:0]
+			it := client.Run(ctx, cmd.newQuery(ns, kind).KeysOnly().Start(start).Limit(cmd.BatchSize*cmd.Workers))
+			for {
+				k, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				}
 				if err != nil {
 					return err
 				}
+				keys = append(keys, k)
+			}
+
+			var err error
+			start, err = it.Cursor()
+			return err
+		})
+		if listErr != nil || len(keys) == 0 {
+			break
+		}
+
+		for i := 0; i < len(keys) && listing; i += cmd.BatchSize {
+			select {
+			case batches <- keys[i:min(i+cmd.BatchSize, len(keys))]:
+			case <-ctx.Done():
+				listing = false
 			}
 		}
 	}
+	close(batches)
+	wg.Wait()
+	close(errs)
 
-	fmt.Println("-------------------------------------------------------------------")
-	fmt.Println("All entities have been successfully deleted!")
-	fmt.Println("Namespaces itself will be cleaned up automatically within 48 hours.")
+	if err := <-errs; err != nil {
+		return int(deleted), err
+	}
+	return int(deleted), listErr
+}
 
-	return nil
+// newQuery selects entities of the kind matching --filter and --ancestor
+func (cmd *DeleteAllCmd) newQuery(ns string, kind string) *datastore.Query {
+	q := datastore.NewQuery(kind).Namespace(ns)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(remapKey(cmd.ancestor, cmd.ancestor.Kind, ns))
+	}
+	for _, f := range cmd.filters {
+		q = q.Filter(f.field+" "+f.op, f.value)
+	}
+	return q
 }
+
 func min(a, b int) int {
 	if a <= b {
 		return a
@@ -126,3 +340,40 @@ func metadataKinds(ctx context.Context, client *datastore.Client, ns string) ([]
 	}
 	return kinds, nil
 }
+
+// skipKinds removes the kinds matching any of the comma separated glob patterns of --skip-kinds
+func skipKinds(kinds []string, skip string) ([]string, error) {
+	if skip == "" {
+		return kinds, nil
+	}
+
+	var left []string
+	for _, k := range kinds {
+		skipped := false
+		for _, p := range strings.Split(skip, ",") {
+			ok, err := path.Match(strings.TrimSpace(p), k)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid --skip-kinds pattern %s: %w", p, err)
+			}
+			skipped = skipped || ok
+		}
+
+		if !skipped {
+			left = append(left, k)
+		}
+	}
+	return left, nil
+}
+
+// parseAge parses a duration of time.ParseDuration, or a number of days as 90d
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("Invalid duration %s, expected e.g. 90d, 36h or 30m", s)
+}
@@ -0,0 +1,201 @@
+package cdskit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DeleteKeysCmd deletes the entities listed in a file
+type DeleteKeysCmd struct {
+	ProjectID  string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace  string `short:"n" long:"namespace" description:"Namespace of keys given as a path or an ID"`
+	Kind       string `short:"k" long:"kind" description:"Kind of keys given by a name or an ID only"`
+	File       string `short:"f" long:"file" description:"File with one encoded key or Kind:id/Kind:name path per line, or a JSON or JSON lines export with the __key__ field" required:"true"`
+	DryRun     bool   `long:"dry-run" description:"Print how many entities would be deleted without deleting them"`
+	Yes        bool   `long:"yes" description:"Delete without asking to type the project ID"`
+	Force      bool   `long:"force" description:"Same as --yes"`
+	MaxRetries int    `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// Execute is called by go-flags
+func (cmd *DeleteKeysCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	keys, err := cmd.readKeys()
+	if err != nil {
+		return err
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would delete %d entities listed in %s\n", len(keys), cmd.File)
+		return nil
+	}
+
+	if !cmd.Yes && !cmd.Force {
+		if err := confirmProject(cmd.ProjectID, []string{fmt.Sprintf("Will delete %d entities listed in %s", len(keys), cmd.File)}); err != nil {
+			return err
+		}
+	}
+
+	if err := cmd.deleteKeys(ctx, keys); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d entities\n", len(keys))
+	return nil
+}
+
+// deleteKeys deletes the entities in batches of 500, progress is logged
+func (cmd *DeleteKeysCmd) deleteKeys(ctx context.Context, keys []*datastore.Key) error {
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	for i := 0; i < len(keys); i += 500 {
+		batch := keys[i:min(i+500, len(keys))]
+		err = withRetries(ctx, cmd.MaxRetries, func() error {
+			return dsClient.DeleteMulti(ctx, batch)
+		})
+		if err != nil {
+			return err
+		}
+		infof("Deleting - %d", i+len(batch))
+	}
+	return nil
+}
+
+// readKeys reads keys of the file, a file starting with [ or { is read as an export
+func (cmd *DeleteKeysCmd) readKeys() ([]*datastore.Key, error) {
+	f, err := os.Open(cmd.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head, err := r.Peek(64)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch trimmed := bytes.TrimSpace(head); {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return cmd.readExportKeys(r, true)
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return cmd.readExportKeys(r, false)
+	default:
+		return cmd.readKeyLines(r)
+	}
+}
+
+// readKeyLines reads one key per line, empty lines and lines starting with # are ignored
+func (cmd *DeleteKeysCmd) readKeyLines(r io.Reader) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, err := cmd.parseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key at %s:%d: %w", cmd.File, n, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, s.Err()
+}
+
+// parseKey parses an encoded key, a Kind:id/Kind:name path or an ID of --kind
+func (cmd *DeleteKeysCmd) parseKey(s string) (*datastore.Key, error) {
+	if !strings.Contains(s, ":") {
+		if k, err := datastore.DecodeKey(s); err == nil {
+			return k, nil
+		}
+		if cmd.Kind == "" {
+			return nil, fmt.Errorf("%q is neither an encoded key nor a key path, and --kind is not given", s)
+		}
+		return parseKeyPath(s, cmd.Kind, cmd.Namespace)
+	}
+	return parseFullKeyPath(s, cmd.Namespace)
+}
+
+// readExportKeys reads __key__ fields of records of a JSON array or JSON lines export,
+// the encoded key is used when present
+func (cmd *DeleteKeysCmd) readExportKeys(r io.Reader, array bool) ([]*datastore.Key, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	if array {
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []*datastore.Key
+	for n := 1; d.More(); n++ {
+		var rec struct {
+			Key map[string]interface{} `json:"__key__"`
+		}
+		if err := d.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("Invalid record %d of %s: %w", n, cmd.File, err)
+		}
+		if rec.Key == nil {
+			return nil, fmt.Errorf("Record %d of %s has no __key__ field", n, cmd.File)
+		}
+
+		k, err := exportedKey(rec.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid __key__ of record %d of %s: %w", n, cmd.File, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// exportedKey restores the key of the __key__ field written by export-kind
+func exportedKey(f map[string]interface{}) (*datastore.Key, error) {
+	if encoded, ok := f["encoded"].(string); ok && encoded != "" {
+		return datastore.DecodeKey(encoded)
+	}
+
+	kind, _ := f["kind"].(string)
+	namespace, _ := f["namespace"].(string)
+
+	var parent *datastore.Key
+	if path, ok := f["parent"].(string); ok && path != "" {
+		var err error
+		if parent, err = parseFullKeyPath(path, namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	var k *datastore.Key
+	if name, _ := f["name"].(string); name != "" {
+		k = datastore.NameKey(kind, name, parent)
+	} else if id, ok := f["id"].(json.Number); ok {
+		v, err := id.Int64()
+		if err != nil {
+			return nil, err
+		}
+		k = datastore.IDKey(kind, v, parent)
+	}
+	if k == nil || kind == "" || k.Incomplete() {
+		return nil, fmt.Errorf("no kind, ID or name")
+	}
+	k.Namespace = namespace
+	return k, nil
+}
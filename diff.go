@@ -0,0 +1,287 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DiffCmd compares the entities of a kind with another namespace, project or kind,
+// or with an export file, by key
+type DiffCmd struct {
+	ProjectID       string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace       string   `short:"n" long:"namespace" description:"Namespace of the kind"`
+	Kind            string   `short:"k" long:"kind" description:"Kind to compare" required:"true"`
+	File            string   `short:"f" long:"file" description:"Export file to compare with the kind instead of the target, written by export-kind with the __key__ field"`
+	Format          string   `long:"format" description:"Format of --file: json, jsonl, ndjson or typed-json (detected from the file extension by default)"`
+	TargetProject   string   `long:"target-project" description:"Project to compare with, the same project by default"`
+	TargetNamespace string   `long:"target-namespace" description:"Namespace to compare with"`
+	TargetKind      string   `long:"target-kind" description:"Kind to compare with, the same kind by default"`
+	IgnoreFields    []string `long:"ignore-field" description:"Property left out of the comparison, e.g. updatedAt (repeatable)"`
+	JSON            bool     `long:"json" description:"Write a JSON line per difference with the source and target values of changed properties"`
+	FailOnDiff      bool     `long:"fail-on-diff" description:"Exit with an error when the entities differ"`
+	MaxRetries      int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// diffEntry is a difference written by --json, values are JSON of the exported properties
+type diffEntry struct {
+	Key    string                     `json:"key"`
+	Change string                     `json:"change"`
+	Fields map[string]diffFieldChange `json:"fields,omitempty"`
+}
+
+type diffFieldChange struct {
+	Source json.RawMessage `json:"source,omitempty"`
+	Target json.RawMessage `json:"target,omitempty"`
+}
+
+// diffFields maps property names to the canonical JSON of their values
+type diffFields map[string][]byte
+
+// Execute is called by go-flags
+func (cmd *DiffCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	if cmd.TargetProject == "" {
+		cmd.TargetProject = cmd.ProjectID
+	}
+	if cmd.TargetKind == "" {
+		cmd.TargetKind = cmd.Kind
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	// with --file the export is the source and the kind the target
+	var source map[string]diffFields
+	target := func(fn func(string, diffFields) error) error {
+		return cmd.scan(ctx, client, cmd.Namespace, cmd.Kind, fn)
+	}
+	if cmd.File != "" {
+		infof("Comparing '%s' with '%s/%s/%s'", cmd.File, cmd.ProjectID, cmd.Namespace, cmd.Kind)
+		source, err = cmd.readFile()
+		if err != nil {
+			return err
+		}
+	} else {
+		infof("Comparing '%s/%s/%s' with '%s/%s/%s'", cmd.ProjectID, cmd.Namespace, cmd.Kind, cmd.TargetProject, cmd.TargetNamespace, cmd.TargetKind)
+		source = make(map[string]diffFields)
+		err = cmd.scan(ctx, client, cmd.Namespace, cmd.Kind, func(key string, fields diffFields) error {
+			source[key] = fields
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		targetClient := client
+		if cmd.TargetProject != cmd.ProjectID {
+			targetClient, err = newClient(ctx, cmd.TargetProject)
+			if err != nil {
+				return err
+			}
+
+			defer targetClient.Close()
+		}
+		target = func(fn func(string, diffFields) error) error {
+			return cmd.scan(ctx, targetClient, cmd.TargetNamespace, cmd.TargetKind, fn)
+		}
+	}
+
+	added, changed, unchanged := 0, 0, 0
+	err = target(func(key string, fields diffFields) error {
+		old, ok := source[key]
+		if !ok {
+			added++
+			return cmd.report(diffEntry{Key: key, Change: "added"})
+		}
+		delete(source, key)
+
+		if changes := compareFields(old, fields); len(changes) > 0 {
+			changed++
+			return cmd.report(diffEntry{Key: key, Change: "changed", Fields: changes})
+		}
+		unchanged++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	removed := make([]string, 0, len(source))
+	for key := range source {
+		removed = append(removed, key)
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		if err := cmd.report(diffEntry{Key: key, Change: "removed"}); err != nil {
+			return err
+		}
+	}
+
+	infof("%d added, %d removed, %d changed, %d unchanged", added, len(removed), changed, unchanged)
+	if cmd.FailOnDiff && added+len(removed)+changed > 0 {
+		return fmt.Errorf("The entities differ")
+	}
+	return nil
+}
+
+// scan reads all entities of the kind, keys are compared in the target kind and namespace
+func (cmd *DiffCmd) scan(ctx context.Context, client *datastore.Client, namespace string, kind string, fn func(string, diffFields) error) error {
+	q := datastore.NewQuery(kind).Namespace(namespace).Limit(500)
+
+	read := 0
+	var start datastore.Cursor
+	for {
+		var batch []*dynamicEntity
+		var cursor datastore.Cursor
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, cursor, err = fetchPage(ctx, client, q.Start(start), defaultValueOptions)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", kind, err)
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, de := range batch {
+			if err := fn(cmd.diffKey(de.key), cmd.fields(de.value)); err != nil {
+				return err
+			}
+		}
+
+		read += len(batch)
+		start = cursor
+		infof("Reading %s - %d", kind, read)
+	}
+}
+
+// readFile loads the export file, its values are converted the way live entities are
+func (cmd *DiffCmd) readFile() (map[string]diffFields, error) {
+	f, err := os.Open(cmd.File)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	imp := &ImportKindCmd{Kind: cmd.TargetKind, Namespace: cmd.TargetNamespace, File: cmd.File, Format: cmd.Format}
+	r, err := imp.newImportReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := make(map[string]diffFields)
+	for n := 1; ; n++ {
+		de, err := r.ReadRecord()
+		if err == io.EOF {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := imp.restoreKey(de); err != nil {
+			return nil, err
+		}
+		if de.key == nil {
+			return nil, fmt.Errorf("Record %d of %s has no key, export the kind with the __key__ field", n, cmd.File)
+		}
+
+		props, err := de.Save()
+		if err != nil {
+			return nil, err
+		}
+		loaded := &dynamicEntity{}
+		if err := loaded.Load(props); err != nil {
+			return nil, err
+		}
+		entities[cmd.diffKey(de.key)] = cmd.fields(loaded.value)
+	}
+}
+
+// diffKey identifies the entity by its key moved to the target kind and namespace
+func (cmd *DiffCmd) diffKey(k *datastore.Key) string {
+	return keyPath(remapKey(k, cmd.TargetKind, cmd.TargetNamespace))
+}
+
+func (cmd *DiffCmd) fields(value map[string]interface{}) diffFields {
+	fields := make(diffFields, len(value))
+	for name, v := range value {
+		if name == "__key__" || cmd.ignored(name) {
+			continue
+		}
+
+		b, err := canonicalJSON(v)
+		if err != nil {
+			b = []byte(fmt.Sprintf("%q", fmt.Sprint(v)))
+		}
+		fields[name] = b
+	}
+	return fields
+}
+
+func (cmd *DiffCmd) ignored(name string) bool {
+	for _, f := range cmd.IgnoreFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compareFields returns the properties with different values, missing on one side
+// when the property is left out
+func compareFields(source, target diffFields) map[string]diffFieldChange {
+	changes := make(map[string]diffFieldChange)
+	for name, v := range source {
+		if t, ok := target[name]; !ok || string(t) != string(v) {
+			changes[name] = diffFieldChange{Source: v, Target: t}
+		}
+	}
+	for name, t := range target {
+		if _, ok := source[name]; !ok {
+			changes[name] = diffFieldChange{Target: t}
+		}
+	}
+	return changes
+}
+
+// report prints the difference to stdout as a JSON line with --json or as text
+func (cmd *DiffCmd) report(e diffEntry) error {
+	if cmd.JSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	if len(e.Fields) == 0 {
+		fmt.Printf("%s %s\n", e.Change, e.Key)
+		return nil
+	}
+
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%s %s: %s\n", e.Change, e.Key, strings.Join(names, ", "))
+	return nil
+}
@@ -0,0 +1,404 @@
+package cdskit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Files written by --encrypt start with the magic and a header naming how the key is
+// found, followed by AES-256-GCM sealed chunks of up to encryptionChunkSize bytes
+const (
+	encryptionMagic     = "CDSKENC1"
+	encryptionChunkSize = 64 * 1024
+
+	encryptionPassphrase = 1
+	encryptionKMS        = 2
+
+	// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 work factor of passphrase keys
+	pbkdf2Iterations = 600000
+)
+
+// fileEncryption is the key of the files of a run, created once so split exports
+// derive or wrap it a single time
+type fileEncryption struct {
+	passphrase string
+	kmsKey     string
+
+	key    []byte
+	header []byte
+}
+
+// parseEncryption parses --encrypt, passphrase keys are derived from the passphrase
+// and kms:<key> keys are random and wrapped by the Cloud KMS key
+func parseEncryption(spec string, passphrase string) (*fileEncryption, error) {
+	switch {
+	case spec == "passphrase":
+		if passphrase == "" {
+			return nil, fmt.Errorf("--encrypt passphrase requires --passphrase or CDSKIT_PASSPHRASE")
+		}
+		return &fileEncryption{passphrase: passphrase}, nil
+	case strings.HasPrefix(spec, "kms:") && strings.Contains(spec, "/cryptoKeys/"):
+		return &fileEncryption{kmsKey: strings.TrimPrefix(spec, "kms:")}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported --encrypt %s, expected passphrase or kms:projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>", spec)
+	}
+}
+
+// init creates the key and the header stored ahead of the chunks
+func (e *fileEncryption) init(ctx context.Context) error {
+	if e.key != nil {
+		return nil
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+
+	if e.passphrase != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		e.key = pbkdf2SHA256([]byte(e.passphrase), salt, pbkdf2Iterations, 32)
+
+		header.WriteByte(encryptionPassphrase)
+		header.Write(salt)
+	} else {
+		e.key = make([]byte, 32)
+		if _, err := rand.Read(e.key); err != nil {
+			return err
+		}
+		wrapped, err := kmsCall(ctx, e.kmsKey, "encrypt", "plaintext", e.key, "ciphertext")
+		if err != nil {
+			return fmt.Errorf("Unable to wrap the key with %s: %w", e.kmsKey, err)
+		}
+
+		header.WriteByte(encryptionKMS)
+		writeShortBytes(&header, []byte(e.kmsKey))
+		writeShortBytes(&header, wrapped)
+	}
+
+	e.header = header.Bytes()
+	return nil
+}
+
+// newWriter writes the header to w and returns the writer sealing the chunks,
+// Close seals the final chunk
+func (e *fileEncryption) newWriter(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	if err := e.init(ctx); err != nil {
+		return nil, err
+	}
+
+	aead, err := newChunkCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, e.header...), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, prefix: prefix}, nil
+}
+
+// encryptWriter seals chunks with nonces of the random prefix, a counter and a flag
+// marking the final chunk, so reordered or truncated files don't decrypt
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(encryptionChunkSize-len(ew.buf), len(p))
+		ew.buf = append(ew.buf, p[:take]...)
+		p = p[take:]
+
+		// the last chunk is sealed by Close, a full buffer waits for more data
+		if len(ew.buf) == encryptionChunkSize && len(p) > 0 {
+			if err := ew.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.seal(true)
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.prefix, ew.counter, last), ew.buf, ew.header)
+	ew.counter++
+	ew.buf = ew.buf[:0]
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(sealed)))
+	if _, err := ew.w.Write(append(size, sealed...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newDecryptReader returns the plain content of a file written by --encrypt, KMS keys
+// are named by the header and passphrase keys derived from the passphrase
+func newDecryptReader(ctx context.Context, r io.Reader, passphrase string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("Not a file encrypted by --encrypt")
+	}
+	header := bytes.NewBuffer(append([]byte{}, magic...))
+
+	var key []byte
+	switch magic[len(encryptionMagic)] {
+	case encryptionPassphrase:
+		if passphrase == "" {
+			return nil, fmt.Errorf("The file is encrypted with a passphrase, give it as --passphrase or CDSKIT_PASSPHRASE")
+		}
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(br, salt); err != nil {
+			return nil, fmt.Errorf("Truncated encryption header: %w", err)
+		}
+		header.Write(salt)
+		key = pbkdf2SHA256([]byte(passphrase), salt, pbkdf2Iterations, 32)
+	case encryptionKMS:
+		name, err := readShortBytes(br)
+		if err != nil {
+			return nil, fmt.Errorf("Truncated encryption header: %w", err)
+		}
+		wrapped, err := readShortBytes(br)
+		if err != nil {
+			return nil, fmt.Errorf("Truncated encryption header: %w", err)
+		}
+		writeShortBytes(header, name)
+		writeShortBytes(header, wrapped)
+
+		if key, err = kmsCall(ctx, string(name), "decrypt", "ciphertext", wrapped, "plaintext"); err != nil {
+			return nil, fmt.Errorf("Unable to unwrap the key with %s: %w", name, err)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported encryption of the file")
+	}
+
+	prefix := make([]byte, 7)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("Truncated encryption header: %w", err)
+	}
+	header.Write(prefix)
+
+	aead, err := newChunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, header: header.Bytes(), prefix: prefix}, nil
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	done    bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads the next chunk, it's the final one when no data follows it
+func (dr *decryptReader) open() error {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(dr.r, size); err != nil {
+		return fmt.Errorf("Truncated encrypted file: %w", err)
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n > encryptionChunkSize+uint32(dr.aead.Overhead()) {
+		return fmt.Errorf("Corrupted encrypted file, chunk of %d bytes", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		return fmt.Errorf("Truncated encrypted file: %w", err)
+	}
+
+	_, err := dr.r.Peek(1)
+	last := err == io.EOF
+	plain, err := dr.aead.Open(nil, chunkNonce(dr.prefix, dr.counter, last), sealed, dr.header)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt, wrong key or the file is truncated or modified")
+	}
+	dr.counter++
+	dr.plain, dr.done = plain, last
+	return nil
+}
+
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func writeShortBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+}
+
+func readShortBytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// pbkdf2SHA256 derives a key of the size from the password as in RFC 8018
+func pbkdf2SHA256(password, salt []byte, iterations, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// kmsCall runs the encrypt or decrypt method of the Cloud KMS key on the data
+func kmsCall(ctx context.Context, key string, method string, in string, data []byte, out string) ([]byte, error) {
+	opts := append([]option.ClientOption{option.WithScopes("https://www.googleapis.com/auth/cloudkms")}, clientOptions...)
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp map[string]string
+	body := map[string]string{in: base64.StdEncoding.EncodeToString(data)}
+	if err := bqCall(ctx, client, http.MethodPost, "https://cloudkms.googleapis.com/v1/"+key+":"+method, body, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp[out])
+}
+
+// DecryptCmd writes the plain content of a file written by --encrypt
+type DecryptCmd struct {
+	Input      string `short:"i" long:"input" description:"File written by --encrypt" required:"true"`
+	Output     string `short:"o" long:"output" description:"File to write, the input without .enc by default, - for stdout"`
+	Passphrase string `long:"passphrase" env:"CDSKIT_PASSPHRASE" description:"Passphrase of files encrypted with --encrypt passphrase"`
+}
+
+// Execute is called by go-flags
+func (cmd *DecryptCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	in, err := os.Open(cmd.Input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := newDecryptReader(ctx, in, cmd.Passphrase)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt %s: %w", cmd.Input, err)
+	}
+
+	output := cmd.Output
+	if output == "" {
+		if !strings.HasSuffix(cmd.Input, ".enc") {
+			return fmt.Errorf("--output is required for inputs without .enc")
+		}
+		output = strings.TrimSuffix(cmd.Input, ".enc")
+	}
+	if output == "-" {
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+
+	// the output is renamed once the whole file is authenticated
+	out, err := os.Create(output + ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output + ".tmp")
+		return fmt.Errorf("Unable to decrypt %s: %w", cmd.Input, err)
+	}
+	if err := os.Rename(output+".tmp", output); err != nil {
+		return err
+	}
+
+	infof("Decrypted %s to %s, %s", cmd.Input, output, formatBytes(n))
+	return nil
+}
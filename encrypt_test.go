@@ -0,0 +1,80 @@
+package cdskit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// test vectors of RFC 7914
+	tests := []struct {
+		password, salt string
+		iterations     int
+		key            string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(pbkdf2SHA256([]byte(tt.password), []byte(tt.salt), tt.iterations, 64)); got != tt.key {
+			t.Errorf("pbkdf2SHA256(%s, %s, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, got, tt.key)
+		}
+	}
+}
+
+func TestExportEncrypted(t *testing.T) {
+	// records of more than a chunk
+	entities := make([]*pb.Entity, 100)
+	for i := range entities {
+		entities[i] = fakeEntity("Item", int64(i+1), map[string]interface{}{"text": strings.Repeat("x", 1000)})
+	}
+	plain, _ := runTestExport(t, entities, map[string]interface{}{"format": "jsonl"})
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "jsonl", "encrypt": "passphrase", "passphrase": "secret"})
+	if len(plain) <= encryptionChunkSize {
+		t.Fatalf("export of %d bytes fits a chunk", len(plain))
+	}
+	if strings.Contains(out, "xxxx") {
+		t.Fatalf("encrypted file contains the plain text")
+	}
+
+	decrypt := func(b []byte, passphrase string) (string, error) {
+		r, err := newDecryptReader(context.Background(), bytes.NewReader(b), passphrase)
+		if err != nil {
+			return "", err
+		}
+		d, err := ioutil.ReadAll(r)
+		return string(d), err
+	}
+
+	got, err := decrypt([]byte(out), "secret")
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if got != plain {
+		t.Errorf("decrypted file differs from the plain export")
+	}
+
+	if _, err := decrypt([]byte(out), "wrong"); err == nil {
+		t.Errorf("decrypted with a wrong passphrase")
+	}
+
+	modified := []byte(out)
+	modified[len(modified)/2] ^= 1
+	if _, err := decrypt(modified, "secret"); err == nil {
+		t.Errorf("decrypted a modified file")
+	}
+
+	// the file cut after its first chunk, which follows the magic, method, salt and nonce prefix
+	header := len(encryptionMagic) + 1 + 16 + 7
+	first := int(binary.BigEndian.Uint32([]byte(out[header:])))
+	if _, err := decrypt([]byte(out[:header+4+first]), "secret"); err == nil {
+		t.Errorf("decrypted a truncated file")
+	}
+}
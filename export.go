@@ -1,276 +1,2326 @@
-package main
+package cdskit
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
 )
 
 // ExportKindCmd dump kind to a json file
 type ExportKindCmd struct {
 	ProjectID string `short:"p" long:"project" description:"Project to be used." required:"true"`
 	Namespace string `short:"n" long:"namespace" description:"Namespace to get data from"`
-	Kind      string `short:"k" long:"kind" description:"Kind to export" required:"true"`
-	Format    string `long:"format" default:"json" description:"One of the follwing formats: csv, json"`
+	Kind      string `short:"k" long:"kind" description:"Kind to export"`
+	Kinds     string `long:"kinds" description:"Comma separated kinds to export into a file each instead of --kind, * and ? match any kinds, e.g. Order*,User"`
+	AllKinds  bool   `long:"all-kinds" description:"Export every kind of the namespace into a file each"`
+	SkipKinds string `long:"skip-kinds" description:"Kinds not to export with --kinds or --all-kinds, comma separated glob patterns, e.g. Session,Log*"`
+	Format    string `long:"format" default:"json" choice:"csv" choice:"json" choice:"jsonl" choice:"ndjson" choice:"parquet" choice:"avro" choice:"typed-json" choice:"bigquery" choice:"xlsx" choice:"sql" choice:"msgpack" description:"One of the follwing formats: csv, json, jsonl or ndjson (one JSON record per line), msgpack (a MessagePack map per record, keeping integers, timestamps and binary values, smaller and faster than JSON), parquet and avro (embedded entities as records and arrays as repeated fields, schema inferred from the first 10000 records or given by --columnar-schema), typed-json (values with their Datastore types and index flags, for lossless import), bigquery (JSON lines with column names and values BigQuery loads, with the inferred schema written to --bq-schema), xlsx (Excel workbook with typed cells and a frozen header, a sheet per kind for --kinds written to one .xlsx --output), sql (CREATE TABLE with the inferred column types and INSERT statements, e.g. for sqlite3)"`
+	Mode      string `long:"mode" default:"datastore" choice:"datastore" choice:"firestore" description:"Database mode of the project: datastore, or firestore to export the documents of every collection named --kind from a Firestore database in Native mode, keyed by their paths with document IDs as names"`
+
+	ExpandAncestors    bool     `long:"expand-ancestors" description:"Add l1_kind, l1_id, l2_kind, ... fields decomposed from the entity key path"`
+	Limit              int      `long:"limit" description:"Maximum number of entities to export, all by default"`
+	Offset             int      `long:"offset" description:"Number of entities to skip before exporting"`
+	Fields             []string `long:"field" description:"Export only the property, or comma separated properties, using a projection query when they are all indexed, CSV columns follow the order of the flags (repeatable)"`
+	Filters            []string `long:"filter" description:"Export only entities matching field OP value with OP one of =, >, >=, <, <=, e.g. status=active or createdAt>2023-01-01 (repeatable, all must match)"`
+	OrderBy            []string `long:"order-by" description:"Property to order by, prefix with - for descending order (repeatable)"`
+	NoDeterministic    bool     `long:"no-deterministic" description:"Do not order by __key__ when --order-by is not given"`
+	KeysOnly           bool     `long:"keys-only" description:"Run a keys-only query and write only the __key__ field with kind, ID or name, ancestor path and encoded key of every entity, e.g. for delete-keys"`
+	NoKey              bool     `long:"no-key" description:"Do not add the __key__ field with the kind, ID, name, namespace, ancestor path and encoded form of the entity key, used by import-kind to restore keys"`
+	IncludeNulls       bool     `long:"include-nulls" description:"Write properties set to null as JSON null and empty CSV cells instead of omitting them"`
+	PruneEmpty         bool     `long:"prune-empty" description:"Omit empty strings, arrays and embedded entities from the output"`
+	Labels             []string `long:"label" description:"Field to add to every record as key=value, value may be a template over entity properties, e.g. env=prod or tenant={{.tenant}} (repeatable)"`
+	FloatPrecision     int      `long:"float-precision" default:"-1" description:"Number of decimal places for floats in CSV, -1 for the shortest exact representation"`
+	MaxInMemory        int      `long:"max-entities-in-memory" default:"100000" description:"Number of CSV records buffered in memory to build the header, further records are spilled to a temporary file"`
+	Delimiter          string   `long:"delimiter" default:"," description:"CSV field delimiter, a single character, \\t or tab for tab"`
+	QuoteEmpty         bool     `long:"csv-quote-empty-strings" description:"Write empty string values as \"\" in CSV, so they differ from missing properties"`
+	QuoteAll           bool     `long:"csv-quote-all" description:"Quote every CSV field except null cells, including the header"`
+	CSVNull            string   `long:"csv-null" description:"Text of null and missing values in CSV, e.g. \\N or null, empty by default"`
+	DetectPII          bool     `long:"detect-pii" description:"Report fields that look like personal data (emails, phones, card numbers, SSNs) in a sample instead of exporting"`
+	PIISample          int      `long:"pii-sample" default:"1000" description:"Number of entities sampled by --detect-pii"`
+	Redact             []string `long:"redact" description:"Property, or comma separated properties, replaced as given by --redact-mode, nested properties as parent:child (repeatable)"`
+	RedactMode         string   `long:"redact-mode" default:"mask" choice:"mask" choice:"hash" choice:"remove" description:"How --redact replaces values: mask all but the last 4 characters of long values, salted SHA-256 hash or remove the property"`
+	Anonymize          []string `long:"anonymize" description:"Replace the property as property:method, method one of fake-name, fake-email, fake-phone, fake-address, mask, hash or remove, e.g. name:fake-name,phone:fake-phone (repeatable)"`
+	RedactSalt         string   `long:"redact-salt" env:"CDSKIT_REDACT_SALT" description:"Salt of hashed and fake values, a value is replaced the same way in every export with the same salt"`
+	Transforms         []string `long:"transform" description:"Change records before they're written: rename old new, set field = template over properties, delete field, drop-if field OP value or keep-if field OP value, statements separated by ; (repeatable)"`
+	ContentHash        string   `long:"content-hash" choice:"sha256" description:"Add a __hash__ field with the hash of entity properties, computed before fields added by other options"`
+	PageSize           int      `long:"page-size" default:"1000" description:"Number of entities fetched per call, lower it for kinds with large properties (1-1000)"`
+	MaxBatchBytes      string   `long:"max-batch-bytes" description:"Lower the page size when the records of a batch encode to more than about the size, e.g. 64MB, so kinds with multi-MB properties don't hold large pages in memory"`
+	Workers            int      `long:"workers" default:"1" description:"Number of concurrent fetches, with more than one the keys are listed by a keys-only scan and loaded in batches in no particular order"`
+	ShardBy            string   `long:"shard-by" default:"keys" choice:"keys" choice:"scatter" description:"How --workers split the export: load batches of a keys-only scan, or export key ranges sampled by the __scatter__ property in parallel"`
+	MaxRetries         int      `long:"max-retries" default:"5" description:"Number of retries of a batch failing with a transient error (unavailable, deadline exceeded, aborted), with exponential backoff"`
+	AdaptiveRate       bool     `long:"adaptive-rate" description:"Slow down on contention errors and latency spikes, and speed back up when they clear"`
+	ArrayMode          string   `long:"array-mode" default:"cell" choice:"cell" choice:"columns" choice:"json" choice:"skip" description:"How arrays are written to CSV: a single cell with elements joined by --array-separator (JSON for arrays of entities), a column per element, e.g. tags_0, tags_1, a JSON array or left out"`
+	NestedMode         string   `long:"nested-mode" default:"flatten" choice:"flatten" choice:"json" choice:"skip" description:"How embedded entities are written to CSV: a column per nested property, e.g. address:city, a JSON cell or left out"`
+	NestingSeparator   string   `long:"nesting-separator" default:":" description:"Separator of property names in CSV columns of embedded entities, e.g. . for address.city"`
+	MaxDepth           int      `long:"max-depth" default:"0" description:"Number of property levels flattened into CSV columns, deeper entities are written as JSON cells, 0 for no limit"`
+	ArraySeparator     string   `long:"array-separator" default:";" description:"Separator of array elements with --array-mode cell"`
+	ArrayMax           int      `long:"array-max" default:"10" description:"Maximum number of columns per array with --array-mode columns, further elements are dropped"`
+	IdempotentName     bool     `long:"idempotent-name" description:"Name the file by project, namespace, kind and date only, so reruns on the same day replace it"`
+	OutputDir          string   `long:"output-dir" default:"exports" description:"Folder of generated file names when --output is not a file"`
+	FilenameTemplate   string   `long:"filename-template" description:"Generated file name with {project}, {namespace}, {kind}, {timestamp}, {date} and {shard}, the part number of split exports, e.g. {namespace}/{kind}-{shard}, the extension is appended"`
+	OnError            string   `long:"on-error" choice:"abort" choice:"skip" choice:"log" default:"abort" description:"Entities that can't be exported stop the export (abort), are left out and recorded in <file>.errors.jsonl (skip) or are left out and logged (log), left out entities fail the command once the export is written"`
+	ContinueOnError    bool     `long:"continue-on-error" description:"Same as --on-error skip"`
+	Joins              []string `long:"join" description:"Inline fields of a referenced entity as lookupKind:localField:remoteFields->alias, remote fields are comma separated or * (repeatable)"`
+	EmitIndexYAML      string   `long:"emit-index-yaml" description:"Write the composite index required by the export query to an index.yaml file"`
+	Since              string   `long:"since" description:"Export only entities with a --timestamp-field after the time, e.g. 2024-05-01T00:00:00Z"`
+	TimestampField     string   `long:"timestamp-field" description:"Indexed property with the modification time of entities, used by --since and --follow, e.g. updatedAt"`
+	Follow             bool     `long:"follow" description:"After the export, keep polling for entities with a --timestamp-field after the last exported one and append them to the JSON lines --output file or stdout until interrupted"`
+	PollInterval       int      `long:"poll-interval" default:"30" description:"Seconds between the polls of --follow"`
+	SinceCursorFile    string   `long:"since-cursor-file" description:"Continue from the cursor stored in the file and store the final cursor there, for append-mostly kinds ordered by __key__"`
+	BlobFormat         string   `long:"blob-format" default:"auto" choice:"auto" choice:"base64" choice:"prefixed" choice:"hex" description:"Rendering of binary properties: {\"base64\": ...} objects in JSON and base64 in CSV, plain base64, base64 prefixed by base64: or hex"`
+	GeoFormat          string   `long:"geo-format" default:"auto" choice:"auto" choice:"object" choice:"string" choice:"wkt" description:"Rendering of geopoints: lat/lng objects in JSON and lat,lng in CSV, lat/lng objects everywhere (:lat and :lng columns in CSV), lat,lng or WKT POINT(lng lat)"`
+	KeyRefFormat       string   `long:"key-ref-format" default:"id" choice:"id" choice:"structured" choice:"encoded" description:"Rendering of key-valued properties: name or ID (Kind:id/Kind:name path for keys with ancestors), kind/ID/path object (path string in CSV) or encoded key"`
+	ExpectSchema       string   `long:"expect-schema" description:"JSON file mapping property names to types (int, float, bool, string, time, bytes, geopoint, key, entity, array), a trailing ? marks optional properties"`
+	SchemaViolation    string   `long:"schema-violation" default:"fail" choice:"warn" choice:"fail" description:"What to do with entities not matching --expect-schema"`
+	Split              int      `long:"split" description:"Start a new file every N records, files are numbered as .part0001, .part0002, ..."`
+	MaxFileSize        string   `long:"max-file-size" description:"Start a new file when the current one reaches about the size, e.g. 500MB or 1GiB, files are numbered as with --split"`
+	Gzip               bool     `long:"gzip" description:"Compress the export with gzip, .gz is appended to the generated file name"`
+	Encrypt            string   `long:"encrypt" description:"Encrypt the export with AES-256-GCM, the key derived from --passphrase (passphrase) or wrapped by a Cloud KMS key (kms:projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>), .enc is appended to the generated file name"`
+	Passphrase         string   `long:"passphrase" env:"CDSKIT_PASSPHRASE" description:"Passphrase of --encrypt passphrase"`
+	Stdout             bool     `long:"stdout" description:"Write the export to stdout, same as --output -"`
+	Output             string   `short:"o" long:"output" description:"Where to export to instead of the exports folder: a file path, - for stdout, gs://bucket/path uploads the file to Cloud Storage, pubsub://project/topic publishes every record as a JSON message"`
+	SignedURL          string   `long:"signed-url" description:"Print a signed URL of every file uploaded to Cloud Storage, valid for the duration, e.g. 24h, at most 168h"`
+	SignedURLSigner    string   `long:"signed-url-signer" description:"Service account signing --signed-url through the IAM Credentials API, needed unless the credentials are a service account key"`
+	NamespaceField     string   `long:"namespace-field" description:"Field to store the namespace of the entity in"`
+	NamespaceTransform string   `long:"namespace-transform" description:"Transform of the --namespace-field value: strip-prefix=<prefix> or regex=<expression> keeping the first group"`
+	Timezone           string   `long:"timezone" description:"IANA time zone, e.g. Europe/Berlin, to convert timestamps to before formatting"`
+	TimeFormat         string   `long:"time-format" default:"rfc3339" description:"Format of timestamps in JSON, CSV and the other text formats: rfc3339, epoch-millis, epoch-seconds or a Go layout, e.g. \"2006-01-02 15:04:05\""`
+	BatchID            string   `long:"batch-id" optional:"yes" optional-value:"auto" description:"Add a __batch__ field identifying the run to every record, a random UUID unless a value is given"`
+	FailOnSchemaDrift  bool     `long:"fail-on-schema-drift" description:"Fail when a CSV record has other columns than the first one, instead of widening the header"`
+	DateLayout         bool     `long:"date-layout" description:"Write into YYYY/MM/DD/ subdirectories of the output folder or Cloud Storage path by the run date"`
+	Precount           bool     `long:"precount" description:"Count entities before exporting to show percent complete and ETA"`
+	Quiet              bool     `long:"quiet" description:"Do not print the progress after every batch"`
+	ProgressJSON       bool     `long:"progress-json" description:"Print the progress after every batch as JSON lines on stderr with entities, bytes, elapsed_seconds, entities_per_second and, when the total is known, percent and eta_seconds"`
+	Total              int      `long:"total" description:"Number of entities to be exported, shows percent complete and ETA without counting"`
+	Pretty             bool     `long:"pretty" description:"Indent JSON records, one array element per line, ignored by other formats"`
+	Canonical          bool     `long:"canonical" description:"Write JSON records in the RFC 8785 canonical form, byte-stable for signing"`
+	DeadLetter         string   `long:"dead-letter" description:"Write entities failing --label, --content-hash or --expect-schema processing to the file as they were loaded and continue"`
+	OrderFields        string   `long:"order-fields" description:"Comma separated fields written first in JSON records in the given order after __key__, other fields follow alphabetically"`
+	KeysFile           string   `long:"keys-file" description:"Export only the entities listed in the file instead of the whole kind, one name or ID per line optionally preceded by the ancestor path, e.g. Parent:42/abc"`
+	Sample             string   `long:"sample" description:"Export a random sample as random:N, picked by the __scatter__ property Datastore sets on a random share of about 1 in 100 entities, so small kinds give fewer entities"`
+	Ancestor           string   `long:"ancestor" description:"Export only the entity group below the key given as a Kind:id/Kind:name path from the root, e.g. Customer:42, a Kind/id path or an encoded key"`
+	Manifest           bool     `long:"manifest" description:"Write <output>.manifest.json with the SHA-256 checksum, size and record count of every written file, the query and the tool version, checked by verify-manifest"`
+	Resume             bool     `long:"resume" description:"Store the progress in <output>.checkpoint after every batch and continue from it when it exists, for JSON lines written to --output files"`
+	SummaryFile        string   `long:"summary-file" description:"Write the JSON summary of the export to the file instead of stderr"`
+	ColumnarSchema     string   `long:"columnar-schema" description:"BigQuery JSON schema, e.g. written by --bq-schema, of the --format parquet or avro columns instead of inferring them, properties not in it are left out"`
+	BigQuerySchema     string   `long:"bq-schema" description:"File to write the BigQuery schema inferred by --format bigquery to, <output>.schema.json next to a local output by default"`
+	BigQueryLoad       string   `long:"bq-load" description:"BigQuery table as [project:]dataset.table to load a --format bigquery export written to Cloud Storage into"`
+	BigQueryReplace    bool     `long:"bq-replace" description:"Replace the contents of the --bq-load table instead of appending"`
+
+	labels           []exportLabel
+	delimiter        rune
+	filters          []queryFilter
+	ancestor         *datastore.Key
+	location         *time.Location
+	joins            []*exportJoin
+	nsTransform      namespaceTransform
+	schema           expectedSchema
+	schemaViolations int
+	transforms       transforms
+	// redactions maps properties to the method replacing their values
+	redactions map[string]string
+	started    time.Time
+	// out replaces stdout for library callers
+	out io.Writer
+	// checkpoint is the progress of the resumed export
+	checkpoint *exportCheckpoint
+	// projection are the --field properties queried by a projection query
+	projection []string
+	// stats is the summary of the last run
+	stats *exportStats
+	// written counts bytes written to the outputs, encoded the bytes produced by the export writers
+	written       int64
+	encoded       int64
+	maxFileSize   int64
+	maxBatchBytes int64
+	// bqSchema is inferred by --format bigquery, uploaded are the Cloud Storage objects written
+	bqSchema *bqSchema
+	uploaded []string
+	// manifest are the committed outputs listed by --manifest
+	manifest []*manifestOutput
+	// workbook is shared by the kinds of --kinds written into one .xlsx file
+	workbook *xlsxWorkbook
+	// columnSchema is read from --columnar-schema
+	columnSchema *columnSchema
+	// lastSeen is the latest --timestamp-field value exported, appendOutput is set by
+	// the polls of --follow
+	lastSeen     time.Time
+	appendOutput bool
+	// progress counts the fetched entities for the jobs of serve
+	progress *int64
+	// encryption is parsed from --encrypt
+	encryption *fileEncryption
+}
+
+// Execute is called by go-flags
+func (cmd *ExportKindCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(true)
+	defer cancel()
+
+	if cmd.Mode == "firestore" && (cmd.Kinds != "" || cmd.AllKinds || cmd.Follow) {
+		return fmt.Errorf("--mode firestore exports a collection given by --kind, it can't be combined with --kinds, --all-kinds or --follow")
+	}
+	if cmd.Kinds != "" || cmd.AllKinds {
+		return cmd.runKinds(ctx)
+	}
+	if cmd.SkipKinds != "" {
+		return fmt.Errorf("--skip-kinds can only be combined with --kinds or --all-kinds")
+	}
+	if cmd.Follow {
+		return cmd.follow(ctx)
+	}
+	return cmd.run(ctx)
+}
+
+func (cmd *ExportKindCmd) run(ctx context.Context) error {
+	if cmd.Kind == "" {
+		return fmt.Errorf("the required flag `-k, --kind' was not specified, or give --kinds or --all-kinds")
+	}
+
+	infof("Exporting '%s' from '%s/%s'", cmd.Kind, cmd.ProjectID, cmd.Namespace)
+
+	cmd.started = time.Now()
+
+	if cmd.ContinueOnError {
+		cmd.OnError = "skip"
+	}
+
+	delimiter, err := parseDelimiter(cmd.Delimiter)
+	if err != nil {
+		return err
+	}
+	cmd.delimiter = delimiter
+
+	if cmd.NestingSeparator == "" {
+		return fmt.Errorf("--nesting-separator can't be empty")
+	}
+
+	labels, err := parseLabels(cmd.Labels)
+	if err != nil {
+		return err
+	}
+	cmd.labels = labels
+
+	var fields []string
+	for _, s := range cmd.Fields {
+		fields = append(fields, strings.Split(s, ",")...)
+	}
+	cmd.Fields = fields
+
+	cmd.filters, cmd.joins = nil, nil
+	for _, s := range cmd.Filters {
+		f, err := parseFilter(s)
+		if err != nil {
+			return err
+		}
+		cmd.filters = append(cmd.filters, f)
+	}
+
+	if (cmd.Since != "" || cmd.Follow) && cmd.TimestampField == "" {
+		return fmt.Errorf("--timestamp-field is required with --since and --follow")
+	}
+	if cmd.Since != "" {
+		since, err := time.Parse(time.RFC3339Nano, cmd.Since)
+		if err != nil {
+			return fmt.Errorf("Invalid --since, expected an RFC 3339 time: %w", err)
+		}
+		cmd.filters = append(cmd.filters, queryFilter{field: cmd.TimestampField, op: ">", value: since})
+	}
+
+	for _, s := range cmd.Joins {
+		j, err := parseJoin(s)
+		if err != nil {
+			return err
+		}
+		cmd.joins = append(cmd.joins, j)
+	}
+
+	if cmd.NamespaceTransform != "" {
+		if cmd.NamespaceField == "" {
+			return fmt.Errorf("--namespace-transform requires --namespace-field")
+		}
+
+		cmd.nsTransform, err = parseNamespaceTransform(cmd.NamespaceTransform)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd.transforms, err = parseTransforms(cmd.Transforms)
+	if err != nil {
+		return err
+	}
+
+	if len(cmd.Redact) > 0 || len(cmd.Anonymize) > 0 {
+		cmd.redactions, err = parseRedactions(cmd.Redact, cmd.RedactMode, cmd.Anonymize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.ExpectSchema != "" {
+		cmd.schema, err = readExpectedSchema(cmd.ExpectSchema)
+		if err != nil {
+			return err
+		}
+	}
+
+	// typed records hold the entity as loaded, fields added to the exported values are lost
+	if cmd.Format == "typed-json" && (len(cmd.Labels) > 0 || cmd.BatchID != "" || cmd.NamespaceField != "" ||
+		cmd.ContentHash != "" || len(cmd.Joins) > 0 || cmd.PruneEmpty || cmd.ExpandAncestors || cmd.OrderFields != "" || cmd.redactions != nil || cmd.transforms != nil) {
+		return fmt.Errorf("--format typed-json can't be combined with options changing records: --label, --batch-id, --namespace-field, --content-hash, --join, --prune-empty, --expand-ancestors, --order-fields, --redact, --anonymize or --transform")
+	}
+
+	if cmd.Canonical && cmd.OrderFields != "" {
+		return fmt.Errorf("--canonical and --order-fields can't be combined, canonical JSON has sorted fields")
+	}
+
+	if cmd.Timezone != "" {
+		cmd.location, err = time.LoadLocation(cmd.Timezone)
+		if err != nil {
+			return fmt.Errorf("Invalid timezone %s: %w", cmd.Timezone, err)
+		}
+	}
+
+	if err := checkTimeFormat(cmd.TimeFormat); err != nil {
+		return err
+	}
+
+	if cmd.BatchID == "auto" {
+		cmd.BatchID, err = newUUID()
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.BatchID != "" {
+		infof("Batch ID %s", cmd.BatchID)
+	}
+
+	if cmd.Ancestor != "" {
+		cmd.ancestor, err = parseAncestor(cmd.Ancestor, cmd.Namespace)
+		if err != nil {
+			return fmt.Errorf("Invalid --ancestor %s: %w", cmd.Ancestor, err)
+		}
+	}
+
+	var keys *keyList
+	if cmd.KeysFile != "" {
+		if cmd.SinceCursorFile != "" || len(cmd.OrderBy) > 0 || cmd.Ancestor != "" {
+			return fmt.Errorf("--keys-file can't be combined with --since-cursor-file, --order-by or --ancestor")
+		}
+
+		keys, err = readKeysFile(cmd.KeysFile, cmd.Kind, cmd.Namespace)
+		if err != nil {
+			return err
+		}
+		keys.pos = min(cmd.Offset, len(keys.keys))
+	}
+
+	sampleSize := 0
+	if cmd.Sample != "" {
+		// the scatter order can't be combined with other orders or filters without an index
+		if keys != nil || len(cmd.Filters) > 0 || len(cmd.OrderBy) > 0 || cmd.SinceCursorFile != "" || cmd.Offset > 0 || cmd.KeysOnly || cmd.ShardBy == "scatter" {
+			return fmt.Errorf("--sample can't be combined with --keys-file, --filter, --order-by, --since-cursor-file, --offset, --keys-only or --shard-by scatter")
+		}
+
+		sampleSize, err = parseSample(cmd.Sample)
+		if err != nil {
+			return err
+		}
+		if cmd.Limit > 0 {
+			sampleSize = min(sampleSize, cmd.Limit)
+		}
+	}
+
+	if cmd.Stdout {
+		if cmd.Output != "" && cmd.Output != "-" {
+			return fmt.Errorf("--stdout can't be combined with --output %s", cmd.Output)
+		}
+		cmd.Output = "-"
+	}
+
+	if cmd.Gzip && strings.HasPrefix(cmd.Output, "pubsub://") {
+		return fmt.Errorf("--gzip can't be used with Pub/Sub output")
+	}
+	if (cmd.BigQuerySchema != "" || cmd.BigQueryLoad != "" || cmd.BigQueryReplace) && cmd.Format != "bigquery" {
+		return fmt.Errorf("--bq-schema, --bq-load and --bq-replace require --format bigquery")
+	}
+	if cmd.BigQueryLoad != "" && !strings.HasPrefix(cmd.Output, "gs://") {
+		return fmt.Errorf("--bq-load requires --output gs://, BigQuery loads from Cloud Storage")
+	}
+	if cmd.Format == "bigquery" {
+		cmd.bqSchema = newBigQuerySchema()
+	}
+	if err := checkFilenameTemplate(cmd.FilenameTemplate); err != nil {
+		return err
+	}
+	if cmd.Gzip && cmd.Format == "parquet" {
+		return fmt.Errorf("--gzip can't be used with Parquet, readers expect an uncompressed file")
+	}
+	if cmd.Gzip && cmd.Format == "avro" {
+		return fmt.Errorf("--gzip can't be used with Avro, readers expect an uncompressed container file")
+	}
+	cmd.columnSchema = nil
+	if cmd.ColumnarSchema != "" {
+		if cmd.Format != "parquet" && cmd.Format != "avro" {
+			return fmt.Errorf("--columnar-schema requires --format parquet or avro")
+		}
+		if cmd.columnSchema, err = loadColumnSchema(cmd.ColumnarSchema); err != nil {
+			return err
+		}
+	}
+	var signedURL time.Duration
+	if cmd.SignedURL != "" {
+		if !strings.HasPrefix(cmd.Output, "gs://") {
+			return fmt.Errorf("--signed-url requires --output gs://")
+		}
+		if signedURL, err = time.ParseDuration(cmd.SignedURL); err != nil || signedURL <= 0 || signedURL > 7*24*time.Hour {
+			return fmt.Errorf("--signed-url must be a duration of at most 168h, e.g. 24h")
+		}
+	}
+	cmd.encryption = nil
+	if cmd.Encrypt != "" {
+		if strings.HasPrefix(cmd.Output, "pubsub://") {
+			return fmt.Errorf("--encrypt can't be used with Pub/Sub output")
+		}
+		if cmd.Resume {
+			return fmt.Errorf("--encrypt can't be combined with --resume, encrypted files can't be appended to")
+		}
+		if cmd.encryption, err = parseEncryption(cmd.Encrypt, cmd.Passphrase); err != nil {
+			return err
+		}
+	}
+	if cmd.Gzip && cmd.Format == "xlsx" {
+		return fmt.Errorf("--gzip can't be used with xlsx, the workbook is already compressed")
+	}
+	if cmd.Split > 0 && (cmd.Output == "-" || strings.HasPrefix(cmd.Output, "pubsub://")) {
+		return fmt.Errorf("--split requires file or Cloud Storage output")
+	}
+	if cmd.Manifest && (cmd.Output == "-" || strings.HasPrefix(cmd.Output, "pubsub://")) {
+		return fmt.Errorf("--manifest requires file or Cloud Storage output")
+	}
+	if cmd.Manifest && cmd.Resume {
+		return fmt.Errorf("--manifest can't be combined with --resume, checksums cover a single run")
+	}
+	cmd.manifest = nil
+
+	if cmd.MaxFileSize != "" {
+		if cmd.Output == "-" || strings.HasPrefix(cmd.Output, "pubsub://") {
+			return fmt.Errorf("--max-file-size requires file or Cloud Storage output")
+		}
+		// CSV rows are written when the header is known at the end of a file
+		if cmd.Format == "csv" {
+			return fmt.Errorf("--max-file-size can't be used with CSV, use --split")
+		}
+
+		cmd.maxFileSize, err = parseSize(cmd.MaxFileSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.PageSize < 1 || cmd.PageSize > 1000 {
+		return fmt.Errorf("--page-size must be between 1 and 1000")
+	}
+	if cmd.MaxBatchBytes != "" {
+		cmd.maxBatchBytes, err = parseSize(cmd.MaxBatchBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cmd.Resume {
+		if err := cmd.checkResumable(); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if cmd.KeysOnly && (cmd.Workers > 1 || keys != nil || len(cmd.Fields) > 0 || cmd.NoKey || len(cmd.Joins) > 0 || cmd.Format == "typed-json") {
+		return fmt.Errorf("--keys-only can't be combined with --workers, --keys-file, --field, --no-key, --join or --format typed-json")
+	}
+	if cmd.Workers > 1 && (cmd.AdaptiveRate || cmd.SinceCursorFile != "") {
+		return fmt.Errorf("--workers can't be combined with --adaptive-rate or --since-cursor-file")
+	}
+	if cmd.Workers > 1 && cmd.ShardBy == "scatter" {
+		inequality := false
+		for _, f := range cmd.filters {
+			inequality = inequality || f.inequality()
+		}
+		// key ranges are inequality filters on __key__ and need the key order
+		if inequality || len(cmd.OrderBy) > 0 || keys != nil || cmd.Offset > 0 {
+			return fmt.Errorf("--shard-by scatter can't be combined with inequality filters, --order-by, --keys-file or --offset")
+		}
+	}
+
+	// documents are read in the order of their paths, queries and key-based options need Datastore
+	if cmd.Mode == "firestore" && (cmd.Namespace != "" || len(cmd.Filters) > 0 || len(cmd.OrderBy) > 0 || len(cmd.Fields) > 0 || cmd.KeysOnly ||
+		len(cmd.Joins) > 0 || cmd.Workers > 1 || cmd.AdaptiveRate || cmd.Since != "" || cmd.SinceCursorFile != "" || keys != nil || cmd.Sample != "" ||
+		cmd.Ancestor != "" || cmd.Resume || cmd.Precount || cmd.DetectPII || cmd.EmitIndexYAML != "") {
+		return fmt.Errorf("--mode firestore can't be combined with --namespace, --filter, --order-by, --field, --keys-only, --join, --workers, --adaptive-rate, --since, --since-cursor-file, --keys-file, --sample, --ancestor, --resume, --precount, --detect-pii or --emit-index-yaml")
+	}
+
+	if cmd.EmitIndexYAML != "" {
+		if err := cmd.emitIndexYAML(cmd.EmitIndexYAML); err != nil {
+			return err
+		}
+	}
+
+	var dsClient *datastore.Client
+	var docs *firestorePages
+	if cmd.Mode == "firestore" {
+		fsClient, err := newFirestoreClient(ctx, cmd.ProjectID)
+		if err != nil {
+			return err
+		}
+
+		defer fsClient.Close()
+		docs = &firestorePages{query: fsClient.CollectionGroup(cmd.Kind).Query}
+	} else {
+		dsClient, err = newClient(ctx, cmd.ProjectID)
+		if err != nil {
+			return err
+		}
+
+		defer dsClient.Close()
+	}
+
+	if cmd.DetectPII {
+		return cmd.detectPII(ctx, dsClient)
+	}
+
+	if sampleSize > 0 {
+		keys, err = cmd.sampleKeys(ctx, dsClient, sampleSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(cmd.Fields) > 0 {
+		if err := cmd.checkProjection(ctx, dsClient); err != nil {
+			return err
+		}
+	}
+
+	fileName := cmd.newExportFileName()
+	if cmd.Output != "" && !strings.Contains(cmd.Output, "://") && cmd.Output != "-" {
+		fileName = cmd.Output
+	}
+
+	if cmd.Resume {
+		cmd.checkpoint, err = readCheckpoint(fileName)
+		if err != nil {
+			return err
+		}
+		if cmd.checkpoint != nil {
+			infof("Resuming after %d entities", cmd.checkpoint.Entities)
+		}
+	}
+
+	var output *exportOutput
+	if cmd.Split > 0 || cmd.maxFileSize > 0 {
+		output, err = cmd.newSplitOutput(ctx, fileName)
+	} else {
+		output, err = cmd.openOutput(ctx, fileName)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+	w := output.writer
+	commit := output.commit
+
+	stats := &exportStats{Kind: cmd.Kind, Namespace: cmd.Namespace, Output: fileName}
+	cmd.stats = stats
+	if strings.Contains(cmd.Output, "://") || cmd.Output == "-" {
+		stats.Output = cmd.Output
+	}
+
+	// errors log goes to the working directory when there is no export folder
+	if cmd.Output != "" && fileName != cmd.Output {
+		fileName = filepath.Base(fileName)
+	}
+
+	manifestPath := fileName + ".manifest.json"
+	skipped := &skipLog{path: fileName + ".errors.jsonl", logOnly: cmd.OnError == "log"}
+	defer skipped.Close()
+
+	deadLetter := &skipLog{path: cmd.DeadLetter}
+	defer deadLetter.Close()
+
+	// pages are chained by cursors, an offset would make the server skip all
+	// previous entities on every page
+	var start datastore.Cursor
+	if cmd.SinceCursorFile != "" {
+		start, err = cmd.readSinceCursor()
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.checkpoint != nil {
+		start, err = datastore.DecodeCursor(cmd.checkpoint.Cursor)
+		if err != nil {
+			return fmt.Errorf("Invalid checkpoint cursor: %w", err)
+		}
+	}
+
+	var rate *adaptiveRate
+	if cmd.AdaptiveRate {
+		rate = newAdaptiveRate()
+	}
+
+	total := cmd.Total
+	if keys != nil {
+		total = len(keys.keys) - keys.pos
+	} else if cmd.Precount {
+		total, err = dsClient.Count(ctx, cmd.newQuery().Start(start).KeysOnly())
+		if err != nil {
+			return fmt.Errorf("Unable to count %s: %w", cmd.Kind, err)
+		}
+		infof("Counted %d entities", total)
+	}
+
+	if cmd.Limit > 0 && total > cmd.Limit {
+		total = cmd.Limit
+	}
+
+	progress := &progressReporter{kind: cmd.Kind, started: time.Now(), total: total, written: &cmd.written, json: cmd.ProgressJSON, quiet: cmd.Quiet}
+	if total > 0 {
+		progress.eta = newProgressETA(total)
+	}
+
+	vopts := cmd.valueOptions()
+	offset := 0
+	if cmd.checkpoint != nil {
+		offset = cmd.checkpoint.Entities
+	}
+
+	// an interrupt stops fetching, the entities fetched so far are still written out
+	fetchCtx, stop := interruptible(ctx)
+	defer stop()
+	interrupted := false
+	// start moves to the next page only once the batch is written
+	next := start
+
+	var results <-chan fetchResult
+	if cmd.Workers > 1 && cmd.ShardBy == "scatter" {
+		results = cmd.fetchSharded(fetchCtx, dsClient, vopts, cmd.Workers)
+	} else if cmd.Workers > 1 {
+		results = cmd.fetchParallel(fetchCtx, dsClient, vopts, keys, cmd.Workers)
+	}
+
+	if err := w.WriteHeader(); err != nil {
+		return err
+	}
+	pageSize := cmd.PageSize
+	for done := false; !done; {
+
+		batchStarted := time.Now()
+		batchEncoded := cmd.encoded
+		var batch []*dynamicEntity
+		size := pageSize
+		if cmd.Limit > 0 {
+			size = min(size, cmd.Limit-offset)
+		}
+
+		if results != nil {
+			r, ok := <-results
+			batch, err, done = r.batch, r.err, !ok
+			if keys != nil {
+				keys.missing = append(keys.missing, r.missing...)
+			}
+		} else if keys != nil {
+			err = withRetries(fetchCtx, cmd.MaxRetries, func() (err error) {
+				batch, done, err = keys.next(fetchCtx, dsClient, vopts, size)
+				return err
+			})
+		} else if docs != nil {
+			skip := 0
+			if offset == 0 {
+				skip = cmd.Offset
+			}
+			err = withRetries(fetchCtx, cmd.MaxRetries, func() (err error) {
+				batch, err = docs.next(fetchCtx, vopts, size, skip)
+				return err
+			})
+			done = len(batch) == 0
+		} else {
+			q := cmd.newQuery().Start(start).Limit(size)
+			if len(cmd.projection) > 0 {
+				q = q.Project(cmd.projection...)
+			}
+			if cmd.KeysOnly {
+				q = q.KeysOnly()
+			}
+			// the cursor of a page already accounts for the offset
+			if offset == 0 && cmd.Offset > 0 {
+				q = q.Offset(cmd.Offset)
+			}
+
+			var cursor datastore.Cursor
+			batch, cursor, err = cmd.fetchPage(fetchCtx, dsClient, q, vopts, rate)
+			if len(batch) > 0 {
+				next = cursor
+			}
+			done = len(batch) == 0
+		}
+		if err != nil && fetchCtx.Err() != nil {
+			interrupted = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if cmd.Limit > 0 && offset+len(batch) >= cmd.Limit {
+			batch = batch[:cmd.Limit-offset]
+			done = true
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		progress.report(offset + len(batch))
+		storeProgress(cmd.progress, offset+len(batch))
+
+		for _, j := range cmd.joins {
+			if err = j.resolve(fetchCtx, dsClient, batch, vopts); err != nil {
+				break
+			}
+		}
+		if err != nil && fetchCtx.Err() != nil {
+			interrupted = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, v := range batch {
+			// redacted first, so personal data doesn't end up in the dead letter file either
+			if cmd.redactions != nil {
+				cmd.redact(v)
+			}
+
+			var raw json.RawMessage
+			if cmd.DeadLetter != "" {
+				raw, err = v.ToJSON()
+				if err != nil {
+					return fmt.Errorf("Unable to export entity %s: %w", v.key, err)
+				}
+			}
+
+			if cmd.TimestampField != "" {
+				cmd.noteSeen(v)
+			}
+
+			err := cmd.prepare(v)
+			if err == errDropped {
+				stats.Dropped++
+				continue
+			}
+			if err != nil && raw != nil {
+				if err := deadLetter.Record(v.key, offset, err, raw); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err == nil {
+				err = w.WriterRecord(v)
+			}
+			if err == nil {
+				stats.Records++
+			}
+
+			if err != nil {
+				// a failed write leaves the output incomplete, skipping it won't help
+				var oe *outputError
+				if cmd.OnError == "abort" || errors.As(err, &oe) {
+					return fmt.Errorf("Unable to export entity %s: %w", v.key, err)
+				}
+				if err := skipped.Record(v.key, offset, err, nil); err != nil {
+					return err
+				}
+			}
+		}
+
+		offset = offset + len(batch)
+		start = next
+		stats.Batches++
+		stats.Read += len(batch)
+		logEvent(logDebug, logFields{"event": "batch", "kind": cmd.Kind, "batch": stats.Batches, "entities": len(batch), "seconds": time.Since(batchStarted).Seconds()},
+			"Batch %d of %s: %d entities in %s", stats.Batches, cmd.Kind, len(batch), time.Since(batchStarted).Round(time.Millisecond))
+
+		// pages are sized so the next batch encodes to about --max-batch-bytes
+		if encoded := cmd.encoded - batchEncoded; cmd.maxBatchBytes > 0 && encoded > 0 {
+			size := int(cmd.maxBatchBytes * int64(len(batch)) / encoded)
+			if size < 1 {
+				size = 1
+			}
+			if size = min(size, cmd.PageSize); size != pageSize {
+				debugf("Page size of %s changed to %d, the last batch encoded to %d bytes", cmd.Kind, size, encoded)
+				pageSize = size
+			}
+		}
+
+		if cmd.Resume {
+			if err := writeCheckpoint(fileName, exportCheckpoint{Cursor: start.String(), Entities: offset}); err != nil {
+				return fmt.Errorf("Unable to write checkpoint: %w", err)
+			}
+		}
+	}
+	if err := w.WriteFooter(); err != nil {
+		return err
+	}
+
+	if err := commit(); err != nil {
+		return err
+	}
+
+	if cmd.Manifest {
+		if err := cmd.writeManifest(manifestPath, stats.Records); err != nil {
+			return err
+		}
+	}
+
+	if cmd.bqSchema != nil {
+		if err := cmd.finishBigQuery(ctx, fileName); err != nil {
+			return err
+		}
+	}
+
+	// the URLs are printed to stdout, separate from the log
+	if signedURL > 0 {
+		for _, name := range cmd.uploaded {
+			url, err := signGCSURL(ctx, name, signedURL, cmd.SignedURLSigner)
+			if err != nil {
+				return fmt.Errorf("Unable to sign a URL of %s: %w", name, err)
+			}
+			infof("Signed URL of %s valid until %s", name, time.Now().Add(signedURL).Format(time.RFC3339))
+			fmt.Println(url)
+		}
+	}
+
+	if keys != nil && len(keys.missing) > 0 {
+		for _, k := range keys.missing {
+			warnf("Not found: %s", keyPath(k))
+		}
+		warnf("%d of %d keys not found", len(keys.missing), len(keys.keys))
+	}
+
+	if skipped.count > 0 && skipped.logOnly {
+		warnf("Skipped %d entities", skipped.count)
+	} else if skipped.count > 0 {
+		warnf("Skipped %d entities, see %s", skipped.count, skipped.path)
+	}
+
+	if deadLetter.count > 0 {
+		warnf("%d entities failed processing, see %s", deadLetter.count, deadLetter.path)
+	}
+
+	if stats.Dropped > 0 {
+		infof("Dropped %d entities by --transform", stats.Dropped)
+	}
+
+	if cmd.schemaViolations > 0 {
+		warnf("%d entities don't match %s", cmd.schemaViolations, cmd.ExpectSchema)
+	}
+
+	if cmd.SinceCursorFile != "" {
+		if err := ioutil.WriteFile(cmd.SinceCursorFile, []byte(start.String()), 0644); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Resume && !interrupted {
+		if err := os.Remove(fileName + ".checkpoint"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	stats.Skipped = skipped.count + deadLetter.count
+	stats.Interrupted = interrupted
+	stats.Elapsed = time.Since(cmd.started).Seconds()
+	if err := stats.write(cmd.SummaryFile); err != nil {
+		return err
+	}
+
+	if interrupted {
+		return fmt.Errorf("%w, the export has %d entities", interruption(), offset)
+	}
+	if stats.Skipped > 0 {
+		return fmt.Errorf("%w, %d of %d entities were left out", ErrIncomplete, stats.Skipped, stats.Read)
+	}
+	return nil
+}
+
+// fetchPage fetches the next page retrying transient errors, with the adaptive rate
+// the retries are delayed by the rate instead of the exponential backoff
+func (cmd *ExportKindCmd) fetchPage(ctx context.Context, client *datastore.Client, q *datastore.Query, opts *valueOptions, rate *adaptiveRate) ([]*dynamicEntity, datastore.Cursor, error) {
+	if rate == nil {
+		var batch []*dynamicEntity
+		var cursor datastore.Cursor
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, cursor, err = fetchPage(ctx, client, q, opts)
+			return err
+		})
+		return batch, cursor, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := rate.wait(ctx); err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		if err := callLimiter.wait(ctx); err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+
+		started := time.Now()
+		batch, cursor, err := fetchPage(ctx, client, q, opts)
+		rate.observe(time.Since(started), err)
+
+		if err != nil && isContention(err) && attempt <= cmd.MaxRetries {
+			continue
+		}
+		return batch, cursor, err
+	}
+}
+
+// fetchPage runs the query and returns loaded entities along with the cursor after the last one
+func fetchPage(ctx context.Context, client *datastore.Client, q *datastore.Query, opts *valueOptions) ([]*dynamicEntity, datastore.Cursor, error) {
+	var batch []*dynamicEntity
+
+	it := client.Run(ctx, q)
+	for {
+		de := &dynamicEntity{opts: opts}
+		k, err := it.Next(de)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+
+		de.key = k
+		batch = append(batch, de)
+	}
+
+	cursor, err := it.Cursor()
+	return batch, cursor, err
+}
+
+// readSinceCursor reads the cursor stored by the previous run, a missing file means
+// the export starts from the beginning.
+func (cmd *ExportKindCmd) readSinceCursor() (datastore.Cursor, error) {
+	for _, o := range cmd.OrderBy {
+		if strings.TrimPrefix(o, "-") != "__key__" {
+			warnf("--since-cursor-file relies on __key__ order, got --order-by %s", o)
+		}
+	}
+
+	b, err := ioutil.ReadFile(cmd.SinceCursorFile)
+	if os.IsNotExist(err) {
+		return datastore.Cursor{}, nil
+	}
+	if err != nil {
+		return datastore.Cursor{}, err
+	}
+
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return datastore.Cursor{}, nil
+	}
+
+	cursor, err := datastore.DecodeCursor(s)
+	if err != nil {
+		return datastore.Cursor{}, fmt.Errorf("Invalid cursor in %s: %w", cmd.SinceCursorFile, err)
+	}
+	return cursor, nil
+}
+
+// newQuery builds the export query without pagination.
+//
+// Unless disabled, the query is ordered by __key__ when no explicit order is given,
+// so consecutive pages never skip or repeat entities. The key order is served by the
+// built-in index, the cost is a slightly slower scan compared to the natural order.
+// With an inequality filter the filtered property goes first, as Datastore requires.
+func (cmd *ExportKindCmd) newQuery() *datastore.Query {
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(cmd.ancestor)
+	}
+	for _, f := range cmd.filters {
+		q = q.Filter(f.field+" "+f.op, f.value)
+	}
+	for _, o := range cmd.OrderBy {
+		q = q.Order(o)
+	}
+
+	if len(cmd.OrderBy) == 0 && !cmd.NoDeterministic {
+		for _, f := range cmd.filters {
+			if f.inequality() {
+				q = q.Order(f.field)
+				break
+			}
+		}
+		q = q.Order("__key__")
+	}
+	return q
+}
+
+func (cmd *ExportKindCmd) valueOptions() *valueOptions {
+	return &valueOptions{keyRefFormat: cmd.KeyRefFormat, blobFormat: cmd.BlobFormat, geoFormat: cmd.GeoFormat, flat: cmd.Format == "csv" || cmd.Format == "parquet" || cmd.Format == "avro" || cmd.Format == "xlsx" || cmd.Format == "sql", columnar: cmd.Format == "parquet" || cmd.Format == "avro" || cmd.Format == "msgpack", location: cmd.location, timeFormat: cmd.TimeFormat, includeNulls: cmd.IncludeNulls, typed: cmd.Format == "typed-json", bigquery: cmd.Format == "bigquery"}
+}
+
+// prepare applies output options to a loaded entity before it's written
+func (cmd *ExportKindCmd) prepare(de *dynamicEntity) error {
+	// entities of a keys-only query have no properties
+	if de.value == nil {
+		de.value = make(map[string]interface{})
+	}
+	// entities loaded by key aren't projected by the query, joined fields are kept
+	if len(cmd.Fields) > 0 {
+		fields := append([]string{}, cmd.Fields...)
+		for _, j := range cmd.joins {
+			fields = append(fields, j.alias)
+		}
+		projectFields(de, fields)
+	}
+	if cmd.transforms != nil {
+		keep, err := cmd.transforms.apply(de.value)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			return errDropped
+		}
+	}
+	if cmd.schema != nil {
+		if err := cmd.checkSchema(de); err != nil {
+			return err
+		}
+	}
+	if cmd.PruneEmpty {
+		de.pruneEmpty()
+	}
+	if cmd.ContentHash != "" {
+		if err := de.addContentHash(); err != nil {
+			return err
+		}
+	}
+	if cmd.ExpandAncestors {
+		de.expandAncestors()
+	}
+	if cmd.NamespaceField != "" && de.key != nil {
+		ns := de.key.Namespace
+		if cmd.nsTransform != nil {
+			ns = cmd.nsTransform(ns)
+		}
+		de.value[cmd.NamespaceField] = ns
+	}
+	if cmd.BatchID != "" {
+		de.value["__batch__"] = cmd.BatchID
+	}
+	if !cmd.NoKey && de.key != nil {
+		de.value["__key__"] = keyField(de.key)
+	}
+	return de.addLabels(cmd.labels)
+}
+
+type exportLabel struct {
+	name  string
+	value *template.Template
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// parseLabels parses key=value pairs given by --label
+func parseLabels(pairs []string) ([]exportLabel, error) {
+	labels := make([]exportLabel, 0, len(pairs))
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid label, expected key=value: %s", pair)
+		}
+
+		tmpl, err := template.New(pair[:i]).Option("missingkey=error").Parse(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label value %s: %w", pair, err)
+		}
+		labels = append(labels, exportLabel{name: pair[:i], value: tmpl})
+	}
+	return labels, nil
+}
+
+// parseDelimiter parses the CSV delimiter given by --delimiter
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` || s == "tab" {
+		return '\t', nil
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("Invalid delimiter %q, expected a single character other than a quote or a line break", s)
+	}
+	return r, nil
+}
+
+func (cmd ExportKindCmd) newExportWriter(w io.Writer) exportWriter {
+	switch cmd.Format {
+	case "csv":
+		csvw := csv.NewWriter(w)
+		if cmd.delimiter != 0 {
+			csvw.Comma = cmd.delimiter
+		}
+		return &csvExportWriter{
+			csvw:       csvw,
+			out:        bufio.NewWriter(w),
+			quoteEmpty: cmd.QuoteEmpty,
+			quoteAll:   cmd.QuoteAll,
+			null:       cmd.CSVNull,
+			opts: csvOptions{
+				floatPrecision: cmd.FloatPrecision,
+				arrayMode:      cmd.ArrayMode,
+				arraySeparator: cmd.ArraySeparator,
+				arrayMax:       cmd.ArrayMax,
+				nestedMode:     cmd.NestedMode,
+				separator:      cmd.NestingSeparator,
+				maxDepth:       cmd.MaxDepth,
+				truncated:      make(map[string]bool),
+			},
+			columns:     make(map[string]bool),
+			columnOrder: cmd.Fields,
+			failOnDrift: cmd.FailOnSchemaDrift,
+			maxInMemory: cmd.MaxInMemory,
+		}
+	case "json", "typed-json":
+		return &jsonExportWriter{jsonEncoding: cmd.jsonEncoding(), writer: w, pretty: cmd.Pretty}
+	case "jsonl", "ndjson":
+		return &jsonlExportWriter{jsonEncoding: cmd.jsonEncoding(), writer: w}
+	case "parquet":
+		return &parquetExportWriter{w: w, schema: cmd.columnSchema}
+	case "msgpack":
+		return &msgpackExportWriter{writer: w}
+	case "avro":
+		return &avroExportWriter{w: w, kind: cmd.Kind, schema: cmd.columnSchema}
+	case "bigquery":
+		return &bigQueryExportWriter{writer: w, schema: cmd.bqSchema}
+	case "sql":
+		return &sqlExportWriter{writer: w, table: cmd.Kind, types: make(map[string]string)}
+	case "xlsx":
+		book, shared := cmd.workbook, cmd.workbook != nil
+		if !shared {
+			book = &xlsxWorkbook{}
+		}
+		return &xlsxExportWriter{
+			writer:  w,
+			book:    book,
+			kind:    cmd.Kind,
+			columns: cmd.Fields,
+			opts:    csvOptions{floatPrecision: -1, arrayMode: "cell", arraySeparator: cmd.ArraySeparator, separator: ":"},
+			shared:  shared,
+		}
+	default:
+		panic("Unsupported format: " + cmd.Format)
+	}
+}
+
+func (cmd ExportKindCmd) jsonEncoding() jsonEncoding {
+	enc := jsonEncoding{canonical: cmd.Canonical, typed: cmd.Format == "typed-json"}
+	if cmd.OrderFields != "" {
+		var order []string
+		keyListed := false
+		for _, name := range strings.Split(cmd.OrderFields, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				order = append(order, name)
+				keyListed = keyListed || name == "__key__"
+			}
+		}
+		// the key goes first unless the order places it elsewhere
+		if !keyListed {
+			order = append([]string{"__key__"}, order...)
+		}
+		enc.fieldOrder = order
+	}
+	return enc
+}
+
+func (cmd *ExportKindCmd) newExportFolder() string {
+	dir := strings.TrimSuffix(cmd.OutputDir, "/") + "/"
+	if cmd.DateLayout {
+		return dir + cmd.started.Format("2006/01/02/")
+	}
+	return dir
+}
+
+func (cmd *ExportKindCmd) newExportFileName() string {
+	name := cmd.newBaseFileName()
+	if cmd.Gzip {
+		name += ".gz"
+	}
+	if cmd.Encrypt != "" {
+		name += ".enc"
+	}
+	// split exports fill in {shard} for every part
+	if cmd.Split == 0 && cmd.maxFileSize == 0 {
+		name = strings.Replace(name, "{shard}", "0001", -1)
+	}
+	return name
+}
+
+func (cmd *ExportKindCmd) newBaseFileName() string {
+	ns := cmd.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+
+	if cmd.FilenameTemplate != "" {
+		name := strings.NewReplacer(
+			"{project}", cmd.ProjectID,
+			"{namespace}", ns,
+			"{kind}", cmd.Kind,
+			"{timestamp}", cmd.started.Format("2006-01-02T15-04-05Z07-00"),
+			"{date}", cmd.started.Format("2006-01-02"),
+		).Replace(cmd.FilenameTemplate)
+		return cmd.newExportFolder() + name + "." + cmd.fileExtension()
+	}
+
+	if cmd.IdempotentName {
+		return fmt.Sprintf("%sexport_%s_%s_%s_%s.%s", cmd.newExportFolder(), cmd.ProjectID, ns, cmd.Kind, cmd.started.Format("2006-01-02"), cmd.fileExtension())
+	}
+	return fmt.Sprintf("%sexport_%s_%s.%s", cmd.newExportFolder(), cmd.Kind, cmd.started.Format("2006-01-02T15-04-05Z07-00"), cmd.fileExtension())
+}
+
+// checkFilenameTemplate fails on placeholders other than the ones newBaseFileName fills in
+func checkFilenameTemplate(tmpl string) error {
+	if filepath.IsAbs(tmpl) || strings.HasPrefix(tmpl, "/") || hasParentElement(tmpl) {
+		return fmt.Errorf("--filename-template has to stay in the output folder, it can't be absolute or contain ..")
+	}
+	for _, m := range regexp.MustCompile(`\{[^}]*\}`).FindAllString(tmpl, -1) {
+		switch m {
+		case "{project}", "{namespace}", "{kind}", "{timestamp}", "{date}", "{shard}":
+		default:
+			return fmt.Errorf("Unknown placeholder %s in --filename-template", m)
+		}
+	}
+	return nil
+}
+
+func (cmd *ExportKindCmd) fileExtension() string {
+	if cmd.Format == "bigquery" {
+		return "jsonl"
+	}
+	return cmd.Format
+}
+
+type dynamicEntity struct {
+	key   *datastore.Key
+	value map[string]interface{}
+	// refs keeps key-valued properties as they are rendered in value according to opts
+	refs map[string]*datastore.Key
+	// types keeps datastore types of loaded properties
+	types map[string]string
+	// props keeps the loaded properties for the typed-json format
+	props []datastore.Property
+	opts  *valueOptions
+}
+
+// Load loads all of the provided properties into l.
+// It does not first reset *l to an empty slice.
+func (de *dynamicEntity) Load(ps []datastore.Property) error {
+	if de.value == nil {
+		de.value = make(map[string]interface{})
+	}
+
+	opts := de.opts
+	if opts == nil {
+		opts = defaultValueOptions
+	}
+
+	if de.types == nil {
+		de.types = make(map[string]string)
+	}
+
+	if opts.typed {
+		de.props = append(de.props, ps...)
+	}
+
+	for _, p := range ps {
+		if p.Value != nil {
+			de.value[p.Name] = opts.toExportValue(p)
+			de.types[p.Name] = datastoreType(p.Value)
+		} else if opts.includeNulls {
+			de.value[p.Name] = nil
+		}
+
+		if k, ok := p.Value.(*datastore.Key); ok {
+			if de.refs == nil {
+				de.refs = make(map[string]*datastore.Key)
+			}
+			de.refs[p.Name] = k
+		}
+	}
+	return nil
+}
+
+// Save converts the entity back into datastore properties
+func (de *dynamicEntity) Save() ([]datastore.Property, error) {
+	if de.props != nil {
+		return de.props, nil
+	}
+	return toProperties(de.value), nil
+}
+
+// expandAncestors adds a pair of kind/id fields for every element of the key path,
+// starting from the root ancestor (l1) down to the entity itself.
+func (de *dynamicEntity) expandAncestors() {
+	if de.value == nil {
+		de.value = make(map[string]interface{})
+	}
+
+	var path []*datastore.Key
+	for k := de.key; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+
+	for i, k := range path {
+		de.value[fmt.Sprintf("l%d_kind", i+1)] = k.Kind
+		de.value[fmt.Sprintf("l%d_id", i+1)] = keyID(k)
+	}
+}
+
+// pruneEmpty removes empty values at all levels of nesting.
+func (de *dynamicEntity) pruneEmpty() {
+	for k, v := range de.value {
+		if pv, ok := pruneValue(v); ok {
+			de.value[k] = pv
+		} else {
+			delete(de.value, k)
+		}
+	}
+}
+
+// pruneValue removes empty values from nested maps and arrays
+// and reports whether anything is left of the value.
+func pruneValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return v, v != ""
+	case map[string]interface{}:
+		for sk, sv := range v {
+			if pv, ok := pruneValue(sv); ok {
+				v[sk] = pv
+			} else {
+				delete(v, sk)
+			}
+		}
+		return v, len(v) > 0
+	case []interface{}:
+		f := make([]interface{}, 0, len(v))
+		for _, sv := range v {
+			if pv, ok := pruneValue(sv); ok {
+				f = append(f, pv)
+			}
+		}
+		return f, len(f) > 0
+	default:
+		return value, true
+	}
+}
+
+// addLabels renders label values against the entity properties and adds them as fields.
+// Values are rendered before any label is added, so labels can't refer to each other.
+func (de *dynamicEntity) addLabels(labels []exportLabel) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	if de.value == nil {
+		de.value = make(map[string]interface{})
+	}
+
+	values := make([]string, len(labels))
+	for i, l := range labels {
+		var sb strings.Builder
+		if err := l.value.Execute(&sb, de.value); err != nil {
+			return err
+		}
+		values[i] = sb.String()
+	}
+
+	for i, l := range labels {
+		de.value[l.name] = values[i]
+	}
+	return nil
+}
+
+// addContentHash adds a __hash__ field with SHA-256 of the entity serialized with sorted keys
+func (de *dynamicEntity) addContentHash() error {
+	delete(de.value, "__hash__")
+
+	// json.Marshal sorts map keys at all levels, so the serialization is canonical
+	b, err := json.Marshal(de.value)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(b)
+	de.value["__hash__"] = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// ToJSON converts entry into the JSON
+func (de *dynamicEntity) ToJSON() ([]byte, error) {
+	value, _ := markFloats(de.value)
+	return json.Marshal(value)
+}
+
+// orderedJSON marshals the top level fields in the given order, fields missing from
+// the order follow sorted by name as json.Marshal does
+func orderedJSON(value map[string]interface{}, order []string) ([]byte, error) {
+	names := make([]string, 0, len(value))
+	listed := make(map[string]bool)
+	for _, name := range order {
+		if _, ok := value[name]; ok && !listed[name] {
+			listed[name] = true
+			names = append(names, name)
+		}
+	}
+
+	rest := make([]string, 0, len(value))
+	for name := range value {
+		if !listed[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		n, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(value[name])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(n)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// traverse calls fn for every leaf value with its path joined by colons,
+// keys are visited in sorted order so repeated runs produce the same output.
+func traverse(v interface{}, fn func(string, interface{})) {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(tv))
+		for sk := range tv {
+			keys = append(keys, sk)
+		}
+		sort.Strings(keys)
+
+		for _, sk := range keys {
+			sv := tv[sk]
+			traverse(sv, func(ssk string, v interface{}) {
+				if ssk == "" {
+					fn(sk, v)
+				} else {
+					fn(fmt.Sprintf("%s:%s", sk, ssk), v)
+				}
+			})
+		}
+	default:
+		fn("", v)
+	}
+}
+
+// csvOptions controls how values are rendered into CSV cells
+type csvOptions struct {
+	floatPrecision int
+	arrayMode      string
+	arraySeparator string
+	arrayMax       int
+	// nestedMode is one of flatten, json or skip
+	nestedMode string
+	// separator joins the property names of nested columns
+	separator string
+	// maxDepth limits the number of flattened levels, 0 for no limit
+	maxDepth int
+	// truncated keeps arrays reported to have more than arrayMax elements
+	truncated map[string]bool
+}
+
+// ToCSVCells flattens entry into cells keyed by the column name
+func (de *dynamicEntity) ToCSVCells(opts csvOptions) map[string]string {
+	cells := make(map[string]string)
+	opts.flatten("", de.value, 0, cells)
+	return cells
+}
+
+// csvNull marks cells of null properties, they are written empty but not quoted
+// by --csv-quote-empty-strings
+const csvNull = "\x00"
+
+// flatten adds cells of the value in the column to cells, depth is the number of
+// property names in the column. Entities are flattened into columns joined by the
+// separator and arrays are expanded into columns suffixed with the element index
+// when arrayMode is columns.
+func (opts csvOptions) flatten(column string, val interface{}, depth int, cells map[string]string) {
+	switch v := val.(type) {
+	case nil:
+		cells[column] = csvNull
+	case map[string]interface{}:
+		// the key stays in columns for import-kind
+		if depth > 0 && column != "__key__" {
+			switch {
+			case opts.nestedMode == "skip":
+				return
+			case opts.nestedMode == "json" || (opts.maxDepth > 0 && depth >= opts.maxDepth):
+				cells[column] = jsonCell(v)
+				return
+			}
+		}
+
+		for name, sub := range v {
+			if depth > 0 {
+				name = column + opts.separator + name
+			}
+			opts.flatten(name, sub, depth+1, cells)
+		}
+	case []interface{}:
+		switch opts.arrayMode {
+		case "skip":
+		case "columns":
+			if len(v) > opts.arrayMax && !opts.truncated[column] {
+				opts.truncated[column] = true
+				warnf("%s has more than %d elements, the rest is dropped", column, opts.arrayMax)
+			}
+
+			for i, item := range v {
+				if i >= opts.arrayMax {
+					break
+				}
+				opts.flatten(fmt.Sprintf("%s_%d", column, i), item, depth, cells)
+			}
+		default:
+			cells[column] = opts.formatArray(v)
+		}
+	default:
+		cells[column] = opts.formatValue(val)
+	}
+}
+
+// jsonCell renders a nested value as a single cell
+func jsonCell(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+// formatArray renders the array as a single cell, elements are joined by the separator
+// unless the mode is json or there are nested entities or arrays
+func (opts csvOptions) formatArray(arr []interface{}) string {
+	scalar := opts.arrayMode != "json"
+	for _, item := range arr {
+		switch item.(type) {
+		case map[string]interface{}, []interface{}:
+			scalar = false
+		}
+	}
+
+	if !scalar {
+		return jsonCell(arr)
+	}
+
+	items := make([]string, len(arr))
+	for i, item := range arr {
+		items[i] = opts.formatValue(item)
+	}
+	return strings.Join(items, opts.arraySeparator)
+}
+
+func (opts csvOptions) formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'f', opts.floatPrecision, 64)
+		// keep floats distinguishable from integers
+		if opts.floatPrecision < 0 && !math.IsInf(v, 0) && !math.IsNaN(v) && !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case encoding.TextMarshaler:
+		tv, _ := v.MarshalText()
+		return string(tv)
+	case []interface{}:
+		return opts.formatArray(v)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// checkTimeFormat validates --time-format, a layout has to contain at least one element
+func checkTimeFormat(format string) error {
+	switch format {
+	case "", "rfc3339", "epoch-millis", "epoch-seconds":
+		return nil
+	}
+	if time.Unix(0, 0).UTC().Format(format) == format {
+		return fmt.Errorf("Invalid time format %q, expected rfc3339, epoch-millis, epoch-seconds or a layout like 2006-01-02T15:04:05Z07:00", format)
+	}
+	return nil
+}
+
+// valueOptions controls how datastore values are converted into exported values
+type valueOptions struct {
+	// keyRefFormat is one of id, structured or encoded
+	keyRefFormat string
+	// blobFormat is one of auto, base64, prefixed or hex
+	blobFormat string
+	// geoFormat is one of auto, object, string or wkt
+	geoFormat string
+	// flat is set for formats which can't represent nested objects
+	flat bool
+	// location timestamps are converted to, if set
+	location *time.Location
+	// timeFormat is rfc3339, epoch-millis, epoch-seconds or a layout
+	timeFormat string
+	// raw keeps values as loaded from datastore, for entities saved back as they are
+	raw bool
+	// includeNulls keeps properties without a value instead of dropping them
+	includeNulls bool
+	// typed keeps the loaded properties along with the exported values
+	typed bool
+	// bigquery renders values with the types BigQuery loads
+	bigquery bool
+	// columnar keeps timestamps and binary values for the typed columns of Parquet and Avro
+	// and the typed values of MessagePack
+	columnar bool
+}
+
+var defaultValueOptions = &valueOptions{keyRefFormat: "id"}
+
+func (opts *valueOptions) toExportValue(value interface{}) interface{} {
+	if opts.raw {
+		if p, ok := value.(datastore.Property); ok {
+			return p.Value
+		}
+		return value
+	}
+
+	switch v := value.(type) {
+	case *datastore.Entity:
+		f := make(map[string]interface{})
+		for _, pp := range v.Properties {
+			if pp.Value == nil && !opts.includeNulls {
+				continue
+			}
+			f[pp.Name] = opts.toExportValue(pp.Value)
+		}
+		return f
+	case *datastore.Key:
+		return opts.keyRef(v)
+	case []interface{}:
+		f := make([]interface{}, 0)
+		for _, pp := range v {
+			if pp == nil {
+				continue
+			}
+			f = append(f, opts.toExportValue(pp))
+		}
+		return f
+	case datastore.Property:
+		return opts.toExportValue(v.Value)
+	case time.Time:
+		if opts.bigquery {
+			return bqTimestamp(v)
+		}
+		if opts.columnar {
+			return v
+		}
+		return opts.formatTime(v)
+	case datastore.GeoPoint:
+		if opts.bigquery {
+			return bqGeography(fmt.Sprintf("POINT(%g %g)", v.Lng, v.Lat))
+		}
+		switch {
+		case opts.geoFormat == "wkt":
+			return fmt.Sprintf("POINT(%g %g)", v.Lng, v.Lat)
+		case opts.geoFormat == "string", opts.geoFormat != "object" && opts.flat:
+			return fmt.Sprintf("%g,%g", v.Lat, v.Lng)
+		}
+		return map[string]interface{}{"lat": v.Lat, "lng": v.Lng}
+	case []byte:
+		if opts.bigquery || opts.columnar {
+			return v
+		}
+		switch {
+		case opts.blobFormat == "hex":
+			return hex.EncodeToString(v)
+		case opts.blobFormat == "prefixed":
+			return "base64:" + base64.StdEncoding.EncodeToString(v)
+		case opts.blobFormat == "base64", opts.flat:
+			return base64.StdEncoding.EncodeToString(v)
+		}
+		// wrapped so readers can tell binary values from strings
+		return map[string]interface{}{"base64": base64.StdEncoding.EncodeToString(v)}
+	default:
+		return value
+	}
+
 }
 
-// Execute is called by go-flags
-func (cmd *ExportKindCmd) Execute(args []string) error {
-	fmt.Fprintf(os.Stderr, "Exporting '%s' from '%s/%s'\n", cmd.Kind, cmd.ProjectID, cmd.Namespace)
+// formatTime converts the timestamp to the location and renders it as given by timeFormat,
+// epoch formats are numbers
+func (opts *valueOptions) formatTime(t time.Time) interface{} {
+	if opts.location != nil {
+		t = t.In(opts.location)
+	}
+
+	switch opts.timeFormat {
+	case "", "rfc3339":
+		return t.Format(time.RFC3339Nano)
+	case "epoch-millis":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "epoch-seconds":
+		return t.Unix()
+	default:
+		return t.Format(opts.timeFormat)
+	}
+}
 
-	ctx := context.Background()
+// keyRef renders a key-valued property
+func (opts *valueOptions) keyRef(k *datastore.Key) interface{} {
+	switch opts.keyRefFormat {
+	case "encoded":
+		return k.Encode()
+	case "structured":
+		if opts.flat {
+			return keyPath(k)
+		}
 
-	dsClient, err := datastore.NewClient(ctx, cmd.ProjectID)
-	if err != nil {
-		return err
+		ref := map[string]interface{}{"kind": k.Kind, "path": keyPath(k)}
+		if k.Name != "" {
+			ref["name"] = k.Name
+		} else {
+			ref["id"] = k.ID
+		}
+		if k.Namespace != "" {
+			ref["namespace"] = k.Namespace
+		}
+		return ref
+	default:
+		// the ID alone doesn't identify a key with ancestors
+		if k.Parent != nil {
+			return keyPath(k)
+		}
+		return keyID(k)
+	}
+}
+
+// keyField renders the key of the entity itself, the same fields are written for
+// every key so CSV gets the same __key__:kind, __key__:id, ... columns. The
+// ancestor path is added only for keys with a parent, the encoded key identifies
+// the entity in the source project.
+func keyField(k *datastore.Key) map[string]interface{} {
+	f := map[string]interface{}{
+		"kind":      k.Kind,
+		"id":        k.ID,
+		"name":      k.Name,
+		"namespace": k.Namespace,
+		"encoded":   k.Encode(),
+	}
+	if k.Parent != nil {
+		f["parent"] = keyPath(k.Parent)
+	}
+	return f
+}
+
+// keyID returns the name of the key or its numeric ID
+func keyID(k *datastore.Key) string {
+	if len(k.Name) == 0 {
+		return fmt.Sprint(k.ID)
+	}
+	return k.Name
+}
+
+// keyPath renders the key as Kind:id/Kind:name starting from the root ancestor,
+// parseKeyPath reads it back. Names that are numbers are quoted as Kind:"42" to tell
+// them from IDs, and % / : " in kinds and names are escaped as in URLs.
+func keyPath(k *datastore.Key) string {
+	path := fmt.Sprint(k.ID)
+	if k.Name != "" {
+		path = escapeKeyElem(k.Name)
+		if _, err := strconv.ParseInt(k.Name, 10, 64); err == nil {
+			path = `"` + path + `"`
+		}
+	}
+	if k.Kind != "" {
+		path = escapeKeyElem(k.Kind) + ":" + path
+	}
+	if k.Parent != nil {
+		return keyPath(k.Parent) + "/" + path
+	}
+	return path
+}
+
+// skipLog records entities skipped because of --on-error or sent to the
+// --dead-letter file, the file is created on the first record.
+type skipLog struct {
+	path  string
+	f     *os.File
+	count int
+	// logOnly logs the records instead of writing them, for --on-error log
+	logOnly bool
+}
+
+// Record appends a line with the entity key, the error, the offset of the batch
+// and the entity itself unless it's nil
+func (l *skipLog) Record(key *datastore.Key, offset int, cause error, entity json.RawMessage) error {
+	if l.logOnly {
+		logEvent(logWarn, logFields{"event": "skipped", "key": key.String(), "offset": offset, "error": cause.Error()},
+			"Skipped %s: %v", keyPath(key), cause)
+		l.count++
+		return nil
+	}
+
+	if l.f == nil {
+		f, err := os.Create(l.path)
+		if err != nil {
+			return err
+		}
+		l.f = f
 	}
 
-	defer dsClient.Close()
+	record := map[string]interface{}{
+		"key":    key.String(),
+		"error":  cause.Error(),
+		"offset": offset,
+	}
+	if entity != nil {
+		record["entity"] = entity
+	}
 
-	err = os.MkdirAll(cmd.newExportFolder(), 0755)
+	line, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Create(cmd.newExportFileName())
-	if err != nil {
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
 		return err
 	}
 
-	w := cmd.newExportWriter(f)
+	l.count++
+	return nil
+}
 
-	read := -1
-	offset := 0
+func (l *skipLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// outputError is a record the output failed to take, the output is incomplete then,
+// so it stops the export whatever --on-error is
+type outputError struct {
+	err error
+}
 
-	w.WriteHeader()
-	for read != 0 {
+func (e *outputError) Error() string {
+	return e.err.Error()
+}
 
-		q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace).Offset(offset).Limit(1000)
+func (e *outputError) Unwrap() error {
+	return e.err
+}
 
-		var batch []*dynamicEntity
-		_, err := dsClient.GetAll(ctx, q, &batch)
+type exportWriter interface {
+	WriteHeader() error
+	WriterRecord(de *dynamicEntity) error
+	WriteFooter() error
+}
+
+// jsonEncoding selects how records are serialized by the JSON writers
+type jsonEncoding struct {
+	canonical  bool
+	fieldOrder []string
+	// typed writes the loaded properties as typed values instead of the exported ones
+	typed bool
+}
+
+// encode writes the record followed by a newline to buf, which is reused by the writers
+// so records aren't marshaled into a new slice each
+func (enc jsonEncoding) encode(buf *bytes.Buffer, de *dynamicEntity, pretty bool) error {
+	buf.Reset()
+	jenc := json.NewEncoder(buf)
+	if pretty {
+		buf.WriteString("  ")
+		jenc.SetIndent("  ", "  ")
+	}
 
+	if enc.canonical || enc.fieldOrder != nil {
+		// written as marshaled, the encoder would escape HTML in canonical JSON
+		v, err := enc.marshal(de)
 		if err != nil {
 			return err
 		}
-
-		read = len(batch)
-		if read == 0 {
-			continue
+		if pretty {
+			err = json.Indent(buf, v, "  ", "  ")
+		} else {
+			_, err = buf.Write(v)
 		}
+		buf.WriteByte('\n')
+		return err
+	}
 
-		fmt.Fprintf(os.Stderr, "Exporintg %s - %d\n", cmd.Kind, offset+read)
+	value, _ := markFloats(de.value)
+	if enc.typed {
+		rec, err := typedEntity(de)
+		if err != nil {
+			return err
+		}
+		value = rec
+	}
+	return jenc.Encode(value)
+}
 
-		if offset != 0 {
-			// second group, write up line break
-			w.WriteLineBreak()
+func (enc jsonEncoding) marshal(de *dynamicEntity) ([]byte, error) {
+	if enc.typed {
+		rec, err := typedEntity(de)
+		if err != nil {
+			return nil, err
 		}
+		if enc.canonical {
+			return canonicalJSON(rec)
+		}
+		return json.Marshal(rec)
+	}
+
+	switch {
+	case enc.canonical:
+		return canonicalJSON(de.value)
+	case enc.fieldOrder != nil:
+		value, _ := markFloats(de.value)
+		return orderedJSON(value.(map[string]interface{}), enc.fieldOrder)
+	default:
+		return de.ToJSON()
+	}
+}
 
-		for i, v := range batch {
-			w.WriterRecord(v)
+// jsonFloat is a float64 written with a fraction or an exponent even when it's whole,
+// e.g. 1.0, so that import-kind reads it back as a float instead of an integer
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(float64(f))
+	if err != nil || bytes.ContainsAny(b, ".eE") {
+		return b, err
+	}
+	return append(b, ".0"...), nil
+}
 
-			if i != len(batch)-1 {
-				w.WriteLineBreak()
+// markFloats replaces whole float64 values by jsonFloat, maps and slices are copied
+// only when they contain one. It returns whether the value was changed.
+func markFloats(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return jsonFloat(v), true
+		}
+	case map[string]interface{}:
+		var c map[string]interface{}
+		for name, e := range v {
+			m, ok := markFloats(e)
+			if !ok {
+				continue
+			}
+			if c == nil {
+				c = make(map[string]interface{}, len(v))
+				for n, e := range v {
+					c[n] = e
+				}
 			}
+			c[name] = m
+		}
+		if c != nil {
+			return c, true
+		}
+	case []interface{}:
+		var c []interface{}
+		for i, e := range v {
+			m, ok := markFloats(e)
+			if !ok {
+				continue
+			}
+			if c == nil {
+				c = append([]interface{}(nil), v...)
+			}
+			c[i] = m
+		}
+		if c != nil {
+			return c, true
 		}
-
-		offset = offset + len(batch)
 	}
-	w.WriteFooter()
+	return value, false
+}
+
+type jsonExportWriter struct {
+	jsonEncoding
+	writer  io.Writer
+	buf     bytes.Buffer
+	written bool
+	pretty  bool
+}
 
+func (format jsonExportWriter) WriteHeader() error {
+	header := "["
+	if format.pretty {
+		header = "[\n"
+	}
+	if _, err := format.writer.Write([]byte(header)); err != nil {
+		return &outputError{fmt.Errorf("Unable to write header: %w", err)}
+	}
 	return nil
 }
 
-func (cmd ExportKindCmd) newExportWriter(w io.Writer) exportWriter {
-	switch cmd.Format {
-	case "csv":
-		return &csvExportWriter{csvw: csv.NewWriter(w)}
-	case "json":
-		return &jsonExportWriter{writer: w}
-	default:
-		panic("Unsupported format: " + cmd.Format)
+func (format *jsonExportWriter) WriterRecord(de *dynamicEntity) error {
+	if err := format.encode(&format.buf, de, format.pretty); err != nil {
+		return fmt.Errorf("Unable to marshal entry: %w", err)
+	}
+	// the newline of the encoder is replaced by the separator
+	format.buf.Truncate(format.buf.Len() - 1)
+
+	// separator goes before the record, so skipped records don't leave dangling commas
+	if format.written {
+		if _, err := format.writer.Write([]byte(",\n")); err != nil {
+			return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
+		}
+	}
+
+	_, err := format.writer.Write(format.buf.Bytes())
+
+	if err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
 	}
+
+	format.written = true
+	return nil
 }
 
-func (cmd *ExportKindCmd) newExportFolder() string {
-	return "exports/"
+func (format jsonExportWriter) WriteFooter() error {
+	footer := "]"
+	if format.pretty {
+		footer = "\n]\n"
+		if !format.written {
+			footer = "]\n"
+		}
+	}
+
+	_, err := format.writer.Write([]byte(footer))
+	return err
 }
 
-func (cmd *ExportKindCmd) newExportFileName() string {
-	return fmt.Sprintf("exports/export_%s_%s.%s", cmd.Kind, time.Now().Format("2006-01-02T15-04-05Z07-00"), cmd.Format)
+// jsonlExportWriter writes one JSON record per line, a truncated file loses
+// only the last record and consumers can stream it.
+type jsonlExportWriter struct {
+	jsonEncoding
+	writer io.Writer
+	buf    bytes.Buffer
 }
 
-type dynamicEntity struct {
-	value map[string]interface{}
+func (format jsonlExportWriter) WriteHeader() error {
+	return nil
 }
 
-// Load loads all of the provided properties into l.
-// It does not first reset *l to an empty slice.
-func (de *dynamicEntity) Load(ps []datastore.Property) error {
-	if de.value == nil {
-		de.value = make(map[string]interface{})
+func (format *jsonlExportWriter) WriterRecord(de *dynamicEntity) error {
+	if err := format.encode(&format.buf, de, false); err != nil {
+		return fmt.Errorf("Unable to marshal entry: %w", err)
 	}
 
-	for _, p := range ps {
-		if p.Value != nil {
-			de.value[p.Name] = toExportValue(p)
-		}
+	if _, err := format.writer.Write(format.buf.Bytes()); err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
 	}
 	return nil
 }
 
-// Save is never used just completes interface
-func (de *dynamicEntity) Save() ([]datastore.Property, error) {
-	return nil, nil
+func (format jsonlExportWriter) WriteFooter() error {
+	return nil
 }
 
-// ToJSON converts entry into the JSON
-func (de *dynamicEntity) ToJSON() ([]byte, error) {
-	return json.Marshal(de.value)
+// csvExportWriter writes the header with the union of columns of all records,
+// so records are buffered until WriteFooter and spilled to disk when there are too many.
+type csvExportWriter struct {
+	csvw *csv.Writer
+	opts csvOptions
+
+	// encoding/csv can't quote empty fields or all of them, rows are written to out directly then
+	quoteEmpty bool
+	quoteAll   bool
+	out        *bufio.Writer
+
+	// null is written for null and missing values
+	null string
+
+	columns     map[string]bool
+	columnOrder []string
+	failOnDrift bool
+	buffered    []map[string]string
+	maxInMemory int
+	spill       *os.File
+	spillw      *bufio.Writer
 }
 
-// ToCSVHeader converts entry into the encoding/csv consumable array
-func (de *dynamicEntity) ToCSVHeader() []string {
-	header := make([]string, 0)
-	traverse(de.value, func(key string, val interface{}) {
-		header = append(header, key)
-	})
-	return header
+func (format csvExportWriter) WriteHeader() error {
+	return nil
 }
 
-func traverse(v interface{}, fn func(string, interface{})) {
-	switch tv := v.(type) {
-	case map[string]interface{}:
-		for sk, sv := range tv {
-			traverse(sv, func(ssk string, v interface{}) {
-				if ssk == "" {
-					fn(sk, v)
-				} else {
-					fn(fmt.Sprintf("%s:%s", sk, ssk), v)
-				}
-			})
+func (format *csvExportWriter) WriterRecord(de *dynamicEntity) error {
+	cells := de.ToCSVCells(format.opts)
+	if format.failOnDrift && len(format.columns) > 0 {
+		if err := format.checkDrift(cells); err != nil {
+			return err
 		}
-	default:
-		fn("", v)
 	}
-}
 
-// ToCSV converts entry into the encoding/csv consumable array
-func (de *dynamicEntity) ToCSVRecord() []string {
-	row := make([]string, 0)
-	traverse(de.value, func(key string, val interface{}) {
-		if tm, ok := val.(encoding.TextMarshaler); ok {
-			v, _ := tm.MarshalText()
-			row = append(row, string(v))
-		} else {
-			row = append(row, fmt.Sprintf("%v", val))
+	for column := range cells {
+		format.columns[column] = true
+	}
+
+	if format.spill == nil && len(format.buffered) < format.maxInMemory {
+		format.buffered = append(format.buffered, cells)
+		return nil
+	}
+
+	if format.spill == nil {
+		f, err := ioutil.TempFile("", "cdskit-*.jsonl")
+		if err != nil {
+			return &outputError{err}
 		}
-	})
-	return row
-}
 
-func toExportValue(value interface{}) interface{} {
-	switch v := value.(type) {
-	case *datastore.Entity:
-		f := make(map[string]interface{})
-		for _, pp := range v.Properties {
-			if pp.Value == nil {
-				continue
+		warnf("More than %d CSV records, buffering to %s", format.maxInMemory, f.Name())
+		format.spill = f
+		format.spillw = bufio.NewWriter(f)
+		for _, c := range format.buffered {
+			if err := format.spillCells(c); err != nil {
+				return &outputError{err}
 			}
-			f[pp.Name] = toExportValue(pp.Value)
 		}
-		return f
-	case *datastore.Key:
-		id := v.Name
-		if len(id) == 0 {
-			id = fmt.Sprint(v.ID)
+		format.buffered = nil
+	}
+
+	if err := format.spillCells(cells); err != nil {
+		return &outputError{err}
+	}
+	return nil
+}
+
+// checkDrift compares columns of the record with the columns of the first record
+func (format *csvExportWriter) checkDrift(cells map[string]string) error {
+	var added, missing []string
+	for column := range cells {
+		if !format.columns[column] {
+			added = append(added, column)
 		}
-		return id
-	case []interface{}:
-		f := make([]interface{}, 0)
-		for _, pp := range v {
-			if pp == nil {
-				continue
-			}
-			f = append(f, toExportValue(pp))
+	}
+	for column := range format.columns {
+		if _, ok := cells[column]; !ok {
+			missing = append(missing, column)
 		}
-		return f
-	case datastore.Property:
-		return toExportValue(v.Value)
-	default:
-		return value
 	}
 
-}
+	if len(added) == 0 && len(missing) == 0 {
+		return nil
+	}
 
-type exportWriter interface {
-	WriteHeader()
-	WriteLineBreak()
-	WriterRecord(de *dynamicEntity)
-	WriteFooter()
+	sort.Strings(added)
+	sort.Strings(missing)
+	return fmt.Errorf("Schema drift, new columns [%s], missing columns [%s]", strings.Join(added, ","), strings.Join(missing, ","))
 }
 
-type jsonExportWriter struct {
-	writer io.Writer
+func (format *csvExportWriter) spillCells(cells map[string]string) error {
+	line, err := json.Marshal(cells)
+	if err != nil {
+		return err
+	}
+	_, err = format.spillw.Write(append(line, '\n'))
+	return err
 }
 
-func (format jsonExportWriter) WriteHeader() {
-	format.writer.Write([]byte("["))
-}
+func (format *csvExportWriter) WriteFooter() error {
+	// ordered columns go first, the rest follows sorted
+	header := make([]string, 0, len(format.columns))
+	ordered := make(map[string]bool)
+	for _, column := range format.columnOrder {
+		if format.columns[column] && !ordered[column] {
+			ordered[column] = true
+			header = append(header, column)
+		}
+	}
 
-func (format *jsonExportWriter) WriterRecord(de *dynamicEntity) {
-	v, err := de.ToJSON()
+	rest := make([]string, 0, len(format.columns))
+	for column := range format.columns {
+		if !ordered[column] {
+			rest = append(rest, column)
+		}
+	}
+	sort.Strings(rest)
+	header = append(header, rest...)
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to marshal entry: %s", err.Error())
-		return
+	if len(header) > 0 {
+		quoted := make([]bool, len(header))
+		for i := range quoted {
+			quoted[i] = format.quoteAll
+		}
+		if err := format.writeRow(header, quoted); err != nil {
+			return err
+		}
 	}
 
-	_, err = format.writer.Write(v)
+	write := func(cells map[string]string) error {
+		row := make([]string, len(header))
+		quoted := make([]bool, len(header))
+		for i, column := range header {
+			v, ok := cells[column]
+			if v == csvNull || !ok {
+				v, ok = format.null, false
+			}
+			row[i] = v
+			quoted[i] = ok && (format.quoteAll || v == "")
+		}
+		return format.writeRow(row, quoted)
+	}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to write entry: %s", err.Error())
-		return
+	for _, cells := range format.buffered {
+		if err := write(cells); err != nil {
+			return err
+		}
 	}
 
-}
+	if format.spill != nil {
+		defer os.Remove(format.spill.Name())
+		defer format.spill.Close()
 
-func (format *jsonExportWriter) WriteLineBreak() {
-	format.writer.Write([]byte(",\n"))
-}
+		if err := format.spillw.Flush(); err != nil {
+			return err
+		}
+		if _, err := format.spill.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
 
-func (format jsonExportWriter) WriteFooter() {
-	format.writer.Write([]byte("]"))
-}
+		dec := json.NewDecoder(bufio.NewReader(format.spill))
+		for {
+			var cells map[string]string
+			if err := dec.Decode(&cells); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
 
-type csvExportWriter struct {
-	csvw   *csv.Writer
-	headed bool
-}
+			if err := write(cells); err != nil {
+				return err
+			}
+		}
+	}
+
+	if format.direct() {
+		return format.out.Flush()
+	}
 
-func (format csvExportWriter) WriteHeader() {
+	format.csvw.Flush()
+	return format.csvw.Error()
+}
 
+// direct tells whether rows are written to out instead of csvw
+func (format *csvExportWriter) direct() bool {
+	return format.quoteEmpty || format.quoteAll
 }
 
-func (format *csvExportWriter) WriterRecord(de *dynamicEntity) {
-	if !format.headed {
-		format.csvw.Write(de.ToCSVHeader())
-		format.headed = true
+// writeRow writes the row, quoted marks fields to be quoted even when they are empty
+func (format *csvExportWriter) writeRow(row []string, quoted []bool) error {
+	if !format.direct() {
+		return format.csvw.Write(row)
 	}
-	format.csvw.Write(de.ToCSVRecord())
-}
 
-func (format *csvExportWriter) WriteLineBreak() {
+	for i, field := range row {
+		if i > 0 {
+			format.out.WriteRune(format.csvw.Comma)
+		}
 
+		if (quoted != nil && quoted[i]) || csvFieldNeedsQuotes(field, format.csvw.Comma) {
+			field = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+		}
+		format.out.WriteString(field)
+	}
+	_, err := format.out.WriteString("\n")
+	return err
 }
 
-func (format csvExportWriter) WriteFooter() {
+// csvFieldNeedsQuotes follows the rules of encoding/csv
+func csvFieldNeedsQuotes(field string, comma rune) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` || strings.ContainsRune(field, comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
 
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
 }
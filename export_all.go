@@ -0,0 +1,222 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// ExportAllCmd runs the export-kind jobs described by a config file in sequence
+type ExportAllCmd struct {
+	Config string `long:"config" description:"JSON file with export jobs: {\"defaults\": {...}, \"jobs\": [{...}, ...]}, keys are export-kind options without the leading --, e.g. {\"kind\": \"User\", \"filter\": [\"status=active\"], \"format\": \"csv\"}" required:"true"`
+}
+
+// exportConfig is the file given by --config, defaults apply to every job unless the job sets the option
+type exportConfig struct {
+	Defaults map[string]interface{}   `json:"defaults"`
+	Jobs     []map[string]interface{} `json:"jobs"`
+}
+
+// Execute is called by go-flags
+func (cmd *ExportAllCmd) Execute(args []string) error {
+	f, err := os.Open(cmd.Config)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var config exportConfig
+	d := json.NewDecoder(f)
+	d.UseNumber()
+	if err := d.Decode(&config); err != nil {
+		return fmt.Errorf("Unable to read %s: %w", cmd.Config, err)
+	}
+
+	// all jobs are parsed first so a typo doesn't fail the run halfway
+	jobs := make([]*ExportKindCmd, len(config.Jobs))
+	for i, job := range config.Jobs {
+		options := make(map[string]interface{})
+		for name, v := range config.Defaults {
+			options[name] = v
+		}
+		for name, v := range job {
+			options[name] = v
+		}
+
+		jobs[i], err = parseExportJob(options)
+		if err != nil {
+			return fmt.Errorf("Invalid job %d in %s: %w", i+1, cmd.Config, err)
+		}
+	}
+
+	// jobs leaving out entities don't stop the others, the run fails at the end
+	var incomplete error
+	for i, job := range jobs {
+		infof("Job %d/%d", i+1, len(jobs))
+		err := job.Execute(nil)
+		if errors.Is(err, ErrIncomplete) {
+			incomplete = fmt.Errorf("Job %d (%s): %w", i+1, job.Kind, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Job %d (%s) failed: %w", i+1, job.Kind, err)
+		}
+	}
+	return incomplete
+}
+
+// parseExportJob turns the options of a job into export-kind arguments and parses them
+// the same way as the command line, so defaults, choices and required options apply
+func parseExportJob(options map[string]interface{}) (*ExportKindCmd, error) {
+	job := &ExportKindCmd{}
+	if err := parseOptions(job, options); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// parseOptions parses the options into the command as its command line arguments
+func parseOptions(cmd interface{}, options map[string]interface{}) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		switch v := options[name].(type) {
+		case nil:
+		case bool:
+			if v {
+				args = append(args, "--"+name)
+			}
+		case string, json.Number:
+			args = append(args, fmt.Sprintf("--%s=%s", name, v))
+		case []interface{}:
+			for _, e := range v {
+				switch e.(type) {
+				case string, json.Number:
+					args = append(args, fmt.Sprintf("--%s=%s", name, e))
+				default:
+					return fmt.Errorf("Option %s must be a list of strings or numbers", name)
+				}
+			}
+		default:
+			return fmt.Errorf("Option %s must be a string, number, bool or list", name)
+		}
+	}
+
+	_, err := flags.NewParser(cmd, flags.None).ParseArgs(args)
+	return err
+}
+
+// runKinds exports the kinds matching --kinds, or all kinds with --all-kinds, one
+// after another into a generated file each
+func (cmd *ExportKindCmd) runKinds(ctx context.Context) error {
+	if cmd.Kind != "" {
+		return fmt.Errorf("--kind can't be combined with --kinds or --all-kinds")
+	}
+	folder := strings.HasPrefix(cmd.Output, "gs://") && strings.HasSuffix(cmd.Output, "/")
+	// an xlsx file gets a sheet per kind
+	workbook := cmd.Format == "xlsx" && cmd.Output != "" && cmd.Output != "-" && !strings.Contains(cmd.Output, "://")
+	if cmd.Output != "" && !folder && !workbook && !strings.HasPrefix(cmd.Output, "pubsub://") {
+		return fmt.Errorf("--kinds and --all-kinds write a file per kind, --output can only be a gs://bucket/folder/, a pubsub:// topic or an .xlsx file with --format xlsx")
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	all, err := metadataKinds(ctx, client, cmd.Namespace)
+	client.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to load list of kinds: %w", err)
+	}
+	all, err = skipKinds(all, cmd.SkipKinds)
+	if err != nil {
+		return err
+	}
+
+	var kinds []string
+	for _, kind := range all {
+		if cmd.AllKinds || matchKind(cmd.Kinds, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) == 0 {
+		return fmt.Errorf("No kind of %s/%s matches %s", cmd.ProjectID, cmd.Namespace, cmd.Kinds)
+	}
+
+	var book *xlsxWorkbook
+	if workbook {
+		book = &xlsxWorkbook{}
+		defer book.Close()
+	}
+
+	var incomplete error
+	for i, kind := range kinds {
+		infof("Kind %d/%d", i+1, len(kinds))
+
+		job := *cmd
+		job.Kind = kind
+		if book != nil {
+			// the sheets are kept by the workbook, the jobs have no output of their own
+			job.workbook, job.Output, job.out = book, "-", ioutil.Discard
+		}
+		err := job.run(ctx)
+		if errors.Is(err, ErrIncomplete) {
+			incomplete = fmt.Errorf("Export of %s: %w", kind, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Export of %s failed: %w", kind, err)
+		}
+	}
+
+	if book != nil {
+		if err := writeWorkbook(book, cmd.Output); err != nil {
+			return err
+		}
+	}
+	return incomplete
+}
+
+// writeWorkbook writes the sheets of all kinds into the file
+func writeWorkbook(book *xlsxWorkbook, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := book.write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	infof("Written %d sheets to %s", len(book.sheets), path)
+	return nil
+}
+
+// matchKind checks the kind against comma separated names and path.Match patterns
+func matchKind(patterns string, kind string) bool {
+	for _, p := range strings.Split(patterns, ",") {
+		if ok, _ := path.Match(strings.TrimSpace(p), kind); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// runTestExport exports the entities of kind Item served by a fake Datastore and
+// returns the written file
+func runTestExport(t *testing.T, entities []*pb.Entity, options map[string]interface{}) (string, *fakeDatastore) {
+	t.Helper()
+
+	fake := startFakeDatastore(t, entities)
+	output := filepath.Join(t.TempDir(), "export")
+	all := map[string]interface{}{"project": "test", "kind": "Item", "output": output, "quiet": true}
+	for name, v := range options {
+		all[name] = v
+	}
+
+	cmd, err := parseExportJob(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.run(context.Background()); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), fake
+}
+
+// testItems returns n entities of kind Item with IDs 1 to n
+func testItems(n int) []*pb.Entity {
+	entities := make([]*pb.Entity, n)
+	for i := range entities {
+		entities[i] = fakeEntity("Item", int64(i+1), map[string]interface{}{"n": i + 1, "name": fmt.Sprintf("item %d", i+1)})
+	}
+	return entities
+}
+
+func TestExportAcrossBatches(t *testing.T) {
+	for _, format := range []string{"json", "jsonl"} {
+		t.Run(format, func(t *testing.T) {
+			out, fake := runTestExport(t, testItems(2500), map[string]interface{}{"format": format})
+
+			var records []map[string]interface{}
+			if format == "json" {
+				if err := json.Unmarshal([]byte(out), &records); err != nil {
+					t.Fatalf("invalid JSON: %v", err)
+				}
+			} else {
+				for i, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+					var record map[string]interface{}
+					if err := json.Unmarshal([]byte(line), &record); err != nil {
+						t.Fatalf("invalid JSON line %d %q: %v", i+1, line, err)
+					}
+					records = append(records, record)
+				}
+			}
+
+			if len(records) != 2500 {
+				t.Fatalf("got %d records, want 2500", len(records))
+			}
+			for i, record := range records {
+				if n, _ := record["n"].(float64); n != float64(i+1) {
+					t.Fatalf("record %d has n %v, want %d", i, record["n"], i+1)
+				}
+			}
+
+			// pages continue at the cursor of the previous one instead of skipping an offset
+			if len(fake.queries) < 2 {
+				t.Fatalf("got %d queries, want several batches", len(fake.queries))
+			}
+			for i, q := range fake.queries {
+				if q.offset != 0 {
+					t.Errorf("query %d has offset %d, want 0", i, q.offset)
+				}
+				if i > 0 && !q.cursor {
+					t.Errorf("query %d has no start cursor", i)
+				}
+			}
+		})
+	}
+}
+
+func TestExportCSVUnionHeader(t *testing.T) {
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{"name": "a", "price": 1}),
+		fakeEntity("Item", 2, map[string]interface{}{"name": "b", "color": "red"}),
+		fakeEntity("Item", 3, map[string]interface{}{"price": 3, "size": "L"}),
+	}
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "csv"})
+
+	r := csv.NewReader(strings.NewReader(out))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV %q: %v", out, err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("got %d rows, want a header and 3 records: %q", len(rows), out)
+	}
+	for i, row := range rows {
+		if len(row) != len(rows[0]) {
+			t.Errorf("row %d has %d fields, the header %d: %q", i, len(row), len(rows[0]), out)
+		}
+	}
+
+	column := make(map[string]int)
+	for i, name := range rows[0] {
+		column[name] = i
+	}
+	for _, name := range []string{"name", "price", "color", "size"} {
+		if _, ok := column[name]; !ok {
+			t.Fatalf("header %v is missing %s", rows[0], name)
+		}
+	}
+	want := []map[string]string{
+		{"name": "a", "price": "1", "color": "", "size": ""},
+		{"name": "b", "price": "", "color": "red", "size": ""},
+		{"name": "", "price": "3", "color": "", "size": "L"},
+	}
+	for i, cells := range want {
+		for name, v := range cells {
+			if got := rows[i+1][column[name]]; got != v {
+				t.Errorf("record %d %s = %q, want %q", i+1, name, got, v)
+			}
+		}
+	}
+}
+
+func TestExportValues(t *testing.T) {
+	created := time.Date(2020, 5, 17, 10, 30, 0, 500000000, time.UTC)
+	tests := []struct {
+		name     string
+		value    interface{}
+		wantJSON string
+		wantCSV  string
+	}{
+		{"geopoint", datastore.GeoPoint{Lat: 52.52, Lng: 13.405}, `{"lat":52.52,"lng":13.405}`, "52.52,13.405"},
+		{"time", created, `"2020-05-17T10:30:00.5Z"`, "2020-05-17T10:30:00.5Z"},
+		{"bytes", []byte("hi\x00"), `{"base64":"aGkA"}`, "aGkA"},
+		{"string", "text", `"text"`, "text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entities := []*pb.Entity{fakeEntity("Item", 1, map[string]interface{}{"v": tt.value})}
+
+			out, _ := runTestExport(t, entities, map[string]interface{}{"format": "jsonl"})
+			var record map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(out), &record); err != nil {
+				t.Fatalf("invalid JSON %q: %v", out, err)
+			}
+			if got := string(record["v"]); got != tt.wantJSON {
+				t.Errorf("JSON value = %s, want %s", got, tt.wantJSON)
+			}
+
+			out, _ = runTestExport(t, entities, map[string]interface{}{"format": "csv"})
+			rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+			if err != nil || len(rows) != 2 {
+				t.Fatalf("invalid CSV %q: %v", out, err)
+			}
+			for i, column := range rows[0] {
+				if column == "v" && rows[1][i] != tt.wantCSV {
+					t.Errorf("CSV value = %q, want %q", rows[1][i], tt.wantCSV)
+				}
+			}
+		})
+	}
+}
+
+func TestExportCSVQuoting(t *testing.T) {
+	value := "hello,\"world\"\nfoo"
+	entities := []*pb.Entity{fakeEntity("Item", 1, map[string]interface{}{"v": value})}
+
+	for _, delimiter := range []string{",", `\t`} {
+		t.Run(delimiter, func(t *testing.T) {
+			out, _ := runTestExport(t, entities, map[string]interface{}{"format": "csv", "delimiter": delimiter})
+
+			r := csv.NewReader(strings.NewReader(out))
+			r.Comma, _ = parseDelimiter(delimiter)
+			rows, err := r.ReadAll()
+			if err != nil {
+				t.Fatalf("invalid CSV %q: %v", out, err)
+			}
+			if len(rows) != 2 {
+				t.Fatalf("got %d rows, want a header and 1 record: %q", len(rows), out)
+			}
+			if len(rows[1]) != len(rows[0]) {
+				t.Fatalf("record has %d fields, the header %d: %q", len(rows[1]), len(rows[0]), out)
+			}
+			found := false
+			for i, column := range rows[0] {
+				if column == "v" {
+					found = true
+					if rows[1][i] != value {
+						t.Errorf("v = %q, want %q", rows[1][i], value)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("header %v is missing v", rows[0])
+			}
+		})
+	}
+}
+
+func TestExportOrderFields(t *testing.T) {
+	entities := []*pb.Entity{fakeEntity("Item", 1, map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4})}
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"c, a", []string{"__key__", "c", "a", "b", "d"}},
+		{"d,__key__ , b", []string{"d", "__key__", "b", "a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			out, _ := runTestExport(t, entities, map[string]interface{}{"format": "jsonl", "order-fields": tt.order})
+
+			d := json.NewDecoder(strings.NewReader(out))
+			if _, err := d.Token(); err != nil {
+				t.Fatalf("invalid JSON %q: %v", out, err)
+			}
+			var names []string
+			for d.More() {
+				name, err := d.Token()
+				if err != nil {
+					t.Fatalf("invalid JSON %q: %v", out, err)
+				}
+				names = append(names, name.(string))
+				var v json.RawMessage
+				if err := d.Decode(&v); err != nil {
+					t.Fatalf("invalid JSON %q: %v", out, err)
+				}
+			}
+			if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("fields %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportDatabase(t *testing.T) {
+	SetDatabase("analytics")
+	t.Cleanup(func() { SetDatabase("") })
+
+	_, fake := runTestExport(t, testItems(3), map[string]interface{}{"format": "jsonl"})
+	if len(fake.queries) == 0 {
+		t.Fatal("no queries")
+	}
+	for i, q := range fake.queries {
+		if q.database != "analytics" {
+			t.Errorf("query %d has database %q, want analytics", i, q.database)
+		}
+	}
+}
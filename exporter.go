@@ -0,0 +1,23 @@
+package cdskit
+
+import (
+	"context"
+	"io"
+)
+
+// Exporter is the export-kind command used as a library, its fields are the command options
+type Exporter = ExportKindCmd
+
+// NewExporter returns an exporter of the kind with the defaults of the export-kind options
+func NewExporter(projectID string, kind string) (*Exporter, error) {
+	return parseExportJob(map[string]interface{}{"project": projectID, "kind": kind})
+}
+
+// Export runs the export writing the output to w instead of the --output destination,
+// progress is reported on stderr as by the command
+func Export(ctx context.Context, opts *Exporter, w io.Writer) error {
+	cmd := *opts
+	cmd.Output = "-"
+	cmd.out = w
+	return cmd.run(ctx)
+}
@@ -0,0 +1,279 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeDatastore serves kind queries of the entities in key order, at most
+// maxBatch per response like the server splitting large pages, and applies
+// the upserts and inserts of commits
+type fakeDatastore struct {
+	pb.UnimplementedDatastoreServer
+
+	entities []*pb.Entity
+	maxBatch int
+
+	mu sync.Mutex
+	// queries keeps the database, start cursor, offset and limit of every query
+	queries []fakeQuery
+	// failCommits is the number of commits failing as unavailable after they were applied,
+	// like a response lost on the way back
+	failCommits int
+	// lastID is the last ID allocated to an incomplete key
+	lastID int64
+}
+
+type fakeQuery struct {
+	database string
+	cursor   bool
+	start    int
+	offset   int32
+	limit    int32
+}
+
+// startFakeDatastore serves the entities to clients created by the test
+func startFakeDatastore(t *testing.T, entities []*pb.Entity) *fakeDatastore {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeDatastore{entities: entities, maxBatch: 300}
+	server := grpc.NewServer()
+	pb.RegisterDatastoreServer(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	prev, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST")
+	os.Setenv("DATASTORE_EMULATOR_HOST", lis.Addr().String())
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("DATASTORE_EMULATOR_HOST", prev)
+		} else {
+			os.Unsetenv("DATASTORE_EMULATOR_HOST")
+		}
+	})
+	return fake
+}
+
+func (fake *fakeDatastore) RunQuery(ctx context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	q := req.GetQuery()
+	if q == nil {
+		return nil, fmt.Errorf("only structured queries are supported")
+	}
+
+	var matching []*pb.Entity
+	fake.mu.Lock()
+	if len(q.Kind) == 1 && q.Kind[0].Name == "__kind__" {
+		matching = fake.kinds()
+	}
+	for _, e := range fake.entities {
+		path := e.Key.Path
+		if len(q.Kind) == 0 || path[len(path)-1].Kind == q.Kind[0].Name {
+			matching = append(matching, e)
+		}
+	}
+	fake.mu.Unlock()
+
+	start := 0
+	if len(q.StartCursor) > 0 {
+		n, err := strconv.Atoi(string(q.StartCursor))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor %q", q.StartCursor)
+		}
+		start = n
+	}
+	limit := q.GetLimit().GetValue()
+	if q.Limit == nil {
+		limit = -1
+	}
+	fake.mu.Lock()
+	fake.queries = append(fake.queries, fakeQuery{database: req.DatabaseId, cursor: len(q.StartCursor) > 0, start: start, offset: q.Offset, limit: limit})
+	fake.mu.Unlock()
+
+	start = min(start+int(q.Offset), len(matching))
+	end := min(start+fake.maxBatch, len(matching))
+	if limit >= 0 {
+		end = min(end, start+int(limit))
+	}
+
+	keysOnly := len(q.Projection) == 1 && q.Projection[0].Property.Name == "__key__"
+	batch := &pb.QueryResultBatch{
+		SkippedResults:   q.Offset,
+		EntityResultType: pb.EntityResult_FULL,
+		EndCursor:        []byte(strconv.Itoa(end)),
+		MoreResults:      pb.QueryResultBatch_NOT_FINISHED,
+	}
+	if keysOnly {
+		batch.EntityResultType = pb.EntityResult_KEY_ONLY
+	}
+	for i := start; i < end; i++ {
+		e := matching[i]
+		if keysOnly {
+			e = &pb.Entity{Key: e.Key}
+		}
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{Entity: e, Cursor: []byte(strconv.Itoa(i + 1))})
+	}
+	switch {
+	case end == len(matching):
+		batch.MoreResults = pb.QueryResultBatch_NO_MORE_RESULTS
+	case limit >= 0 && end-start == int(limit):
+		batch.MoreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+	return &pb.RunQueryResponse{Batch: batch}, nil
+}
+
+func (fake *fakeDatastore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	resp := &pb.CommitResponse{}
+	for _, m := range req.Mutations {
+		e := m.GetUpsert()
+		if m.GetInsert() != nil {
+			e = m.GetInsert()
+		}
+		if e == nil {
+			return nil, fmt.Errorf("only upserts and inserts are supported")
+		}
+
+		e = proto.Clone(e).(*pb.Entity)
+		result := &pb.MutationResult{}
+		if last := e.Key.Path[len(e.Key.Path)-1]; last.IdType == nil {
+			last.IdType = &pb.Key_PathElement_Id{Id: fake.allocateID()}
+			result.Key = e.Key
+		}
+		fake.upsert(e)
+		resp.MutationResults = append(resp.MutationResults, result)
+	}
+
+	if fake.failCommits > 0 {
+		fake.failCommits--
+		return nil, status.Error(codes.Unavailable, "connection reset")
+	}
+	return resp, nil
+}
+
+func (fake *fakeDatastore) AllocateIds(ctx context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	resp := &pb.AllocateIdsResponse{}
+	for _, k := range req.Keys {
+		k = proto.Clone(k).(*pb.Key)
+		k.Path[len(k.Path)-1].IdType = &pb.Key_PathElement_Id{Id: fake.allocateID()}
+		resp.Keys = append(resp.Keys, k)
+	}
+	return resp, nil
+}
+
+func (fake *fakeDatastore) allocateID() int64 {
+	fake.lastID++
+	return 1000 + fake.lastID
+}
+
+// upsert replaces the entity of the key or adds it
+func (fake *fakeDatastore) upsert(e *pb.Entity) {
+	for i, old := range fake.entities {
+		if proto.Equal(old.Key, e.Key) {
+			fake.entities[i] = e
+			return
+		}
+	}
+	fake.entities = append(fake.entities, e)
+}
+
+// kinds returns the __kind__ entities of the kinds of the entities in name order
+func (fake *fakeDatastore) kinds() []*pb.Entity {
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range fake.entities {
+		kind := e.Key.Path[len(e.Key.Path)-1].Kind
+		if !seen[kind] {
+			seen[kind] = true
+			names = append(names, kind)
+		}
+	}
+	sort.Strings(names)
+
+	kinds := make([]*pb.Entity, len(names))
+	for i, name := range names {
+		kinds[i] = &pb.Entity{Key: &pb.Key{
+			PartitionId: &pb.PartitionId{ProjectId: "test"},
+			Path:        []*pb.Key_PathElement{{Kind: "__kind__", IdType: &pb.Key_PathElement_Name{Name: name}}},
+		}}
+	}
+	return kinds
+}
+
+// fakeEntity returns an entity of the kind with the ID and properties
+func fakeEntity(kind string, id int64, props map[string]interface{}) *pb.Entity {
+	e := &pb.Entity{
+		Key: &pb.Key{
+			PartitionId: &pb.PartitionId{ProjectId: "test"},
+			Path:        []*pb.Key_PathElement{{Kind: kind, IdType: &pb.Key_PathElement_Id{Id: id}}},
+		},
+		Properties: make(map[string]*pb.Value),
+	}
+	for name, v := range props {
+		e.Properties[name] = fakeValue(v)
+	}
+	return e
+}
+
+func fakeValue(v interface{}) *pb.Value {
+	switch v := v.(type) {
+	case nil:
+		return &pb.Value{ValueType: &pb.Value_NullValue{}}
+	case bool:
+		return &pb.Value{ValueType: &pb.Value_BooleanValue{BooleanValue: v}}
+	case int:
+		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: int64(v)}}
+	case int64:
+		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: v}}
+	case float64:
+		return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: v}}
+	case string:
+		return &pb.Value{ValueType: &pb.Value_StringValue{StringValue: v}}
+	case []byte:
+		return &pb.Value{ValueType: &pb.Value_BlobValue{BlobValue: v}}
+	case time.Time:
+		return &pb.Value{ValueType: &pb.Value_TimestampValue{TimestampValue: timestamppb.New(v)}}
+	case *pb.Key:
+		return &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: v}}
+	case datastore.GeoPoint:
+		return &pb.Value{ValueType: &pb.Value_GeoPointValue{GeoPointValue: &latlng.LatLng{Latitude: v.Lat, Longitude: v.Lng}}}
+	case map[string]interface{}:
+		e := &pb.Entity{Properties: make(map[string]*pb.Value)}
+		for name, p := range v {
+			e.Properties[name] = fakeValue(p)
+		}
+		return &pb.Value{ValueType: &pb.Value_EntityValue{EntityValue: e}}
+	case []interface{}:
+		values := make([]*pb.Value, len(v))
+		for i, e := range v {
+			values[i] = fakeValue(e)
+		}
+		return &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: values}}}
+	default:
+		panic(fmt.Sprintf("unsupported value %T", v))
+	}
+}
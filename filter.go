@@ -0,0 +1,55 @@
+package cdskit
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// queryFilter is a property condition given by --filter
+type queryFilter struct {
+	field string
+	op    string
+	value interface{}
+}
+
+// inequality filters require the query to be ordered by the filtered property first
+func (f queryFilter) inequality() bool {
+	return f.op != "="
+}
+
+var filterPattern = regexp.MustCompile(`^\s*([^\s=<>]+)\s*(>=|<=|=|>|<)\s*(.*?)\s*$`)
+
+// parseFilter parses "field OP value", the value is parsed as an int, float, bool,
+// RFC3339 time or date, anything else, or a quoted value, is a string.
+func parseFilter(s string) (queryFilter, error) {
+	m := filterPattern.FindStringSubmatch(s)
+	if m == nil {
+		return queryFilter{}, fmt.Errorf("Invalid filter, expected field OP value with OP one of =, >, >=, <, <=: %s", s)
+	}
+	return queryFilter{field: m[1], op: m[2], value: parseFilterValue(m[3])}, nil
+}
+
+func parseFilterValue(s string) interface{} {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t
+	}
+	return s
+}
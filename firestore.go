@@ -0,0 +1,192 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Firestore native mode: collections are the kinds of Datastore mode and documents the
+// entities, a document path maps to a key path with the document IDs as names, e.g.
+// users/alice/orders/o1 is the key users:alice/orders:o1.
+
+// newFirestoreClient connects to Firestore of the project as newClient connects to Datastore,
+// FIRESTORE_EMULATOR_HOST selects an emulator
+func newFirestoreClient(ctx context.Context, projectID string) (*firestore.Client, error) {
+	opts := append(rpcOptions(), clientOptions...)
+	if databaseID != "" {
+		return firestore.NewClientWithDatabase(ctx, projectID, databaseID, opts...)
+	}
+	return firestore.NewClient(ctx, projectID, opts...)
+}
+
+// firestorePages reads the documents of a collection group a page at a time, in the
+// order of their paths
+type firestorePages struct {
+	query firestore.Query
+	last  *firestore.DocumentSnapshot
+}
+
+// next loads the next page of at most size documents, skipping the first skip
+func (p *firestorePages) next(ctx context.Context, opts *valueOptions, size int, skip int) ([]*dynamicEntity, error) {
+	q := p.query.Limit(size)
+	if p.last != nil {
+		q = q.StartAfter(p.last)
+	}
+	if skip > 0 {
+		q = q.Offset(skip)
+	}
+
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]*dynamicEntity, 0, len(docs))
+	for _, doc := range docs {
+		de := &dynamicEntity{key: firestoreKey(doc.Ref), opts: opts}
+		props := toProperties(fromFirestoreValue(doc.Data()).(map[string]interface{}))
+		if err := de.Load(props); err != nil {
+			return nil, err
+		}
+		batch = append(batch, de)
+	}
+	if len(docs) > 0 {
+		p.last = docs[len(docs)-1]
+	}
+	return batch, nil
+}
+
+// firestoreKey converts the path of a document to a key of name elements
+func firestoreKey(ref *firestore.DocumentRef) *datastore.Key {
+	var parent *datastore.Key
+	if ref.Parent.Parent != nil {
+		parent = firestoreKey(ref.Parent.Parent)
+	}
+	return datastore.NameKey(ref.Parent.ID, ref.ID, parent)
+}
+
+// firestoreDoc converts a key to the path of a document, IDs become document IDs, an
+// incomplete key gets a random document ID as Firestore assigns them
+func firestoreDoc(client *firestore.Client, k *datastore.Key) (*firestore.DocumentRef, error) {
+	var coll *firestore.CollectionRef
+	if k.Parent != nil {
+		parent, err := firestoreDoc(client, k.Parent)
+		if err != nil {
+			return nil, err
+		}
+		coll = parent.Collection(k.Kind)
+	} else {
+		coll = client.Collection(k.Kind)
+	}
+
+	switch {
+	case k.Name != "":
+		if strings.Contains(k.Name, "/") {
+			return nil, fmt.Errorf("Name %q of %s can't be a document ID, it contains /", k.Name, k.Kind)
+		}
+		return coll.Doc(k.Name), nil
+	case k.ID != 0:
+		return coll.Doc(strconv.FormatInt(k.ID, 10)), nil
+	default:
+		return coll.NewDoc(), nil
+	}
+}
+
+// fromFirestoreValue converts the values of a document to the Datastore ones, maps are
+// converted to embedded entities by toProperties
+func fromFirestoreValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for name, vv := range v {
+			m[name] = fromFirestoreValue(vv)
+		}
+		return m
+	case []interface{}:
+		f := make([]interface{}, len(v))
+		for i, vv := range v {
+			f[i] = fromFirestoreValue(vv)
+		}
+		return f
+	case *latlng.LatLng:
+		return datastore.GeoPoint{Lat: v.Latitude, Lng: v.Longitude}
+	case *firestore.DocumentRef:
+		return firestoreKey(v)
+	default:
+		return value
+	}
+}
+
+// toFirestoreValue converts a Datastore value to the one of a document field
+func toFirestoreValue(client *firestore.Client, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case *datastore.Entity:
+		return toFirestoreData(client, v.Properties)
+	case []interface{}:
+		f := make([]interface{}, len(v))
+		for i, vv := range v {
+			var err error
+			if f[i], err = toFirestoreValue(client, vv); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case datastore.GeoPoint:
+		return &latlng.LatLng{Latitude: v.Lat, Longitude: v.Lng}, nil
+	case *datastore.Key:
+		if v.Incomplete() {
+			return nil, fmt.Errorf("Incomplete key of %s can't reference a document", v.Kind)
+		}
+		return firestoreDoc(client, v)
+	default:
+		return value, nil
+	}
+}
+
+// toFirestoreData converts the properties of an entity to the fields of a document
+func toFirestoreData(client *firestore.Client, props []datastore.Property) (map[string]interface{}, error) {
+	data := make(map[string]interface{}, len(props))
+	for _, p := range props {
+		v, err := toFirestoreValue(client, p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %w", p.Name, err)
+		}
+		data[p.Name] = v
+	}
+	return data, nil
+}
+
+// putDocuments writes the entities as documents of their keys, a batch is a single
+// commit like PutMulti, so it's retried as a whole, incomplete keys get their document
+// IDs before the first attempt
+func putDocuments(ctx context.Context, client *firestore.Client, keys []*datastore.Key, entities []*dynamicEntity, retries int) error {
+	refs := make([]*firestore.DocumentRef, len(keys))
+	data := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		props, err := entities[i].Save()
+		if err != nil {
+			return err
+		}
+		if refs[i], err = firestoreDoc(client, k); err != nil {
+			return err
+		}
+		if data[i], err = toFirestoreData(client, props); err != nil {
+			return fmt.Errorf("Unable to convert entity %s: %w", k, err)
+		}
+	}
+
+	return withRetries(ctx, retries, func() error {
+		b := client.Batch()
+		for i, ref := range refs {
+			b.Set(ref, data[i])
+		}
+		_, err := b.Commit(ctx)
+		return err
+	})
+}
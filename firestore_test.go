@@ -0,0 +1,227 @@
+package cdskit
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "cloud.google.com/go/firestore/apiv1/firestorepb"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const fakeFirestoreRoot = "projects/test/databases/(default)/documents"
+
+// fakeFirestore serves collection queries of the documents in path order and applies
+// the writes of commits
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+
+	mu        sync.Mutex
+	documents map[string]*pb.Document
+	// queries keeps the queries run
+	queries []*pb.StructuredQuery
+}
+
+// startFakeFirestore serves the documents to Firestore clients created by the test
+func startFakeFirestore(t *testing.T, documents ...*pb.Document) *fakeFirestore {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeFirestore{documents: make(map[string]*pb.Document)}
+	for _, d := range documents {
+		d.CreateTime, d.UpdateTime = timestamppb.Now(), timestamppb.Now()
+		fake.documents[d.Name] = d
+	}
+	server := grpc.NewServer()
+	pb.RegisterFirestoreServer(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	prev, ok := os.LookupEnv("FIRESTORE_EMULATOR_HOST")
+	os.Setenv("FIRESTORE_EMULATOR_HOST", lis.Addr().String())
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("FIRESTORE_EMULATOR_HOST", prev)
+		} else {
+			os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+		}
+	})
+	return fake
+}
+
+func (fake *fakeFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	q := req.GetStructuredQuery()
+	fake.mu.Lock()
+	fake.queries = append(fake.queries, q)
+	var names []string
+	for name := range fake.documents {
+		parent, id := name[:strings.LastIndex(name, "/")], ""
+		parent, id = parent[:strings.LastIndex(parent, "/")], parent[strings.LastIndex(parent, "/")+1:]
+		if id != q.From[0].CollectionId || (!q.From[0].AllDescendants && parent != req.Parent) {
+			continue
+		}
+		if c := q.StartAt; c != nil {
+			ref := c.Values[0].GetReferenceValue()
+			if name < ref || (name == ref && !c.Before) {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	fake.mu.Unlock()
+	sort.Strings(names)
+
+	names = names[min(int(q.Offset), len(names)):]
+	if q.Limit != nil {
+		names = names[:min(int(q.Limit.Value), len(names))]
+	}
+	for _, name := range names {
+		fake.mu.Lock()
+		doc := fake.documents[name]
+		fake.mu.Unlock()
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: timestamppb.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fake *fakeFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	resp := &pb.CommitResponse{CommitTime: timestamppb.Now()}
+	for _, w := range req.Writes {
+		doc := proto.Clone(w.GetUpdate()).(*pb.Document)
+		doc.CreateTime, doc.UpdateTime = resp.CommitTime, resp.CommitTime
+		fake.documents[doc.Name] = doc
+		resp.WriteResults = append(resp.WriteResults, &pb.WriteResult{UpdateTime: resp.CommitTime})
+	}
+	return resp, nil
+}
+
+func TestExportImportFirestore(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 30, 0, 250000000, time.UTC)
+	fields := map[string]*pb.Value{
+		"name":    {ValueType: &pb.Value_StringValue{StringValue: "a"}},
+		"n":       {ValueType: &pb.Value_IntegerValue{IntegerValue: 1 << 40}},
+		"price":   {ValueType: &pb.Value_DoubleValue{DoubleValue: 2}},
+		"ok":      {ValueType: &pb.Value_BooleanValue{BooleanValue: true}},
+		"created": {ValueType: &pb.Value_TimestampValue{TimestampValue: timestamppb.New(created)}},
+		"data":    {ValueType: &pb.Value_BytesValue{BytesValue: []byte{0, 1}}},
+		"at":      {ValueType: &pb.Value_GeoPointValue{GeoPointValue: &latlng.LatLng{Latitude: 52.5, Longitude: 13.4}}},
+		"owner":   {ValueType: &pb.Value_ReferenceValue{ReferenceValue: fakeFirestoreRoot + "/users/u1"}},
+		"missing": {ValueType: &pb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}},
+		"tags": {ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: []*pb.Value{
+			{ValueType: &pb.Value_IntegerValue{IntegerValue: 1}},
+			{ValueType: &pb.Value_StringValue{StringValue: "x"}},
+		}}}},
+		"address": {ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{Fields: map[string]*pb.Value{
+			"city": {ValueType: &pb.Value_StringValue{StringValue: "Berlin"}},
+		}}}},
+	}
+	docs := []*pb.Document{
+		{Name: fakeFirestoreRoot + "/items/a", Fields: fields},
+		{Name: fakeFirestoreRoot + "/users/u1/items/b", Fields: map[string]*pb.Value{"name": {ValueType: &pb.Value_StringValue{StringValue: "b"}}}},
+		{Name: fakeFirestoreRoot + "/items/c", Fields: map[string]*pb.Value{"name": {ValueType: &pb.Value_StringValue{StringValue: "c"}}}},
+		{Name: fakeFirestoreRoot + "/other/x", Fields: map[string]*pb.Value{"name": {ValueType: &pb.Value_StringValue{StringValue: "x"}}}},
+	}
+	fake := startFakeFirestore(t, docs...)
+
+	output := filepath.Join(t.TempDir(), "items.jsonl")
+	export, err := parseExportJob(map[string]interface{}{"project": "test", "kind": "items", "mode": "firestore", "format": "jsonl",
+		"key-ref-format": "structured", "page-size": "2", "output": output, "quiet": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := export.run(context.Background()); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("exported %d documents, want 3:\n%s", len(lines), b)
+	}
+	for i, want := range []string{`"kind":"items","name":"a","namespace":""}`, `"kind":"items","name":"c","namespace":""}`, `"kind":"items","name":"b","namespace":"","parent":"users:u1"}`} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("record %d is %s, want a key with %s", i, lines[i], want)
+		}
+	}
+
+	// pages follow the last document of the previous one
+	if len(fake.queries) != 3 {
+		t.Fatalf("ran %d queries, want 3", len(fake.queries))
+	}
+	for i, after := range []string{"", "/items/c", "/users/u1/items/b"} {
+		q := fake.queries[i]
+		if !q.From[0].AllDescendants || q.Limit.GetValue() != 2 {
+			t.Errorf("query %d is %v, want a collection group query of 2 documents", i, q)
+		}
+		if got := q.StartAt.GetValues(); after != "" && (len(got) != 1 || got[0].GetReferenceValue() != fakeFirestoreRoot+after || q.StartAt.Before) {
+			t.Errorf("query %d starts at %v, want after %s", i, q.StartAt, after)
+		}
+	}
+
+	// the export imported into another collection gives the same documents
+	imp := &ImportKindCmd{}
+	if err := parseOptions(imp, map[string]interface{}{"project": "test", "kind": "copies", "mode": "firestore", "file": output}); err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.run(context.Background()); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	for from, to := range map[string]string{
+		"/items/a":          "/copies/a",
+		"/items/c":          "/copies/c",
+		"/users/u1/items/b": "/users/u1/copies/b",
+	} {
+		got, want := fake.documents[fakeFirestoreRoot+to], proto.Clone(fake.documents[fakeFirestoreRoot+from]).(*pb.Document)
+		if got == nil {
+			t.Errorf("document %s wasn't imported", to)
+			continue
+		}
+		// null values are left out of exports
+		delete(want.Fields, "missing")
+		want.Name, want.CreateTime, want.UpdateTime = got.Name, got.CreateTime, got.UpdateTime
+		if !proto.Equal(got, want) {
+			t.Errorf("imported %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFirestoreOptions(t *testing.T) {
+	export, err := parseExportJob(map[string]interface{}{"project": "test", "kind": "items", "mode": "firestore", "namespace": "ns", "quiet": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := export.run(context.Background()); err == nil || !strings.Contains(err.Error(), "--mode firestore") {
+		t.Errorf("export with --namespace: %v, want an error of --mode firestore", err)
+	}
+
+	imp := &ImportKindCmd{}
+	if err := parseOptions(imp, map[string]interface{}{"project": "test", "kind": "items", "mode": "firestore", "namespace": "ns", "file": "items.jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := imp.run(context.Background()); err == nil || !strings.Contains(err.Error(), "--mode firestore") {
+		t.Errorf("import with --namespace: %v, want an error of --mode firestore", err)
+	}
+}
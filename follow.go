@@ -0,0 +1,83 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// follow exports the kind and then polls for entities with a --timestamp-field after the
+// last exported one, appending them to the output until interrupted
+func (cmd *ExportKindCmd) follow(ctx context.Context) error {
+	if cmd.Format != "jsonl" && cmd.Format != "ndjson" {
+		return fmt.Errorf("--follow requires --format jsonl or ndjson")
+	}
+	if cmd.Output == "" || strings.Contains(cmd.Output, "://") {
+		return fmt.Errorf("--follow requires --output with a file or - for stdout")
+	}
+	if cmd.Split > 0 || cmd.MaxFileSize != "" || cmd.Resume || cmd.Manifest || cmd.Gzip || cmd.Encrypt != "" || cmd.IdempotentName {
+		return fmt.Errorf("--follow can't be combined with --split, --max-file-size, --resume, --manifest, --gzip, --encrypt or --idempotent-name")
+	}
+	if cmd.PollInterval < 1 {
+		return fmt.Errorf("--poll-interval must be at least 1 second")
+	}
+
+	ctx, stop := interruptible(ctx)
+	defer stop()
+
+	for {
+		if err := cmd.run(ctx); err != nil {
+			return err
+		}
+
+		// later polls append what changed since the last exported entity
+		cmd.appendOutput = true
+		if !cmd.lastSeen.IsZero() {
+			cmd.Since = cmd.lastSeen.Format(time.RFC3339Nano)
+		}
+
+		select {
+		case <-ctx.Done():
+			infof("Stopped following %s", cmd.Kind)
+			return nil
+		case <-time.After(time.Duration(cmd.PollInterval) * time.Second):
+		}
+	}
+}
+
+// noteSeen keeps the latest --timestamp-field value of the exported entities, the value
+// is parsed back from its exported form
+func (cmd *ExportKindCmd) noteSeen(de *dynamicEntity) {
+	loc := cmd.location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var t time.Time
+	switch v := de.value[cmd.TimestampField].(type) {
+	case bqTimestamp:
+		t = time.Time(v)
+	case int64:
+		if cmd.TimeFormat == "epoch-seconds" {
+			t = time.Unix(v, 0)
+		} else {
+			t = time.Unix(0, v*int64(time.Millisecond))
+		}
+	case string:
+		layout := cmd.TimeFormat
+		if layout == "" || layout == "rfc3339" {
+			layout = time.RFC3339Nano
+		}
+		var err error
+		if t, err = time.ParseInLocation(layout, v, loc); err != nil {
+			return
+		}
+	default:
+		return
+	}
+
+	if t.After(cmd.lastSeen) {
+		cmd.lastSeen = t
+	}
+}
@@ -0,0 +1,246 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// gcsChunkSize is the size of a resumable upload chunk, a failed chunk is retried
+// without restarting the whole upload.
+const gcsChunkSize = 16 << 20
+
+// gcsObject is an export file uploaded to Cloud Storage. The object is created only
+// when the writer is closed, an aborted export leaves no partial object behind.
+type gcsObject struct {
+	*storage.Writer
+	client *storage.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newGCSObject starts an upload to gs://bucket/path, the file name, which may include
+// subdirectories, is appended when the path is empty or ends with a slash.
+func newGCSObject(ctx context.Context, url string, fileName string) (*gcsObject, error) {
+	bucket, name := splitGCSPath(url)
+	if bucket == "" {
+		return nil, fmt.Errorf("Invalid Cloud Storage output, expected gs://bucket/path: %s", url)
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		name = name + fileName
+	}
+
+	client, err := storage.NewClient(ctx, clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := client.Bucket(bucket).Object(name).NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+	w.ProgressFunc = func(n int64) {
+		infof("Uploaded %d MiB to gs://%s/%s", n>>20, bucket, name)
+	}
+
+	return &gcsObject{Writer: w, client: client, ctx: ctx, cancel: cancel}, nil
+}
+
+// Write passes the data on to the upload at the rate of --max-bandwidth
+func (o *gcsObject) Write(p []byte) (int, error) {
+	if err := transferLimiter.waitN(o.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return o.Writer.Write(p)
+}
+
+// Commit finishes the upload and creates the object
+func (o *gcsObject) Commit() error {
+	if err := o.Writer.Close(); err != nil {
+		return fmt.Errorf("Unable to upload gs://%s/%s: %w", o.Bucket, o.Name, err)
+	}
+	return nil
+}
+
+// Close aborts the upload unless it was committed
+func (o *gcsObject) Close() error {
+	o.cancel()
+	return o.client.Close()
+}
+
+// splitGCSPath splits gs://bucket/path into the bucket and the object name
+func splitGCSPath(url string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "gs://"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// transferLimiter spaces the bytes uploaded to and downloaded from Cloud Storage,
+// set by --max-bandwidth
+var transferLimiter = &limiter{}
+
+// SetMaxBandwidth limits Cloud Storage transfers to a rate like 20MB/s, units are
+// those of --max-file-size
+func SetMaxBandwidth(rate string) error {
+	n, err := parseSize(strings.TrimSuffix(strings.TrimSpace(rate), "/s"))
+	if err != nil {
+		return fmt.Errorf("--max-bandwidth: %w", err)
+	}
+
+	transferLimiter.mu.Lock()
+	defer transferLimiter.mu.Unlock()
+	transferLimiter.interval = time.Duration(float64(time.Second) / float64(n))
+	return nil
+}
+
+// gcsReader downloads an object, a failed download resumes at the offset reached
+// with a range read of the same generation
+type gcsReader struct {
+	ctx     context.Context
+	client  *storage.Client
+	obj     *storage.ObjectHandle
+	name    string
+	r       *storage.Reader
+	offset  int64
+	retries int
+}
+
+func openGCSReader(ctx context.Context, url string, retries int) (*gcsReader, error) {
+	bucket, name := splitGCSPath(url)
+	if bucket == "" || name == "" || strings.HasSuffix(name, "/") {
+		return nil, fmt.Errorf("Invalid Cloud Storage file, expected gs://bucket/object: %s", url)
+	}
+
+	client, err := storage.NewClient(ctx, clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	gr := &gcsReader{ctx: ctx, client: client, obj: client.Bucket(bucket).Object(name), name: url, retries: retries}
+	if err := gr.open(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return gr, nil
+}
+
+func (gr *gcsReader) open() error {
+	r, err := gr.obj.NewRangeReader(gr.ctx, gr.offset, -1)
+	if err != nil {
+		return fmt.Errorf("Unable to download %s: %w", gr.name, err)
+	}
+	if gr.offset == 0 {
+		// resumed reads fail rather than mix in a newer version of the object
+		gr.obj = gr.obj.Generation(r.Attrs.Generation)
+	}
+	gr.r = r
+	return nil
+}
+
+func (gr *gcsReader) Read(p []byte) (int, error) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		if gr.r == nil {
+			if err := gr.open(); err != nil {
+				if errors.Is(err, storage.ErrObjectNotExist) || attempt > gr.retries || gr.ctx.Err() != nil {
+					return 0, err
+				}
+				warnf("Retrying in %s after error: %v", delay, err)
+				select {
+				case <-gr.ctx.Done():
+					return 0, gr.ctx.Err()
+				case <-time.After(delay):
+				}
+				delay *= 2
+				continue
+			}
+		}
+
+		n, err := gr.r.Read(p)
+		gr.offset += int64(n)
+		if werr := transferLimiter.waitN(gr.ctx, n); werr != nil {
+			return n, werr
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		gr.r.Close()
+		gr.r = nil
+		if attempt >= gr.retries || gr.ctx.Err() != nil {
+			return n, fmt.Errorf("Unable to download %s: %w", gr.name, err)
+		}
+		warnf("Resuming the download of %s at %s after error: %v", gr.name, formatBytes(gr.offset), err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (gr *gcsReader) Close() error {
+	if gr.r != nil {
+		gr.r.Close()
+	}
+	return gr.client.Close()
+}
+
+// signGCSURL returns a V4 signed URL to download the object for the duration. The
+// URL is signed with the service account key given as credentials, or by the IAM
+// Credentials API as the signer, whose Service Account Token Creator role is needed
+func signGCSURL(ctx context.Context, url string, expires time.Duration, signer string) (string, error) {
+	opts := &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(expires),
+	}
+
+	if signer != "" {
+		client, _, err := htransport.NewClient(ctx, append([]option.ClientOption{option.WithScopes("https://www.googleapis.com/auth/cloud-platform")}, clientOptions...)...)
+		if err != nil {
+			return "", err
+		}
+		opts.GoogleAccessID = signer
+		opts.SignBytes = func(b []byte) ([]byte, error) {
+			var resp struct {
+				SignedBlob string `json:"signedBlob"`
+			}
+			body := map[string]string{"payload": base64.StdEncoding.EncodeToString(b)}
+			if err := bqCall(ctx, client, http.MethodPost, "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"+signer+":signBlob", body, &resp); err != nil {
+				return nil, err
+			}
+			return base64.StdEncoding.DecodeString(resp.SignedBlob)
+		}
+	} else {
+		creds, err := transport.Creds(ctx, clientOptions...)
+		if err != nil {
+			return "", err
+		}
+		var key struct {
+			Type        string `json:"type"`
+			ClientEmail string `json:"client_email"`
+			PrivateKey  string `json:"private_key"`
+		}
+		if len(creds.JSON) > 0 {
+			json.Unmarshal(creds.JSON, &key)
+		}
+		if key.Type != "service_account" {
+			return "", fmt.Errorf("--signed-url requires a service account key as credentials or --signed-url-signer")
+		}
+		opts.GoogleAccessID, opts.PrivateKey = key.ClientEmail, []byte(key.PrivateKey)
+	}
+
+	bucket, name := splitGCSPath(url)
+	return storage.SignedURL(bucket, name, opts)
+}
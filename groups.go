@@ -0,0 +1,117 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// maxGroupEntities is the number of entities a transaction writes at most
+const maxGroupEntities = 500
+
+// groupCopy copies entity groups with --transactional, the entities of a group are read
+// in a read-only transaction of the source and written in a transaction of the destination.
+// Only the writes are atomic across the projects, a group changed in the source between
+// them is copied as it was read.
+type groupCopy struct {
+	src, dst *datastore.Client
+	retries  int
+	// query selects the entities to copy below the root of a group
+	query func(root *datastore.Key) *datastore.Query
+	// prepare transforms the entities of a group and returns them with their new keys
+	prepare func(batch []*dynamicEntity) ([]*datastore.Key, []*dynamicEntity, error)
+}
+
+// copy copies the group of the root and returns the number of entities read and written
+func (gc *groupCopy) copy(ctx context.Context, root *datastore.Key) (int, int, error) {
+	opts := &valueOptions{raw: true, includeNulls: true}
+
+	var batch []*dynamicEntity
+	err := withRetries(ctx, gc.retries, func() error {
+		_, err := gc.src.RunInTransaction(ctx, func(tx *datastore.Transaction) (err error) {
+			batch, _, err = fetchPage(ctx, gc.src, gc.query(root).Transaction(tx), opts)
+			return err
+		}, datastore.ReadOnly)
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to read the entity group %s: %w", keyPath(root), err)
+	}
+
+	read := len(batch)
+	keys, batch, err := gc.prepare(batch)
+	if err != nil || len(batch) == 0 {
+		return read, 0, err
+	}
+	if len(batch) > maxGroupEntities {
+		return read, 0, fmt.Errorf("The entity group %s has %d entities, a transaction writes at most %d", keyPath(root), len(batch), maxGroupEntities)
+	}
+
+	// conflicting commits are retried by the transaction, other transient errors by withRetries
+	err = withRetries(ctx, gc.retries, func() error {
+		_, err := gc.dst.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			_, err := tx.PutMulti(keys, batch)
+			return err
+		}, datastore.MaxAttempts(gc.retries+1))
+		return err
+	})
+	if err != nil {
+		return read, 0, fmt.Errorf("Unable to write the entity group %s: %w", keyPath(root), err)
+	}
+	return read, len(batch), nil
+}
+
+// forEachRoot calls fn with the root of the entity group of every entity of the query,
+// once per group as entities are listed in key order and those of a group are adjacent
+func forEachRoot(ctx context.Context, client *datastore.Client, q *datastore.Query, retries int, fn func(root *datastore.Key) error) error {
+	var start datastore.Cursor
+	last := ""
+	for {
+		var keys []*datastore.Key
+		page := q.KeysOnly().Start(start).Limit(500)
+		err := withRetries(ctx, retries, func() error {
+			keys = keys[:0]
+			it := client.Run(ctx, page)
+			for {
+				k, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				keys = append(keys, k)
+			}
+
+			var err error
+			start, err = it.Cursor()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		for _, k := range keys {
+			root := rootKey(k)
+			if id := root.String(); id != last {
+				last = id
+				if err := fn(root); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// rootKey returns the key of the root entity of the group of k
+func rootKey(k *datastore.Key) *datastore.Key {
+	for k.Parent != nil {
+		k = k.Parent
+	}
+	return k
+}
@@ -0,0 +1,625 @@
+package cdskit
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/firestore"
+)
+
+// ImportKindCmd loads entities produced by export-kind back into a kind
+type ImportKindCmd struct {
+	ProjectID  string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace  string   `short:"n" long:"namespace" description:"Namespace to import data into"`
+	Kind       string   `short:"k" long:"kind" description:"Kind to import into" required:"true"`
+	File       string   `short:"f" long:"file" description:"File to import, gs://bucket/object downloads it from Cloud Storage" required:"true"`
+	Format     string   `long:"format" description:"One of the follwing formats: csv, json, jsonl, ndjson, typed-json or msgpack (detected from the file extension by default)"`
+	Mode       string   `long:"mode" default:"datastore" choice:"datastore" choice:"firestore" description:"Database mode of the project: datastore, or firestore to write the records as documents of the collection named --kind into a Firestore database in Native mode, keys become document paths with IDs and names as document IDs"`
+	Delimiter  string   `long:"delimiter" default:"," description:"CSV field delimiter, a single character, \\t or tab for tab"`
+	CSVNull    string   `long:"csv-null" description:"Text of null values in CSV, e.g. \\N or null, such cells are left out like empty ones"`
+	Separator  string   `long:"nesting-separator" default:":" description:"Separator of property names in CSV columns of embedded entities, as given to export-kind"`
+	BatchSize  int      `long:"batch-size" default:"500" description:"Number of entities written per call, at most 500"`
+	MaxRetries int      `long:"max-retries" default:"5" description:"Number of retries of a write failing with a transient error, with exponential backoff"`
+	DryRun     bool     `long:"dry-run" description:"Read and convert the file and print how many entities would be imported without writing them"`
+	Types      string   `long:"types" description:"Column to property type mapping, e.g. age:int,created:time (string, int, float, bool, time, key for encoded keys or Kind:id paths), nested properties are given as parent:child, entity keeps lat/lng and base64 objects of JSON files as embedded entities. JSON files don't need types for the values export-kind writes, RFC 3339 strings are read as timestamps unless typed as string"`
+	Transforms []string `long:"transform" description:"Change records before they're imported, as export-kind --transform does, not supported with typed-json"`
+	Passphrase string   `long:"passphrase" env:"CDSKIT_PASSPHRASE" description:"Passphrase of files exported with --encrypt passphrase, files of --encrypt are decrypted transparently"`
+
+	// progress counts the imported entities for the jobs of serve
+	progress *int64
+	// imported is the number of entities imported by run, of entities that would be with --dry-run
+	imported int
+}
+
+// Execute is called by go-flags
+func (cmd *ImportKindCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+	if err := cmd.run(ctx); err != nil {
+		return err
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would import %d entities into %s/%s/%s\n", cmd.imported, cmd.ProjectID, cmd.Namespace, cmd.Kind)
+	}
+	return nil
+}
+
+func (cmd *ImportKindCmd) run(ctx context.Context) error {
+	infof("Importing '%s' into '%s/%s'", cmd.File, cmd.ProjectID, cmd.Namespace)
+
+	// PutMulti accepts at most 500 entities
+	if cmd.BatchSize < 1 || cmd.BatchSize > 500 {
+		return fmt.Errorf("--batch-size must be between 1 and 500")
+	}
+	if cmd.Mode == "firestore" && cmd.Namespace != "" {
+		return fmt.Errorf("--mode firestore can't be combined with --namespace, Firestore has no namespaces")
+	}
+
+	ts, err := parseTransforms(cmd.Transforms)
+	if err != nil {
+		return err
+	}
+
+	var f io.ReadCloser
+	if strings.HasPrefix(cmd.File, "gs://") {
+		f, err = openGCSReader(ctx, cmd.File, cmd.MaxRetries)
+	} else {
+		f, err = os.Open(cmd.File)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var in io.Reader = br
+	if magic, _ := br.Peek(len(encryptionMagic)); string(magic) == encryptionMagic {
+		// chunks are authenticated as they're read, a modified file fails where it was changed
+		if in, err = newDecryptReader(ctx, br, cmd.Passphrase); err != nil {
+			return fmt.Errorf("Unable to decrypt %s: %w", cmd.File, err)
+		}
+	}
+
+	r, err := cmd.newImportReader(in)
+	if err != nil {
+		return err
+	}
+
+	var dsClient *datastore.Client
+	var fsClient *firestore.Client
+	if cmd.Mode == "firestore" && !cmd.DryRun {
+		fsClient, err = newFirestoreClient(ctx, cmd.ProjectID)
+		if err != nil {
+			return err
+		}
+
+		defer fsClient.Close()
+	} else if !cmd.DryRun {
+		dsClient, err = newClient(ctx, cmd.ProjectID)
+		if err != nil {
+			return err
+		}
+
+		defer dsClient.Close()
+	}
+
+	imported, dropped := 0, 0
+	batch := make([]*dynamicEntity, 0, cmd.BatchSize)
+	started, batchStarted := time.Now(), time.Now()
+
+	put := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		keys := make([]*datastore.Key, len(batch))
+		for i, de := range batch {
+			keys[i] = de.key
+			if keys[i] == nil {
+				keys[i] = datastore.IncompleteKey(cmd.Kind, nil)
+				keys[i].Namespace = cmd.Namespace
+			}
+		}
+
+		var err error
+		if dsClient != nil {
+			err = allocateIDs(ctx, dsClient, keys, cmd.MaxRetries)
+			if err == nil {
+				err = withRetries(ctx, cmd.MaxRetries, func() error {
+					_, err := dsClient.PutMulti(ctx, keys, batch)
+					return err
+				})
+			}
+		} else if fsClient != nil {
+			err = putDocuments(ctx, fsClient, keys, batch, cmd.MaxRetries)
+		}
+		if err != nil && ctx.Err() != nil {
+			return fmt.Errorf("%w, %d entities were imported", interruption(), imported)
+		}
+		if err != nil {
+			return err
+		}
+
+		imported += len(batch)
+		cmd.imported = imported
+		storeProgress(cmd.progress, imported)
+		logEvent(logDebug, logFields{"event": "batch", "entities": len(batch), "seconds": time.Since(batchStarted).Seconds()},
+			"Batch of %d entities in %s", len(batch), time.Since(batchStarted).Round(time.Millisecond))
+		batch, batchStarted = batch[:0], time.Now()
+		infof("Importing %s - %d", cmd.Kind, imported)
+		return nil
+	}
+
+	for {
+		de, err := r.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := cmd.restoreKey(de); err != nil {
+			return err
+		}
+
+		if ts != nil {
+			// typed records are imported from their properties, not the values
+			if de.props != nil {
+				return fmt.Errorf("--transform isn't supported with typed-json")
+			}
+
+			keep, err := ts.apply(de.value)
+			if err != nil {
+				return fmt.Errorf("Unable to transform record %d: %w", imported+len(batch)+dropped+1, err)
+			}
+			if !keep {
+				dropped++
+				continue
+			}
+		}
+
+		batch = append(batch, de)
+		if len(batch) == cmd.BatchSize {
+			if err := put(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := put(); err != nil {
+		return err
+	}
+
+	if dropped > 0 {
+		infof("Dropped %d records by --transform", dropped)
+	}
+
+	logEvent(logInfo, logFields{"event": "summary", "kind": cmd.Kind, "namespace": cmd.Namespace, "read": imported + dropped, "written": imported, "dropped": dropped, "elapsed_seconds": time.Since(started).Seconds()},
+		"Imported %d entities in %s", imported, time.Since(started).Round(time.Second))
+
+	return nil
+}
+
+func (cmd *ImportKindCmd) newImportReader(r io.Reader) (importReader, error) {
+	format := cmd.Format
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(cmd.File, ".enc")), ".")
+	}
+
+	types, err := parseColumnTypes(cmd.Types)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "csv":
+		delimiter, err := parseDelimiter(cmd.Delimiter)
+		if err != nil {
+			return nil, err
+		}
+		return newCSVImportReader(r, types, delimiter, cmd.CSVNull, cmd.Separator)
+	case "json":
+		return newJSONImportReader(r, types, true)
+	case "jsonl", "ndjson":
+		return newJSONImportReader(r, types, false)
+	case "typed-json":
+		return newTypedImportReader(r, cmd.Kind, cmd.Namespace)
+	case "msgpack":
+		return newMsgpackImportReader(r), nil
+	default:
+		return nil, fmt.Errorf("Unsupported format: %s", format)
+	}
+}
+
+// restoreKey takes the key written by export-kind from the __key__ field, the key is
+// moved to the imported kind and namespace keeping its ID or name and ancestors.
+func (cmd *ImportKindCmd) restoreKey(de *dynamicEntity) error {
+	f, ok := de.value["__key__"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	delete(de.value, "__key__")
+
+	// the encoded key keeps the types of the ancestors, the parent path is read
+	// for files with the encoded key dropped
+	var parent *datastore.Key
+	if encoded, ok := f["encoded"].(string); ok && encoded != "" {
+		k, err := datastore.DecodeKey(encoded)
+		if err != nil {
+			return fmt.Errorf("Invalid __key__ encoded %s: %w", encoded, err)
+		}
+		if k.Parent != nil {
+			parent = remapKey(k.Parent, k.Parent.Kind, cmd.Namespace)
+		}
+	} else if path, ok := f["parent"].(string); ok && path != "" {
+		var err error
+		parent, err = parseFullKeyPath(path, cmd.Namespace)
+		if err != nil {
+			return fmt.Errorf("Invalid __key__ parent %s: %w", path, err)
+		}
+	}
+
+	// CSV cells are read as strings unless typed
+	var id int64
+	switch v := f["id"].(type) {
+	case int64:
+		id = v
+	case string:
+		if v != "" {
+			var err error
+			id, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid __key__ id %s: %w", v, err)
+			}
+		}
+	}
+
+	name, _ := f["name"].(string)
+	switch {
+	case name != "":
+		de.key = datastore.NameKey(cmd.Kind, name, parent)
+	case id != 0:
+		de.key = datastore.IDKey(cmd.Kind, id, parent)
+	default:
+		return nil
+	}
+
+	de.key.Namespace = cmd.Namespace
+	return nil
+}
+
+// parseColumnTypes parses column:type pairs given by --types
+func parseColumnTypes(s string) (map[string]string, error) {
+	types := make(map[string]string)
+	if s == "" {
+		return types, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid column type mapping: %s", pair)
+		}
+
+		column, typ := pair[:i], pair[i+1:]
+		switch typ {
+		case "string", "int", "float", "bool", "time", "key", "entity":
+			types[column] = typ
+		default:
+			return nil, fmt.Errorf("Unsupported type '%s' for column %s", typ, column)
+		}
+	}
+	return types, nil
+}
+
+type importReader interface {
+	// ReadRecord returns the next entity or io.EOF when there are no more records.
+	ReadRecord() (*dynamicEntity, error)
+}
+
+type csvImportReader struct {
+	csvr   *csv.Reader
+	header []string
+	types  map[string]string
+	null   string
+	sep    string
+}
+
+func newCSVImportReader(r io.Reader, types map[string]string, delimiter rune, null string, sep string) (*csvImportReader, error) {
+	if sep == "" {
+		sep = ":"
+	}
+
+	csvr := csv.NewReader(r)
+	csvr.Comma = delimiter
+	csvr.FieldsPerRecord = -1
+
+	header, err := csvr.Read()
+	if err == io.EOF {
+		header = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var untyped []string
+	for _, column := range header {
+		if _, ok := types[column]; !ok && !strings.HasPrefix(column, "__key__"+sep) {
+			untyped = append(untyped, column)
+		}
+	}
+
+	if len(untyped) > 0 {
+		infof("Columns without type mapping are imported as strings: %s", strings.Join(untyped, ", "))
+	}
+
+	return &csvImportReader{csvr: csvr, header: header, types: types, null: null, sep: sep}, nil
+}
+
+func (format *csvImportReader) ReadRecord() (*dynamicEntity, error) {
+	if format.header == nil {
+		return nil, io.EOF
+	}
+
+	row, err := format.csvr.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	de := &dynamicEntity{value: make(map[string]interface{})}
+	for i, cell := range row {
+		if i >= len(format.header) || cell == "" || cell == format.null {
+			continue
+		}
+
+		column := format.header[i]
+		v, err := parseColumnValue(cell, format.types[column])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse column %s: %w", column, err)
+		}
+
+		// nested properties are flattened as parent:child
+		m := de.value
+		path := strings.Split(column, format.sep)
+		for _, p := range path[:len(path)-1] {
+			sub, ok := m[p].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				m[p] = sub
+			}
+			m = sub
+		}
+		m[path[len(path)-1]] = v
+	}
+	return de, nil
+}
+
+type jsonImportReader struct {
+	d     *json.Decoder
+	types map[string]string
+}
+
+// newJSONImportReader reads records of the array written by the JSON export writer,
+// or of the lines written by the JSON lines one
+func newJSONImportReader(r io.Reader, types map[string]string, array bool) (*jsonImportReader, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	if !array {
+		return &jsonImportReader{d: d, types: types}, nil
+	}
+
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		return nil, fmt.Errorf("Expected a JSON array of records")
+	}
+
+	return &jsonImportReader{d: d, types: types}, nil
+}
+
+func (format *jsonImportReader) ReadRecord() (*dynamicEntity, error) {
+	if !format.d.More() {
+		return nil, io.EOF
+	}
+
+	var m map[string]interface{}
+	if err := format.d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	v, err := format.convert("", m)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamicEntity{value: v.(map[string]interface{})}, nil
+}
+
+// convert turns JSON numbers into int64 or float64 and applies --types to the
+// properties, path is the property name as a CSV column
+func (format *jsonImportReader) convert(path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if format.types[path] != "entity" {
+			if c, ok := fromWrappedValue(v); ok {
+				return c, nil
+			}
+		}
+
+		for name, sub := range v {
+			p := name
+			if path != "" {
+				p = path + ":" + name
+			}
+
+			c, err := format.convert(p, sub)
+			if err != nil {
+				return nil, err
+			}
+			v[name] = c
+		}
+		return v, nil
+	case []interface{}:
+		for i, sub := range v {
+			c, err := format.convert(path, sub)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+		return v, nil
+	case json.Number:
+		if format.types[path] == "float" {
+			return v.Float64()
+		}
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case string:
+		// timestamps are written as RFC 3339 strings by export-kind, --types x:string keeps them strings
+		if _, typed := format.types[path]; !typed {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t, nil
+			}
+		}
+
+		c, err := parseColumnValue(v, format.types[path])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse property %s: %w", path, err)
+		}
+		return c, nil
+	default:
+		return value, nil
+	}
+}
+
+// fromWrappedValue restores geo points, binary values and keys written by export-kind
+// as {"lat": ..., "lng": ...}, {"base64": ...} and --key-ref-format structured objects,
+// lat/lng objects out of the range of geo points stay embedded entities
+func fromWrappedValue(m map[string]interface{}) (interface{}, bool) {
+	if k, ok := fromKeyRef(m); ok {
+		return k, true
+	}
+
+	switch len(m) {
+	case 1:
+		s, ok := m["base64"].(string)
+		if !ok {
+			return nil, false
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		return b, err == nil
+	case 2:
+		lat, ok1 := m["lat"].(json.Number)
+		lng, ok2 := m["lng"].(json.Number)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+
+		var g datastore.GeoPoint
+		var err1, err2 error
+		g.Lat, err1 = lat.Float64()
+		g.Lng, err2 = lng.Float64()
+		return g, err1 == nil && err2 == nil && g.Valid()
+	default:
+		return nil, false
+	}
+}
+
+// fromKeyRef restores a key written as {"kind": ..., "path": ..., "id"|"name": ...}
+// with an optional namespace
+func fromKeyRef(m map[string]interface{}) (*datastore.Key, bool) {
+	kind, ok1 := m["kind"].(string)
+	path, ok2 := m["path"].(string)
+	_, hasID := m["id"]
+	_, hasName := m["name"]
+	if !ok1 || !ok2 || hasID == hasName {
+		return nil, false
+	}
+
+	fields := 3
+	namespace, ok := m["namespace"].(string)
+	if ok {
+		fields++
+	}
+	if len(m) != fields {
+		return nil, false
+	}
+
+	k, err := parseFullKeyPath(path, namespace)
+	if err != nil || k.Kind != kind {
+		return nil, false
+	}
+	return k, true
+}
+
+func parseColumnValue(s string, typ string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	case "time":
+		return time.Parse(time.RFC3339Nano, s)
+	case "key":
+		// a Kind:id/Kind:name path as --key-ref-format id writes for keys with ancestors, or an encoded key
+		if strings.Contains(s, ":") {
+			return parseFullKeyPath(s, "")
+		}
+		return datastore.DecodeKey(s)
+	default:
+		return s, nil
+	}
+}
+
+// toProperties converts exported values back into datastore properties
+func toProperties(m map[string]interface{}) []datastore.Property {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props := make([]datastore.Property, 0, len(m))
+	for _, name := range names {
+		v := toDatastoreValue(m[name])
+		// strings longer than 1500 bytes can't be indexed
+		s, long := v.(string)
+		props = append(props, datastore.Property{Name: name, Value: v, NoIndex: long && len(s) > 1500})
+	}
+	return props
+}
+
+func toDatastoreValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return &datastore.Entity{Properties: toProperties(v)}
+	case []interface{}:
+		f := make([]interface{}, 0, len(v))
+		for _, pp := range v {
+			f = append(f, toDatastoreValue(pp))
+		}
+		return f
+	default:
+		return value
+	}
+}
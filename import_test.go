@@ -0,0 +1,269 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFromWrappedValue(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want interface{}
+		ok   bool
+	}{
+		{"geopoint", `{"lat": 52.52, "lng": 13.405}`, datastore.GeoPoint{Lat: 52.52, Lng: 13.405}, true},
+		{"integer geopoint", `{"lat": 0, "lng": -180}`, datastore.GeoPoint{Lat: 0, Lng: -180}, true},
+		{"latitude out of range", `{"lat": 120, "lng": 13}`, nil, false},
+		{"longitude out of range", `{"lat": 52, "lng": 200}`, nil, false},
+		{"string coordinates", `{"lat": "52.52", "lng": "13.405"}`, nil, false},
+		{"more properties", `{"lat": 52.52, "lng": 13.405, "name": "Berlin"}`, nil, false},
+		{"other properties", `{"x": 1, "y": 2}`, nil, false},
+		{"base64", `{"base64": "aGkA"}`, []byte("hi\x00"), true},
+		{"invalid base64", `{"base64": "not base64!"}`, nil, false},
+		{"base64 number", `{"base64": 12}`, nil, false},
+		{"key", `{"kind": "User", "path": "Shop:\"42\"/User:7", "id": 7}`, datastore.IDKey("User", 7, datastore.NameKey("Shop", "42", nil)), true},
+		{"key of other kind", `{"kind": "User", "path": "Shop:1", "id": 1}`, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := json.NewDecoder(strings.NewReader(tt.json))
+			d.UseNumber()
+			var m map[string]interface{}
+			if err := d.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := fromWrappedValue(m)
+			if ok != tt.ok {
+				t.Fatalf("fromWrappedValue(%s) converted = %v, want %v", tt.json, ok, tt.ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fromWrappedValue(%s) = %#v, want %#v", tt.json, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportJSONEntityType(t *testing.T) {
+	types, err := parseColumnTypes("place:entity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newJSONImportReader(strings.NewReader(`[{"place": {"lat": 1, "lng": 2}, "home": {"lat": 3, "lng": 4}}]`), types, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	de, err := r.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := de.value["place"].(map[string]interface{}); !ok {
+		t.Errorf("place = %#v, want an embedded entity", de.value["place"])
+	}
+	if _, ok := de.value["home"].(datastore.GeoPoint); !ok {
+		t.Errorf("home = %#v, want a geo point", de.value["home"])
+	}
+}
+
+func TestImportRetriedCommit(t *testing.T) {
+	fake := startFakeDatastore(t, nil)
+	// the first commit is applied but fails like a response lost on the way back
+	fake.failCommits = 1
+
+	file := filepath.Join(t.TempDir(), "items.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"name": "a"}, {"name": "b"}, {"name": "c"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &ImportKindCmd{}
+	if err := parseOptions(cmd, map[string]interface{}{"project": "test", "kind": "Item", "file": file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.run(context.Background()); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	if fake.failCommits != 0 {
+		t.Fatalf("the failing commit wasn't made")
+	}
+	if len(fake.entities) != 3 {
+		t.Errorf("the retried batch left %d entities, want 3", len(fake.entities))
+	}
+}
+
+func TestPutWriterRetriedCommit(t *testing.T) {
+	fake := startFakeDatastore(t, nil)
+	fake.failCommits = 1
+
+	ctx := context.Background()
+	client, err := newClient(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	w := NewPutWriter(client, 500, 3)
+	for _, name := range []string{"a", "b"} {
+		props := datastore.PropertyList{{Name: "name", Value: name}}
+		if err := w.WriteEntity(ctx, datastore.IncompleteKey("Item", nil), props); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if len(fake.entities) != 2 {
+		t.Errorf("the retried batch left %d entities, want 2", len(fake.entities))
+	}
+}
+
+func TestImportKeyParentRoundTrip(t *testing.T) {
+	child := func(id int64, ancestors ...*pb.Key_PathElement) *pb.Entity {
+		e := fakeEntity("Item", id, map[string]interface{}{"n": id})
+		e.Key.Path = append(ancestors, e.Key.Path...)
+		return e
+	}
+	named := func(kind, name string) *pb.Key_PathElement {
+		return &pb.Key_PathElement{Kind: kind, IdType: &pb.Key_PathElement_Name{Name: name}}
+	}
+	entities := []*pb.Entity{
+		child(1, named("Shop", "42")),
+		child(2, named("Shop", "a/b:c")),
+		child(3, named("Org", "100%"), named("Shop:Old", `"x"`)),
+		child(4, &pb.Key_PathElement{Kind: "Shop", IdType: &pb.Key_PathElement_Id{Id: 42}}),
+	}
+	out, fake := runTestExport(t, entities, map[string]interface{}{"format": "jsonl"})
+
+	for _, keepEncoded := range []bool{true, false} {
+		t.Run(fmt.Sprintf("encoded %v", keepEncoded), func(t *testing.T) {
+			var lines []string
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				var rec map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &rec); err != nil {
+					t.Fatal(err)
+				}
+				if !keepEncoded {
+					delete(rec["__key__"].(map[string]interface{}), "encoded")
+				}
+				b, _ := json.Marshal(rec)
+				lines = append(lines, string(b))
+			}
+			file := filepath.Join(t.TempDir(), "items.jsonl")
+			if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fake.entities = nil
+			cmd := &ImportKindCmd{}
+			if err := parseOptions(cmd, map[string]interface{}{"project": "test", "kind": "Item", "file": file}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.run(context.Background()); err != nil {
+				t.Fatalf("import: %v", err)
+			}
+
+			if len(fake.entities) != len(entities) {
+				t.Fatalf("imported %d entities, want %d", len(fake.entities), len(entities))
+			}
+			for i, e := range fake.entities {
+				got, want := e.Key.Path, entities[i].Key.Path
+				if !reflect.DeepEqual(fmt.Sprint(got), fmt.Sprint(want)) {
+					t.Errorf("imported key %v, want %v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyPathRoundTrip(t *testing.T) {
+	keys := []*datastore.Key{
+		datastore.IDKey("Item", 1, datastore.NameKey("Shop", "42", nil)),
+		datastore.NameKey("Item", "7", datastore.IDKey("Shop", 7, nil)),
+		datastore.NameKey("Item", "x/y", datastore.NameKey("Shop", "a:b", nil)),
+		datastore.NameKey("Item", "50%off", datastore.NameKey("Shop", `"q"`, nil)),
+	}
+	for _, k := range keys {
+		path := keyPath(k)
+		got, err := parseFullKeyPath(path, "")
+		if err != nil {
+			t.Errorf("parseFullKeyPath(%s): %v", path, err)
+			continue
+		}
+		if !got.Equal(k) {
+			t.Errorf("parseFullKeyPath(%s) = %v, want %v", path, got, k)
+		}
+	}
+}
+
+func TestImportJSONRoundTrip(t *testing.T) {
+	// the project of key values is left to the server
+	ref := &pb.Key{
+		Path: []*pb.Key_PathElement{
+			{Kind: "Shop", IdType: &pb.Key_PathElement_Name{Name: "42"}},
+			{Kind: "User", IdType: &pb.Key_PathElement_Id{Id: 7}},
+		},
+	}
+	created := time.Date(2023, 5, 1, 12, 30, 0, 123000000, time.UTC)
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{
+			"created": created,
+			"price":   2.0,
+			"ratio":   0.25,
+			"count":   3,
+			"owner":   ref,
+			"data":    []byte{0, 1, 2},
+			"label":   "2023 edition",
+			"nested":  []interface{}{1.0, "x"},
+		}),
+	}
+
+	for _, format := range []string{"json", "jsonl"} {
+		t.Run(format, func(t *testing.T) {
+			out, fake := runTestExport(t, entities, map[string]interface{}{"format": format, "key-ref-format": "structured"})
+			file := filepath.Join(t.TempDir(), "items."+format)
+			if err := ioutil.WriteFile(file, []byte(out), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fake.entities = nil
+			cmd := &ImportKindCmd{}
+			if err := parseOptions(cmd, map[string]interface{}{"project": "test", "kind": "Item", "file": file}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.run(context.Background()); err != nil {
+				t.Fatalf("import: %v", err)
+			}
+			if len(fake.entities) != 1 {
+				t.Fatalf("imported %d entities, want 1", len(fake.entities))
+			}
+
+			got, want := fake.entities[0].Properties, entities[0].Properties
+			for name, w := range want {
+				g := got[name]
+				// the index flags are set by import-kind
+				g.ExcludeFromIndexes = w.ExcludeFromIndexes
+				if !proto.Equal(g, w) {
+					t.Errorf("property %s imported as %v, want %v", name, g, w)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("imported %d properties, want %d", len(got), len(want))
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package cdskit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type indexProperty struct {
+	name string
+	desc bool
+}
+
+// compositeIndex returns the properties of the composite index the export query needs,
+// or nil when it's served by the built-in single property indexes.
+//
+// The index lists the properties of equality filters first, then the property of the
+// inequality filter and the orders, as Datastore requires.
+func (cmd *ExportKindCmd) compositeIndex() []indexProperty {
+	var props []indexProperty
+	seen := make(map[string]bool)
+	add := func(p indexProperty) {
+		// ascending key order is implied by every index
+		if seen[p.name] || (p.name == "__key__" && !p.desc) {
+			return
+		}
+		seen[p.name] = true
+		props = append(props, p)
+	}
+
+	for _, f := range cmd.filters {
+		if !f.inequality() {
+			add(indexProperty{name: f.field})
+		}
+	}
+	equalities := len(props)
+
+	var orders []indexProperty
+	for _, o := range cmd.OrderBy {
+		name := strings.TrimSpace(o)
+		desc := strings.HasPrefix(name, "-")
+		orders = append(orders, indexProperty{name: strings.TrimPrefix(name, "-"), desc: desc})
+	}
+	for _, f := range cmd.filters {
+		if f.inequality() {
+			p := indexProperty{name: f.field}
+			if len(orders) > 0 && orders[0].name == f.field {
+				p.desc = orders[0].desc
+			}
+			add(p)
+			break
+		}
+	}
+	for _, o := range orders {
+		add(o)
+	}
+
+	// equality filters alone are served by merging the built-in indexes,
+	// ancestor queries need a composite index for any other filter or order
+	if len(props) == equalities || (len(props) < 2 && cmd.Ancestor == "") {
+		return nil
+	}
+	return props
+}
+
+// emitIndexYAML writes the composite index definition in the index.yaml format used by gcloud
+func (cmd *ExportKindCmd) emitIndexYAML(path string) error {
+	props := cmd.compositeIndex()
+	if props == nil {
+		infof("Export query doesn't need a composite index, %s is not written", path)
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("indexes:\n")
+	fmt.Fprintf(&sb, "- kind: %s\n", cmd.Kind)
+	if cmd.Ancestor != "" {
+		sb.WriteString("  ancestor: yes\n")
+	}
+	sb.WriteString("  properties:\n")
+	for _, p := range props {
+		fmt.Fprintf(&sb, "  - name: %s\n", p.name)
+		if p.desc {
+			sb.WriteString("    direction: desc\n")
+		}
+	}
+
+	infof("Writing composite index definition to %s", path)
+	return ioutil.WriteFile(path, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,50 @@
+package cdskit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompositeIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		filters  []string
+		orderBy  []string
+		ancestor string
+		want     []indexProperty
+	}{
+		{"no filters or orders", nil, nil, "", nil},
+		{"single order", nil, []string{"-created"}, "", nil},
+		{"key order", nil, []string{"__key__"}, "", nil},
+		{"equality filters", []string{"status=active", "type=user"}, nil, "", nil},
+		{"inequality filter", []string{"age>18"}, nil, "", nil},
+		{"two orders", nil, []string{"name", "-created"}, "", []indexProperty{{"name", false}, {"created", true}}},
+		{"equality filter and order", []string{"status=active"}, []string{"-created"}, "", []indexProperty{{"status", false}, {"created", true}}},
+		{"equality filter and key order", []string{"status=active"}, []string{"-__key__"}, "", []indexProperty{{"status", false}, {"__key__", true}}},
+		{"equality and inequality filters", []string{"age>=18", "status=active"}, nil, "", []indexProperty{{"status", false}, {"age", false}}},
+		{"inequality filter and orders", []string{"age>18"}, []string{"-age", "name"}, "", []indexProperty{{"age", true}, {"name", false}}},
+		{"all combined", []string{"status=active", "age<65"}, []string{"age", "-created"}, "", []indexProperty{{"status", false}, {"age", false}, {"created", true}}},
+		{"equality filter on the order", []string{"status=active"}, []string{"status"}, "", nil},
+		{"ancestor only", nil, nil, "Parent:1", nil},
+		{"ancestor and equality filter", []string{"status=active"}, nil, "Parent:1", nil},
+		{"ancestor and order", nil, []string{"-created"}, "Parent:1", []indexProperty{{"created", true}}},
+		{"ancestor and inequality filter", []string{"age>18"}, nil, "Parent:1", []indexProperty{{"age", false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &ExportKindCmd{OrderBy: tt.orderBy, Ancestor: tt.ancestor}
+			for _, s := range tt.filters {
+				f, err := parseFilter(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cmd.filters = append(cmd.filters, f)
+			}
+
+			if got := cmd.compositeIndex(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compositeIndex() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
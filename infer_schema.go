@@ -0,0 +1,249 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// InferSchemaCmd reports the properties observed in the entities of a kind
+type InferSchemaCmd struct {
+	ProjectID  string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace  string `short:"n" long:"namespace" description:"Namespace of the kind"`
+	Kind       string `short:"k" long:"kind" description:"Kind to describe" required:"true"`
+	Sample     int    `long:"sample" default:"1000" description:"Number of entities to read, 0 scans the whole kind"`
+	Examples   int    `long:"examples" default:"3" description:"Number of distinct example values shown per property"`
+	JSON       bool   `long:"json" description:"Print the schema as JSON instead of a table"`
+	MaxRetries int    `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// inferredSchema is the report printed by infer-schema
+type inferredSchema struct {
+	Kind       string              `json:"kind"`
+	Namespace  string              `json:"namespace"`
+	Entities   int                 `json:"entities"`
+	Properties []*inferredProperty `json:"properties"`
+
+	byName map[string]*inferredProperty
+}
+
+// inferredProperty describes a property, nested properties are named parent:child
+// as CSV columns are
+type inferredProperty struct {
+	Name string `json:"name"`
+	// Types counts values by datastore type, elements of lists are counted in List
+	Types     map[string]int `json:"types"`
+	Present   int            `json:"present"`
+	Nulls     int            `json:"nulls"`
+	Nullable  bool           `json:"nullable"`
+	Unindexed int            `json:"unindexed"`
+	List      *inferredList  `json:"list,omitempty"`
+	Examples  []string       `json:"examples,omitempty"`
+}
+
+// inferredList is the cardinality of a list property
+type inferredList struct {
+	MinLength    int            `json:"min_length"`
+	MaxLength    int            `json:"max_length"`
+	ElementTypes map[string]int `json:"element_types"`
+}
+
+// Execute is called by go-flags
+func (cmd *InferSchemaCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	schema := &inferredSchema{Kind: cmd.Kind, Namespace: cmd.Namespace, byName: make(map[string]*inferredProperty)}
+
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace)
+	var start datastore.Cursor
+	for cmd.Sample == 0 || schema.Entities < cmd.Sample {
+		limit := 500
+		if cmd.Sample > 0 && cmd.Sample-schema.Entities < limit {
+			limit = cmd.Sample - schema.Entities
+		}
+
+		var batch []datastore.PropertyList
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			batch = nil
+			it := dsClient.Run(ctx, q.Start(start).Limit(limit))
+			for {
+				var props datastore.PropertyList
+				_, err := it.Next(&props)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				batch = append(batch, props)
+			}
+
+			var err error
+			start, err = it.Cursor()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", cmd.Kind, err)
+		}
+
+		for _, props := range batch {
+			schema.Entities++
+			cmd.walk(schema, "", props, make(map[string]bool))
+		}
+		infof("Reading %s - %d", cmd.Kind, schema.Entities)
+
+		if len(batch) < limit {
+			break
+		}
+	}
+
+	sort.Slice(schema.Properties, func(i, j int) bool { return schema.Properties[i].Name < schema.Properties[j].Name })
+	for _, p := range schema.Properties {
+		p.Nullable = p.Nulls > 0 || p.Present < schema.Entities
+	}
+
+	if cmd.JSON {
+		b, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	return schema.print()
+}
+
+// walk adds the properties of an entity, seen keeps the properties counted as present
+func (cmd *InferSchemaCmd) walk(schema *inferredSchema, parent string, props []datastore.Property, seen map[string]bool) {
+	for _, p := range props {
+		name := p.Name
+		if parent != "" {
+			name = parent + ":" + p.Name
+		}
+
+		ip := schema.byName[name]
+		if ip == nil {
+			ip = &inferredProperty{Name: name, Types: make(map[string]int)}
+			schema.byName[name] = ip
+			schema.Properties = append(schema.Properties, ip)
+		}
+		if !seen[name] {
+			seen[name] = true
+			ip.Present++
+		}
+		if p.NoIndex {
+			ip.Unindexed++
+		}
+
+		ip.Types[datastoreType(p.Value)]++
+		values := []interface{}{p.Value}
+		if arr, ok := p.Value.([]interface{}); ok {
+			if ip.List == nil {
+				ip.List = &inferredList{MinLength: len(arr), ElementTypes: make(map[string]int)}
+			}
+			if len(arr) < ip.List.MinLength {
+				ip.List.MinLength = len(arr)
+			}
+			if len(arr) > ip.List.MaxLength {
+				ip.List.MaxLength = len(arr)
+			}
+			for _, e := range arr {
+				ip.List.ElementTypes[datastoreType(e)]++
+			}
+			values = arr
+		}
+
+		for _, v := range values {
+			switch v := v.(type) {
+			case nil:
+				ip.Nulls++
+			case *datastore.Entity:
+				cmd.walk(schema, name, v.Properties, seen)
+			default:
+				cmd.addExample(ip, v)
+			}
+		}
+	}
+}
+
+// addExample keeps distinct values rendered as they are exported, long ones are shortened
+func (cmd *InferSchemaCmd) addExample(ip *inferredProperty, v interface{}) {
+	if len(ip.Examples) >= cmd.Examples {
+		return
+	}
+
+	b, err := json.Marshal(defaultValueOptions.toExportValue(v))
+	if err != nil {
+		return
+	}
+	s := string(b)
+	if r := []rune(s); len(r) > 60 {
+		s = string(r[:57]) + "..."
+	}
+
+	for _, e := range ip.Examples {
+		if e == s {
+			return
+		}
+	}
+	ip.Examples = append(ip.Examples, s)
+}
+
+// print writes the schema as a table
+func (schema *inferredSchema) print() error {
+	fmt.Printf("%d entities of %s/%s\n", schema.Entities, schema.Namespace, schema.Kind)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROPERTY\tTYPES\tPRESENT\tNULLABLE\tINDEXED\tLIST\tEXAMPLES")
+	for _, p := range schema.Properties {
+		list := "-"
+		if p.List != nil {
+			list = fmt.Sprintf("%d..%d of %s", p.List.MinLength, p.List.MaxLength, typeCounts(p.List.ElementTypes))
+		}
+
+		indexed := "yes"
+		if p.Unindexed > 0 {
+			indexed = "no"
+			if p.Unindexed < p.Present {
+				indexed = "partly"
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%t\t%s\t%s\t%s\n", p.Name, typeCounts(p.Types), p.Present, schema.Entities, p.Nullable, indexed, list, strings.Join(p.Examples, ", "))
+	}
+	return tw.Flush()
+}
+
+// typeCounts renders the types ordered by their counts, e.g. string(90),int(10)
+func typeCounts(types map[string]int) string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if types[names[i]] != types[names[j]] {
+			return types[names[i]] > types[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s(%d)", name, types[name]))
+	}
+	return strings.Join(parts, ",")
+}
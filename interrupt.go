@@ -0,0 +1,40 @@
+package cdskit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// ErrInterrupted is returned by commands stopped by an interrupt after writing partial results
+var ErrInterrupted = errors.New("Interrupted")
+
+// interruptible returns a context cancelled on the first interrupt or at --timeout,
+// a second interrupt terminates the process as usual
+func interruptible(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var deadline <-chan time.Time
+	if !runDeadline.IsZero() {
+		deadline = time.After(time.Until(runDeadline))
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		select {
+		case <-ch:
+			warnf("Interrupted, finishing the output")
+			cancel()
+		case <-deadline:
+			warnf("Stopped by --timeout, finishing the output")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,142 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// exportJoin inlines fields of a referenced entity of another kind
+type exportJoin struct {
+	kind   string
+	field  string
+	fields []string
+	alias  string
+
+	cache map[string]*dynamicEntity
+}
+
+var joinPattern = regexp.MustCompile(`^([^:]+):([^:]+):([^:]+)->(.+)$`)
+
+// parseJoin parses lookupKind:localField:remoteFields->alias given by --join,
+// remote fields are comma separated or * for all of them.
+func parseJoin(s string) (*exportJoin, error) {
+	m := joinPattern.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("Invalid join, expected lookupKind:localField:remoteFields->alias: %s", s)
+	}
+
+	j := &exportJoin{kind: m[1], field: m[2], alias: m[4], cache: make(map[string]*dynamicEntity)}
+	if m[3] != "*" {
+		j.fields = strings.Split(m[3], ",")
+	}
+	return j, nil
+}
+
+// lookupKey returns the key of the referenced entity. Besides key-valued properties
+// the local field may hold a name or a numeric ID of an entity of the lookup kind.
+func (j *exportJoin) lookupKey(de *dynamicEntity) *datastore.Key {
+	if k, ok := de.refs[j.field]; ok {
+		return k
+	}
+
+	var ns string
+	if de.key != nil {
+		ns = de.key.Namespace
+	}
+
+	var k *datastore.Key
+	switch v := de.value[j.field].(type) {
+	case int64:
+		k = datastore.IDKey(j.kind, v, nil)
+	case string:
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			k = datastore.IDKey(j.kind, id, nil)
+		} else if v != "" {
+			k = datastore.NameKey(j.kind, v, nil)
+		}
+	}
+
+	if k != nil {
+		k.Namespace = ns
+	}
+	return k
+}
+
+// resolve fetches the referenced entities missing from the cache and inlines them
+func (j *exportJoin) resolve(ctx context.Context, client *datastore.Client, batch []*dynamicEntity, opts *valueOptions) error {
+	var missing []*datastore.Key
+	seen := make(map[string]bool)
+	for _, de := range batch {
+		k := j.lookupKey(de)
+		if k == nil {
+			continue
+		}
+
+		ek := k.Encode()
+		if _, ok := j.cache[ek]; ok || seen[ek] {
+			continue
+		}
+		seen[ek] = true
+		missing = append(missing, k)
+	}
+
+	// GetMulti accepts at most 1000 keys per call
+	for i := 0; i < len(missing); i += 1000 {
+		keys := missing[i:min(i+1000, len(missing))]
+		found := make([]*dynamicEntity, len(keys))
+		for n := range found {
+			found[n] = &dynamicEntity{opts: opts}
+		}
+
+		err := client.GetMulti(ctx, keys, found)
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return fmt.Errorf("Unable to load %s: %w", j.kind, err)
+		}
+
+		for n, k := range keys {
+			if merr != nil && merr[n] != nil {
+				if merr[n] != datastore.ErrNoSuchEntity {
+					return fmt.Errorf("Unable to load %s: %w", k, merr[n])
+				}
+				j.cache[k.Encode()] = nil
+				continue
+			}
+			j.cache[k.Encode()] = found[n]
+		}
+	}
+
+	for _, de := range batch {
+		k := j.lookupKey(de)
+		if k == nil {
+			continue
+		}
+
+		if ref := j.cache[k.Encode()]; ref != nil {
+			de.value[j.alias] = j.project(ref)
+		}
+	}
+	return nil
+}
+
+func (j *exportJoin) project(ref *dynamicEntity) map[string]interface{} {
+	v := make(map[string]interface{})
+	if j.fields == nil {
+		for name, val := range ref.value {
+			v[name] = val
+		}
+		return v
+	}
+
+	for _, name := range j.fields {
+		if val, ok := ref.value[name]; ok {
+			v[name] = val
+		}
+	}
+	return v
+}
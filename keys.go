@@ -0,0 +1,180 @@
+package cdskit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// keyList is a list of keys exported with GetMulti instead of a query
+type keyList struct {
+	keys    []*datastore.Key
+	pos     int
+	missing []*datastore.Key
+}
+
+// readKeysFile reads one key per line given by --keys-file. A line is a name or an ID
+// of an entity of the exported kind, optionally preceded by the ancestor path,
+// e.g. Parent:42/abc. Empty lines and lines starting with # are ignored.
+func readKeysFile(path string, kind string, namespace string) (*keyList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &keyList{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, err := parseKeyPath(line, kind, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key at %s:%d: %w", path, n, err)
+		}
+		l.keys = append(l.keys, k)
+	}
+	return l, s.Err()
+}
+
+// parseKeyPath parses Kind:id/Kind:name elements as written by keyPath, the kind of
+// the last element may be omitted.
+func parseKeyPath(s string, kind string, namespace string) (*datastore.Key, error) {
+	var k *datastore.Key
+	elems := strings.Split(s, "/")
+	for i, e := range elems {
+		elemKind, id := kind, e
+		if n := strings.Index(e, ":"); n >= 0 {
+			elemKind, id = unescapeKeyElem(e[:n]), e[n+1:]
+		} else if i < len(elems)-1 {
+			return nil, fmt.Errorf("ancestor %q has no kind", e)
+		}
+
+		if elemKind == "" || id == "" {
+			return nil, fmt.Errorf("empty kind or id in %q", e)
+		}
+
+		if len(id) >= 2 && strings.HasPrefix(id, `"`) && strings.HasSuffix(id, `"`) {
+			k = datastore.NameKey(elemKind, unescapeKeyElem(id[1:len(id)-1]), k)
+		} else if v, err := strconv.ParseInt(id, 10, 64); err == nil {
+			k = datastore.IDKey(elemKind, v, k)
+		} else {
+			k = datastore.NameKey(elemKind, unescapeKeyElem(id), k)
+		}
+		k.Namespace = namespace
+	}
+
+	if k.Kind != kind {
+		return nil, fmt.Errorf("key of kind %s, expected %s", k.Kind, kind)
+	}
+	return k, nil
+}
+
+// parseFullKeyPath parses a key path with the kind of every element given
+func parseFullKeyPath(s string, namespace string) (*datastore.Key, error) {
+	kind := s[strings.LastIndex(s, "/")+1:]
+	if n := strings.Index(kind, ":"); n >= 0 {
+		kind = unescapeKeyElem(kind[:n])
+	} else {
+		return nil, fmt.Errorf("%q has no kind", kind)
+	}
+	return parseKeyPath(s, kind, namespace)
+}
+
+var keyElemEscaper = strings.NewReplacer("%", "%25", "/", "%2F", ":", "%3A", `"`, "%22")
+
+// escapeKeyElem escapes the characters of a kind or name separating the elements of a key path
+func escapeKeyElem(s string) string {
+	return keyElemEscaper.Replace(s)
+}
+
+// unescapeKeyElem reverses escapeKeyElem, text that isn't escaped, e.g. a name with a
+// literal % typed by hand, is kept as it is
+func unescapeKeyElem(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// parseAncestor parses --ancestor given as a Kind:id/Kind:name path, a Kind/id/Kind/name
+// path or an encoded key, the key is moved to the namespace of the command
+func parseAncestor(s string, namespace string) (*datastore.Key, error) {
+	if strings.Contains(s, ":") {
+		return parseFullKeyPath(s, namespace)
+	}
+
+	if parts := strings.Split(s, "/"); len(parts) >= 2 && len(parts)%2 == 0 {
+		elems := make([]string, 0, len(parts)/2)
+		for i := 0; i < len(parts); i += 2 {
+			elems = append(elems, parts[i]+":"+parts[i+1])
+		}
+		return parseFullKeyPath(strings.Join(elems, "/"), namespace)
+	}
+
+	k, err := datastore.DecodeKey(s)
+	if err != nil {
+		return nil, fmt.Errorf("expected a Kind:id path, Kind/id path or encoded key")
+	}
+	return remapKey(k, k.Kind, namespace), nil
+}
+
+// next loads up to size keys, at most 1000 as GetMulti accepts per call. Keys without
+// an entity are collected in missing.
+func (l *keyList) next(ctx context.Context, client *datastore.Client, opts *valueOptions, size int) ([]*dynamicEntity, bool, error) {
+	if l.pos >= len(l.keys) {
+		return nil, true, nil
+	}
+
+	keys := l.keys[l.pos:min(l.pos+min(size, 1000), len(l.keys))]
+
+	// a failed batch is attempted again on the next call
+	batch, missing, err := getEntities(ctx, client, keys, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	l.pos += len(keys)
+	l.missing = append(l.missing, missing...)
+	return batch, false, nil
+}
+
+// getEntities loads entities of at most 1000 keys, keys without an entity are returned
+// separately.
+func getEntities(ctx context.Context, client *datastore.Client, keys []*datastore.Key, opts *valueOptions) ([]*dynamicEntity, []*datastore.Key, error) {
+	found := make([]*dynamicEntity, len(keys))
+	for n := range found {
+		found[n] = &dynamicEntity{opts: opts}
+	}
+
+	err := client.GetMulti(ctx, keys, found)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, nil, err
+	}
+
+	var missing []*datastore.Key
+	batch := make([]*dynamicEntity, 0, len(keys))
+	for n, k := range keys {
+		if merr != nil && merr[n] != nil {
+			if merr[n] != datastore.ErrNoSuchEntity {
+				return nil, nil, fmt.Errorf("Unable to load %s: %w", k, merr[n])
+			}
+			missing = append(missing, k)
+			continue
+		}
+
+		found[n].key = k
+		batch = append(batch, found[n])
+	}
+	return batch, missing, nil
+}
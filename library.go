@@ -0,0 +1,205 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/datastore"
+)
+
+// EntityReader reads entities one after another, ReadEntity returns io.EOF after the last one
+type EntityReader interface {
+	ReadEntity(ctx context.Context) (*datastore.Key, datastore.PropertyList, error)
+}
+
+// EntityWriter writes entities, Close writes the entities it still buffers
+type EntityWriter interface {
+	WriteEntity(ctx context.Context, key *datastore.Key, props datastore.PropertyList) error
+	Close(ctx context.Context) error
+}
+
+// Importer is the import-kind command used as a library, its fields are the command options
+type Importer = ImportKindCmd
+
+// NewImporter returns an import of the file into the kind with the defaults of the import-kind options
+func NewImporter(projectID string, kind string, file string) (*Importer, error) {
+	imp := &Importer{}
+	if err := parseOptions(imp, map[string]interface{}{"project": projectID, "kind": kind, "file": file}); err != nil {
+		return nil, err
+	}
+	return imp, nil
+}
+
+// Import runs the import and returns the number of imported entities, with DryRun the
+// number that would be imported, progress is logged as by the command
+func Import(ctx context.Context, opts *Importer) (int, error) {
+	err := opts.run(ctx)
+	return opts.imported, err
+}
+
+// Deleter is the delete-all command used as a library, its fields are the command options
+type Deleter = DeleteAllCmd
+
+// NewDeleter returns a deletion in the project with the defaults of the delete-all options,
+// set Namespaces and Kinds to limit it
+func NewDeleter(projectID string) (*Deleter, error) {
+	d := &Deleter{}
+	if err := parseOptions(d, map[string]interface{}{"project": projectID}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteAll runs the deletion without asking for confirmation and returns the number of
+// deleted entities, with DryRun the number that would be deleted
+func DeleteAll(ctx context.Context, opts *Deleter) (int, error) {
+	cmd := *opts
+	cmd.Yes = true
+	err := cmd.run(ctx)
+	return cmd.deleted, err
+}
+
+// NewQueryReader reads the entities of the query in pages of 500, retrying transient errors,
+// a limit of the query is replaced by the page size
+func NewQueryReader(client *datastore.Client, q *datastore.Query, retries int) EntityReader {
+	return &queryReader{client: client, q: q, retries: retries}
+}
+
+type queryReader struct {
+	client  *datastore.Client
+	q       *datastore.Query
+	retries int
+	start   datastore.Cursor
+	page    []*dynamicEntity
+	done    bool
+}
+
+func (r *queryReader) ReadEntity(ctx context.Context) (*datastore.Key, datastore.PropertyList, error) {
+	if len(r.page) == 0 && !r.done {
+		opts := &valueOptions{raw: true, includeNulls: true}
+		err := withRetries(ctx, r.retries, func() (err error) {
+			r.page, r.start, err = fetchPage(ctx, r.client, r.q.Start(r.start).Limit(500), opts)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		r.done = len(r.page) < 500
+	}
+	if len(r.page) == 0 {
+		return nil, nil, io.EOF
+	}
+
+	de := r.page[0]
+	r.page = r.page[1:]
+	props, err := de.Save()
+	return de.key, props, err
+}
+
+// NewFileReader reads an export of the kind in the format of import-kind, keys of the
+// __key__ field are moved to the kind and namespace, records without one get an incomplete key
+func NewFileReader(r io.Reader, format string, namespace string, kind string) (EntityReader, error) {
+	if format == "" {
+		return nil, fmt.Errorf("The format of the file is required")
+	}
+
+	imp := &ImportKindCmd{Kind: kind, Namespace: namespace, Format: format}
+	ir, err := imp.newImportReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{imp: imp, r: ir}, nil
+}
+
+type fileReader struct {
+	imp *ImportKindCmd
+	r   importReader
+}
+
+func (r *fileReader) ReadEntity(ctx context.Context) (*datastore.Key, datastore.PropertyList, error) {
+	de, err := r.r.ReadRecord()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.imp.restoreKey(de); err != nil {
+		return nil, nil, err
+	}
+	if de.key == nil {
+		de.key = datastore.IncompleteKey(r.imp.Kind, nil)
+		de.key.Namespace = r.imp.Namespace
+	}
+
+	props, err := de.Save()
+	return de.key, props, err
+}
+
+// NewPutWriter writes entities with PutMulti in batches of batchSize, at most 500,
+// retrying transient errors
+func NewPutWriter(client *datastore.Client, batchSize int, retries int) EntityWriter {
+	if batchSize < 1 || batchSize > 500 {
+		batchSize = 500
+	}
+	return &putWriter{client: client, batchSize: batchSize, retries: retries}
+}
+
+type putWriter struct {
+	client    *datastore.Client
+	batchSize int
+	retries   int
+	keys      []*datastore.Key
+	entities  []datastore.PropertyList
+}
+
+func (w *putWriter) WriteEntity(ctx context.Context, key *datastore.Key, props datastore.PropertyList) error {
+	w.keys = append(w.keys, key)
+	w.entities = append(w.entities, props)
+	if len(w.keys) < w.batchSize {
+		return nil
+	}
+	return w.flush(ctx)
+}
+
+func (w *putWriter) flush(ctx context.Context) error {
+	if len(w.keys) == 0 {
+		return nil
+	}
+
+	if err := allocateIDs(ctx, w.client, w.keys, w.retries); err != nil {
+		return err
+	}
+	err := withRetries(ctx, w.retries, func() error {
+		_, err := w.client.PutMulti(ctx, w.keys, w.entities)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to write entities: %w", err)
+	}
+	w.keys, w.entities = w.keys[:0], w.entities[:0]
+	return nil
+}
+
+func (w *putWriter) Close(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// Copy writes all entities of r to w and closes w, it returns the number of entities written
+func Copy(ctx context.Context, r EntityReader, w EntityWriter) (int, error) {
+	n := 0
+	for {
+		key, props, err := r.ReadEntity(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if err := w.WriteEntity(ctx, key, props); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, w.Close(ctx)
+}
@@ -0,0 +1,156 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+)
+
+// ListKindsCmd prints kinds of a namespace
+type ListKindsCmd struct {
+	ProjectID       string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace       string `short:"n" long:"namespace" description:"Namespace to list kinds of"`
+	IncludeInternal bool   `long:"include-internal" description:"Include internal __*__ kinds"`
+	JSON            bool   `long:"json" description:"Print a JSON array with entity counts and sizes from the Datastore statistics, which are updated about once a day"`
+}
+
+// Execute is called by go-flags
+func (cmd *ListKindsCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	var kinds []string
+	if cmd.IncludeInternal {
+		keys, err := dsClient.GetAll(ctx, datastore.NewQuery("__kind__").Namespace(cmd.Namespace).KeysOnly(), nil)
+		if err != nil {
+			return fmt.Errorf("Unable to load list of kinds: %w", err)
+		}
+		for _, k := range keys {
+			kinds = append(kinds, k.Name)
+		}
+	} else {
+		kinds, err = metadataKinds(ctx, dsClient, cmd.Namespace)
+		if err != nil {
+			return fmt.Errorf("Unable to load list of kinds: %w", err)
+		}
+	}
+
+	if cmd.JSON {
+		// statistics of other namespaces are kept in these namespaces under another kind
+		statKind := "__Stat_Kind__"
+		if cmd.Namespace != "" {
+			statKind = "__Stat_Ns_Kind__"
+		}
+
+		stats, err := loadStats(ctx, dsClient, datastore.NewQuery(statKind).Namespace(cmd.Namespace), "kind_name")
+		if err != nil {
+			return err
+		}
+		return printStats(kinds, "kind", stats)
+	}
+
+	for _, kind := range kinds {
+		fmt.Println(kind)
+	}
+	return nil
+}
+
+// ListNamespacesCmd prints namespaces of a project
+type ListNamespacesCmd struct {
+	ProjectID string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	JSON      bool   `long:"json" description:"Print a JSON array with entity counts and sizes from the Datastore statistics, which are updated about once a day"`
+}
+
+// Execute is called by go-flags
+func (cmd *ListNamespacesCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	namespaces, err := metadataNamespaces(ctx, dsClient)
+	if err != nil {
+		return fmt.Errorf("Unable to load list of namespaces: %w", err)
+	}
+
+	if cmd.JSON {
+		stats, err := loadStats(ctx, dsClient, datastore.NewQuery("__Stat_Namespace__"), "subject_namespace")
+		if err != nil {
+			return err
+		}
+		return printStats(namespaces, "namespace", stats)
+	}
+
+	// the default namespace has an empty name and is printed as an empty line
+	for _, ns := range namespaces {
+		fmt.Println(ns)
+	}
+	return nil
+}
+
+// entityStat is the count and size of entities from a statistics entity
+type entityStat struct {
+	Count int64
+	Bytes int64
+}
+
+// loadStats loads statistics entities keyed by the subject property, the statistics
+// are missing until Datastore computes them the first time
+func loadStats(ctx context.Context, client *datastore.Client, q *datastore.Query, subject string) (map[string]entityStat, error) {
+	var entities []datastore.PropertyList
+	if _, err := client.GetAll(ctx, q, &entities); err != nil {
+		return nil, fmt.Errorf("Unable to load statistics: %w", err)
+	}
+
+	stats := make(map[string]entityStat)
+	for _, props := range entities {
+		var name string
+		var stat entityStat
+		for _, p := range props {
+			switch p.Name {
+			case subject:
+				name, _ = p.Value.(string)
+			case "count":
+				stat.Count, _ = p.Value.(int64)
+			case "bytes":
+				stat.Bytes, _ = p.Value.(int64)
+			}
+		}
+		stats[name] = stat
+	}
+	return stats, nil
+}
+
+// printStats prints names with their statistics as a JSON array, count and bytes are
+// null for names without statistics
+func printStats(names []string, field string, stats map[string]entityStat) error {
+	out := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		m := map[string]interface{}{field: name, "count": nil, "bytes": nil}
+		if stat, ok := stats[name]; ok {
+			m["count"], m["bytes"] = stat.Count, stat.Bytes
+		}
+		out = append(out, m)
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,125 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// logLevel orders the messages written to stderr, --verbose adds debug messages
+// and --quiet keeps only warnings and errors
+type logLevel int
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+var logLevelNames = map[logLevel]string{logDebug: "debug", logInfo: "info", logWarn: "warn", logError: "error"}
+
+// logFields are added to the JSON line of a message, text messages don't show them
+type logFields map[string]interface{}
+
+// logger writes the messages of all commands, as text or as JSON lines given by
+// --log-format json for log pipelines
+var logger = &stderrLogger{level: logInfo, out: os.Stderr}
+
+type stderrLogger struct {
+	mu    sync.Mutex
+	level logLevel
+	json  bool
+	out   io.Writer
+}
+
+// SetVerbose adds debug messages, e.g. the timing of every batch
+func SetVerbose() {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.level = logDebug
+}
+
+// SetQuiet drops progress and other informational messages
+func SetQuiet() {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.level = logWarn
+}
+
+// SetLogFormat switches between text and json messages
+func SetLogFormat(format string) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	switch format {
+	case "text":
+		logger.json = false
+	case "json":
+		logger.json = true
+	default:
+		return fmt.Errorf("Unsupported log format %s, expected text or json", format)
+	}
+	return nil
+}
+
+// LogError reports the error a command failed with
+func LogError(err error) {
+	logEvent(logError, nil, "%v", err)
+}
+
+func debugf(format string, args ...interface{}) {
+	logEvent(logDebug, nil, format, args...)
+}
+
+func infof(format string, args ...interface{}) {
+	logEvent(logInfo, nil, format, args...)
+}
+
+// warnf prefixes text messages with Warning
+func warnf(format string, args ...interface{}) {
+	logEvent(logWarn, nil, format, args...)
+}
+
+// logEnabled reports whether messages of the level are written
+func logEnabled(level logLevel) bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return level >= logger.level
+}
+
+// logEvent writes the message, fields are only written to JSON lines
+func logEvent(level logLevel, fields logFields, format string, args ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	if level < logger.level {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if !logger.json {
+		if level == logWarn {
+			msg = "Warning: " + msg
+		}
+		fmt.Fprintln(logger.out, msg)
+		return
+	}
+
+	line := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = logLevelNames[level]
+	line["msg"] = msg
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"time": line["time"], "level": line["level"], "msg": msg})
+	}
+	fmt.Fprintln(logger.out, string(b))
+}
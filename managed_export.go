@@ -0,0 +1,143 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	admin "cloud.google.com/go/datastore/admin/apiv1"
+	adminpb "google.golang.org/genproto/googleapis/datastore/admin/v1"
+)
+
+// ManagedExportCmd starts a server-side export to Cloud Storage using the Datastore Admin API
+type ManagedExportCmd struct {
+	ProjectID  string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespaces string `short:"n" long:"namespaces" description:"Namespaces to export, all namespaces by default"`
+	Kinds      string `short:"k" long:"kinds" description:"Kinds to export, all kinds by default"`
+	OutputURL  string `long:"output-url" description:"Cloud Storage prefix to export to, e.g. gs://bucket/path" required:"true"`
+	SkipKinds  string `long:"skip-kinds" description:"Kinds not to export, comma separated glob patterns, e.g. Session,Log*"`
+	NoWait     bool   `long:"no-wait" description:"Print the operation name and exit without waiting for completion"`
+}
+
+// Execute is called by go-flags
+func (cmd *ManagedExportCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	// export requests of the Admin API client have no database ID
+	if databaseID != "" {
+		return fmt.Errorf("managed-export doesn't support --database, only the default database can be exported")
+	}
+
+	adminClient, err := admin.NewDatastoreAdminClient(ctx, clientOptions...)
+	if err != nil {
+		return err
+	}
+
+	defer adminClient.Close()
+
+	req := &adminpb.ExportEntitiesRequest{
+		ProjectId:       cmd.ProjectID,
+		OutputUrlPrefix: cmd.OutputURL,
+		EntityFilter:    &adminpb.EntityFilter{},
+	}
+
+	if cmd.Kinds != "" {
+		req.EntityFilter.Kinds = strings.Split(cmd.Kinds, ",")
+	}
+	if cmd.Namespaces != "" {
+		req.EntityFilter.NamespaceIds = strings.Split(cmd.Namespaces, ",")
+	}
+
+	if cmd.SkipKinds != "" {
+		if req.EntityFilter.Kinds == nil {
+			req.EntityFilter.Kinds, err = cmd.discoverKinds(ctx, req.EntityFilter.NamespaceIds)
+			if err != nil {
+				return err
+			}
+		}
+
+		req.EntityFilter.Kinds, err = skipKinds(req.EntityFilter.Kinds, cmd.SkipKinds)
+		if err != nil {
+			return err
+		}
+
+		if len(req.EntityFilter.Kinds) == 0 {
+			return fmt.Errorf("No kinds left to export after --skip-kinds %s", cmd.SkipKinds)
+		}
+		infof("Exporting kinds %s", strings.Join(req.EntityFilter.Kinds, ","))
+	}
+
+	op, err := adminClient.ExportEntities(ctx, req)
+	if err != nil {
+		return fmt.Errorf("Unable to start export: %w", err)
+	}
+
+	infof("Started export operation %s", op.Name())
+	if cmd.NoWait {
+		return nil
+	}
+
+	for {
+		resp, err := op.Poll(ctx)
+		if err != nil {
+			return fmt.Errorf("Export operation failed: %w", err)
+		}
+
+		if op.Done() {
+			fmt.Println(resp.OutputUrl)
+			return nil
+		}
+
+		if meta, err := op.Metadata(); err == nil && meta != nil {
+			infof("Exporting %s - entities %d/%d", meta.OutputUrlPrefix,
+				meta.GetProgressEntities().GetWorkCompleted(), meta.GetProgressEntities().GetWorkEstimated())
+		}
+
+		t := time.NewTimer(10 * time.Second)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// discoverKinds returns kinds of all given namespaces, of all namespaces if none is given
+func (cmd *ManagedExportCmd) discoverKinds(ctx context.Context, namespaces []string) ([]string, error) {
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer dsClient.Close()
+
+	if len(namespaces) == 0 {
+		namespaces, err = metadataNamespaces(ctx, dsClient)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	var kinds []string
+	for _, ns := range namespaces {
+		nsKinds, err := metadataKinds(ctx, dsClient, ns)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range nsKinds {
+			if !seen[k] {
+				seen[k] = true
+				kinds = append(kinds, k)
+			}
+		}
+	}
+
+	sort.Strings(kinds)
+	return kinds, nil
+}
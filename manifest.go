@@ -0,0 +1,197 @@
+package cdskit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// exportManifest is written by export-kind --manifest next to the export, it's the
+// integrity evidence checked by verify-manifest
+type exportManifest struct {
+	Tool      string                 `json:"tool"`
+	Version   string                 `json:"version"`
+	Project   string                 `json:"project"`
+	Namespace string                 `json:"namespace"`
+	Kind      string                 `json:"kind"`
+	Format    string                 `json:"format"`
+	Query     map[string]interface{} `json:"query,omitempty"`
+	Started   time.Time              `json:"started"`
+	Finished  time.Time              `json:"finished"`
+	Records   int                    `json:"records"`
+	Files     []manifestFile         `json:"files"`
+}
+
+// manifestFile is a written file, local files are named relative to the manifest
+type manifestFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// manifestOutput hashes the bytes of an output and counts its records
+type manifestOutput struct {
+	file manifestFile
+	hash hash.Hash
+}
+
+func (o *manifestOutput) Write(p []byte) (int, error) {
+	o.hash.Write(p)
+	o.file.Bytes += int64(len(p))
+	return len(p), nil
+}
+
+// manifestWriter counts the records written to an output
+type manifestWriter struct {
+	exportWriter
+	output *manifestOutput
+}
+
+func (w manifestWriter) WriterRecord(de *dynamicEntity) error {
+	if err := w.exportWriter.WriterRecord(de); err != nil {
+		return err
+	}
+	w.output.file.Records++
+	return nil
+}
+
+// manifestQuery returns the options selecting the exported entities
+func (cmd *ExportKindCmd) manifestQuery() map[string]interface{} {
+	q := make(map[string]interface{})
+	set := func(name string, v interface{}, ok bool) {
+		if ok {
+			q[name] = v
+		}
+	}
+	set("filter", cmd.Filters, len(cmd.Filters) > 0)
+	set("field", cmd.Fields, len(cmd.Fields) > 0)
+	set("order-by", cmd.OrderBy, len(cmd.OrderBy) > 0)
+	set("ancestor", cmd.Ancestor, cmd.Ancestor != "")
+	set("limit", cmd.Limit, cmd.Limit > 0)
+	set("offset", cmd.Offset, cmd.Offset > 0)
+	set("keys-only", true, cmd.KeysOnly)
+	set("since", cmd.TimestampField+" > "+cmd.Since, cmd.Since != "")
+	set("since-cursor-file", cmd.SinceCursorFile, cmd.SinceCursorFile != "")
+	set("transform", cmd.Transforms, len(cmd.Transforms) > 0)
+	return q
+}
+
+// writeManifest writes the manifest of the committed outputs to path
+func (cmd *ExportKindCmd) writeManifest(path string, records int) error {
+	manifest := exportManifest{
+		Tool:      "cdskit",
+		Version:   version,
+		Project:   cmd.ProjectID,
+		Namespace: cmd.Namespace,
+		Kind:      cmd.Kind,
+		Format:    cmd.Format,
+		Query:     cmd.manifestQuery(),
+		Started:   cmd.started.UTC(),
+		Finished:  time.Now().UTC(),
+		Records:   records,
+	}
+	for _, o := range cmd.manifest {
+		manifest.Files = append(manifest.Files, o.file)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("Unable to write the manifest: %w", err)
+	}
+
+	infof("Wrote manifest %s", path)
+	return nil
+}
+
+// VerifyManifestCmd checks the files of an export against the checksums of its manifest
+type VerifyManifestCmd struct {
+	Manifest string `short:"m" long:"manifest" description:"Manifest written by export-kind --manifest" required:"true"`
+}
+
+// Execute is called by go-flags
+func (cmd *VerifyManifestCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	b, err := ioutil.ReadFile(cmd.Manifest)
+	if err != nil {
+		return fmt.Errorf("Unable to read the manifest: %w", err)
+	}
+
+	var manifest exportManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("Invalid manifest %s: %w", cmd.Manifest, err)
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("Manifest %s lists no files", cmd.Manifest)
+	}
+
+	var client *storage.Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	failed := 0
+	for _, f := range manifest.Files {
+		var r io.ReadCloser
+		if strings.HasPrefix(f.Name, "gs://") {
+			if client == nil {
+				if client, err = storage.NewClient(ctx, clientOptions...); err != nil {
+					return err
+				}
+			}
+			parts := strings.SplitN(strings.TrimPrefix(f.Name, "gs://"), "/", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("Invalid file %s in the manifest", f.Name)
+			}
+			r, err = client.Bucket(parts[0]).Object(parts[1]).NewReader(ctx)
+		} else {
+			r, err = os.Open(filepath.Join(filepath.Dir(cmd.Manifest), f.Name))
+		}
+		if err != nil {
+			failed++
+			warnf("%s: %v", f.Name, err)
+			continue
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", f.Name, err)
+		}
+
+		switch {
+		case n != f.Bytes:
+			failed++
+			warnf("%s: %d bytes, the manifest lists %d", f.Name, n, f.Bytes)
+		case hex.EncodeToString(h.Sum(nil)) != f.SHA256:
+			failed++
+			warnf("%s: checksum doesn't match the manifest", f.Name)
+		default:
+			infof("%s: OK", f.Name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files of %s don't match the manifest", failed, len(manifest.Files), cmd.Manifest)
+	}
+	infof("All %d files of the %s export match the manifest", len(manifest.Files), manifest.Kind)
+	return nil
+}
@@ -0,0 +1,526 @@
+package cdskit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// MigrateCmd copies kinds of a namespace to another project or namespace, renaming kinds
+// and allocating new numeric IDs on the way. Changed keys are written to a mapping file,
+// so key properties can be fixed up afterwards.
+type MigrateCmd struct {
+	SrcProjectID  string   `long:"src-project" description:"Project to migrate from" required:"true"`
+	SrcNamespace  string   `long:"src-namespace" description:"Namespace to migrate from"`
+	DstProjectID  string   `long:"dst-project" description:"Project to migrate to, the source project by default"`
+	DstNamespace  string   `long:"dst-namespace" description:"Namespace to migrate to"`
+	Kinds         string   `short:"k" long:"kinds" description:"Comma separated kinds to migrate, all kinds of the source namespace by default"`
+	RenameKinds   []string `long:"rename-kind" description:"Kind renamed in the destination as old:new, keys with ancestors of the kind are re-parented under the renamed kind (repeatable)"`
+	NewIDs        bool     `long:"new-ids" description:"Allocate new numeric IDs in the destination instead of keeping the source IDs, named keys keep their names and descendants are re-parented under the new keys"`
+	MappingFile   string   `long:"mapping-file" description:"JSON lines file the old and new path of every changed key is appended to, keys of an earlier run are read from it so a migration can be continued"`
+	FixReferences bool     `long:"fix-references" description:"After copying, rewrite key properties of the migrated entities that point to migrated entities of the source namespace"`
+	Transforms    []string `long:"transform" description:"Change entities before they're written, as export-kind --transform does, values keep their Datastore types"`
+	DryRun        bool     `long:"dry-run" description:"Print how many entities of every kind would be migrated without writing them"`
+	MaxRetries    int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+	Transactional bool     `long:"transactional" description:"Migrate entity group by group, reading the entities of the migrated kinds below a root in a read-only transaction and writing them in one transaction, retried on contention, so parents and children land together"`
+
+	renames map[string]string
+	// allocated maps old keys to the new keys with allocated IDs, keys without a new ID
+	// are derived from the old key
+	allocated map[string]*datastore.Key
+	mapping   *os.File
+	mappingw  *bufio.Writer
+}
+
+// keyMapping is a line of the --mapping-file
+type keyMapping struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Execute is called by go-flags
+func (cmd *MigrateCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	dstProject := cmd.DstProjectID
+	if dstProject == "" {
+		dstProject = cmd.SrcProjectID
+	}
+
+	cmd.renames = make(map[string]string)
+	for _, s := range cmd.RenameKinds {
+		for _, pair := range strings.Split(s, ",") {
+			i := strings.Index(pair, ":")
+			if i <= 0 || i == len(pair)-1 {
+				return fmt.Errorf("Invalid --rename-kind, expected old:new: %s", pair)
+			}
+			cmd.renames[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	if dstProject == cmd.SrcProjectID && cmd.DstNamespace == cmd.SrcNamespace && len(cmd.renames) == 0 && !cmd.NewIDs {
+		return fmt.Errorf("Source and destination are the same: %s/%s", dstProject, cmd.DstNamespace)
+	}
+
+	ts, err := parseTransforms(cmd.Transforms)
+	if err != nil {
+		return err
+	}
+
+	srcClient, err := newClient(ctx, cmd.SrcProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer srcClient.Close()
+
+	kinds := strings.Split(cmd.Kinds, ",")
+	if cmd.Kinds == "" {
+		kinds, err = metadataKinds(ctx, srcClient, cmd.SrcNamespace)
+		if err != nil {
+			return fmt.Errorf("Unable to load list of kinds: %w", err)
+		}
+	}
+
+	if cmd.DryRun {
+		total := 0
+		for _, kind := range kinds {
+			n, err := countQuery(ctx, srcClient, datastore.NewQuery(kind).Namespace(cmd.SrcNamespace), kind)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Would migrate %s/%s to %s/%s/%s - %d\n", cmd.SrcNamespace, kind, dstProject, cmd.DstNamespace, cmd.kindName(kind), n)
+			total += n
+		}
+		fmt.Printf("Would migrate %d entities in total\n", total)
+		return nil
+	}
+
+	dstClient, err := newClient(ctx, dstProject)
+	if err != nil {
+		return err
+	}
+
+	defer dstClient.Close()
+
+	if err := cmd.openMapping(); err != nil {
+		return err
+	}
+	defer cmd.closeMapping()
+
+	started := time.Now()
+	total := 0
+	if cmd.Transactional {
+		if total, err = cmd.migrateGroups(ctx, srcClient, dstClient, kinds, ts); err != nil {
+			return err
+		}
+	} else {
+		for i, kind := range kinds {
+			infof("Migrating %s to %s/%s/%s (%d/%d)", kind, dstProject, cmd.DstNamespace, cmd.kindName(kind), i+1, len(kinds))
+			n, err := cmd.migrateKind(ctx, srcClient, dstClient, kind, ts)
+			total += n
+			if err != nil {
+				return fmt.Errorf("Migration of %s failed: %w", kind, err)
+			}
+		}
+	}
+	// keys are on disk before references are rewritten to them
+	if err := cmd.closeMapping(); err != nil {
+		return err
+	}
+
+	if cmd.FixReferences {
+		migrated := make(map[string]bool)
+		for _, kind := range kinds {
+			migrated[kind] = true
+		}
+		for _, kind := range kinds {
+			if err := cmd.fixReferences(ctx, dstClient, cmd.kindName(kind), migrated); err != nil {
+				return fmt.Errorf("Unable to fix references of %s: %w", cmd.kindName(kind), err)
+			}
+		}
+	}
+
+	logEvent(logInfo, logFields{"event": "summary", "kinds": len(kinds), "written": total, "elapsed_seconds": time.Since(started).Seconds()},
+		"Migrated %d entities of %d kinds in %s", total, len(kinds), time.Since(started).Round(time.Second))
+	return nil
+}
+
+// migrateKind copies the entities of the kind under their new keys
+func (cmd *MigrateCmd) migrateKind(ctx context.Context, srcClient, dstClient *datastore.Client, kind string, ts transforms) (int, error) {
+	opts := &valueOptions{raw: true, includeNulls: true}
+	q := datastore.NewQuery(kind).Namespace(cmd.SrcNamespace).Limit(500)
+
+	migrated := 0
+	var start datastore.Cursor
+	for {
+		var batch []*dynamicEntity
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, start, err = fetchPage(ctx, srcClient, q.Start(start), opts)
+			return err
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("Unable to read %s: %w", kind, err)
+		}
+
+		if len(batch) == 0 {
+			return migrated, nil
+		}
+
+		if batch, err = ts.applyBatch(batch); err != nil {
+			return migrated, err
+		}
+
+		keys := make([]*datastore.Key, len(batch))
+		for i, de := range batch {
+			keys[i] = de.key
+		}
+		keys, err = cmd.mapKeys(ctx, dstClient, keys)
+		if err != nil {
+			return migrated, err
+		}
+
+		err = withRetries(ctx, cmd.MaxRetries, func() error {
+			_, err := dstClient.PutMulti(ctx, keys, batch)
+			return err
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("Unable to write %s: %w", cmd.kindName(kind), err)
+		}
+
+		migrated += len(batch)
+		infof("Migrating %s - %d", kind, migrated)
+	}
+}
+
+// migrateGroups copies the entity groups having entities of the kinds in transactions, a
+// group holds the entities of all migrated kinds below its root
+func (cmd *MigrateCmd) migrateGroups(ctx context.Context, srcClient, dstClient *datastore.Client, kinds []string, ts transforms) (int, error) {
+	migrating := make(map[string]bool)
+	for _, kind := range kinds {
+		migrating[kind] = true
+	}
+
+	gc := &groupCopy{
+		src:     srcClient,
+		dst:     dstClient,
+		retries: cmd.MaxRetries,
+		query: func(root *datastore.Key) *datastore.Query {
+			return datastore.NewQuery("").Namespace(cmd.SrcNamespace).Ancestor(root)
+		},
+		prepare: func(batch []*dynamicEntity) ([]*datastore.Key, []*dynamicEntity, error) {
+			kept := batch[:0]
+			for _, de := range batch {
+				if migrating[de.key.Kind] {
+					kept = append(kept, de)
+				}
+			}
+			batch, err := ts.applyBatch(kept)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			keys := make([]*datastore.Key, len(batch))
+			for i, de := range batch {
+				keys[i] = de.key
+			}
+			keys, err = cmd.mapKeys(ctx, dstClient, keys)
+			return keys, batch, err
+		},
+	}
+
+	// groups with entities of several kinds are copied with the first of them
+	copied := make(map[string]bool)
+	migrated := 0
+	for i, kind := range kinds {
+		infof("Migrating entity groups of %s (%d/%d)", kind, i+1, len(kinds))
+		err := forEachRoot(ctx, srcClient, datastore.NewQuery(kind).Namespace(cmd.SrcNamespace), cmd.MaxRetries, func(root *datastore.Key) error {
+			if copied[root.String()] {
+				return nil
+			}
+			copied[root.String()] = true
+
+			_, n, err := gc.copy(ctx, root)
+			migrated += n
+			if err == nil && len(copied)%100 == 0 {
+				infof("Migrating %s - %d entities of %d groups", kind, migrated, len(copied))
+			}
+			return err
+		})
+		if err != nil {
+			return migrated, fmt.Errorf("Migration of %s failed after %d entities: %w", kind, migrated, err)
+		}
+	}
+
+	infof("Migrated %d entity groups", len(copied))
+	return migrated, nil
+}
+
+// kindName returns the kind renamed by --rename-kind
+func (cmd *MigrateCmd) kindName(kind string) string {
+	if name, ok := cmd.renames[kind]; ok {
+		return name
+	}
+	return kind
+}
+
+// newKey returns the new key of a source key, it's nil for keys waiting for an allocated
+// ID, of the key itself or of an ancestor
+func (cmd *MigrateCmd) newKey(k *datastore.Key) *datastore.Key {
+	if nk, ok := cmd.allocated[k.Encode()]; ok {
+		return nk
+	}
+	if cmd.NewIDs && k.ID != 0 {
+		return nil
+	}
+
+	var parent *datastore.Key
+	if k.Parent != nil {
+		if parent = cmd.newKey(k.Parent); parent == nil {
+			return nil
+		}
+	}
+	return &datastore.Key{Kind: cmd.kindName(k.Kind), ID: k.ID, Name: k.Name, Parent: parent, Namespace: cmd.DstNamespace}
+}
+
+// mapKeys returns the new keys of the source keys. With --new-ids IDs are allocated for the
+// keys and their ancestors level by level from the root, so parents have their new keys first.
+func (cmd *MigrateCmd) mapKeys(ctx context.Context, client *datastore.Client, keys []*datastore.Key) ([]*datastore.Key, error) {
+	var levels [][]*datastore.Key
+	if cmd.NewIDs {
+		queued := make(map[string]bool)
+		for _, k := range keys {
+			var path []*datastore.Key
+			for p := k; p != nil; p = p.Parent {
+				path = append([]*datastore.Key{p}, path...)
+			}
+
+			for depth, p := range path {
+				id := p.Encode()
+				if p.ID == 0 || queued[id] || cmd.allocated[id] != nil {
+					continue
+				}
+				queued[id] = true
+				for len(levels) <= depth {
+					levels = append(levels, nil)
+				}
+				levels[depth] = append(levels[depth], p)
+			}
+		}
+	}
+
+	for _, level := range levels {
+		incomplete := make([]*datastore.Key, len(level))
+		for i, old := range level {
+			var parent *datastore.Key
+			if old.Parent != nil {
+				parent = cmd.newKey(old.Parent)
+			}
+			incomplete[i] = datastore.IncompleteKey(cmd.kindName(old.Kind), parent)
+			incomplete[i].Namespace = cmd.DstNamespace
+		}
+
+		for i := 0; i < len(incomplete); i += 500 {
+			j := min(i+500, len(incomplete))
+			var allocated []*datastore.Key
+			err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+				allocated, err = client.AllocateIDs(ctx, incomplete[i:j])
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Unable to allocate IDs: %w", err)
+			}
+
+			for n, nk := range allocated {
+				cmd.allocated[level[i+n].Encode()] = nk
+				if err := cmd.record(level[i+n], nk); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	mapped := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		mapped[i] = cmd.newKey(k)
+		// allocated keys are recorded as they're allocated
+		if !cmd.NewIDs || k.ID == 0 {
+			if err := cmd.record(k, mapped[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return mapped, nil
+}
+
+// openMapping reads the keys allocated by an earlier run and opens the file to append
+func (cmd *MigrateCmd) openMapping() error {
+	cmd.allocated = make(map[string]*datastore.Key)
+	if cmd.MappingFile == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(cmd.MappingFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd.mapping = f
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var m keyMapping
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return fmt.Errorf("Invalid line %d of %s: %w", n, cmd.MappingFile, err)
+		}
+
+		old, err := parseFullKeyPath(m.Old, cmd.SrcNamespace)
+		if err != nil {
+			return fmt.Errorf("Invalid line %d of %s: %w", n, cmd.MappingFile, err)
+		}
+		nk, err := parseFullKeyPath(m.New, cmd.DstNamespace)
+		if err != nil {
+			return fmt.Errorf("Invalid line %d of %s: %w", n, cmd.MappingFile, err)
+		}
+		if cmd.NewIDs && old.ID != 0 {
+			cmd.allocated[old.Encode()] = nk
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(cmd.allocated) > 0 {
+		infof("Continuing with %d allocated keys of %s", len(cmd.allocated), cmd.MappingFile)
+	}
+	cmd.mappingw = bufio.NewWriter(f)
+	return nil
+}
+
+// record appends a changed key to the mapping file
+func (cmd *MigrateCmd) record(old, nk *datastore.Key) error {
+	if cmd.mappingw == nil || keyPath(old) == keyPath(nk) {
+		return nil
+	}
+
+	b, err := json.Marshal(keyMapping{Old: keyPath(old), New: keyPath(nk)})
+	if err != nil {
+		return err
+	}
+	_, err = cmd.mappingw.Write(append(b, '\n'))
+	return err
+}
+
+func (cmd *MigrateCmd) closeMapping() error {
+	if cmd.mapping == nil {
+		return nil
+	}
+
+	err := cmd.mappingw.Flush()
+	if cerr := cmd.mapping.Close(); err == nil {
+		err = cerr
+	}
+	cmd.mapping, cmd.mappingw = nil, nil
+	return err
+}
+
+// fixReferences rewrites key properties of the migrated entities of the kind pointing to
+// entities of a migrated kind in the source namespace, nested entities and lists included
+func (cmd *MigrateCmd) fixReferences(ctx context.Context, client *datastore.Client, kind string, migrated map[string]bool) error {
+	opts := &valueOptions{raw: true, includeNulls: true}
+	q := datastore.NewQuery(kind).Namespace(cmd.DstNamespace).Limit(500)
+
+	read, fixed := 0, 0
+	var start datastore.Cursor
+	for {
+		var batch []*dynamicEntity
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			batch, start, err = fetchPage(ctx, client, q.Start(start), opts)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+		read += len(batch)
+
+		var keys []*datastore.Key
+		var changed []*dynamicEntity
+		for _, de := range batch {
+			if cmd.fixValues(de.value, migrated) {
+				keys, changed = append(keys, de.key), append(changed, de)
+			}
+		}
+
+		if len(changed) > 0 {
+			err = withRetries(ctx, cmd.MaxRetries, func() error {
+				_, err := client.PutMulti(ctx, keys, changed)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		fixed += len(changed)
+		infof("Fixing references of %s - %d of %d", kind, fixed, read)
+	}
+	return nil
+}
+
+// fixValues replaces the keys of migrated entities in the properties and reports whether
+// any was replaced
+func (cmd *MigrateCmd) fixValues(value map[string]interface{}, migrated map[string]bool) bool {
+	changed := false
+	for name, v := range value {
+		if nv, ok := cmd.fixValue(v, migrated); ok {
+			value[name] = nv
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (cmd *MigrateCmd) fixValue(v interface{}, migrated map[string]bool) (interface{}, bool) {
+	switch v := v.(type) {
+	case *datastore.Key:
+		if v.Namespace != cmd.SrcNamespace || !migrated[v.Kind] {
+			return v, false
+		}
+		// references to entities which weren't migrated are kept
+		nk := cmd.newKey(v)
+		if nk == nil || nk.Equal(v) {
+			return v, false
+		}
+		return nk, true
+	case *datastore.Entity:
+		changed := false
+		for i, p := range v.Properties {
+			if nv, ok := cmd.fixValue(p.Value, migrated); ok {
+				v.Properties[i].Value = nv
+				changed = true
+			}
+		}
+		return v, changed
+	case []interface{}:
+		changed := false
+		for i, e := range v {
+			if nv, ok := cmd.fixValue(e, migrated); ok {
+				v[i] = nv
+				changed = true
+			}
+		}
+		return v, changed
+	default:
+		return v, false
+	}
+}
@@ -0,0 +1,378 @@
+package cdskit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// msgpackTimestamp is the extension type of MessagePack timestamps
+const msgpackTimestamp = -1
+
+// msgpackExportWriter writes a MessagePack map per record one after another, integers,
+// floats, timestamps and binary values keep their types
+type msgpackExportWriter struct {
+	writer io.Writer
+	buf    bytes.Buffer
+}
+
+func (format *msgpackExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *msgpackExportWriter) WriterRecord(de *dynamicEntity) error {
+	format.buf.Reset()
+	if err := encodeMsgpack(&format.buf, de.value); err != nil {
+		return fmt.Errorf("Unable to encode entry: %w", err)
+	}
+
+	if _, err := format.writer.Write(format.buf.Bytes()); err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
+	}
+	return nil
+}
+
+func (format *msgpackExportWriter) WriteFooter() error {
+	return nil
+}
+
+// encodeMsgpack appends the exported value, integers and strings use the smallest encoding
+func encodeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		msgpackInt(buf, int64(v))
+	case int32:
+		msgpackInt(buf, int64(v))
+	case int64:
+		msgpackInt(buf, v)
+	case float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(v))
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return encodeMsgpack(buf, f)
+	case string:
+		msgpackHeader(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []byte:
+		msgpackHeader(buf, len(v), 0, 0, 0xc4, 0xc5, 0xc6)
+		buf.Write(v)
+	case time.Time:
+		msgpackTime(buf, v)
+	case []interface{}:
+		msgpackHeader(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := encodeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackHeader(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for name, e := range v {
+			if err := encodeMsgpack(buf, name); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(buf, e); err != nil {
+				return fmt.Errorf("Property %s: %w", name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported value %T in MessagePack", value)
+	}
+	return nil
+}
+
+func msgpackInt(buf *bytes.Buffer, v int64) {
+	switch {
+	case v >= 0 && v < 128:
+		buf.WriteByte(byte(v))
+	case v >= -32 && v < 0:
+		buf.WriteByte(byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(v))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+// msgpackHeader writes the type and length of a string, binary, array or map, fix is
+// the type of lengths below fixMax, types of 0 aren't used
+func msgpackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case t8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(t8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(t16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(t32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackTime writes the timestamp extension in its 32, 64 or 96 bit form
+func msgpackTime(buf *bytes.Buffer, t time.Time) {
+	sec, nsec := t.Unix(), uint32(t.Nanosecond())
+	switch {
+	case nsec == 0 && sec >= 0 && sec <= math.MaxUint32:
+		buf.Write([]byte{0xd6, 0xff})
+		binary.Write(buf, binary.BigEndian, uint32(sec))
+	case sec >= 0 && sec>>34 == 0:
+		buf.Write([]byte{0xd7, 0xff})
+		binary.Write(buf, binary.BigEndian, uint64(nsec)<<34|uint64(sec))
+	default:
+		buf.Write([]byte{0xc7, 12, 0xff})
+		binary.Write(buf, binary.BigEndian, nsec)
+		binary.Write(buf, binary.BigEndian, sec)
+	}
+}
+
+// msgpackImportReader reads the records of --format msgpack, lat/lng maps become
+// geopoints as in JSON imports
+type msgpackImportReader struct {
+	r *bufio.Reader
+}
+
+func newMsgpackImportReader(r io.Reader) *msgpackImportReader {
+	return &msgpackImportReader{r: bufio.NewReader(r)}
+}
+
+func (format *msgpackImportReader) ReadRecord() (*dynamicEntity, error) {
+	if _, err := format.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	v, err := format.decode()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid MessagePack record: %w", err)
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a MessagePack map per record, got %T", v)
+	}
+	return &dynamicEntity{value: m}, nil
+}
+
+func (format *msgpackImportReader) decode() (interface{}, error) {
+	t, err := format.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case t < 0x80:
+		return int64(t), nil
+	case t >= 0xe0:
+		return int64(int8(t)), nil
+	case t&0xf0 == 0x80:
+		return format.decodeMap(int(t & 0x0f))
+	case t&0xf0 == 0x90:
+		return format.decodeArray(int(t & 0x0f))
+	case t&0xe0 == 0xa0:
+		b, err := format.read(int(t & 0x1f))
+		return string(b), err
+	}
+
+	switch t {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := format.length(t - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return format.read(n)
+	case 0xd9, 0xda, 0xdb:
+		n, err := format.length(t - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		b, err := format.read(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := format.length(t - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return format.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := format.length(t - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return format.decodeMap(n)
+	case 0xca:
+		b, err := format.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := format.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := format.read(1 << (t - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		u := uint64(0)
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		if u > math.MaxInt64 {
+			return nil, fmt.Errorf("Integer %d out of the range of Datastore integers", u)
+		}
+		return int64(u), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := format.read(1 << (t - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		i := int64(int8(b[0]))
+		for _, c := range b[1:] {
+			i = i<<8 | int64(c)
+		}
+		return i, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return format.decodeExt(1 << (t - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := format.length(t - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return format.decodeExt(n)
+	default:
+		return nil, fmt.Errorf("Unsupported MessagePack type 0x%x", t)
+	}
+}
+
+// length reads a big endian length of 1, 2 or 4 bytes for size 0, 1 or 2
+func (format *msgpackImportReader) length(size byte) (int, error) {
+	b, err := format.read(1 << size)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+func (format *msgpackImportReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(format.r, b)
+	return b, err
+}
+
+func (format *msgpackImportReader) decodeArray(n int) (interface{}, error) {
+	a := make([]interface{}, 0, min(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := format.decode()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (format *msgpackImportReader) decodeMap(n int) (interface{}, error) {
+	m := make(map[string]interface{}, min(n, 1024))
+	for i := 0; i < n; i++ {
+		k, err := format.decode()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("Map key %v is not a string", k)
+		}
+		if m[name], err = format.decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(m) == 2 {
+		lat, ok1 := m["lat"].(float64)
+		lng, ok2 := m["lng"].(float64)
+		if g := (datastore.GeoPoint{Lat: lat, Lng: lng}); ok1 && ok2 && g.Valid() {
+			return g, nil
+		}
+	}
+	return m, nil
+}
+
+// decodeExt reads an extension of n bytes, only timestamps are supported
+func (format *msgpackImportReader) decodeExt(n int) (interface{}, error) {
+	typ, err := format.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := format.read(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != msgpackTimestamp {
+		return nil, fmt.Errorf("Unsupported MessagePack extension %d", int8(typ))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0).UTC(), nil
+	case 8:
+		u := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)).UTC(), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b[:4]))).UTC(), nil
+	default:
+		return nil, fmt.Errorf("Invalid MessagePack timestamp of %d bytes", n)
+	}
+}
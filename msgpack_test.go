@@ -0,0 +1,95 @@
+package cdskit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestEncodeMsgpack(t *testing.T) {
+	// encodings given by the MessagePack specification
+	tests := []struct {
+		value interface{}
+		hex   string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{int64(5), "05"},
+		{int64(-1), "ff"},
+		{int64(-33), "d0df"},
+		{int64(128), "d10080"},
+		{int64(1) << 40, "d30000010000000000"},
+		{1.5, "cb3ff8000000000000"},
+		{"a", "a161"},
+		{strings.Repeat("x", 32), "d920" + strings.Repeat("78", 32)},
+		{[]byte{1, 2}, "c4020102"},
+		{[]interface{}{int64(1), "b"}, "9201a162"},
+		{map[string]interface{}{"k": int64(1)}, "81a16b01"},
+		{time.Unix(1, 0), "d6ff00000001"},
+		{time.Unix(1, 5), "d7ff0000001400000001"},
+		{time.Unix(-1, 0), "c70cff00000000ffffffffffffffff"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := encodeMsgpack(&buf, tt.value); err != nil {
+			t.Errorf("encodeMsgpack(%v): %v", tt.value, err)
+			continue
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != tt.hex {
+			t.Errorf("encodeMsgpack(%v) = %s, want %s", tt.value, got, tt.hex)
+		}
+	}
+}
+
+func TestExportMsgpack(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 30, 0, 250000000, time.UTC)
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{
+			"name":    "a",
+			"n":       int64(1) << 40,
+			"price":   2.0,
+			"ok":      true,
+			"created": created,
+			"data":    []byte{0, 1},
+			"tags":    []interface{}{1, "x"},
+			"address": map[string]interface{}{"city": "Berlin"},
+		}),
+		fakeEntity("Item", 2, map[string]interface{}{"name": "b", "n": -3}),
+	}
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "msgpack", "no-key": true})
+
+	want := []map[string]interface{}{
+		{
+			"name":    "a",
+			"n":       int64(1) << 40,
+			"price":   2.0,
+			"ok":      true,
+			"created": created,
+			"data":    []byte{0, 1},
+			"tags":    []interface{}{int64(1), "x"},
+			"address": map[string]interface{}{"city": "Berlin"},
+		},
+		{"name": "b", "n": int64(-3)},
+	}
+
+	r := newMsgpackImportReader(strings.NewReader(out))
+	for i, w := range want {
+		de, err := r.ReadRecord()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(de.value, w) {
+			t.Errorf("record %d is %v, want %v", i, de.value, w)
+		}
+	}
+	if _, err := r.ReadRecord(); err != io.EOF {
+		t.Errorf("file has more records: %v", err)
+	}
+}
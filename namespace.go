@@ -0,0 +1,45 @@
+package cdskit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namespaceTransform rewrites namespace values stored by --namespace-field
+type namespaceTransform func(string) string
+
+// parseNamespaceTransform parses strip-prefix=<prefix> or regex=<expression>, the regex
+// transform keeps the first capture group or the whole match when there are no groups.
+func parseNamespaceTransform(s string) (namespaceTransform, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid namespace transform, expected strip-prefix=<prefix> or regex=<expression>: %s", s)
+	}
+
+	switch arg := s[i+1:]; s[:i] {
+	case "strip-prefix":
+		return func(ns string) string {
+			return strings.TrimPrefix(ns, arg)
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid namespace transform: %w", err)
+		}
+
+		return func(ns string) string {
+			m := re.FindStringSubmatch(ns)
+			switch {
+			case m == nil:
+				return ns
+			case len(m) > 1:
+				return m[1]
+			default:
+				return m[0]
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported namespace transform: %s", s[:i])
+	}
+}
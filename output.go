@@ -0,0 +1,312 @@
+package cdskit
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// exportOutput is an opened export destination
+type exportOutput struct {
+	writer exportWriter
+	// commit completes the output after the footer is written
+	commit func() error
+	// closers release the output, they run in reverse order
+	closers []func() error
+}
+
+func (o *exportOutput) Close() error {
+	var err error
+	for i := len(o.closers) - 1; i >= 0; i-- {
+		if cerr := o.closers[i](); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	o.closers = nil
+	return err
+}
+
+// openOutput opens the destination given by --output, fileName is the generated
+// name in the exports folder.
+func (cmd *ExportKindCmd) openOutput(ctx context.Context, fileName string) (*exportOutput, error) {
+	o := &exportOutput{commit: func() error { return nil }}
+
+	var out io.Writer
+	var name string
+	switch {
+	case strings.HasPrefix(cmd.Output, "pubsub://"):
+		pw, err := newPubSubExportWriter(ctx, cmd.Output, cmd.Kind, len(cmd.OrderBy) > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		o.closers = append(o.closers, pw.Close)
+		o.writer = pw
+		return o, nil
+	case strings.HasPrefix(cmd.Output, "gs://"):
+		obj, err := newGCSObject(ctx, cmd.Output, strings.TrimPrefix(fileName, strings.TrimSuffix(cmd.OutputDir, "/")+"/"))
+		if err != nil {
+			return nil, err
+		}
+
+		o.closers = append(o.closers, obj.Close)
+		out = obj
+		o.commit = obj.Commit
+		name = "gs://" + obj.Bucket + "/" + obj.Name
+		cmd.uploaded = append(cmd.uploaded, name)
+	case cmd.Output == "-":
+		out = os.Stdout
+		if cmd.out != nil {
+			out = cmd.out
+		}
+	default:
+		if cmd.Output == "" {
+			if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+				return nil, err
+			}
+		}
+
+		// idempotent files are written aside and renamed when complete,
+		// so a failed rerun doesn't destroy the previous export
+		partName := fileName
+		if cmd.IdempotentName {
+			partName = fileName + ".tmp"
+		}
+
+		create := os.Create
+		if cmd.appendOutput {
+			create = func(name string) (*os.File, error) {
+				return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			}
+		}
+		if cmd.checkpoint != nil {
+			create = func(name string) (*os.File, error) {
+				return os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+			}
+		}
+
+		f, err := create(partName)
+		if err != nil {
+			return nil, err
+		}
+
+		o.closers = append(o.closers, f.Close)
+		out = f
+		name = filepath.Base(fileName)
+
+		if partName != fileName {
+			o.commit = func() error {
+				if err := f.Close(); err != nil {
+					return err
+				}
+				return os.Rename(partName, fileName)
+			}
+		}
+	}
+
+	out = countingWriter{w: out, n: &cmd.written}
+
+	var mo *manifestOutput
+	if cmd.Manifest {
+		mo = &manifestOutput{file: manifestFile{Name: name}, hash: sha256.New()}
+		out = io.MultiWriter(out, mo)
+
+		// the file is listed once it's complete
+		next := o.commit
+		o.commit = func() error {
+			if err := next(); err != nil {
+				return err
+			}
+			mo.file.SHA256 = hex.EncodeToString(mo.hash.Sum(nil))
+			cmd.manifest = append(cmd.manifest, mo)
+			return nil
+		}
+	}
+
+	if cmd.encryption != nil {
+		// only a committed file gets the final chunk, an aborted one fails to decrypt
+		ew, err := cmd.encryption.newWriter(ctx, out)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("Unable to encrypt the export: %w", err)
+		}
+		next := o.commit
+		o.commit = func() error {
+			if err := ew.Close(); err != nil {
+				return err
+			}
+			return next()
+		}
+		out = ew
+	}
+
+	if cmd.Gzip {
+		// the gzip stream is closed before the file
+		gz := gzip.NewWriter(out)
+		o.closers = append(o.closers, gz.Close)
+
+		next := o.commit
+		o.commit = func() error {
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			return next()
+		}
+		out = gz
+	}
+
+	o.writer = cmd.newExportWriter(countingWriter{w: out, n: &cmd.encoded})
+	// writers holding temporary files release them when the output is closed
+	if c, ok := o.writer.(io.Closer); ok {
+		o.closers = append(o.closers, c.Close)
+	}
+	if mo != nil {
+		o.writer = manifestWriter{exportWriter: o.writer, output: mo}
+	}
+	return o, nil
+}
+
+// splitExportWriter starts a new part of the export every size records or when the
+// part reaches maxBytes, every part is a complete file with its own header and footer.
+type splitExportWriter struct {
+	open    func(part int) (*exportOutput, error)
+	size    int
+	part    int
+	count   int
+	current *exportOutput
+
+	maxBytes int64
+	// written counts bytes of all parts, partStart is the count when the part was opened
+	written   *int64
+	partStart int64
+}
+
+// newSplitOutput opens the first part, parts are named by partFileName
+func (cmd *ExportKindCmd) newSplitOutput(ctx context.Context, fileName string) (*exportOutput, error) {
+	sw := &splitExportWriter{
+		size:     cmd.Split,
+		maxBytes: cmd.maxFileSize,
+		written:  &cmd.written,
+		open: func(part int) (*exportOutput, error) {
+			return cmd.openOutput(ctx, partFileName(fileName, part))
+		},
+	}
+
+	if err := sw.next(); err != nil {
+		return nil, err
+	}
+
+	return &exportOutput{
+		writer:  sw,
+		commit:  func() error { return sw.current.commit() },
+		closers: []func() error{func() error { return sw.current.Close() }},
+	}, nil
+}
+
+// partFileName inserts the part number before the extensions, e.g. export.json.gz
+// becomes export.part0001.json.gz, or replaces {shard} of --filename-template
+func partFileName(fileName string, part int) string {
+	if strings.Contains(fileName, "{shard}") {
+		return strings.Replace(fileName, "{shard}", fmt.Sprintf("%04d", part), -1)
+	}
+
+	dir, base := filepath.Split(fileName)
+	name, ext := base, ""
+	// compression and encryption wrap the extension of the format
+	for _, wrapper := range []string{".enc", ".gz"} {
+		if strings.HasSuffix(name, wrapper) && len(name) > len(wrapper) {
+			name, ext = strings.TrimSuffix(name, wrapper), wrapper+ext
+		}
+	}
+	if e := filepath.Ext(name); e != "" && e != name {
+		name, ext = strings.TrimSuffix(name, e), e+ext
+	}
+	return fmt.Sprintf("%s%s.part%04d%s", dir, name, part, ext)
+}
+
+// next completes the current part and opens the next one
+func (format *splitExportWriter) next() error {
+	if format.current != nil {
+		if err := format.current.writer.WriteFooter(); err != nil {
+			return err
+		}
+		if err := format.current.commit(); err != nil {
+			return err
+		}
+		if err := format.current.Close(); err != nil {
+			return err
+		}
+	}
+
+	format.part++
+	o, err := format.open(format.part)
+	if err != nil {
+		return err
+	}
+
+	format.current = o
+	format.count = 0
+	format.partStart = atomic.LoadInt64(format.written)
+	return o.writer.WriteHeader()
+}
+
+func (format *splitExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *splitExportWriter) WriterRecord(de *dynamicEntity) error {
+	full := format.size > 0 && format.count == format.size
+	if format.maxBytes > 0 && format.count > 0 {
+		// buffered writers flush in blocks, so parts end up slightly larger
+		full = full || atomic.LoadInt64(format.written)-format.partStart >= format.maxBytes
+	}
+	if full {
+		if err := format.next(); err != nil {
+			return &outputError{err}
+		}
+	}
+
+	if err := format.current.writer.WriterRecord(de); err != nil {
+		return err
+	}
+	format.count++
+	return nil
+}
+
+func (format *splitExportWriter) WriteFooter() error {
+	return format.current.writer.WriteFooter()
+}
+
+// parseSize parses a size in bytes with an optional unit, KB, MB and GB are powers of
+// 1000 and KiB, MiB and GiB powers of 1024
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+
+	num, factor := strings.TrimSpace(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(num), strings.ToUpper(u.suffix)) {
+			num, factor = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid size %s, expected e.g. 500MB or 1GiB", s)
+	}
+	return int64(n * float64(factor)), nil
+}
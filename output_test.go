@@ -0,0 +1,26 @@
+package cdskit
+
+import "testing"
+
+func TestPartFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"export.json", "export.part0003.json"},
+		{"export.json.gz", "export.part0003.json.gz"},
+		{"export.jsonl.gz.enc", "export.part0003.jsonl.gz.enc"},
+		{"out.v2.json", "out.v2.part0003.json"},
+		{"/tmp/x.y/file", "/tmp/x.y/file.part0003"},
+		{"/tmp/x.y/file.csv", "/tmp/x.y/file.part0003.csv"},
+		{"gs://bucket/a.b/export.typed-json", "gs://bucket/a.b/export.part0003.typed-json"},
+		{".hidden", ".hidden.part0003"},
+		{"export_{shard}.json", "export_0003.json"},
+	}
+
+	for _, tt := range tests {
+		if got := partFileName(tt.name, 3); got != tt.want {
+			t.Errorf("partFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package cdskit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// parquetRowGroupSize is the number of records of a row group
+const parquetRowGroupSize = 10000
+
+// Parquet physical and converted types and repetitions, see parquet.thrift
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+
+	parquetOptional = 1
+	parquetRepeated = 2
+)
+
+// parquetColumn is a leaf column buffering the levels and values of the current row group
+type parquetColumn struct {
+	path           []string
+	kind           string
+	maxRep, maxDef int
+	repLevels      []int
+	defLevels      []int
+	values         []interface{}
+}
+
+func (c *parquetColumn) add(rep, def int, v interface{}) {
+	c.repLevels = append(c.repLevels, rep)
+	c.defLevels = append(c.defLevels, def)
+	if v != nil {
+		c.values = append(c.values, v)
+	}
+}
+
+// parquetChunk is the location of a column chunk written to the file
+type parquetChunk struct {
+	offset    int64
+	size      int64
+	numValues int
+}
+
+type parquetRowGroup struct {
+	chunks  []parquetChunk
+	numRows int
+}
+
+// parquetExportWriter writes an uncompressed Parquet file with a column per property,
+// embedded entities are groups and arrays repeated fields
+type parquetExportWriter struct {
+	w      io.Writer
+	offset int64
+	// schema is given by --columnar-schema or inferred from the first records
+	schema    *columnSchema
+	columns   []*parquetColumn
+	leaves    map[*columnField]*parquetColumn
+	sample    []*dynamicEntity
+	rows      int
+	rowGroups []parquetRowGroup
+}
+
+func (format *parquetExportWriter) WriteHeader() error {
+	if format.schema != nil {
+		format.addColumns(&format.schema.columnField, nil, 0, 0)
+	}
+	return nil
+}
+
+func (format *parquetExportWriter) WriterRecord(de *dynamicEntity) error {
+	if format.schema == nil {
+		format.sample = append(format.sample, de)
+		if len(format.sample) < columnarSampleSize {
+			return nil
+		}
+		if err := format.inferSchema(); err != nil {
+			return &outputError{err}
+		}
+		return nil
+	}
+
+	if err := format.appendRow(de); err != nil {
+		return err
+	}
+	if format.rows == parquetRowGroupSize {
+		if err := format.flushRowGroup(); err != nil {
+			return &outputError{err}
+		}
+	}
+	return nil
+}
+
+func (format *parquetExportWriter) WriteFooter() error {
+	if format.schema == nil {
+		if err := format.inferSchema(); err != nil {
+			return err
+		}
+	}
+	if format.rows > 0 {
+		if err := format.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	if format.offset == 0 {
+		if err := format.write([]byte("PAR1")); err != nil {
+			return err
+		}
+	}
+
+	meta := format.fileMetaData()
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(meta)))
+	return format.write(append(append(meta, size...), "PAR1"...))
+}
+
+// inferSchema creates columns from the sampled records and adds the records to them
+func (format *parquetExportWriter) inferSchema() error {
+	schema, err := inferColumnSchema(format.sample)
+	if err != nil {
+		return err
+	}
+	format.schema = schema
+	format.addColumns(&schema.columnField, nil, 0, 0)
+
+	for _, de := range format.sample {
+		if err := format.appendRow(de); err != nil {
+			return fmt.Errorf("Unable to convert entity %s: %w", de.key, err)
+		}
+		if format.rows == parquetRowGroupSize {
+			if err := format.flushRowGroup(); err != nil {
+				return err
+			}
+		}
+	}
+	format.sample = nil
+	return nil
+}
+
+// addColumns adds the leaf columns below the record, every field is optional or
+// repeated and adds a definition level, repeated ones a repetition level
+func (format *parquetExportWriter) addColumns(record *columnField, path []string, maxRep, maxDef int) {
+	if format.leaves == nil {
+		format.leaves = make(map[*columnField]*parquetColumn)
+	}
+	for _, f := range record.fields {
+		rep := maxRep
+		if f.repeated {
+			rep++
+		}
+		p := append(append([]string{}, path...), f.name)
+
+		if f.kind == "record" {
+			format.addColumns(f, p, rep, maxDef+1)
+			continue
+		}
+		c := &parquetColumn{path: p, kind: f.kind, maxRep: rep, maxDef: maxDef + 1}
+		format.columns = append(format.columns, c)
+		format.leaves[f] = c
+	}
+}
+
+// appendRow adds the record to the columns, nothing is added when a value doesn't fit
+func (format *parquetExportWriter) appendRow(de *dynamicEntity) error {
+	if err := format.schema.checkRecord(&format.schema.columnField, de.value); err != nil {
+		return err
+	}
+
+	sizes := make([][2]int, len(format.columns))
+	for i, c := range format.columns {
+		sizes[i] = [2]int{len(c.defLevels), len(c.values)}
+	}
+
+	if err := format.shred(&format.schema.columnField, de.value, 0, 0, 0); err != nil {
+		for i, c := range format.columns {
+			c.repLevels, c.defLevels, c.values = c.repLevels[:sizes[i][0]], c.defLevels[:sizes[i][0]], c.values[:sizes[i][1]]
+		}
+		return err
+	}
+	format.rows++
+	return nil
+}
+
+// shred adds the values of the record to the leaf columns as described by Dremel, rep
+// is the repetition level of the first value, def and depth the definition and
+// repetition levels of the record itself
+func (format *parquetExportWriter) shred(record *columnField, m map[string]interface{}, rep, def, depth int) error {
+	for _, f := range record.fields {
+		var values []interface{}
+		switch v := m[f.name].(type) {
+		case nil:
+		case []interface{}:
+			if !f.repeated && f.kind != "json" {
+				return fmt.Errorf("Property %s is an array, the column isn't repeated", f.name)
+			}
+			values = v
+			if !f.repeated {
+				values = []interface{}{v}
+			}
+		default:
+			values = []interface{}{v}
+		}
+
+		if len(values) == 0 {
+			format.null(f, rep, def)
+			continue
+		}
+
+		fieldDepth := depth
+		if f.repeated {
+			fieldDepth++
+		}
+		for i, v := range values {
+			r := rep
+			if i > 0 {
+				r = fieldDepth
+			}
+
+			if f.kind == "record" {
+				nested, ok := v.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("Property %s: %T value in a record column", f.name, v)
+				}
+				if err := format.shred(f, nested, r, def+1, fieldDepth); err != nil {
+					return fmt.Errorf("%s.%w", f.name, err)
+				}
+				continue
+			}
+
+			pv, err := convertLeaf(f.kind, v)
+			if err != nil {
+				return fmt.Errorf("Property %s: %w", f.name, err)
+			}
+			format.leaves[f].add(r, def+1, pv)
+		}
+	}
+	return nil
+}
+
+// null adds a missing value to the leaf columns below the field
+func (format *parquetExportWriter) null(f *columnField, rep, def int) {
+	if f.kind != "record" {
+		format.leaves[f].add(rep, def, nil)
+		return
+	}
+	for _, c := range f.fields {
+		format.null(c, rep, def)
+	}
+}
+
+// flushRowGroup writes a data page per column and resets the columns
+func (format *parquetExportWriter) flushRowGroup() error {
+	if format.offset == 0 {
+		if err := format.write([]byte("PAR1")); err != nil {
+			return err
+		}
+	}
+
+	rg := parquetRowGroup{numRows: format.rows}
+	for _, c := range format.columns {
+		data := c.encodePage()
+		header := thriftStruct(func(t *thriftWriter) {
+			t.i32(1, 0) // DATA_PAGE
+			t.i32(2, int32(len(data)))
+			t.i32(3, int32(len(data)))
+			t.strct(5, func() {
+				t.i32(1, int32(len(c.defLevels)))
+				t.i32(2, 0) // PLAIN
+				t.i32(3, 3) // RLE
+				t.i32(4, 3)
+			})
+		})
+
+		chunk := parquetChunk{offset: format.offset, size: int64(len(header) + len(data)), numValues: len(c.defLevels)}
+		if err := format.write(append(header, data...)); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+
+		c.repLevels = c.repLevels[:0]
+		c.defLevels = c.defLevels[:0]
+		c.values = c.values[:0]
+	}
+
+	format.rowGroups = append(format.rowGroups, rg)
+	format.rows = 0
+	return nil
+}
+
+func (format *parquetExportWriter) write(b []byte) error {
+	n, err := format.w.Write(b)
+	format.offset += int64(n)
+	return err
+}
+
+// encodePage encodes repetition and definition levels with the RLE/bit-packed hybrid
+// encoding followed by PLAIN encoded values
+func (c *parquetColumn) encodePage() []byte {
+	var buf bytes.Buffer
+
+	for _, l := range []struct {
+		levels []int
+		max    int
+	}{{c.repLevels, c.maxRep}, {c.defLevels, c.maxDef}} {
+		if l.max == 0 {
+			continue
+		}
+		levels := bitPackLevels(l.levels, levelWidth(l.max))
+		header := uvarint(uint64((len(l.levels)+7)/8)<<1 | 1)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(header)+len(levels)))
+		buf.Write(header)
+		buf.Write(levels)
+	}
+
+	if c.kind == "bool" {
+		bools := make([]int, len(c.values))
+		for i, v := range c.values {
+			if v.(bool) {
+				bools[i] = 1
+			}
+		}
+		buf.Write(bitPackLevels(bools, 1))
+		return buf.Bytes()
+	}
+
+	for _, v := range c.values {
+		switch tv := v.(type) {
+		case int64:
+			binary.Write(&buf, binary.LittleEndian, tv)
+		case float64:
+			binary.Write(&buf, binary.LittleEndian, math.Float64bits(tv))
+		case []byte:
+			binary.Write(&buf, binary.LittleEndian, uint32(len(tv)))
+			buf.Write(tv)
+		}
+	}
+	return buf.Bytes()
+}
+
+// levelWidth is the number of bits of levels up to max
+func levelWidth(max int) int {
+	width := 0
+	for ; max > 0; max >>= 1 {
+		width++
+	}
+	return width
+}
+
+// bitPackLevels packs the values with width bits each least significant bit first,
+// padded to groups of 8
+func bitPackLevels(values []int, width int) []byte {
+	b := make([]byte, (len(values)+7)/8*width)
+	for i, v := range values {
+		for bit := 0; bit < width; bit++ {
+			if v&(1<<uint(bit)) != 0 {
+				n := i*width + bit
+				b[n/8] |= 1 << uint(n%8)
+			}
+		}
+	}
+	return b
+}
+
+func (format *parquetExportWriter) fileMetaData() []byte {
+	numRows := 0
+	for _, rg := range format.rowGroups {
+		numRows += rg.numRows
+	}
+
+	var elements []func(t *thriftWriter)
+	var addElements func(record *columnField)
+	addElements = func(record *columnField) {
+		for _, f := range record.fields {
+			f := f
+			repetition := int32(parquetOptional)
+			if f.repeated {
+				repetition = parquetRepeated
+			}
+
+			if f.kind == "record" {
+				elements = append(elements, func(t *thriftWriter) {
+					t.i32(3, repetition)
+					t.str(4, f.name)
+					t.i32(5, int32(len(f.fields)))
+				})
+				addElements(f)
+				continue
+			}
+
+			typ, converted := parquetTypes(f.kind)
+			elements = append(elements, func(t *thriftWriter) {
+				t.i32(1, typ)
+				t.i32(3, repetition)
+				t.str(4, f.name)
+				if converted >= 0 {
+					t.i32(6, converted)
+				}
+			})
+		}
+	}
+	addElements(&format.schema.columnField)
+
+	return thriftStruct(func(t *thriftWriter) {
+		t.i32(1, 1)
+		t.list(2, thriftStructType, len(elements)+1)
+		t.nested(func() {
+			t.str(4, "schema")
+			t.i32(5, int32(len(format.schema.fields)))
+		})
+		for _, element := range elements {
+			t.nested(func() { element(t) })
+		}
+		t.i64(3, int64(numRows))
+
+		t.list(4, thriftStructType, len(format.rowGroups))
+		for _, rg := range format.rowGroups {
+			t.nested(func() {
+				var total int64
+				t.list(1, thriftStructType, len(rg.chunks))
+				for i, chunk := range rg.chunks {
+					c := format.columns[i]
+					typ, _ := parquetTypes(c.kind)
+					total += chunk.size
+
+					t.nested(func() {
+						t.i64(2, chunk.offset)
+						t.strct(3, func() {
+							t.i32(1, typ)
+							t.list(2, thriftI32Type, 2)
+							t.rawI32(0) // PLAIN
+							t.rawI32(3) // RLE
+							t.list(3, thriftBinaryType, len(c.path))
+							for _, name := range c.path {
+								t.rawStr(name)
+							}
+							t.i32(4, 0) // UNCOMPRESSED
+							t.i64(5, int64(chunk.numValues))
+							t.i64(6, chunk.size)
+							t.i64(7, chunk.size)
+							t.i64(9, chunk.offset)
+						})
+					})
+				}
+				t.i64(2, total)
+				t.i64(3, int64(rg.numRows))
+			})
+		}
+		t.str(6, "cdskit")
+	})
+}
+
+// parquetTypes returns the physical and converted type of a column kind, -1 for no converted type
+func parquetTypes(kind string) (int32, int32) {
+	switch kind {
+	case "int64":
+		return parquetInt64, -1
+	case "double":
+		return parquetDouble, -1
+	case "bool":
+		return parquetBoolean, -1
+	case "timestamp":
+		return parquetInt64, parquetTimestampMicros
+	case "bytes":
+		return parquetByteArray, -1
+	case "json":
+		return parquetByteArray, parquetJSON
+	default:
+		return parquetByteArray, parquetUTF8
+	}
+}
+
+// Thrift compact protocol types used by the Parquet metadata
+const (
+	thriftI32Type    = 5
+	thriftI64Type    = 6
+	thriftBinaryType = 8
+	thriftListType   = 9
+	thriftStructType = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, field IDs are
+// delta encoded against the previous field of the enclosing struct
+type thriftWriter struct {
+	bytes.Buffer
+	lastID []int16
+}
+
+// thriftStruct encodes the fields written by fn as a top-level struct
+func thriftStruct(fn func(t *thriftWriter)) []byte {
+	t := &thriftWriter{}
+	t.nested(func() { fn(t) })
+	return t.Bytes()
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastID[len(t.lastID)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.Write(uvarint(uint64(v<<1 ^ v>>63)))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32Type)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64Type)
+	t.varint(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinaryType)
+	t.rawStr(s)
+}
+
+// rawI32 and rawStr write list elements, which have no field header
+func (t *thriftWriter) rawI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) rawStr(s string) {
+	t.Write(uvarint(uint64(len(s))))
+	t.WriteString(s)
+}
+
+func (t *thriftWriter) strct(id int16, fn func()) {
+	t.field(id, thriftStructType)
+	t.nested(fn)
+}
+
+// nested writes a struct without a field header, as a list element or the top-level struct
+func (t *thriftWriter) nested(fn func()) {
+	t.lastID = append(t.lastID, 0)
+	fn()
+	t.WriteByte(0)
+	t.lastID = t.lastID[:len(t.lastID)-1]
+}
+
+func uvarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func (t *thriftWriter) list(id int16, elemType byte, n int) {
+	t.field(id, thriftListType)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		t.WriteByte(0xf0 | elemType)
+		t.Write(uvarint(uint64(n)))
+	}
+}
@@ -0,0 +1,317 @@
+package cdskit
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps of field IDs, integers
+// are int64, binaries strings and lists slices
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	u := r.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *thriftReader) strct() map[int16]interface{} {
+	m := make(map[int16]interface{})
+	var id int16
+	for {
+		b := r.byte()
+		if b == 0 {
+			return m
+		}
+		if d := b >> 4; d != 0 {
+			id += int16(d)
+		} else {
+			id = int16(r.zigzag())
+		}
+		m[id] = r.value(b & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case 3:
+		return int64(r.byte())
+	case 4, 5, 6:
+		return r.zigzag()
+	case 7:
+		v := math.Float64frombits(binary.LittleEndian.Uint64(r.b[r.pos:]))
+		r.pos += 8
+		return v
+	case 8:
+		n := int(r.uvarint())
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case 9, 10:
+		h := r.byte()
+		n, elem := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if elem == 1 || elem == 2 {
+				list[i] = r.byte() == 1
+				continue
+			}
+			list[i] = r.value(elem)
+		}
+		return list
+	case 12:
+		return r.strct()
+	default:
+		panic("unsupported thrift type")
+	}
+}
+
+// parquetLevel is a value of a leaf column with its repetition and definition level,
+// byte arrays are strings and missing values nil
+type parquetLevel struct {
+	rep, def int
+	value    interface{}
+}
+
+type parquetLeaf struct {
+	path           string
+	typ, converted int64
+	maxRep, maxDef int
+}
+
+// readParquet decodes an uncompressed Parquet file into its number of rows and the
+// levels and values of every leaf column by dotted path
+func readParquet(t *testing.T, b []byte) (int64, map[string]parquetLeaf, map[string][]parquetLevel) {
+	t.Helper()
+
+	if string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		t.Fatalf("no PAR1 magic")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&thriftReader{b: b[len(b)-8-size : len(b)-8]}).strct()
+
+	// leaves in schema order, which is the order of the column chunks
+	elements := meta[2].([]interface{})
+	var leaves []parquetLeaf
+	pos := 1
+	var walk func(n int, path []string, rep, def int)
+	walk = func(n int, path []string, rep, def int) {
+		for i := 0; i < n; i++ {
+			e := elements[pos].(map[int16]interface{})
+			pos++
+			p := append(append([]string{}, path...), e[4].(string))
+			r, d := rep, def
+			if e[3].(int64) != 0 {
+				d++
+			}
+			if e[3].(int64) == 2 {
+				r++
+			}
+			if children, ok := e[5].(int64); ok {
+				walk(int(children), p, r, d)
+				continue
+			}
+			converted := int64(-1)
+			if c, ok := e[6].(int64); ok {
+				converted = c
+			}
+			leaves = append(leaves, parquetLeaf{path: strings.Join(p, "."), typ: e[1].(int64), converted: converted, maxRep: r, maxDef: d})
+		}
+	}
+	walk(int(elements[0].(map[int16]interface{})[5].(int64)), nil, 0, 0)
+
+	schema := make(map[string]parquetLeaf)
+	columns := make(map[string][]parquetLevel)
+	for _, rg := range meta[4].([]interface{}) {
+		for i, chunk := range rg.(map[int16]interface{})[1].([]interface{}) {
+			leaf := leaves[i]
+			schema[leaf.path] = leaf
+			cm := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			var path []string
+			for _, p := range cm[3].([]interface{}) {
+				path = append(path, p.(string))
+			}
+			if strings.Join(path, ".") != leaf.path || cm[4].(int64) != 0 {
+				t.Fatalf("column chunk %d is %v with codec %d, want %s uncompressed", i, path, cm[4], leaf.path)
+			}
+
+			r := &thriftReader{b: b, pos: int(cm[9].(int64))}
+			header := r.strct()
+			data := b[r.pos : r.pos+int(header[3].(int64))]
+			n := int(header[5].(map[int16]interface{})[1].(int64))
+			columns[leaf.path] = append(columns[leaf.path], decodeParquetPage(t, data, leaf, n)...)
+		}
+	}
+	return meta[3].(int64), schema, columns
+}
+
+// decodeParquetPage decodes the levels and PLAIN values of a data page
+func decodeParquetPage(t *testing.T, data []byte, leaf parquetLeaf, n int) []parquetLevel {
+	t.Helper()
+
+	levels := func(max int) []int {
+		if max == 0 {
+			return make([]int, n)
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		l := decodeHybrid(data[4:4+size], levelWidth(max), n)
+		data = data[4+size:]
+		return l
+	}
+	reps, defs := levels(leaf.maxRep), levels(leaf.maxDef)
+
+	var out []parquetLevel
+	bit := 0
+	for i := 0; i < n; i++ {
+		l := parquetLevel{rep: reps[i], def: defs[i]}
+		if l.def == leaf.maxDef {
+			switch leaf.typ {
+			case 0:
+				l.value = data[bit/8]&(1<<uint(bit%8)) != 0
+				bit++
+			case 2:
+				l.value = int64(binary.LittleEndian.Uint64(data))
+				data = data[8:]
+			case 5:
+				l.value = math.Float64frombits(binary.LittleEndian.Uint64(data))
+				data = data[8:]
+			case 6:
+				size := int(binary.LittleEndian.Uint32(data))
+				l.value = string(data[4 : 4+size])
+				data = data[4+size:]
+			default:
+				t.Fatalf("unsupported physical type %d", leaf.typ)
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// decodeHybrid decodes n values of the RLE/bit-packed hybrid encoding
+func decodeHybrid(b []byte, width int, n int) []int {
+	var out []int
+	pos := 0
+	for len(out) < n {
+		h, k := binary.Uvarint(b[pos:])
+		pos += k
+		if h&1 == 1 {
+			groups := int(h >> 1)
+			for i := 0; i < groups*8; i++ {
+				v := 0
+				for bit := 0; bit < width; bit++ {
+					nbit := i*width + bit
+					if b[pos+nbit/8]&(1<<uint(nbit%8)) != 0 {
+						v |= 1 << uint(bit)
+					}
+				}
+				out = append(out, v)
+			}
+			pos += groups * width
+			continue
+		}
+
+		v := 0
+		for i := 0; i < (width+7)/8; i++ {
+			v |= int(b[pos+i]) << uint(8*i)
+		}
+		pos += (width + 7) / 8
+		for i := 0; i < int(h>>1); i++ {
+			out = append(out, v)
+		}
+	}
+	return out[:n]
+}
+
+func TestExportParquet(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 30, 0, 250000000, time.UTC)
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{
+			"name":    "a",
+			"n":       1,
+			"price":   1.5,
+			"ok":      true,
+			"created": created,
+			"data":    []byte{0, 1},
+			"tags":    []interface{}{1, 2},
+			"address": map[string]interface{}{"city": "Berlin"},
+		}),
+		fakeEntity("Item", 2, map[string]interface{}{
+			"name":    "b",
+			"n":       2,
+			"price":   2.0,
+			"ok":      false,
+			"created": created.Add(time.Hour),
+			"data":    []byte{9},
+		}),
+	}
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "parquet", "no-key": true})
+
+	rows, schema, columns := readParquet(t, []byte(out))
+	if rows != 2 {
+		t.Errorf("file has %d rows, want 2", rows)
+	}
+
+	types := map[string][2]int64{
+		"address.city": {6, 0},
+		"created":      {2, 10},
+		"data":         {6, -1},
+		"n":            {2, -1},
+		"name":         {6, 0},
+		"ok":           {0, -1},
+		"price":        {5, -1},
+		"tags":         {2, -1},
+	}
+	for path, want := range types {
+		if got := schema[path]; [2]int64{got.typ, got.converted} != want {
+			t.Errorf("column %s has type and converted type %d/%d, want %v", path, got.typ, got.converted, want)
+		}
+	}
+
+	micros := created.UnixNano() / 1000
+	want := map[string][]parquetLevel{
+		"address.city": {{0, 2, "Berlin"}, {0, 0, nil}},
+		"created":      {{0, 1, micros}, {0, 1, micros + 3600e6}},
+		"data":         {{0, 1, "\x00\x01"}, {0, 1, "\x09"}},
+		"n":            {{0, 1, int64(1)}, {0, 1, int64(2)}},
+		"name":         {{0, 1, "a"}, {0, 1, "b"}},
+		"ok":           {{0, 1, true}, {0, 1, false}},
+		"price":        {{0, 1, 1.5}, {0, 1, 2.0}},
+		"tags":         {{0, 1, int64(1)}, {1, 1, int64(2)}, {0, 0, nil}},
+	}
+	if len(columns) != len(want) {
+		t.Errorf("file has columns %v, want %d", reflect.ValueOf(columns).MapKeys(), len(want))
+	}
+	for path, levels := range want {
+		if got := columns[path]; !reflect.DeepEqual(got, levels) {
+			t.Errorf("column %s has %v, want %v", path, got, levels)
+		}
+	}
+}
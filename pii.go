@@ -0,0 +1,115 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+
+	"cloud.google.com/go/datastore"
+)
+
+type piiPattern struct {
+	name  string
+	re    *regexp.Regexp
+	check func(string) bool
+}
+
+var piiPatterns = []piiPattern{
+	{name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "phone", re: regexp.MustCompile(`(?:^|[^\d])\+?\d{1,3}[ .-]?\(?\d{2,4}\)?[ .-]?\d{3,4}[ .-]?\d{3,4}(?:[^\d]|$)`)},
+	{name: "credit-card", re: regexp.MustCompile(`(?:\d[ -]?){12,18}\d`), check: luhnValid},
+	{name: "ssn", re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+}
+
+// luhnValid reports whether digits of s pass the Luhn checksum used by card numbers
+func luhnValid(s string) bool {
+	var digits []int
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return len(digits) > 0 && sum%10 == 0
+}
+
+func (p piiPattern) matches(s string) bool {
+	m := p.re.FindString(s)
+	if m == "" {
+		return false
+	}
+	return p.check == nil || p.check(m)
+}
+
+// detectPII samples the kind and prints fields whose values look like personal data
+func (cmd *ExportKindCmd) detectPII(ctx context.Context, client *datastore.Client) error {
+	infof("Sampling %d entities of '%s' for personal data", cmd.PIISample, cmd.Kind)
+
+	batch, _, err := fetchPage(ctx, client, cmd.newQuery().Limit(cmd.PIISample), cmd.valueOptions())
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]int)
+	matched := make(map[string]map[string]int)
+	for _, de := range batch {
+		traverse(de.value, func(field string, val interface{}) {
+			present[field]++
+
+			s, ok := val.(string)
+			if !ok {
+				return
+			}
+
+			for _, p := range piiPatterns {
+				if p.matches(s) {
+					if matched[field] == nil {
+						matched[field] = make(map[string]int)
+					}
+					matched[field][p.name]++
+				}
+			}
+		})
+	}
+
+	fields := make([]string, 0, len(matched))
+	for field := range matched {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	if len(fields) == 0 {
+		infof("No personal data found in %d entities", len(batch))
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tPATTERN\tMATCHES\tRATE")
+	for _, field := range fields {
+		names := make([]string, 0, len(matched[field]))
+		for name := range matched[field] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			n := matched[field][name]
+			fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%.1f%%\n", field, name, n, present[field], 100*float64(n)/float64(present[field]))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,128 @@
+package cdskit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultConfigFile is the file profiles are read from without --config
+const DefaultConfigFile = "~/.cdskit.yaml"
+
+// LoadProfile returns the options of the named profile of the config file, keys are long
+// option names without the leading --. The file is a small subset of YAML:
+//
+//	profiles:
+//	  staging:
+//	    project: my-staging
+//	    namespace: tenant-a
+//	    credentials-file: ~/keys/staging.json
+//	    output-dir: exports/staging
+func LoadProfile(path string, name string) (map[string]string, error) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read profiles: %w", err)
+	}
+	defer f.Close()
+
+	profiles := make(map[string]map[string]string)
+	var section, profile string
+	var profileIndent, optionIndent int
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		i := strings.Index(line, ":")
+		if line[indent] == '\t' || i < 0 {
+			return nil, fmt.Errorf("Invalid line %d of %s, expected key: value indented by spaces", n, path)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch {
+		case indent == 0:
+			section, profile = key, ""
+			if value != "" {
+				return nil, fmt.Errorf("Invalid line %d of %s, %s has to be a mapping", n, path, key)
+			}
+		case section != "profiles":
+			// other sections are left for later versions
+		case profile == "" || indent <= profileIndent:
+			if value != "" {
+				return nil, fmt.Errorf("Invalid line %d of %s, profile %s has to be a mapping", n, path, key)
+			}
+			profile, profileIndent, optionIndent = key, indent, 0
+			profiles[profile] = make(map[string]string)
+		default:
+			if optionIndent == 0 {
+				optionIndent = indent
+			}
+			if indent != optionIndent {
+				return nil, fmt.Errorf("Invalid line %d of %s, options of profile %s have to be indented alike", n, path, profile)
+			}
+
+			v, err := unquoteYAML(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid line %d of %s: %w", n, path, err)
+			}
+			profiles[profile][key] = expandHome(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	options, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("No profile %s in %s", name, path)
+	}
+	return options, nil
+}
+
+// stripYAMLComment removes a # comment unless it's within quotes
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' '):
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+	return strings.TrimRight(line, " ")
+}
+
+func unquoteYAML(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	default:
+		return s, nil
+	}
+}
+
+// expandHome replaces a leading ~/ with the home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,150 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// etaWindow is the number of recent batches the throughput is measured over
+const etaWindow = 10
+
+// progressETA estimates the remaining time of an export of a known size
+type progressETA struct {
+	total   int
+	samples []progressSample
+}
+
+type progressSample struct {
+	at    time.Time
+	count int
+}
+
+func newProgressETA(total int) *progressETA {
+	return &progressETA{total: total, samples: []progressSample{{at: time.Now()}}}
+}
+
+// update records the number of exported entities and returns the percent complete
+// and the ETA based on the throughput of the recent batches, the ETA is negative
+// when it can't be estimated yet
+func (p *progressETA) update(count int) (int, time.Duration) {
+	p.samples = append(p.samples, progressSample{at: time.Now(), count: count})
+	if len(p.samples) > etaWindow+1 {
+		p.samples = p.samples[1:]
+	}
+
+	percent := 100
+	if p.total > 0 && count < p.total {
+		percent = count * 100 / p.total
+	}
+
+	first := p.samples[0]
+	elapsed := time.Since(first.at)
+	if count <= first.count || elapsed <= 0 || count >= p.total {
+		return percent, -1
+	}
+
+	rate := float64(count-first.count) / elapsed.Seconds()
+	return percent, time.Duration(float64(p.total-count) / rate * float64(time.Second))
+}
+
+// storeProgress sets the counter of a job run by serve, commands run from the
+// command line have none
+func storeProgress(counter *int64, n int) {
+	if counter != nil {
+		atomic.StoreInt64(counter, int64(n))
+	}
+}
+
+// progressReporter prints the progress of an export after every batch, as text or
+// as JSON lines given by --progress-json
+type progressReporter struct {
+	kind    string
+	started time.Time
+	total   int
+	eta     *progressETA
+	written *int64
+	json    bool
+	quiet   bool
+}
+
+// progressLine is the progress written by --progress-json
+type progressLine struct {
+	Kind     string   `json:"kind"`
+	Entities int      `json:"entities"`
+	Total    int      `json:"total,omitempty"`
+	Percent  int      `json:"percent,omitempty"`
+	Bytes    int64    `json:"bytes"`
+	Elapsed  float64  `json:"elapsed_seconds"`
+	Rate     float64  `json:"entities_per_second"`
+	ETA      *float64 `json:"eta_seconds,omitempty"`
+}
+
+func (p *progressReporter) report(count int) {
+	if p.quiet {
+		return
+	}
+
+	elapsed := time.Since(p.started)
+	line := progressLine{Kind: p.kind, Entities: count, Total: p.total, Bytes: atomic.LoadInt64(p.written), Elapsed: elapsed.Seconds()}
+	if elapsed > 0 {
+		line.Rate = float64(count) / elapsed.Seconds()
+	}
+
+	eta := time.Duration(-1)
+	if p.eta != nil {
+		line.Percent, eta = p.eta.update(count)
+		if eta >= 0 {
+			seconds := eta.Seconds()
+			line.ETA = &seconds
+		}
+	}
+
+	if p.json {
+		b, _ := json.Marshal(line)
+		fmt.Fprintln(os.Stderr, string(b))
+		return
+	}
+	if !logEnabled(logInfo) {
+		return
+	}
+
+	msg := fmt.Sprintf("Exporting %s - %d, %.0f/s, %s, %s elapsed", p.kind, count, line.Rate, formatBytes(line.Bytes), elapsed.Round(time.Second))
+	if p.eta != nil {
+		msg += fmt.Sprintf(", %d%%", line.Percent)
+		if eta >= 0 {
+			msg += fmt.Sprintf(" (ETA %s)", eta.Round(time.Second))
+		}
+	}
+	logEvent(logInfo, logFields{"event": "progress", "progress": line}, "%s", msg)
+}
+
+// formatBytes renders the size in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// countingWriter adds the number of bytes written to n
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,70 @@
+package cdskit
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// checkProjection loads a sample entity to decide whether the --field properties can
+// be queried by a projection query. Projection queries skip entities with the properties
+// unindexed and return arrays element by element, such fields are pruned from full
+// entities instead.
+func (cmd *ExportKindCmd) checkProjection(ctx context.Context, client *datastore.Client) error {
+	var sample []datastore.PropertyList
+	if _, err := client.GetAll(ctx, cmd.newQuery().Limit(1), &sample); err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(cmd.Fields))
+	for _, f := range cmd.Fields {
+		wanted[f] = true
+	}
+
+	cmd.projection = cmd.Fields
+	for _, props := range sample {
+		for _, p := range props {
+			if !wanted[p.Name] {
+				continue
+			}
+
+			reason := ""
+			switch typ := datastoreType(p.Value); {
+			case p.NoIndex:
+				reason = "isn't indexed"
+			case typ == "array" || typ == "entity":
+				reason = "is of type " + typ
+			}
+			if reason != "" {
+				infof("Field %s %s, loading full entities and dropping other fields", p.Name, reason)
+				cmd.projection = nil
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// projectFields keeps only the given properties of an entity
+func projectFields(de *dynamicEntity, fields []string) {
+	keep := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		keep[f] = true
+	}
+
+	for name := range de.value {
+		if !keep[name] {
+			delete(de.value, name)
+		}
+	}
+
+	if de.props != nil {
+		props := de.props[:0]
+		for _, p := range de.props {
+			if keep[p.Name] {
+				props = append(props, p)
+			}
+		}
+		de.props = props
+	}
+}
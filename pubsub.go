@@ -0,0 +1,90 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// pubsubExportWriter publishes every record as a separate JSON message
+// with the kind and the encoded key as attributes.
+type pubsubExportWriter struct {
+	ctx         context.Context
+	client      *pubsub.Client
+	topic       *pubsub.Topic
+	kind        string
+	orderingKey string
+	pending     []*pubsub.PublishResult
+}
+
+// newPubSubExportWriter connects to the topic given as pubsub://project/topic,
+// ordered writer publishes all messages with the kind as the ordering key.
+func newPubSubExportWriter(ctx context.Context, url string, kind string, ordered bool) (*pubsubExportWriter, error) {
+	parts := strings.Split(strings.TrimPrefix(url, "pubsub://"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid Pub/Sub output, expected pubsub://project/topic: %s", url)
+	}
+
+	client, err := pubsub.NewClient(ctx, parts[0], clientOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	format := &pubsubExportWriter{ctx: ctx, client: client, topic: client.Topic(parts[1]), kind: kind}
+	if ordered {
+		format.topic.EnableMessageOrdering = true
+		format.orderingKey = kind
+	}
+	return format, nil
+}
+
+func (format *pubsubExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *pubsubExportWriter) WriterRecord(de *dynamicEntity) error {
+	data, err := de.ToJSON()
+	if err != nil {
+		return fmt.Errorf("Unable to marshal entry: %w", err)
+	}
+
+	msg := &pubsub.Message{
+		Data:        data,
+		Attributes:  map[string]string{"kind": format.kind},
+		OrderingKey: format.orderingKey,
+	}
+	if de.key != nil {
+		msg.Attributes["key"] = de.key.Encode()
+	}
+
+	format.pending = append(format.pending, format.topic.Publish(format.ctx, msg))
+	if len(format.pending) >= 1000 {
+		if err := format.wait(); err != nil {
+			return &outputError{err}
+		}
+	}
+	return nil
+}
+
+// wait blocks until all pending messages are published
+func (format *pubsubExportWriter) wait() error {
+	for _, r := range format.pending {
+		if _, err := r.Get(format.ctx); err != nil {
+			return fmt.Errorf("Unable to publish entry: %w", err)
+		}
+	}
+	format.pending = format.pending[:0]
+	return nil
+}
+
+func (format *pubsubExportWriter) WriteFooter() error {
+	err := format.wait()
+	format.topic.Stop()
+	return err
+}
+
+func (format *pubsubExportWriter) Close() error {
+	return format.client.Close()
+}
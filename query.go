@@ -0,0 +1,268 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QueryCmd runs a GQL query and writes its results as export-kind does
+type QueryCmd struct {
+	ProjectID string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace string `short:"n" long:"namespace" description:"Namespace to query"`
+	GQL       string `long:"gql" description:"Query as SELECT * | properties FROM Kind [WHERE property OP value [AND ...]] [ORDER BY property [ASC | DESC], ...] [LIMIT n] [OFFSET n], values are strings in quotes, numbers, true, false or DATETIME('RFC3339 time')" required:"true"`
+	Format    string `long:"format" default:"json" choice:"csv" choice:"json" choice:"jsonl" choice:"ndjson" description:"One of the follwing formats: csv, json, jsonl or ndjson"`
+	Output    string `short:"o" long:"output" description:"File to write the results to, stdout by default"`
+}
+
+// Execute is called by go-flags
+func (cmd *QueryCmd) Execute(args []string) error {
+	options, err := parseGQL(cmd.GQL)
+	if err != nil {
+		return err
+	}
+
+	options["project"] = cmd.ProjectID
+	options["namespace"] = cmd.Namespace
+	options["format"] = cmd.Format
+	options["output"] = cmd.Output
+	if cmd.Output == "" {
+		options["output"] = "-"
+	}
+
+	job, err := parseExportJob(options)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext(true)
+	defer cancel()
+	return job.run(ctx)
+}
+
+// gqlToken is a word, an operator or a quoted literal of a GQL query
+type gqlToken struct {
+	text string
+	// quote is the quote character of a literal or a `name`, 0 otherwise
+	quote byte
+}
+
+// keyword checks the token is the unquoted keyword in any case
+func (t gqlToken) keyword(kw string) bool {
+	return t.quote == 0 && strings.EqualFold(t.text, kw)
+}
+
+// tokenizeGQL splits the query into tokens, quotes inside literals are escaped by doubling them
+func tokenizeGQL(s string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						b.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("Unterminated %c in query", c)
+			}
+			tokens = append(tokens, gqlToken{text: b.String(), quote: c})
+			i = j + 1
+		case strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			tokens = append(tokens, gqlToken{text: s[i : i+2]})
+			i += 2
+		case strings.IndexByte("=<>,*()", c) >= 0:
+			tokens = append(tokens, gqlToken{text: s[i : i+1]})
+			i++
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n\r'\"`=<>,*()", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, gqlToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseGQL translates a GQL query into export-kind options
+func parseGQL(query string) (map[string]interface{}, error) {
+	tokens, err := tokenizeGQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := 0
+	peek := func() gqlToken {
+		if pos < len(tokens) {
+			return tokens[pos]
+		}
+		return gqlToken{}
+	}
+	next := func() gqlToken {
+		t := peek()
+		pos++
+		return t
+	}
+	expect := func(kw string) error {
+		if t := next(); !t.keyword(kw) {
+			return fmt.Errorf("Expected %s in query, found %q", kw, t.text)
+		}
+		return nil
+	}
+	name := func(what string) (string, error) {
+		t := next()
+		if t.text == "" || (t.quote != 0 && t.quote != '`') {
+			return "", fmt.Errorf("Expected %s in query, found %q", what, t.text)
+		}
+		return t.text, nil
+	}
+
+	options := make(map[string]interface{})
+
+	if err := expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if peek().text == "*" && peek().quote == 0 {
+		next()
+	} else {
+		var fields []interface{}
+		for {
+			field, err := name("property")
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			if peek().text != "," {
+				break
+			}
+			next()
+		}
+		options["field"] = fields
+	}
+
+	if err := expect("FROM"); err != nil {
+		return nil, err
+	}
+	kind, err := name("kind")
+	if err != nil {
+		return nil, err
+	}
+	options["kind"] = kind
+
+	if peek().keyword("WHERE") {
+		next()
+		var filters []interface{}
+		for {
+			field, err := name("property")
+			if err != nil {
+				return nil, err
+			}
+
+			op := next()
+			switch op.text {
+			case "=", "<", "<=", ">", ">=":
+			default:
+				return nil, fmt.Errorf("Unsupported operator %q in query, expected one of =, <, <=, >, >=", op.text)
+			}
+
+			value, err := gqlValue(next)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, field+" "+op.text+" "+value)
+
+			if !peek().keyword("AND") {
+				break
+			}
+			next()
+		}
+		options["filter"] = filters
+	}
+
+	if peek().keyword("ORDER") {
+		next()
+		if err := expect("BY"); err != nil {
+			return nil, err
+		}
+
+		var orders []interface{}
+		for {
+			field, err := name("property")
+			if err != nil {
+				return nil, err
+			}
+			if peek().keyword("DESC") {
+				next()
+				field = "-" + field
+			} else if peek().keyword("ASC") {
+				next()
+			}
+			orders = append(orders, field)
+
+			if peek().text != "," {
+				break
+			}
+			next()
+		}
+		options["order-by"] = orders
+	}
+
+	for _, clause := range []string{"LIMIT", "OFFSET"} {
+		if peek().keyword(clause) {
+			next()
+			n := next()
+			if _, err := json.Number(n.text).Int64(); err != nil || n.quote != 0 {
+				return nil, fmt.Errorf("Expected a number after %s in query, found %q", clause, n.text)
+			}
+			options[strings.ToLower(clause)] = json.Number(n.text)
+		}
+	}
+
+	if pos < len(tokens) {
+		return nil, fmt.Errorf("Unsupported query clause starting at %q", tokens[pos].text)
+	}
+	return options, nil
+}
+
+// gqlValue reads a literal of a condition and renders it as a --filter value
+func gqlValue(next func() gqlToken) (string, error) {
+	t := next()
+	switch {
+	case t.quote == '\'' || t.quote == '"':
+		return "'" + t.text + "'", nil
+	case t.keyword("DATETIME"):
+		if next().text != "(" {
+			return "", fmt.Errorf("Expected ( after DATETIME in query")
+		}
+		v := next()
+		if next().text != ")" {
+			return "", fmt.Errorf("Expected ) after the DATETIME value in query")
+		}
+		if _, err := time.Parse(time.RFC3339Nano, v.text); err != nil {
+			return "", fmt.Errorf("Invalid DATETIME value in query: %w", err)
+		}
+		return v.text, nil
+	case t.keyword("true"), t.keyword("false"):
+		return strings.ToLower(t.text), nil
+	case t.quote == 0 && t.text != "":
+		if _, err := json.Number(t.text).Float64(); err != nil {
+			return "", fmt.Errorf("Unsupported value %q in query, strings have to be quoted", t.text)
+		}
+		return t.text, nil
+	default:
+		return "", fmt.Errorf("Expected a value in query")
+	}
+}
@@ -0,0 +1,80 @@
+package cdskit
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// adaptiveRate is an AIMD controller of the delay between batches. The delay grows
+// multiplicatively on contention errors and on latency spikes and shrinks additively
+// while requests succeed, so the request rate backs off quickly and recovers slowly.
+type adaptiveRate struct {
+	delay   time.Duration
+	step    time.Duration
+	max     time.Duration
+	latency time.Duration // moving average of successful requests
+}
+
+func newAdaptiveRate() *adaptiveRate {
+	return &adaptiveRate{step: 50 * time.Millisecond, max: time.Minute}
+}
+
+// isContention reports whether the error means datastore is overloaded and the request can be retried
+func isContention(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps for the current delay
+func (r *adaptiveRate) wait(ctx context.Context) error {
+	if r.delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(r.delay)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// observe adjusts the delay according to the outcome of a request
+func (r *adaptiveRate) observe(latency time.Duration, err error) {
+	congested := isContention(err) || (err == nil && r.latency > 0 && latency > 2*r.latency)
+
+	if err == nil {
+		if r.latency == 0 {
+			r.latency = latency
+		} else {
+			r.latency = (r.latency*7 + latency) / 8
+		}
+	}
+
+	if congested {
+		r.delay *= 2
+		if r.delay < r.step {
+			r.delay = r.step
+		}
+		if r.delay > r.max {
+			r.delay = r.max
+		}
+		warnf("Backing off, delay between batches is %s", r.delay)
+		return
+	}
+
+	r.delay -= r.step
+	if r.delay < 0 {
+		r.delay = 0
+	}
+}
@@ -0,0 +1,141 @@
+package cdskit
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// redactMethods replace a property value, the same value and salt always give the same
+// replacement so redacted exports still join on the replaced properties
+var redactMethods = map[string]func(s string, seed []byte) string{
+	"mask": maskValue,
+	"hash": func(s string, seed []byte) string { return hex.EncodeToString(seed) },
+	"fake-name": func(s string, seed []byte) string {
+		return pick(fakeFirstNames, seed, 0) + " " + pick(fakeLastNames, seed, 1)
+	},
+	"fake-email": func(s string, seed []byte) string {
+		return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(pick(fakeFirstNames, seed, 0)), strings.ToLower(pick(fakeLastNames, seed, 1)), seed[2]%100)
+	},
+	"fake-phone": func(s string, seed []byte) string {
+		return fmt.Sprintf("+1-555-%03d-%04d", binary.BigEndian.Uint16(seed[0:])%1000, binary.BigEndian.Uint16(seed[2:])%10000)
+	},
+	"fake-address": func(s string, seed []byte) string {
+		return fmt.Sprintf("%d %s %s", 1+binary.BigEndian.Uint16(seed[0:])%9999, pick(fakeLastNames, seed, 2), pick(fakeStreetTypes, seed, 3))
+	},
+	// remove is handled by dropping the property
+	"remove": nil,
+}
+
+var (
+	fakeFirstNames  = []string{"Alex", "Ana", "Ben", "Chen", "Dana", "Elena", "Farid", "Grace", "Hugo", "Ines", "Jonas", "Kira", "Liam", "Maya", "Noah", "Olga", "Priya", "Quinn", "Rosa", "Sam", "Tariq", "Uma", "Victor", "Wen", "Yusuf", "Zoe"}
+	fakeLastNames   = []string{"Adams", "Berger", "Costa", "Dubois", "Evans", "Fischer", "Garcia", "Hansen", "Ito", "Jensen", "Kowalski", "Larsen", "Moreau", "Novak", "Olsen", "Petrov", "Quinn", "Rossi", "Silva", "Tanaka", "Urban", "Vargas", "Walsh", "Young", "Zimmer"}
+	fakeStreetTypes = []string{"Street", "Avenue", "Road", "Lane", "Way", "Drive"}
+)
+
+func pick(values []string, seed []byte, i int) string {
+	return values[int(seed[i])%len(values)]
+}
+
+// maskValue keeps the last 4 characters of values long enough to stay unidentifiable
+func maskValue(s string, seed []byte) string {
+	r := []rune(s)
+	keep := 0
+	if len(r) >= 8 {
+		keep = 4
+	}
+	return strings.Repeat("*", len(r)-keep) + string(r[len(r)-keep:])
+}
+
+// parseRedactions maps properties of --redact to the --redact-mode and the
+// property:method pairs of --anonymize to their methods
+func parseRedactions(redact []string, mode string, anonymize []string) (map[string]string, error) {
+	redactions := make(map[string]string)
+	for _, s := range redact {
+		for _, field := range strings.Split(s, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				redactions[field] = mode
+			}
+		}
+	}
+
+	for _, s := range anonymize {
+		for _, pair := range strings.Split(s, ",") {
+			i := strings.LastIndex(pair, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("Invalid --anonymize, expected property:method: %s", pair)
+			}
+
+			field, method := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+			if _, ok := redactMethods[method]; !ok {
+				return nil, fmt.Errorf("Unsupported anonymization method '%s' for %s, expected one of fake-name, fake-email, fake-phone, fake-address, mask, hash or remove", method, field)
+			}
+			redactions[field] = method
+		}
+	}
+	return redactions, nil
+}
+
+// redact replaces the --redact and --anonymize properties of the loaded entity
+func (cmd *ExportKindCmd) redact(de *dynamicEntity) {
+	for field, method := range cmd.redactions {
+		redactField(de.value, strings.Split(field, ":"), method, cmd.RedactSalt)
+	}
+}
+
+// redactField replaces the property at the path of nested property names, elements
+// of arrays are replaced one by one
+func redactField(m map[string]interface{}, path []string, method string, salt string) {
+	v, ok := m[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) > 1 {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			redactField(v, path[1:], method, salt)
+		case []interface{}:
+			for _, e := range v {
+				if e, ok := e.(map[string]interface{}); ok {
+					redactField(e, path[1:], method, salt)
+				}
+			}
+		}
+		return
+	}
+
+	if method == "remove" {
+		delete(m, path[0])
+		return
+	}
+	m[path[0]] = redactValue(v, method, salt)
+}
+
+func redactValue(v interface{}, method string, salt string) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			values = append(values, redactValue(e, method, salt))
+		}
+		return values
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			b = []byte(fmt.Sprint(v))
+		}
+		s = string(b)
+	}
+
+	seed := sha256.Sum256([]byte(salt + "\x00" + s))
+	return redactMethods[method](s, seed[:])
+}
@@ -0,0 +1,126 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// withRetries calls fn until it succeeds, fails with an error other than contention
+// or the retries run out, waiting about twice as long after every failed attempt.
+// Calls are throttled by --max-rps.
+func withRetries(ctx context.Context, retries int, fn func() error) error {
+	delay := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if err := callLimiter.wait(ctx); err != nil {
+			return err
+		}
+
+		err := fn()
+		if err == nil || attempt >= retries || !isContention(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// jitter keeps concurrent workers from retrying in lockstep
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+		logEvent(logWarn, logFields{"event": "retry", "attempt": attempt + 1, "retries": retries, "wait_seconds": wait.Seconds(), "error": err.Error()},
+			"Retrying in %s after error: %v", wait.Round(time.Millisecond), err)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// allocateIDs replaces the incomplete keys with keys of IDs allocated by Datastore before
+// they're put, a retried put of a batch that was applied overwrites the same entities then
+// instead of adding them once more
+func allocateIDs(ctx context.Context, client *datastore.Client, keys []*datastore.Key, retries int) error {
+	var incomplete []*datastore.Key
+	var at []int
+	for i, k := range keys {
+		if k.Incomplete() {
+			incomplete = append(incomplete, k)
+			at = append(at, i)
+		}
+	}
+	if len(incomplete) == 0 {
+		return nil
+	}
+
+	var allocated []*datastore.Key
+	err := withRetries(ctx, retries, func() (err error) {
+		allocated, err = client.AllocateIDs(ctx, incomplete)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to allocate IDs: %w", err)
+	}
+	for n, k := range allocated {
+		keys[at[n]] = k
+	}
+	return nil
+}
+
+// callLimiter spaces Datastore calls made with retries, set by --max-rps
+var callLimiter = &limiter{}
+
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// SetMaxRPS limits Datastore calls to n per second, 0 removes the limit
+func SetMaxRPS(n float64) {
+	callLimiter.mu.Lock()
+	defer callLimiter.mu.Unlock()
+
+	callLimiter.interval = 0
+	if n > 0 {
+		callLimiter.interval = time.Duration(float64(time.Second) / n)
+	}
+}
+
+// wait blocks until the next call is allowed
+func (l *limiter) wait(ctx context.Context) error {
+	return l.waitN(ctx, 1)
+}
+
+// waitN blocks until n more calls, or bytes of --max-bandwidth, are allowed
+func (l *limiter) waitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.interval == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+
+	t := time.NewTimer(time.Until(at))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
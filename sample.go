@@ -0,0 +1,50 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+)
+
+// parseSample parses random:N given by --sample
+func parseSample(s string) (int, error) {
+	if !strings.HasPrefix(s, "random:") {
+		return 0, fmt.Errorf("Invalid --sample %s, expected random:N", s)
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "random:"))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid --sample %s, expected random:N with N at least 1", s)
+	}
+	return n, nil
+}
+
+// sampleKeys picks n keys ordered by the __scatter__ property, which Datastore sets
+// to random values on a small share of entities, so the sample is spread over the
+// whole kind instead of being its first keys. The keys are exported in key order.
+func (cmd *ExportKindCmd) sampleKeys(ctx context.Context, client *datastore.Client, n int) (*keyList, error) {
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace).Order("__scatter__").KeysOnly().Limit(n)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(cmd.ancestor)
+	}
+
+	var sample []*datastore.Key
+	err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+		sample, err = client.GetAll(ctx, q, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sample keys of %s: %w", cmd.Kind, err)
+	}
+
+	if len(sample) < n {
+		infof("Only %d entities of %s carry __scatter__, the sample has %d entities", len(sample), cmd.Kind, len(sample))
+	}
+
+	sort.Slice(sample, func(i, j int) bool { return compareKeys(sample[i], sample[j]) < 0 })
+	return &keyList{keys: sample}, nil
+}
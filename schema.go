@@ -0,0 +1,101 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// datastoreType returns the name of the datastore type of a property value
+func datastoreType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	case time.Time:
+		return "time"
+	case []byte:
+		return "bytes"
+	case datastore.GeoPoint:
+		return "geopoint"
+	case *datastore.Key:
+		return "key"
+	case *datastore.Entity:
+		return "entity"
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// expectedSchema maps property names to datastore types, optional properties
+// are declared with a trailing ?, e.g. {"name": "string", "nickname": "string?"}
+type expectedSchema map[string]string
+
+func readExpectedSchema(path string) (expectedSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schema expectedSchema
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// violations compares property types of an entity with the schema
+func (schema expectedSchema) violations(types map[string]string) []string {
+	var found []string
+	for name, typ := range types {
+		expected, ok := schema[name]
+		if !ok {
+			found = append(found, fmt.Sprintf("unexpected property %s", name))
+			continue
+		}
+
+		expected = strings.TrimSuffix(expected, "?")
+		if typ != expected {
+			found = append(found, fmt.Sprintf("property %s is %s, expected %s", name, typ, expected))
+		}
+	}
+
+	for name, expected := range schema {
+		if _, ok := types[name]; !ok && !strings.HasSuffix(expected, "?") {
+			found = append(found, fmt.Sprintf("missing property %s", name))
+		}
+	}
+
+	sort.Strings(found)
+	return found
+}
+
+// checkSchema reports schema violations of the entity according to --schema-violation
+func (cmd *ExportKindCmd) checkSchema(de *dynamicEntity) error {
+	violations := cmd.schema.violations(de.types)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	cmd.schemaViolations++
+	if cmd.SchemaViolation == "fail" {
+		return fmt.Errorf("Schema violation: %s", strings.Join(violations, ", "))
+	}
+
+	warnf("Schema violation in %s: %s", de.key, strings.Join(violations, ", "))
+	return nil
+}
@@ -0,0 +1,525 @@
+package cdskit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServeCmd runs export, import and delete jobs submitted over HTTP, so they can
+// be launched and monitored without the command line
+type ServeCmd struct {
+	Listen  string `long:"listen" default:"localhost:8080" description:"Address the HTTP API listens on"`
+	DataDir string `long:"data-dir" default:"serve-jobs" description:"Folder of the files written by export jobs, a folder per job, and read by import jobs"`
+	Token   string `long:"token" env:"CDSKIT_SERVE_TOKEN" description:"Token required as Authorization: Bearer <token> or ?token=<token> by every request"`
+	MaxJobs int    `long:"max-jobs" default:"2" description:"Number of jobs running at the same time, others wait in the queue"`
+	UI      bool   `long:"ui" description:"Serve a minimal web page for submitting and watching jobs at /"`
+
+	mu    sync.Mutex
+	jobs  map[string]*serveJob
+	order []string
+	slots chan struct{}
+	// ctx is cancelled at the interrupt, jobs run on contexts derived from it
+	ctx context.Context
+	// closed refuses jobs once the server waits for the running ones
+	closed  bool
+	running sync.WaitGroup
+}
+
+// serveJob is a submitted job with the options of its command, without the leading --
+type serveJob struct {
+	ID       string                 `json:"id"`
+	Type     string                 `json:"type"`
+	Options  map[string]interface{} `json:"options"`
+	State    string                 `json:"state"`
+	Error    string                 `json:"error,omitempty"`
+	Progress int64                  `json:"progress"`
+	Created  time.Time              `json:"created"`
+	Started  *time.Time             `json:"started,omitempty"`
+	Finished *time.Time             `json:"finished,omitempty"`
+	Files    []string               `json:"files,omitempty"`
+
+	progress int64
+	cancel   context.CancelFunc
+}
+
+// serveRequest is the body of POST /jobs, delete jobs have to repeat the project in confirm
+type serveRequest struct {
+	Type    string                 `json:"type"`
+	Options map[string]interface{} `json:"options"`
+	Confirm string                 `json:"confirm"`
+}
+
+// Job states, a job is incomplete when an export or import left out entities
+const (
+	jobQueued     = "queued"
+	jobRunning    = "running"
+	jobSucceeded  = "succeeded"
+	jobIncomplete = "incomplete"
+	jobFailed     = "failed"
+	jobCancelled  = "cancelled"
+)
+
+// Execute is called by go-flags
+func (cmd *ServeCmd) Execute(args []string) error {
+	if cmd.MaxJobs < 1 {
+		return fmt.Errorf("--max-jobs must be at least 1")
+	}
+	if err := os.MkdirAll(cmd.DataDir, 0755); err != nil {
+		return err
+	}
+
+	cmd.jobs = make(map[string]*serveJob)
+	cmd.slots = make(chan struct{}, cmd.MaxJobs)
+
+	root, cancel := commandContext(true)
+	defer cancel()
+	ctx, stop := interruptible(root)
+	defer stop()
+	cmd.ctx = ctx
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", cmd.handleJobs)
+	mux.HandleFunc("/jobs/", cmd.handleJob)
+	if cmd.UI {
+		mux.HandleFunc("/", cmd.handleUI)
+	}
+
+	server := &http.Server{Addr: cmd.Listen, Handler: cmd.authorize(mux)}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+
+	infof("Serving jobs on http://%s", cmd.Listen)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+
+	// running jobs stop at the interrupt as well, their partial files are written out
+	cmd.mu.Lock()
+	cmd.closed = true
+	cmd.mu.Unlock()
+	infof("Waiting for running jobs to finish their output")
+	cmd.running.Wait()
+
+	infof("Stopped serving")
+	return nil
+}
+
+func (cmd *ServeCmd) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cmd.Token != "" {
+			// links to downloads can't set headers
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if given == "" {
+				given = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(cmd.Token)) != 1 {
+				serveError(w, http.StatusUnauthorized, fmt.Errorf("Missing or invalid token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleJobs lists the jobs on GET and submits one on POST
+func (cmd *ServeCmd) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		cmd.mu.Lock()
+		jobs := make([]serveJob, 0, len(cmd.order))
+		for _, id := range cmd.order {
+			jobs = append(jobs, cmd.jobs[id].snapshot())
+		}
+		cmd.mu.Unlock()
+		serveJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		var req serveRequest
+		d := json.NewDecoder(r.Body)
+		d.UseNumber()
+		if err := d.Decode(&req); err != nil {
+			serveError(w, http.StatusBadRequest, fmt.Errorf("Invalid job: %w", err))
+			return
+		}
+		job, err := cmd.submit(req)
+		if err != nil {
+			serveError(w, http.StatusBadRequest, err)
+			return
+		}
+		serveJSON(w, http.StatusAccepted, job)
+	default:
+		serveError(w, http.StatusMethodNotAllowed, fmt.Errorf("Use GET or POST"))
+	}
+}
+
+// handleJob serves /jobs/<id>, DELETE or POST /jobs/<id>/cancel cancel the job and
+// /jobs/<id>/download?file=<name> returns a file written by an export job
+func (cmd *ServeCmd) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/", 2)
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	cmd.mu.Lock()
+	job, ok := cmd.jobs[parts[0]]
+	var snapshot serveJob
+	if ok {
+		snapshot = job.snapshot()
+	}
+	cmd.mu.Unlock()
+	if !ok {
+		serveError(w, http.StatusNotFound, fmt.Errorf("No job %s", parts[0]))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		serveJSON(w, http.StatusOK, snapshot)
+	case action == "" && r.Method == http.MethodDelete, action == "cancel" && r.Method == http.MethodPost:
+		cmd.mu.Lock()
+		if job.State == jobQueued || job.State == jobRunning {
+			job.cancel()
+		}
+		cmd.mu.Unlock()
+		serveJSON(w, http.StatusAccepted, snapshot)
+	case action == "download" && r.Method == http.MethodGet:
+		name := r.URL.Query().Get("file")
+		if name == "" && len(snapshot.Files) == 1 {
+			name = snapshot.Files[0]
+		}
+		for _, f := range snapshot.Files {
+			if f == name {
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+				http.ServeFile(w, r, filepath.Join(cmd.DataDir, job.ID, name))
+				return
+			}
+		}
+		serveError(w, http.StatusNotFound, fmt.Errorf("Job %s has no file %q, give one of its files as ?file=", job.ID, name))
+	default:
+		serveError(w, http.StatusNotFound, fmt.Errorf("Unsupported request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// submit parses the options of the job and queues it
+func (cmd *ServeCmd) submit(req serveRequest) (serveJob, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return serveJob{}, err
+	}
+	job := &serveJob{ID: hex.EncodeToString(b), Type: req.Type, Options: req.Options, State: jobQueued, Created: time.Now().UTC()}
+
+	run, err := cmd.prepare(job, req)
+	if err != nil {
+		return serveJob{}, err
+	}
+
+	ctx, cancel := context.WithCancel(cmd.ctx)
+	job.cancel = cancel
+
+	cmd.mu.Lock()
+	if cmd.closed {
+		cmd.mu.Unlock()
+		cancel()
+		return serveJob{}, fmt.Errorf("Server is shutting down")
+	}
+	cmd.jobs[job.ID] = job
+	cmd.order = append(cmd.order, job.ID)
+	snapshot := job.snapshot()
+	cmd.running.Add(1)
+	cmd.mu.Unlock()
+
+	infof("Job %s: %s queued", job.ID, job.Type)
+	go func() {
+		defer cmd.running.Done()
+		cmd.run(ctx, job, run)
+	}()
+	return snapshot, nil
+}
+
+// prepare returns the run of the job, export jobs write into the folder of the
+// job and import jobs read files of the --data-dir only
+func (cmd *ServeCmd) prepare(job *serveJob, req serveRequest) (func(ctx context.Context) error, error) {
+	options := make(map[string]interface{})
+	for name, v := range req.Options {
+		options[name] = v
+	}
+
+	switch req.Type {
+	case "export":
+		if output, ok := options["output"].(string); ok && !strings.HasPrefix(output, "gs://") && !strings.HasPrefix(output, "pubsub://") {
+			return nil, fmt.Errorf("Export jobs can only set a gs:// or pubsub:// output, local files are written to the folder of the job")
+		}
+		if _, ok := options["output-dir"]; ok {
+			return nil, fmt.Errorf("Export jobs can't set output-dir, local files are written to the folder of the job")
+		}
+		dir := filepath.Join(cmd.DataDir, job.ID)
+		options["output-dir"] = dir
+
+		// files the job writes stay in its folder, files it reads in the data folder
+		for _, name := range []string{"dead-letter", "summary-file", "bq-schema", "emit-index-yaml", "since-cursor-file"} {
+			if err := rebaseOption(options, name, dir); err != nil {
+				return nil, fmt.Errorf("Export jobs write %s in the folder of the job only: %w", name, err)
+			}
+		}
+		for _, name := range []string{"keys-file", "expect-schema", "columnar-schema"} {
+			if err := rebaseOption(options, name, cmd.DataDir); err != nil {
+				return nil, fmt.Errorf("Export jobs read %s of the data folder only: %w", name, err)
+			}
+		}
+		if tmpl, ok := options["filename-template"].(string); ok && (filepath.IsAbs(tmpl) || strings.HasPrefix(tmpl, "/") || hasParentElement(tmpl)) {
+			return nil, fmt.Errorf("Export jobs can't set a filename-template that is absolute or contains ..")
+		}
+
+		export, err := parseExportJob(options)
+		if err != nil {
+			return nil, err
+		}
+		if export.Follow || export.Resume {
+			return nil, fmt.Errorf("Export jobs don't support follow and resume")
+		}
+		export.progress = &job.progress
+		return func(ctx context.Context) error {
+			if export.Kinds != "" || export.AllKinds {
+				return export.runKinds(ctx)
+			}
+			return export.run(ctx)
+		}, nil
+	case "import":
+		file, _ := options["file"].(string)
+		if file == "" {
+			return nil, fmt.Errorf("Import jobs require a file")
+		}
+		if err := rebaseOption(options, "file", cmd.DataDir, "gs"); err != nil {
+			return nil, fmt.Errorf("Import jobs read gs:// URLs and files of the data folder only, e.g. <job id>/<file> of an export job")
+		}
+
+		imp := &ImportKindCmd{}
+		if err := parseOptions(imp, options); err != nil {
+			return nil, err
+		}
+		imp.progress = &job.progress
+		return imp.run, nil
+	case "delete":
+		del := &DeleteAllCmd{}
+		if err := parseOptions(del, options); err != nil {
+			return nil, err
+		}
+		if req.Confirm != del.ProjectID {
+			return nil, fmt.Errorf("Delete jobs have to repeat the project in confirm")
+		}
+		del.Yes = true
+		del.progress = &job.progress
+		return del.run, nil
+	default:
+		return nil, fmt.Errorf("Unsupported job type %q, expected export, import or delete", req.Type)
+	}
+}
+
+// rebaseOption resolves the path of the option below dir, paths leaving dir are refused.
+// URLs of the schemes the option reads, e.g. gs for gs://bucket/object, are kept as they are.
+func rebaseOption(options map[string]interface{}, name, dir string, schemes ...string) error {
+	v, ok := options[name]
+	if !ok {
+		return nil
+	}
+	file, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("Expected a path, got %v", v)
+	}
+	for _, scheme := range schemes {
+		if strings.HasPrefix(file, scheme+"://") {
+			return nil
+		}
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(file))
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s leaves the folder", file)
+	}
+	options[name] = path
+	return nil
+}
+
+// hasParentElement reports whether the path has a .. element
+func hasParentElement(path string) bool {
+	for _, elem := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// run waits for a free slot, runs the job and records its outcome and files
+func (cmd *ServeCmd) run(ctx context.Context, job *serveJob, run func(ctx context.Context) error) {
+	defer job.cancel()
+
+	select {
+	case cmd.slots <- struct{}{}:
+		defer func() { <-cmd.slots }()
+	case <-ctx.Done():
+		cmd.finish(job, jobCancelled, nil)
+		return
+	}
+
+	started := time.Now().UTC()
+	cmd.mu.Lock()
+	job.State, job.Started = jobRunning, &started
+	cmd.mu.Unlock()
+	infof("Job %s: %s running", job.ID, job.Type)
+
+	err := run(ctx)
+	switch {
+	case ctx.Err() != nil, errors.Is(err, ErrInterrupted):
+		cmd.finish(job, jobCancelled, err)
+	case errors.Is(err, ErrIncomplete):
+		cmd.finish(job, jobIncomplete, err)
+	case err != nil:
+		cmd.finish(job, jobFailed, err)
+	default:
+		cmd.finish(job, jobSucceeded, nil)
+	}
+}
+
+func (cmd *ServeCmd) finish(job *serveJob, state string, err error) {
+	var files []string
+	if infos, _ := ioutil.ReadDir(filepath.Join(cmd.DataDir, job.ID)); len(infos) > 0 {
+		for _, info := range infos {
+			if !info.IsDir() {
+				files = append(files, info.Name())
+			}
+		}
+		sort.Strings(files)
+	}
+
+	finished := time.Now().UTC()
+	cmd.mu.Lock()
+	job.State, job.Finished, job.Files = state, &finished, files
+	if err != nil {
+		job.Error = err.Error()
+	}
+	cmd.mu.Unlock()
+
+	if err != nil {
+		warnf("Job %s: %s %s: %v", job.ID, job.Type, state, err)
+		return
+	}
+	infof("Job %s: %s %s", job.ID, job.Type, state)
+}
+
+// snapshot copies the job for a response, the caller holds the lock of the server
+func (job *serveJob) snapshot() serveJob {
+	s := *job
+	s.Progress = atomic.LoadInt64(&job.progress)
+	s.cancel = nil
+	return s
+}
+
+func serveJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func serveError(w http.ResponseWriter, status int, err error) {
+	serveJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (cmd *ServeCmd) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, serveUI)
+}
+
+// serveUI submits jobs and lists them every few seconds, the token is kept by the page
+const serveUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>cdskit jobs</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+textarea { width: 40em; height: 8em; font-family: monospace; }
+table { border-collapse: collapse; margin-top: 2em; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>cdskit jobs</h1>
+<p>
+<select id="type"><option>export</option><option>import</option><option>delete</option></select>
+Token <input id="token" type="password">
+Confirm project <input id="confirm">
+</p>
+<p><textarea id="options">{"project": "", "kind": "", "format": "jsonl"}</textarea></p>
+<p><button onclick="submitJob()">Submit</button> <span id="message"></span></p>
+<table>
+<thead><tr><th>ID</th><th>Type</th><th>State</th><th>Progress</th><th>Created</th><th>Files</th><th></th></tr></thead>
+<tbody id="jobs"></tbody>
+</table>
+<script>
+function call(method, path, body) {
+  var headers = {"Content-Type": "application/json"};
+  var token = document.getElementById("token").value;
+  if (token) headers["Authorization"] = "Bearer " + token;
+  return fetch(path, {method: method, headers: headers, body: body}).then(function (r) {
+    return r.json().then(function (v) { if (!r.ok) throw new Error(v.error); return v; });
+  });
+}
+function text(s) { var d = document.createElement("div"); d.textContent = s; return d.innerHTML; }
+function submitJob() {
+  var message = document.getElementById("message");
+  var body;
+  try {
+    body = JSON.stringify({type: document.getElementById("type").value,
+      options: JSON.parse(document.getElementById("options").value),
+      confirm: document.getElementById("confirm").value});
+  } catch (e) { message.textContent = e.message; return; }
+  call("POST", "/jobs", body).then(function (job) { message.textContent = "Submitted " + job.id; refresh(); },
+    function (e) { message.textContent = e.message; });
+}
+function cancelJob(id) { call("POST", "/jobs/" + id + "/cancel").then(refresh); }
+function refresh() {
+  call("GET", "/jobs").then(function (jobs) {
+    document.getElementById("jobs").innerHTML = jobs.reverse().map(function (job) {
+      var files = (job.files || []).map(function (f) {
+        return '<a href="/jobs/' + job.id + '/download?file=' + encodeURIComponent(f) + '&token=' + encodeURIComponent(document.getElementById("token").value) + '">' + text(f) + '</a>';
+      }).join("<br>");
+      var cancel = job.state == "queued" || job.state == "running" ? '<button onclick="cancelJob(\'' + job.id + '\')">Cancel</button>' : "";
+      return "<tr><td>" + job.id + "</td><td>" + job.type + "</td><td>" + job.state + (job.error ? "<br>" + text(job.error) : "") +
+        "</td><td>" + job.progress + "</td><td>" + job.created + "</td><td>" + files + "</td><td>" + cancel + "</td></tr>";
+    }).join("");
+  }, function () {});
+}
+refresh();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`
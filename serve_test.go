@@ -0,0 +1,72 @@
+package cdskit
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestServePrepareExportPaths(t *testing.T) {
+	cmd := &ServeCmd{DataDir: "data"}
+	job := &serveJob{ID: "job1"}
+
+	_, err := cmd.prepare(job, serveRequest{Type: "export", Options: map[string]interface{}{
+		"project":      "p",
+		"kind":         "User",
+		"dead-letter":  "/tmp/dead.jsonl",
+		"keys-file":    "job0/keys.txt",
+		"summary-file": "summary.json",
+	}})
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+
+	refused := []map[string]interface{}{
+		{"dead-letter": "../../x"},
+		{"summary-file": "a/../../x"},
+		{"bq-schema": "../schema.json"},
+		{"emit-index-yaml": "../index.yaml"},
+		{"since-cursor-file": "../cursor"},
+		{"keys-file": "../keys.txt"},
+		{"expect-schema": "../../etc/schema.json"},
+		{"columnar-schema": "../schema.json"},
+		{"filename-template": "../../{kind}"},
+		{"filename-template": "/tmp/{kind}"},
+		{"output": "/tmp/out.jsonl"},
+		{"output-dir": "elsewhere"},
+	}
+	for _, options := range refused {
+		options["project"], options["kind"] = "p", "User"
+		if _, err := cmd.prepare(job, serveRequest{Type: "export", Options: options}); err == nil {
+			t.Errorf("prepare accepted %v", options)
+		}
+	}
+}
+
+func TestRebaseOption(t *testing.T) {
+	tests := []struct {
+		file, want string
+		ok         bool
+	}{
+		{"keys.txt", filepath.Join("data", "keys.txt"), true},
+		{"job/keys.txt", filepath.Join("data", "job", "keys.txt"), true},
+		{"/etc/passwd", filepath.Join("data", "etc", "passwd"), true},
+		{"job/../keys.txt", filepath.Join("data", "keys.txt"), true},
+		{"/../keys.txt", "", false},
+		{"../keys.txt", "", false},
+		{"job/../../keys.txt", "", false},
+		{"gs://bucket/exports/users.jsonl", "gs://bucket/exports/users.jsonl", true},
+		{"gs://bucket/../users.jsonl", "gs://bucket/../users.jsonl", true},
+		{"file:///etc/passwd", filepath.Join("data", "file:", "etc", "passwd"), true},
+	}
+	for _, tt := range tests {
+		options := map[string]interface{}{"file": tt.file}
+		err := rebaseOption(options, "file", "data", "gs")
+		if (err == nil) != tt.ok {
+			t.Errorf("rebaseOption(%q) error = %v", tt.file, err)
+			continue
+		}
+		if tt.ok && options["file"] != tt.want {
+			t.Errorf("rebaseOption(%q) = %v, want %s", tt.file, options["file"], tt.want)
+		}
+	}
+}
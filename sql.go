@@ -0,0 +1,176 @@
+package cdskit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlExportWriter writes a CREATE TABLE statement for the kind followed by an INSERT
+// per record, e.g. for sqlite3 data.db < export.sql. The column types are inferred
+// from all records, so the inserts are kept in a temporary file until the footer.
+type sqlExportWriter struct {
+	writer  io.Writer
+	table   string
+	columns []string
+	types   map[string]string
+	rows    *os.File
+	buf     *bufio.Writer
+}
+
+func (format *sqlExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *sqlExportWriter) WriterRecord(de *dynamicEntity) error {
+	if format.rows == nil {
+		f, err := ioutil.TempFile("", "cdskit-sql-")
+		if err != nil {
+			return &outputError{err}
+		}
+		format.rows, format.buf = f, bufio.NewWriter(f)
+	}
+
+	var names, values []string
+	var err error
+	traverse(de.value, func(name string, v interface{}) {
+		if v == nil {
+			return
+		}
+
+		typ := sqlType(v, de.types[name])
+		if _, ok := format.types[name]; !ok {
+			format.columns = append(format.columns, name)
+		}
+		format.types[name] = mergeSQLTypes(format.types[name], typ)
+
+		literal, lerr := sqlLiteral(v)
+		if lerr != nil && err == nil {
+			err = lerr
+		}
+		names = append(names, sqlIdentifier(name))
+		values = append(values, literal)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to marshal entry: %w", err)
+	}
+
+	_, err = fmt.Fprintf(format.buf, "INSERT INTO %s (%s) VALUES (%s);\n", sqlIdentifier(format.table), strings.Join(names, ", "), strings.Join(values, ", "))
+	if err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
+	}
+	return nil
+}
+
+func (format *sqlExportWriter) WriteFooter() error {
+	defer format.Close()
+
+	w := bufio.NewWriter(format.writer)
+	fmt.Fprintf(w, "CREATE TABLE %s (\n", sqlIdentifier(format.table))
+	for i, name := range format.columns {
+		sep := ","
+		if i == len(format.columns)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(w, "  %s %s%s\n", sqlIdentifier(name), format.types[name], sep)
+	}
+	fmt.Fprintln(w, ");")
+
+	if format.rows != nil {
+		fmt.Fprintln(w, "BEGIN;")
+		if err := format.buf.Flush(); err != nil {
+			return err
+		}
+		if _, err := format.rows.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, format.rows); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "COMMIT;")
+	}
+	return w.Flush()
+}
+
+// Close removes the temporary file of the inserts
+func (format *sqlExportWriter) Close() error {
+	if format.rows == nil {
+		return nil
+	}
+	format.rows.Close()
+	err := os.Remove(format.rows.Name())
+	format.rows = nil
+	return err
+}
+
+// sqlType returns the column type of an exported value, dsType is the datastore type
+// of the property telling timestamps from strings
+func sqlType(v interface{}, dsType string) string {
+	switch v.(type) {
+	case int64:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	case bool:
+		return "BOOLEAN"
+	case string:
+		if dsType == "time" {
+			return "TIMESTAMP"
+		}
+		return "TEXT"
+	default:
+		return "TEXT"
+	}
+}
+
+// mergeSQLTypes widens integer columns with floats to REAL, other mixed columns become TEXT
+func mergeSQLTypes(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case a == "INTEGER" && b == "REAL", a == "REAL" && b == "INTEGER":
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqlIdentifier quotes the name with double quotes as standard SQL does
+func sqlIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// sqlLiteral renders the value, arrays are written as JSON text
+func sqlLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return "NULL", nil
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'", nil
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'", nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return sqlLiteral(string(b))
+	}
+}
@@ -0,0 +1,195 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// StatsCmd prints the entity counts and sizes of kinds from the Datastore statistics
+type StatsCmd struct {
+	ProjectID     string `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace     string `short:"n" long:"namespace" description:"Namespace to print statistics of"`
+	AllNamespaces bool   `long:"all-namespaces" description:"Print statistics of every namespace"`
+	Kinds         string `short:"k" long:"kinds" description:"Comma separated kinds or patterns, e.g. User,Order*, all kinds by default"`
+	Types         bool   `long:"types" description:"Break the statistics of every kind down by property type"`
+	Sort          string `long:"sort" default:"bytes" choice:"name" choice:"count" choice:"bytes" description:"Order of the kinds, largest first for count and bytes"`
+	JSON          bool   `long:"json" description:"Print a JSON array instead of a table"`
+}
+
+// kindStat is a statistics entity of a kind, or of a property type of a kind with --types
+type kindStat struct {
+	Namespace      string    `json:"namespace"`
+	Kind           string    `json:"kind"`
+	PropertyType   string    `json:"property_type,omitempty"`
+	Count          int64     `json:"count"`
+	Bytes          int64     `json:"bytes"`
+	EntityBytes    int64     `json:"entity_bytes"`
+	BuiltinIndex   int64     `json:"builtin_index_bytes"`
+	BuiltinCount   int64     `json:"builtin_index_count"`
+	CompositeIndex int64     `json:"composite_index_bytes"`
+	CompositeCount int64     `json:"composite_index_count"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Execute is called by go-flags
+func (cmd *StatsCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	if cmd.AllNamespaces && cmd.Namespace != "" {
+		return fmt.Errorf("--namespace can't be combined with --all-namespaces")
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	namespaces := []string{cmd.Namespace}
+	if cmd.AllNamespaces {
+		if namespaces, err = metadataNamespaces(ctx, client); err != nil {
+			return fmt.Errorf("Unable to load list of namespaces: %w", err)
+		}
+	}
+
+	var stats []kindStat
+	for _, ns := range namespaces {
+		s, err := cmd.load(ctx, client, ns)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s...)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		switch {
+		case cmd.Sort == "count" && a.Count != b.Count:
+			return a.Count > b.Count
+		case cmd.Sort == "bytes" && a.Bytes != b.Bytes:
+			return a.Bytes > b.Bytes
+		case a.Kind != b.Kind:
+			return a.Kind < b.Kind
+		}
+		return a.PropertyType < b.PropertyType
+	})
+
+	if cmd.JSON {
+		if stats == nil {
+			stats = []kindStat{}
+		}
+		b, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	if len(stats) == 0 {
+		// new projects and kinds have none until Datastore computes them
+		warnf("No statistics found, they're updated about once a day")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := "KIND\tCOUNT\tSIZE\tENTITIES\tBUILTIN INDEXES\tCOMPOSITE INDEXES"
+	if cmd.Types {
+		header = "KIND\tTYPE\tCOUNT\tSIZE\tENTITIES\tBUILTIN INDEXES\tCOMPOSITE INDEXES"
+	}
+	if cmd.AllNamespaces {
+		header = "NAMESPACE\t" + header
+	}
+	fmt.Fprintln(tw, header)
+
+	var total kindStat
+	for _, s := range stats {
+		if cmd.AllNamespaces {
+			fmt.Fprintf(tw, "%s\t", s.Namespace)
+		}
+		fmt.Fprintf(tw, "%s\t", s.Kind)
+		if cmd.Types {
+			fmt.Fprintf(tw, "%s\t", s.PropertyType)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.Count, formatBytes(s.Bytes), formatBytes(s.EntityBytes), formatBytes(s.BuiltinIndex), formatBytes(s.CompositeIndex))
+
+		total.Count += s.Count
+		total.Bytes += s.Bytes
+		if s.Updated.After(total.Updated) {
+			total.Updated = s.Updated
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if !cmd.Types {
+		fmt.Printf("\n%d entities, %s in total, statistics of %s\n", total.Count, formatBytes(total.Bytes), total.Updated.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// load reads the statistics of the kinds of the namespace, those of other namespaces
+// than the default are kept in the namespace under the __Stat_Ns_ kinds
+func (cmd *StatsCmd) load(ctx context.Context, client *datastore.Client, ns string) ([]kindStat, error) {
+	statKind := "__Stat_Kind__"
+	if cmd.Types {
+		statKind = "__Stat_PropertyType_Kind__"
+	}
+	if ns != "" {
+		statKind = "__Stat_Ns_" + statKind[len("__Stat_"):]
+	}
+
+	var entities []datastore.PropertyList
+	if _, err := client.GetAll(ctx, datastore.NewQuery(statKind).Namespace(ns), &entities); err != nil {
+		return nil, fmt.Errorf("Unable to load statistics: %w", err)
+	}
+
+	var stats []kindStat
+	for _, props := range entities {
+		s := kindStat{Namespace: ns}
+		for _, p := range props {
+			n, _ := p.Value.(int64)
+			switch p.Name {
+			case "kind_name":
+				s.Kind, _ = p.Value.(string)
+			case "property_type":
+				s.PropertyType, _ = p.Value.(string)
+			case "count":
+				s.Count = n
+			case "bytes":
+				s.Bytes = n
+			case "entity_bytes":
+				s.EntityBytes = n
+			case "builtin_index_bytes":
+				s.BuiltinIndex = n
+			case "builtin_index_count":
+				s.BuiltinCount = n
+			case "composite_index_bytes":
+				s.CompositeIndex = n
+			case "composite_index_count":
+				s.CompositeCount = n
+			case "timestamp":
+				s.Updated, _ = p.Value.(time.Time)
+			}
+		}
+
+		if cmd.Kinds != "" && !matchKind(cmd.Kinds, s.Kind) {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
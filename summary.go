@@ -0,0 +1,50 @@
+package cdskit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrIncomplete is returned by exports that left out entities failing to export
+// with --on-error skip or log, or sent them to the --dead-letter file
+var ErrIncomplete = errors.New("Export incomplete")
+
+// exportStats is the summary of an export written as a single JSON line when it ends
+type exportStats struct {
+	Kind        string  `json:"kind"`
+	Namespace   string  `json:"namespace"`
+	Read        int     `json:"read"`
+	Records     int     `json:"records"`
+	Batches     int     `json:"batches"`
+	Skipped     int     `json:"skipped"`
+	Dropped     int     `json:"dropped,omitempty"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+	Output      string  `json:"output"`
+	Interrupted bool    `json:"interrupted,omitempty"`
+}
+
+// write prints the summary to stderr, or writes it to the file when path is given.
+// With --log-format json the summary is a log line of its own.
+func (s *exportStats) write(path string) error {
+	if path == "" && logger.json {
+		logEvent(logInfo, logFields{"event": "summary", "summary": s}, "Exported %d entities of %s in %.1fs", s.Records, s.Kind, s.Elapsed)
+		return nil
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		logEvent(logInfo, nil, "%s", b)
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("Unable to write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package cdskit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// ErrTimeout is returned by commands stopped by --timeout, exports still write out the
+// entities fetched until then
+var ErrTimeout = errors.New("Timed out")
+
+// flushGrace is how long commands finishing their output have after --timeout stopped them
+const flushGrace = time.Minute
+
+// runDeadline ends the run, set by --timeout, rpcTimeout bounds every Datastore call,
+// set by --rpc-timeout
+var (
+	runDeadline time.Time
+	rpcTimeout  time.Duration
+)
+
+// SetTimeout stops the command after d, 0 removes the limit
+func SetTimeout(d time.Duration) {
+	runDeadline = time.Time{}
+	if d > 0 {
+		runDeadline = time.Now().Add(d)
+	}
+}
+
+// SetRPCTimeout fails Datastore calls taking longer than d, they're retried like other
+// transient errors, 0 removes the limit
+func SetRPCTimeout(d time.Duration) {
+	rpcTimeout = d
+}
+
+// commandContext is the context of a command, ending at --timeout. Commands whose output
+// is finished when interruptible stops them at --timeout get flushGrace more.
+func commandContext(flush bool) (context.Context, context.CancelFunc) {
+	if runDeadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	if flush {
+		return context.WithDeadline(context.Background(), runDeadline.Add(flushGrace))
+	}
+	return context.WithDeadline(context.Background(), runDeadline)
+}
+
+// interruption is the error of a command stopped early, by --timeout or an interrupt
+func interruption() error {
+	if !runDeadline.IsZero() && !time.Now().Before(runDeadline) {
+		return ErrTimeout
+	}
+	return ErrInterrupted
+}
+
+// rpcOptions bound the Datastore calls of a client by --rpc-timeout
+func rpcOptions() []option.ClientOption {
+	return []option.ClientOption{option.WithGRPCDialOption(grpc.WithUnaryInterceptor(
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if rpcTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, rpcTimeout)
+				defer cancel()
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))}
+}
@@ -0,0 +1,146 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// TouchCmd writes the entities of a kind back unchanged, so they're indexed again
+// after index changes or saved again by the application after model changes
+type TouchCmd struct {
+	ProjectID   string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace   string   `short:"n" long:"namespace" description:"Namespace of the kind"`
+	Kind        string   `short:"k" long:"kind" description:"Kind to rewrite" required:"true"`
+	Filters     []string `long:"filter" description:"Rewrite only entities matching field OP value with OP one of =, >, >=, <, <=, e.g. status=active (repeatable, all must match)"`
+	BatchSize   int      `long:"batch-size" default:"500" description:"Number of entities written per call, at most 500"`
+	Transaction bool     `long:"transaction" description:"Read and write every batch in a transaction, so concurrent writes aren't overwritten by older data"`
+	DryRun      bool     `long:"dry-run" description:"Print how many entities would be rewritten without writing them"`
+	MaxRetries  int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// Execute is called by go-flags
+func (cmd *TouchCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	if cmd.BatchSize < 1 || cmd.BatchSize > 500 {
+		return fmt.Errorf("--batch-size must be between 1 and 500")
+	}
+
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace)
+	for _, s := range cmd.Filters {
+		f, err := parseFilter(s)
+		if err != nil {
+			return err
+		}
+		q = q.Filter(f.field+" "+f.op, f.value)
+	}
+	// transactions read the entities again, the scan only lists keys
+	keysOnly := cmd.Transaction || cmd.DryRun
+	if keysOnly {
+		q = q.KeysOnly()
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	touched := 0
+	var start datastore.Cursor
+	for {
+		var keys []*datastore.Key
+		var entities []datastore.PropertyList
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			keys, entities = nil, nil
+			it := client.Run(ctx, q.Start(start).Limit(cmd.BatchSize))
+			for {
+				var props datastore.PropertyList
+				var dst interface{}
+				if !keysOnly {
+					dst = &props
+				}
+				k, err := it.Next(dst)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				keys = append(keys, k)
+				entities = append(entities, props)
+			}
+
+			var err error
+			start, err = it.Cursor()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", cmd.Kind, err)
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		if !cmd.DryRun {
+			err = withRetries(ctx, cmd.MaxRetries, func() error {
+				return cmd.touchBatch(ctx, client, keys, entities)
+			})
+			if err != nil {
+				return fmt.Errorf("Unable to write %s: %w", cmd.Kind, err)
+			}
+		}
+
+		touched += len(keys)
+		infof("Touching %s - %d", cmd.Kind, touched)
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would rewrite %d entities of %s/%s\n", touched, cmd.Namespace, cmd.Kind)
+		return nil
+	}
+	fmt.Printf("Rewrote %d entities of %s/%s\n", touched, cmd.Namespace, cmd.Kind)
+	return nil
+}
+
+// touchBatch writes the entities back, with --transaction they're read again within
+// the transaction and entities deleted since the scan are left out
+func (cmd *TouchCmd) touchBatch(ctx context.Context, client *datastore.Client, keys []*datastore.Key, entities []datastore.PropertyList) error {
+	if !cmd.Transaction {
+		_, err := client.PutMulti(ctx, keys, entities)
+		return err
+	}
+
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		entities := make([]datastore.PropertyList, len(keys))
+		err := tx.GetMulti(keys, entities)
+
+		found, foundEntities := keys, entities
+		if merr, ok := err.(datastore.MultiError); ok {
+			found, foundEntities = nil, nil
+			for i, e := range merr {
+				if e == nil {
+					found = append(found, keys[i])
+					foundEntities = append(foundEntities, entities[i])
+				} else if e != datastore.ErrNoSuchEntity {
+					return e
+				}
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if len(found) == 0 {
+			return nil
+		}
+		_, err = tx.PutMulti(found, foundEntities)
+		return err
+	})
+	return err
+}
@@ -0,0 +1,243 @@
+package cdskit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// errDropped is returned by prepare for entities dropped by --transform
+var errDropped = errors.New("dropped by --transform")
+
+// entityTransform is a statement of --transform
+type entityTransform struct {
+	// op is one of rename, set, delete, drop-if or keep-if
+	op    string
+	field string
+	to    string
+	value *template.Template
+	cond  queryFilter
+}
+
+// transforms run in the given order on the top-level properties of an entity
+type transforms []entityTransform
+
+var transformFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// parseTransforms parses --transform statements separated by semicolons:
+// rename old new, set field = template, delete field, drop-if condition and
+// keep-if condition, conditions are written as by --filter
+func parseTransforms(exprs []string) (transforms, error) {
+	var ts transforms
+	for _, expr := range exprs {
+		for _, stmt := range strings.Split(expr, ";") {
+			stmt = strings.TrimSpace(stmt)
+			if stmt == "" {
+				continue
+			}
+
+			op, rest := stmt, ""
+			if i := strings.IndexAny(stmt, " \t"); i > 0 {
+				op, rest = stmt[:i], strings.TrimSpace(stmt[i+1:])
+			}
+
+			t := entityTransform{op: op}
+			switch op {
+			case "rename":
+				args := strings.Fields(rest)
+				if len(args) != 2 {
+					return nil, fmt.Errorf("Invalid transform, expected rename old new: %s", stmt)
+				}
+				t.field, t.to = args[0], args[1]
+			case "set":
+				i := strings.Index(rest, "=")
+				if i <= 0 {
+					return nil, fmt.Errorf("Invalid transform, expected set field = template: %s", stmt)
+				}
+				t.field = strings.TrimSpace(rest[:i])
+
+				var err error
+				t.value, err = template.New(t.field).Funcs(transformFuncs).Option("missingkey=error").Parse(strings.TrimSpace(rest[i+1:]))
+				if err != nil {
+					return nil, fmt.Errorf("Invalid transform %s: %w", stmt, err)
+				}
+			case "delete":
+				if rest == "" || strings.ContainsAny(rest, " \t") {
+					return nil, fmt.Errorf("Invalid transform, expected delete field: %s", stmt)
+				}
+				t.field = rest
+			case "drop-if", "keep-if":
+				var err error
+				t.cond, err = parseFilter(rest)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid transform %s: %w", stmt, err)
+				}
+			default:
+				return nil, fmt.Errorf("Unsupported transform %s, expected rename, set, delete, drop-if or keep-if", stmt)
+			}
+			ts = append(ts, t)
+		}
+	}
+	return ts, nil
+}
+
+// drops reports whether some statement may drop entities
+func (ts transforms) drops() bool {
+	for _, t := range ts {
+		if t.op == "drop-if" || t.op == "keep-if" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBatch transforms the entities of a copy and returns those kept
+func (ts transforms) applyBatch(batch []*dynamicEntity) ([]*dynamicEntity, error) {
+	if ts == nil {
+		return batch, nil
+	}
+
+	kept := batch[:0]
+	for _, de := range batch {
+		keep, err := ts.apply(de.value)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to transform %s: %w", keyPath(de.key), err)
+		}
+		if keep {
+			kept = append(kept, de)
+		}
+	}
+	return kept, nil
+}
+
+// apply changes the properties in place, it returns false for dropped entities.
+// Templates of set see the properties changed by the previous statements, the
+// rendered value is parsed as by --filter, so quote it to keep a string.
+func (ts transforms) apply(m map[string]interface{}) (bool, error) {
+	for _, t := range ts {
+		switch t.op {
+		case "rename":
+			if v, ok := m[t.field]; ok {
+				delete(m, t.field)
+				m[t.to] = v
+			}
+		case "set":
+			var sb strings.Builder
+			if err := t.value.Execute(&sb, m); err != nil {
+				return false, fmt.Errorf("Unable to set %s: %w", t.field, err)
+			}
+			m[t.field] = parseFilterValue(sb.String())
+		case "delete":
+			delete(m, t.field)
+		case "drop-if":
+			if t.cond.matches(m[t.cond.field]) {
+				return false, nil
+			}
+		case "keep-if":
+			if !t.cond.matches(m[t.cond.field]) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// matches compares a property value with the condition, values of other types
+// than the condition value don't match. Strings are compared with times as RFC3339
+// times, since exported timestamps are rendered as strings.
+func (f queryFilter) matches(v interface{}) bool {
+	c, ok := compareFilterValue(v, f.value)
+	if !ok {
+		return false
+	}
+
+	switch f.op {
+	case "=":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	default:
+		return false
+	}
+}
+
+func compareFilterValue(v interface{}, want interface{}) (int, bool) {
+	if s, ok := v.(string); ok {
+		if _, isTime := want.(time.Time); isTime {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return 0, false
+			}
+			v = t
+		}
+	}
+
+	switch a := v.(type) {
+	case int64:
+		switch b := want.(type) {
+		case int64:
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			default:
+				return 0, true
+			}
+		case float64:
+			return compareFloats(float64(a), b), true
+		}
+	case float64:
+		switch b := want.(type) {
+		case int64:
+			return compareFloats(a, float64(b)), true
+		case float64:
+			return compareFloats(a, b), true
+		}
+	case string:
+		if b, ok := want.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := want.(bool); ok && a == b {
+			return 0, true
+		} else if ok {
+			return 1, true
+		}
+	case time.Time:
+		if b, ok := want.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, true
+			case a.After(b):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
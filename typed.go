@@ -0,0 +1,306 @@
+package cdskit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// typedEntity renders the entity as loaded in the representation of the Datastore REST
+// API, every value is an object naming its type, e.g. {"integerValue": "42"}, and
+// unindexed values are marked with excludeFromIndexes
+func typedEntity(de *dynamicEntity) (map[string]interface{}, error) {
+	props, err := typedProperties(de.props)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := map[string]interface{}{"properties": props}
+	if de.key != nil {
+		rec["key"] = typedKey(de.key)
+	}
+	return rec, nil
+}
+
+func typedProperties(ps []datastore.Property) (map[string]interface{}, error) {
+	props := make(map[string]interface{}, len(ps))
+	for _, p := range ps {
+		v, err := typedValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %w", p.Name, err)
+		}
+		if p.NoIndex {
+			v["excludeFromIndexes"] = true
+		}
+		props[p.Name] = v
+	}
+	return props, nil
+}
+
+func typedValue(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{"nullValue": nil}, nil
+	case int64:
+		// a string like the REST API, so int64 values survive JSON parsers using doubles
+		return map[string]interface{}{"integerValue": strconv.FormatInt(v, 10)}, nil
+	case float64:
+		return map[string]interface{}{"doubleValue": v}, nil
+	case bool:
+		return map[string]interface{}{"booleanValue": v}, nil
+	case string:
+		return map[string]interface{}{"stringValue": v}, nil
+	case time.Time:
+		return map[string]interface{}{"timestampValue": v.UTC().Format(time.RFC3339Nano)}, nil
+	case []byte:
+		return map[string]interface{}{"blobValue": base64.StdEncoding.EncodeToString(v)}, nil
+	case datastore.GeoPoint:
+		return map[string]interface{}{"geoPointValue": map[string]interface{}{"latitude": v.Lat, "longitude": v.Lng}}, nil
+	case *datastore.Key:
+		return map[string]interface{}{"keyValue": typedKey(v)}, nil
+	case *datastore.Entity:
+		props, err := typedProperties(v.Properties)
+		if err != nil {
+			return nil, err
+		}
+
+		e := map[string]interface{}{"properties": props}
+		if v.Key != nil {
+			e["key"] = typedKey(v.Key)
+		}
+		return map[string]interface{}{"entityValue": e}, nil
+	case []interface{}:
+		values := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			tv, err := typedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, tv)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported value of type %T", value)
+	}
+}
+
+// typedKey renders the key with its path from the root ancestor, IDs are strings
+func typedKey(k *datastore.Key) map[string]interface{} {
+	var path []interface{}
+	for _, e := range keyElements(k) {
+		elem := map[string]interface{}{"kind": e.Kind}
+		if e.Name != "" {
+			elem["name"] = e.Name
+		} else if e.ID != 0 {
+			elem["id"] = strconv.FormatInt(e.ID, 10)
+		}
+		path = append(path, elem)
+	}
+
+	key := map[string]interface{}{"path": path}
+	if k.Namespace != "" {
+		key["partitionId"] = map[string]interface{}{"namespaceId": k.Namespace}
+	}
+	return key
+}
+
+// typedImportReader reads records written by the typed-json export format, entity
+// keys are moved to the imported kind and namespace keeping their IDs, names and ancestors
+type typedImportReader struct {
+	d         *json.Decoder
+	kind      string
+	namespace string
+}
+
+func newTypedImportReader(r io.Reader, kind string, namespace string) (*typedImportReader, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('[') {
+		return nil, fmt.Errorf("Expected a JSON array of records")
+	}
+
+	return &typedImportReader{d: d, kind: kind, namespace: namespace}, nil
+}
+
+func (format *typedImportReader) ReadRecord() (*dynamicEntity, error) {
+	if !format.d.More() {
+		return nil, io.EOF
+	}
+
+	var rec struct {
+		Key        map[string]interface{} `json:"key"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	if err := format.d.Decode(&rec); err != nil {
+		return nil, err
+	}
+
+	props, err := fromTypedProperties(rec.Properties)
+	if err != nil {
+		return nil, err
+	}
+
+	de := &dynamicEntity{props: props}
+	if rec.Key != nil {
+		k, err := fromTypedKey(rec.Key)
+		if err != nil {
+			return nil, err
+		}
+		if k != nil {
+			de.key = remapKey(k, format.kind, format.namespace)
+		}
+	}
+	return de, nil
+}
+
+// fromTypedProperties restores properties in the order of their names
+func fromTypedProperties(m map[string]interface{}) ([]datastore.Property, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props := make([]datastore.Property, 0, len(m))
+	for _, name := range names {
+		tv, ok := m[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Property %s is not a typed value", name)
+		}
+
+		v, err := fromTypedValue(tv)
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %w", name, err)
+		}
+
+		noIndex, _ := tv["excludeFromIndexes"].(bool)
+		props = append(props, datastore.Property{Name: name, Value: v, NoIndex: noIndex})
+	}
+	return props, nil
+}
+
+func fromTypedValue(tv map[string]interface{}) (interface{}, error) {
+	for typ, v := range tv {
+		switch typ {
+		case "excludeFromIndexes":
+			continue
+		case "nullValue":
+			return nil, nil
+		case "integerValue":
+			s, _ := v.(string)
+			return strconv.ParseInt(s, 10, 64)
+		case "doubleValue":
+			n, _ := v.(json.Number)
+			return n.Float64()
+		case "booleanValue":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Invalid booleanValue %v", v)
+			}
+			return b, nil
+		case "stringValue":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Invalid stringValue %v", v)
+			}
+			return s, nil
+		case "timestampValue":
+			s, _ := v.(string)
+			return time.Parse(time.RFC3339Nano, s)
+		case "blobValue":
+			s, _ := v.(string)
+			return base64.StdEncoding.DecodeString(s)
+		case "geoPointValue":
+			m, _ := v.(map[string]interface{})
+			lat, _ := m["latitude"].(json.Number)
+			lng, _ := m["longitude"].(json.Number)
+
+			var g datastore.GeoPoint
+			var err error
+			if g.Lat, err = lat.Float64(); err != nil {
+				return nil, fmt.Errorf("Invalid geoPointValue latitude: %w", err)
+			}
+			if g.Lng, err = lng.Float64(); err != nil {
+				return nil, fmt.Errorf("Invalid geoPointValue longitude: %w", err)
+			}
+			return g, nil
+		case "keyValue":
+			m, _ := v.(map[string]interface{})
+			return fromTypedKey(m)
+		case "entityValue":
+			m, _ := v.(map[string]interface{})
+			props, _ := m["properties"].(map[string]interface{})
+			ps, err := fromTypedProperties(props)
+			if err != nil {
+				return nil, err
+			}
+
+			e := &datastore.Entity{Properties: ps}
+			if k, ok := m["key"].(map[string]interface{}); ok {
+				if e.Key, err = fromTypedKey(k); err != nil {
+					return nil, err
+				}
+			}
+			return e, nil
+		case "arrayValue":
+			m, _ := v.(map[string]interface{})
+			items, _ := m["values"].([]interface{})
+			values := make([]interface{}, 0, len(items))
+			for _, item := range items {
+				itv, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("Array element is not a typed value")
+				}
+				iv, err := fromTypedValue(itv)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, iv)
+			}
+			return values, nil
+		default:
+			return nil, fmt.Errorf("Unsupported value type %s", typ)
+		}
+	}
+	return nil, fmt.Errorf("Value without a type")
+}
+
+// fromTypedKey restores a key written by typedKey, a path without elements is a nil key
+func fromTypedKey(m map[string]interface{}) (*datastore.Key, error) {
+	var namespace string
+	if p, ok := m["partitionId"].(map[string]interface{}); ok {
+		namespace, _ = p["namespaceId"].(string)
+	}
+
+	path, _ := m["path"].([]interface{})
+	var k *datastore.Key
+	for _, elem := range path {
+		e, _ := elem.(map[string]interface{})
+		kind, _ := e["kind"].(string)
+		if kind == "" {
+			return nil, fmt.Errorf("Key path element without a kind")
+		}
+
+		k = &datastore.Key{Kind: kind, Parent: k, Namespace: namespace}
+		if name, ok := e["name"].(string); ok {
+			k.Name = name
+		} else if id, ok := e["id"].(string); ok {
+			var err error
+			if k.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid key ID %s: %w", id, err)
+			}
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,240 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// UpdateFieldCmd changes properties of the entities of a kind in place
+type UpdateFieldCmd struct {
+	ProjectID  string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace  string   `short:"n" long:"namespace" description:"Namespace of the kind"`
+	Kind       string   `short:"k" long:"kind" description:"Kind to update" required:"true"`
+	Filters    []string `long:"filter" description:"Update only entities matching field OP value with OP one of =, >, >=, <, <=, e.g. status=archived (repeatable, all must match)"`
+	Set        []string `long:"set" description:"Set the property to a value as name=value, the value is parsed as by --filter (repeatable)"`
+	Rename     []string `long:"rename" description:"Rename the property as old:new, replacing a property with the new name (repeatable)"`
+	Delete     []string `long:"delete" description:"Remove the property (repeatable)"`
+	DryRun     bool     `long:"dry-run" description:"Print how many entities would be changed without writing them"`
+	MaxRetries int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+
+	filters []queryFilter
+	sets    []queryFilter
+	renames [][2]string
+}
+
+// Execute is called by go-flags
+func (cmd *UpdateFieldCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	if err := cmd.parse(); err != nil {
+		return err
+	}
+
+	dsClient, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer dsClient.Close()
+
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace).KeysOnly()
+	for _, f := range cmd.filters {
+		q = q.Filter(f.field+" "+f.op, f.value)
+	}
+
+	matched, changed := 0, 0
+	var start datastore.Cursor
+	for {
+		var keys []*datastore.Key
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			keys = nil
+			it := dsClient.Run(ctx, q.Start(start).Limit(500))
+			for {
+				k, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				keys = append(keys, k)
+			}
+
+			var err error
+			start, err = it.Cursor()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", cmd.Kind, err)
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		var n int
+		err = withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			n, err = cmd.updateBatch(ctx, dsClient, keys)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to update %s: %w", cmd.Kind, err)
+		}
+
+		matched += len(keys)
+		changed += n
+		infof("Updating %s - %d", cmd.Kind, matched)
+	}
+
+	if cmd.DryRun {
+		fmt.Printf("Would update %d of %d matching entities of %s/%s\n", changed, matched, cmd.Namespace, cmd.Kind)
+		return nil
+	}
+	fmt.Printf("Updated %d of %d matching entities of %s/%s\n", changed, matched, cmd.Namespace, cmd.Kind)
+	return nil
+}
+
+func (cmd *UpdateFieldCmd) parse() error {
+	for _, s := range cmd.Filters {
+		f, err := parseFilter(s)
+		if err != nil {
+			return err
+		}
+		cmd.filters = append(cmd.filters, f)
+	}
+
+	for _, s := range cmd.Set {
+		n := strings.Index(s, "=")
+		if n <= 0 {
+			return fmt.Errorf("Invalid --set, expected name=value: %s", s)
+		}
+		cmd.sets = append(cmd.sets, queryFilter{field: s[:n], op: "=", value: parseFilterValue(s[n+1:])})
+	}
+
+	for _, s := range cmd.Rename {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid --rename, expected old:new: %s", s)
+		}
+		cmd.renames = append(cmd.renames, [2]string{parts[0], parts[1]})
+	}
+
+	if len(cmd.sets) == 0 && len(cmd.renames) == 0 && len(cmd.Delete) == 0 {
+		return fmt.Errorf("Nothing to update, give --set, --rename or --delete")
+	}
+	return nil
+}
+
+// updateBatch reads and writes the entities in a transaction so concurrent writes
+// aren't overwritten, only changed entities are written. It returns the number of
+// changed entities.
+func (cmd *UpdateFieldCmd) updateBatch(ctx context.Context, client *datastore.Client, keys []*datastore.Key) (int, error) {
+	changed := 0
+	update := func(get func([]*datastore.Key, interface{}) error, put func([]*datastore.Key, interface{}) error) error {
+		changed = 0
+		entities := make([]datastore.PropertyList, len(keys))
+		if err := get(keys, entities); err != nil {
+			return err
+		}
+
+		var changedKeys []*datastore.Key
+		var changedEntities []datastore.PropertyList
+		for i, props := range entities {
+			if props, ok := cmd.apply(props); ok {
+				changedKeys = append(changedKeys, keys[i])
+				changedEntities = append(changedEntities, props)
+			}
+		}
+
+		changed = len(changedKeys)
+		if changed == 0 || put == nil {
+			return nil
+		}
+		return put(changedKeys, changedEntities)
+	}
+
+	if cmd.DryRun {
+		err := update(func(keys []*datastore.Key, dst interface{}) error {
+			return client.GetMulti(ctx, keys, dst)
+		}, nil)
+		return changed, err
+	}
+
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return update(tx.GetMulti, func(keys []*datastore.Key, src interface{}) error {
+			_, err := tx.PutMulti(keys, src)
+			return err
+		})
+	})
+	return changed, err
+}
+
+// apply renames, sets and deletes properties in this order, it reports whether
+// the entity changed
+func (cmd *UpdateFieldCmd) apply(props datastore.PropertyList) (datastore.PropertyList, bool) {
+	changed := false
+
+	for _, r := range cmd.renames {
+		if !hasProperty(props, r[0]) {
+			continue
+		}
+		props = withoutProperty(props, r[1])
+		for i := range props {
+			if props[i].Name == r[0] {
+				props[i].Name = r[1]
+			}
+		}
+		changed = true
+	}
+
+	for _, s := range cmd.sets {
+		found := false
+		for i := range props {
+			if props[i].Name != s.field {
+				continue
+			}
+			found = true
+			if !reflect.DeepEqual(props[i].Value, s.value) {
+				props[i].Value = s.value
+				changed = true
+			}
+		}
+		if !found {
+			props = append(props, datastore.Property{Name: s.field, Value: s.value})
+			changed = true
+		}
+	}
+
+	for _, name := range cmd.Delete {
+		if hasProperty(props, name) {
+			props = withoutProperty(props, name)
+			changed = true
+		}
+	}
+	return props, changed
+}
+
+func hasProperty(props datastore.PropertyList, name string) bool {
+	for _, p := range props {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutProperty(props datastore.PropertyList, name string) datastore.PropertyList {
+	kept := props[:0]
+	for _, p := range props {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,219 @@
+package cdskit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/datastore"
+)
+
+// VerifyCmd checks that the entities of an export file or a backup still exist in
+// the project, e.g. after restore or copy-kind
+type VerifyCmd struct {
+	ProjectID    string   `short:"p" long:"project" description:"Project to be used." required:"true"`
+	Namespace    string   `short:"n" long:"namespace" description:"Namespace of the live entities, the namespace of the backup by default"`
+	Kind         string   `short:"k" long:"kind" description:"Kind of the live entities, required with --file"`
+	File         string   `short:"f" long:"file" description:"Export file to verify, written by export-kind with the __key__ field"`
+	Format       string   `long:"format" description:"Format of --file: json, jsonl, ndjson or typed-json (detected from the file extension by default)"`
+	Dir          string   `short:"d" long:"dir" description:"Backup directory to verify instead of --file, all kinds of its manifest are checked"`
+	Content      bool     `long:"content" description:"Also compare a hash of the properties of every entity, reporting the properties that differ"`
+	IgnoreFields []string `long:"ignore-field" description:"Property left out of --content, e.g. updatedAt (repeatable)"`
+	JSON         bool     `long:"json" description:"Write a JSON line per discrepancy"`
+	MaxRetries   int      `long:"max-retries" default:"5" description:"Number of retries of a call failing with a transient error, with exponential backoff"`
+}
+
+// verifyResult counts the checked entities of a file
+type verifyResult struct {
+	checked int
+	missing int
+	changed int
+}
+
+// Execute is called by go-flags
+func (cmd *VerifyCmd) Execute(args []string) error {
+	ctx, cancel := commandContext(false)
+	defer cancel()
+
+	if (cmd.File == "") == (cmd.Dir == "") {
+		return fmt.Errorf("Give either --file or --dir")
+	}
+	if cmd.File != "" && cmd.Kind == "" {
+		return fmt.Errorf("--kind is required with --file")
+	}
+
+	client, err := newClient(ctx, cmd.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	if cmd.File != "" {
+		res, err := cmd.verifyFile(ctx, client, cmd.File, cmd.Format, cmd.Namespace, cmd.Kind)
+		if err != nil {
+			return err
+		}
+		return cmd.finish(res)
+	}
+
+	manifestPath := filepath.Join(cmd.Dir, backupManifestFile)
+	b, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read the backup manifest: %w", err)
+	}
+
+	var manifest backupManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return fmt.Errorf("Invalid backup manifest %s: %w", manifestPath, err)
+	}
+
+	namespace := cmd.Namespace
+	if namespace == "" {
+		namespace = manifest.Namespace
+	}
+
+	total := verifyResult{}
+	for i, k := range manifest.Kinds {
+		infof("Verifying %s (%d/%d)", k.Kind, i+1, len(manifest.Kinds))
+
+		path := filepath.Join(cmd.Dir, k.File)
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != k.SHA256 {
+			return fmt.Errorf("Checksum of %s doesn't match the manifest, the backup is damaged", k.File)
+		}
+
+		res, err := cmd.verifyFile(ctx, client, path, manifest.kindFormat(k), namespace, k.Kind)
+		if err != nil {
+			return fmt.Errorf("Verification of %s failed: %w", k.Kind, err)
+		}
+		if res.checked != k.Entities {
+			warnf("%s has %d entities, the manifest lists %d", k.File, res.checked, k.Entities)
+		}
+
+		total.checked += res.checked
+		total.missing += res.missing
+		total.changed += res.changed
+	}
+	return cmd.finish(total)
+}
+
+// verifyFile looks up the keys of the file in batches and reports the missing and,
+// with --content, the changed entities
+func (cmd *VerifyCmd) verifyFile(ctx context.Context, client *datastore.Client, path string, format string, namespace string, kind string) (verifyResult, error) {
+	var res verifyResult
+
+	f, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+
+	defer f.Close()
+
+	imp := &ImportKindCmd{Kind: kind, Namespace: namespace, File: path, Format: format}
+	r, err := imp.newImportReader(f)
+	if err != nil {
+		return res, err
+	}
+
+	// the comparison of properties is shared with diff
+	cmp := &DiffCmd{IgnoreFields: cmd.IgnoreFields, JSON: cmd.JSON}
+
+	var keys []*datastore.Key
+	exported := make(map[string]diffFields)
+	check := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		var found []*dynamicEntity
+		var missing []*datastore.Key
+		err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+			found, missing, err = getEntities(ctx, client, keys, defaultValueOptions)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read %s: %w", kind, err)
+		}
+
+		for _, k := range missing {
+			res.missing++
+			if err := cmp.report(diffEntry{Key: keyPath(k), Change: "missing"}); err != nil {
+				return err
+			}
+		}
+
+		if cmd.Content {
+			for _, de := range found {
+				key := keyPath(de.key)
+				if changes := compareFields(exported[key], cmp.fields(de.value)); len(changes) > 0 {
+					res.changed++
+					if err := cmp.report(diffEntry{Key: key, Change: "changed", Fields: changes}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		res.checked += len(keys)
+		infof("Verifying %s - %d", kind, res.checked)
+		keys, exported = keys[:0], make(map[string]diffFields)
+		return nil
+	}
+
+	for n := 1; ; n++ {
+		de, err := r.ReadRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+
+		if err := imp.restoreKey(de); err != nil {
+			return res, err
+		}
+		if de.key == nil {
+			return res, fmt.Errorf("Record %d of %s has no key, export the kind with the __key__ field", n, path)
+		}
+
+		if cmd.Content {
+			// values are converted the way live entities are loaded
+			props, err := de.Save()
+			if err != nil {
+				return res, err
+			}
+			loaded := &dynamicEntity{}
+			if err := loaded.Load(props); err != nil {
+				return res, err
+			}
+			exported[keyPath(de.key)] = cmp.fields(loaded.value)
+		}
+
+		keys = append(keys, de.key)
+		if len(keys) == 500 {
+			if err := check(); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	return res, check()
+}
+
+// finish prints the totals and fails when any entity doesn't match
+func (cmd *VerifyCmd) finish(res verifyResult) error {
+	logEvent(logInfo, logFields{"event": "summary", "checked": res.checked, "missing": res.missing, "changed": res.changed},
+		"%d entities checked, %d missing, %d changed", res.checked, res.missing, res.changed)
+	if res.missing+res.changed > 0 {
+		return fmt.Errorf("%d of %d exported entities don't match the live data", res.missing+res.changed, res.checked)
+	}
+	return nil
+}
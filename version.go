@@ -0,0 +1,44 @@
+package cdskit
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is injected at build time with -ldflags "-X github.com/dpfg/cdskit.version=..."
+var version = "dev"
+
+// VersionCmd prints the version of the build
+type VersionCmd struct{}
+
+// Execute is called by go-flags
+func (cmd *VersionCmd) Execute(args []string) error {
+	printVersion()
+	return nil
+}
+
+func printVersion() {
+	fmt.Printf("cdskit %s\n", version)
+	fmt.Printf("go %s\n", runtime.Version())
+	fmt.Printf("cloud.google.com/go/datastore %s\n", moduleVersion("cloud.google.com/go/datastore"))
+}
+
+// moduleVersion returns the version of a dependency the binary is built with
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return "unknown"
+}
@@ -0,0 +1,296 @@
+package cdskit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// fetchResult is a batch loaded by one of the --workers
+type fetchResult struct {
+	batch   []*dynamicEntity
+	missing []*datastore.Key
+	err     error
+}
+
+// fetchParallel lists keys of the export, from the keys file or by a keys-only scan,
+// and loads them with GetMulti by the given number of workers. Batches come in no
+// particular order, the channel is closed after the last one or the first error.
+func (cmd *ExportKindCmd) fetchParallel(ctx context.Context, client *datastore.Client, opts *valueOptions, keys *keyList, workers int) <-chan fetchResult {
+	chunks := make(chan []*datastore.Key, workers)
+	results := make(chan fetchResult, workers)
+
+	send := func(r fetchResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				var batch []*dynamicEntity
+				var missing []*datastore.Key
+				err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+					batch, missing, err = getEntities(ctx, client, chunk, opts)
+					return err
+				})
+				if !send(fetchResult{batch: batch, missing: missing, err: err}) || err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		err := cmd.listKeys(ctx, client, keys, func(chunk []*datastore.Key) bool {
+			select {
+			case chunks <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		close(chunks)
+
+		wg.Wait()
+		if err != nil {
+			send(fetchResult{err: err})
+		}
+		close(results)
+	}()
+
+	return results
+}
+
+// listKeys passes keys to export in chunks of --page-size to fn until it returns false,
+// --offset and --limit are applied to the keys.
+func (cmd *ExportKindCmd) listKeys(ctx context.Context, client *datastore.Client, keys *keyList, fn func([]*datastore.Key) bool) error {
+	listed := 0
+	remaining := func() int {
+		if cmd.Limit > 0 {
+			return min(cmd.PageSize, cmd.Limit-listed)
+		}
+		return cmd.PageSize
+	}
+
+	if keys != nil {
+		for pos := keys.pos; pos < len(keys.keys) && remaining() > 0; {
+			chunk := keys.keys[pos:min(pos+remaining(), len(keys.keys))]
+			pos += len(chunk)
+			listed += len(chunk)
+			if !fn(chunk) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	var start datastore.Cursor
+	for remaining() > 0 {
+		q := cmd.newQuery().KeysOnly().Start(start).Limit(remaining())
+		if listed == 0 && cmd.Offset > 0 {
+			q = q.Offset(cmd.Offset)
+		}
+
+		var chunk []*datastore.Key
+		var cursor datastore.Cursor
+		err := withRetries(ctx, cmd.MaxRetries, func() error {
+			chunk = nil
+			it := client.Run(ctx, q)
+			for {
+				k, err := it.Next(nil)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				chunk = append(chunk, k)
+			}
+
+			var err error
+			cursor, err = it.Cursor()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(chunk) == 0 {
+			return nil
+		}
+		start = cursor
+		listed += len(chunk)
+
+		if !fn(chunk) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// fetchSharded splits the kind into key ranges at keys sampled by the __scatter__
+// property and exports the ranges by the given number of workers. Batches come in
+// no particular order, the channel is closed after the last one or the first error.
+func (cmd *ExportKindCmd) fetchSharded(ctx context.Context, client *datastore.Client, opts *valueOptions, workers int) <-chan fetchResult {
+	results := make(chan fetchResult, workers)
+
+	send := func(r fetchResult) bool {
+		select {
+		case results <- r:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(results)
+
+		// a few ranges per worker even out ranges of different size
+		splits, err := cmd.scatterSplits(ctx, client, workers*4)
+		if err != nil {
+			send(fetchResult{err: err})
+			return
+		}
+		infof("Exporting %d key ranges", len(splits)+1)
+
+		shards := make(chan [2]*datastore.Key, len(splits)+1)
+		for i := 0; i <= len(splits); i++ {
+			var shard [2]*datastore.Key
+			if i > 0 {
+				shard[0] = splits[i-1]
+			}
+			if i < len(splits) {
+				shard[1] = splits[i]
+			}
+			shards <- shard
+		}
+		close(shards)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for shard := range shards {
+					if !cmd.fetchRange(ctx, client, opts, shard[0], shard[1], send) {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return results
+}
+
+// fetchRange sends pages of entities with keys from lo up to hi, a nil key leaves the
+// range open. It returns false after an error or when sending is cancelled.
+func (cmd *ExportKindCmd) fetchRange(ctx context.Context, client *datastore.Client, opts *valueOptions, lo, hi *datastore.Key, send func(fetchResult) bool) bool {
+	q := cmd.newQuery()
+	if lo != nil {
+		q = q.Filter("__key__ >=", lo)
+	}
+	if hi != nil {
+		q = q.Filter("__key__ <", hi)
+	}
+	if len(cmd.projection) > 0 {
+		q = q.Project(cmd.projection...)
+	}
+
+	var start datastore.Cursor
+	for {
+		batch, cursor, err := cmd.fetchPage(ctx, client, q.Start(start).Limit(cmd.PageSize), opts, nil)
+		if err != nil {
+			send(fetchResult{err: err})
+			return false
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		if !send(fetchResult{batch: batch}) {
+			return false
+		}
+		start = cursor
+	}
+}
+
+// scatterSplits returns up to n-1 keys splitting the kind into ranges of similar size,
+// sampled from the keys with the highest __scatter__ values as Datastore recommends
+func (cmd *ExportKindCmd) scatterSplits(ctx context.Context, client *datastore.Client, n int) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(cmd.Kind).Namespace(cmd.Namespace).Order("__scatter__").KeysOnly().Limit(n * 32)
+	if cmd.ancestor != nil {
+		q = q.Ancestor(cmd.ancestor)
+	}
+
+	var sample []*datastore.Key
+	err := withRetries(ctx, cmd.MaxRetries, func() (err error) {
+		sample, err = client.GetAll(ctx, q, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sample keys of %s: %w", cmd.Kind, err)
+	}
+
+	sort.Slice(sample, func(i, j int) bool { return compareKeys(sample[i], sample[j]) < 0 })
+
+	var splits []*datastore.Key
+	for i := 1; i < n && len(sample) > 0; i++ {
+		k := sample[i*len(sample)/n]
+		if len(splits) == 0 || compareKeys(splits[len(splits)-1], k) < 0 {
+			splits = append(splits, k)
+		}
+	}
+	return splits, nil
+}
+
+// compareKeys orders keys of a namespace as Datastore does, element by element from
+// the root: by kind, then numeric IDs before names
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyElements(a), keyElements(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		ea, eb := pa[i], pb[i]
+		if c := strings.Compare(ea.Kind, eb.Kind); c != 0 {
+			return c
+		}
+
+		switch {
+		case ea.Name == "" && eb.Name != "":
+			return -1
+		case ea.Name != "" && eb.Name == "":
+			return 1
+		case ea.Name != "" || eb.Name != "":
+			if c := strings.Compare(ea.Name, eb.Name); c != 0 {
+				return c
+			}
+		case ea.ID < eb.ID:
+			return -1
+		case ea.ID > eb.ID:
+			return 1
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// keyElements returns the key path starting from the root ancestor
+func keyElements(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
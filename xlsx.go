@@ -0,0 +1,371 @@
+package cdskit
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxMaxCellText is the longest text Excel keeps in a cell
+const xlsxMaxCellText = 32767
+
+// xlsxWorkbook collects sheets written to temporary files, the .xlsx zip is written
+// when the workbook is complete since the header row needs all columns
+type xlsxWorkbook struct {
+	sheets []*xlsxSheet
+}
+
+// xlsxSheet holds the data rows of a sheet, the header row is written with them
+type xlsxSheet struct {
+	name    string
+	columns []string
+	index   map[string]int
+	rows    *os.File
+	buf     *bufio.Writer
+	count   int
+}
+
+// addSheet adds a sheet named after the kind, names are shortened to the 31
+// characters Excel allows and characters it rejects are replaced
+func (book *xlsxWorkbook) addSheet(kind string, columns []string) *xlsxSheet {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, kind)
+	if r := []rune(name); len(r) > 31 {
+		name = string(r[:31])
+	}
+	if name == "" {
+		name = "Sheet"
+	}
+
+	unique := name
+	for n := 2; book.hasSheet(unique); n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		r := []rune(name)
+		unique = string(r[:min(len(r), 31-len(suffix))]) + suffix
+	}
+
+	s := &xlsxSheet{name: unique, index: make(map[string]int)}
+	for _, c := range columns {
+		s.column(c)
+	}
+	book.sheets = append(book.sheets, s)
+	return s
+}
+
+func (book *xlsxWorkbook) hasSheet(name string) bool {
+	for _, s := range book.sheets {
+		if strings.EqualFold(s.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// column returns the index of the column, new columns are added to the right
+func (s *xlsxSheet) column(name string) int {
+	i, ok := s.index[name]
+	if !ok {
+		i = len(s.columns)
+		s.index[name] = i
+		s.columns = append(s.columns, name)
+	}
+	return i
+}
+
+// xlsxCell is a value of a data row, placed by its column
+type xlsxCell struct {
+	col   int
+	value interface{}
+}
+
+func (s *xlsxSheet) writeRow(cells []xlsxCell) error {
+	if s.rows == nil {
+		f, err := ioutil.TempFile("", "cdskit-xlsx-")
+		if err != nil {
+			return err
+		}
+		s.rows, s.buf = f, bufio.NewWriter(f)
+	}
+
+	// the header is row 1
+	s.count++
+	row := s.count + 1
+
+	sort.Slice(cells, func(i, j int) bool { return cells[i].col < cells[j].col })
+	fmt.Fprintf(s.buf, `<row r="%d">`, row)
+	for _, c := range cells {
+		writeXLSXCell(s.buf, xlsxColumnName(c.col)+strconv.Itoa(row), c.value)
+	}
+	_, err := s.buf.WriteString("</row>")
+	return err
+}
+
+// writeXLSXCell writes numbers, booleans and times as typed cells and anything
+// else as inline text, so leading zeros and date-like strings are kept as they are
+func writeXLSXCell(w *bufio.Writer, ref string, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+	case int64:
+		// Excel keeps 15 significant digits, larger integers stay exact as text
+		if v > 1<<53 || v < -(1<<53) {
+			writeXLSXText(w, ref, strconv.FormatInt(v, 10), 0)
+			return
+		}
+		fmt.Fprintf(w, `<c r="%s"><v>%d</v></c>`, ref, v)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			writeXLSXText(w, ref, strconv.FormatFloat(v, 'g', -1, 64), 0)
+			return
+		}
+		fmt.Fprintf(w, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		b := 0
+		if v {
+			b = 1
+		}
+		fmt.Fprintf(w, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+	case time.Time:
+		fmt.Fprintf(w, `<c r="%s" s="1"><v>%s</v></c>`, ref, strconv.FormatFloat(xlsxSerial(v), 'f', -1, 64))
+	case string:
+		writeXLSXText(w, ref, v, 0)
+	default:
+		writeXLSXText(w, ref, fmt.Sprint(v), 0)
+	}
+}
+
+// writeXLSXText writes an inline string cell with the style
+func writeXLSXText(w *bufio.Writer, ref string, s string, style int) {
+	if r := []rune(s); len(r) > xlsxMaxCellText {
+		s = string(r[:xlsxMaxCellText])
+	}
+
+	if style > 0 {
+		fmt.Fprintf(w, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+	} else {
+		fmt.Fprintf(w, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+	}
+	xml.EscapeText(w, []byte(s))
+	w.WriteString("</t></is></c>")
+}
+
+// xlsxSerial converts the wall clock time into days since 1899-12-30, the date
+// serial of Excel, so the cell shows the time in its own offset
+func xlsxSerial(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)).Hours() / 24
+}
+
+// xlsxColumnName returns the letters of the column, A for 0, AA for 26
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// write stores the workbook into w and removes the temporary files
+func (book *xlsxWorkbook) write(w io.Writer) error {
+	defer book.Close()
+
+	zw := zip.NewWriter(w)
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", book.contentTypes()},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", book.workbook()},
+		{"xl/_rels/workbook.xml.rels", book.relationships()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, f.content); err != nil {
+			return err
+		}
+	}
+
+	for i, s := range book.sheets {
+		fw, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := s.write(fw); err != nil {
+			return fmt.Errorf("Unable to write sheet %s: %w", s.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+// write writes the sheet with a frozen bold header row followed by the data rows
+func (s *xlsxSheet) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData><row r="1">`)
+	for i, c := range s.columns {
+		writeXLSXText(bw, xlsxColumnName(i)+"1", c, 2)
+	}
+	bw.WriteString("</row>")
+
+	if s.rows != nil {
+		if err := s.buf.Flush(); err != nil {
+			return err
+		}
+		if _, err := s.rows.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(bw, s.rows); err != nil {
+			return err
+		}
+	}
+
+	bw.WriteString("</sheetData></worksheet>")
+	return bw.Flush()
+}
+
+// Close removes the temporary files of the sheets
+func (book *xlsxWorkbook) Close() error {
+	for _, s := range book.sheets {
+		if s.rows != nil {
+			s.rows.Close()
+			os.Remove(s.rows.Name())
+			s.rows = nil
+		}
+	}
+	return nil
+}
+
+func (book *xlsxWorkbook) contentTypes() string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := range book.sheets {
+		fmt.Fprintf(&sb, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+	}
+	sb.WriteString(`</Types>`)
+	return sb.String()
+}
+
+func (book *xlsxWorkbook) workbook() string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	for i, s := range book.sheets {
+		sb.WriteString(`<sheet name="`)
+		xml.EscapeText(&sb, []byte(s.name))
+		fmt.Fprintf(&sb, `" sheetId="%d" r:id="rId%d"/>`, i+1, i+1)
+	}
+	sb.WriteString(`</sheets></workbook>`)
+	return sb.String()
+}
+
+func (book *xlsxWorkbook) relationships() string {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := range book.sheets {
+		fmt.Fprintf(&sb, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	fmt.Fprintf(&sb, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(book.sheets)+1)
+	sb.WriteString(`</Relationships>`)
+	return sb.String()
+}
+
+// xlsxStyles defines the cell formats: 0 general, 1 date and time, 2 bold header
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+	`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
+
+// xlsxExportWriter adds the records to a sheet of the workbook, nested properties
+// become parent:child columns and arrays are joined as by --array-mode cell
+type xlsxExportWriter struct {
+	writer  io.Writer
+	book    *xlsxWorkbook
+	sheet   *xlsxSheet
+	kind    string
+	columns []string
+	opts    csvOptions
+	// shared workbooks get a sheet per kind and are written once all kinds are exported
+	shared bool
+}
+
+func (format *xlsxExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (format *xlsxExportWriter) WriterRecord(de *dynamicEntity) error {
+	if format.sheet == nil {
+		format.sheet = format.book.addSheet(format.kind, format.columns)
+	}
+
+	var cells []xlsxCell
+	traverse(de.value, func(name string, v interface{}) {
+		switch tv := v.(type) {
+		case []interface{}:
+			v = format.opts.formatArray(tv)
+		case string:
+			// timestamps are exported as strings, typed by the loaded property
+			if de.types[name] == "time" {
+				if t, err := time.Parse(time.RFC3339Nano, tv); err == nil {
+					v = t
+				}
+			}
+		}
+		cells = append(cells, xlsxCell{col: format.sheet.column(name), value: v})
+	})
+
+	if err := format.sheet.writeRow(cells); err != nil {
+		return &outputError{fmt.Errorf("Unable to write entry: %w", err)}
+	}
+	return nil
+}
+
+// Close removes temporary files of a workbook which wasn't written
+func (format *xlsxExportWriter) Close() error {
+	if format.shared {
+		return nil
+	}
+	return format.book.Close()
+}
+
+func (format *xlsxExportWriter) WriteFooter() error {
+	if format.sheet == nil {
+		format.sheet = format.book.addSheet(format.kind, format.columns)
+	}
+	if format.shared {
+		return nil
+	}
+	return format.book.write(format.writer)
+}
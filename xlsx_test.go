@@ -0,0 +1,186 @@
+package cdskit
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// readXLSX reads the sheets of a workbook by name as rows of header column to value,
+// numeric cells are float64 or, with a date format, time.Time
+func readXLSX(t *testing.T, b []byte) map[string][]map[string]interface{} {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+	parts := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	decode := func(name string, v interface{}) {
+		t.Helper()
+		if err := xml.Unmarshal(parts[name], v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	decode("_rels/.rels", &rels)
+	workbookPath := rels.Relationships[0].Target
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	decode(workbookPath, &workbook)
+	decode(path.Join(path.Dir(workbookPath), "_rels", path.Base(workbookPath)+".rels"), &rels)
+	targets := make(map[string]string)
+	for _, r := range rels.Relationships {
+		targets[r.ID] = path.Join(path.Dir(workbookPath), r.Target)
+	}
+
+	// the styles whose number format shows a date
+	var styles struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	decode(path.Join(path.Dir(workbookPath), "styles.xml"), &styles)
+	dateFormats := make(map[int]bool)
+	for _, f := range styles.NumFmts {
+		dateFormats[f.ID] = regexp.MustCompile(`y+|d+`).MatchString(f.Code)
+	}
+
+	sheets := make(map[string][]map[string]interface{})
+	for _, s := range workbook.Sheets {
+		var sheet struct {
+			Rows []struct {
+				Cells []struct {
+					Ref    string `xml:"r,attr"`
+					Type   string `xml:"t,attr"`
+					Style  int    `xml:"s,attr"`
+					Value  string `xml:"v"`
+					Inline string `xml:"is>t"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		decode(targets[s.RID], &sheet)
+
+		header := make(map[string]string)
+		var rows []map[string]interface{}
+		for i, row := range sheet.Rows {
+			values := make(map[string]interface{})
+			for _, c := range row.Cells {
+				col := regexp.MustCompile(`^[A-Z]+`).FindString(c.Ref)
+				var v interface{}
+				switch c.Type {
+				case "inlineStr":
+					v = c.Inline
+				case "b":
+					v = c.Value == "1"
+				case "":
+					f, err := strconv.ParseFloat(c.Value, 64)
+					if err != nil {
+						t.Fatalf("cell %s: %v", c.Ref, err)
+					}
+					v = f
+					if dateFormats[styles.CellXfs[c.Style].NumFmtID] {
+						// serials keep about a millisecond of precision
+						days, frac := math.Modf(f)
+						v = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(days)).Add(time.Duration(frac * 24 * float64(time.Hour))).Round(time.Millisecond)
+					}
+				default:
+					t.Fatalf("cell %s of unexpected type %s", c.Ref, c.Type)
+				}
+
+				if i == 0 {
+					header[col] = v.(string)
+				} else {
+					values[header[col]] = v
+				}
+			}
+			if i > 0 {
+				rows = append(rows, values)
+			}
+		}
+		sheets[s.Name] = rows
+	}
+	return sheets
+}
+
+func TestExportXLSX(t *testing.T) {
+	created := time.Date(2023, 5, 1, 12, 30, 0, 0, time.UTC)
+	entities := []*pb.Entity{
+		fakeEntity("Item", 1, map[string]interface{}{
+			"name":    "a & b",
+			"code":    "007",
+			"n":       1,
+			"big":     int64(1) << 60,
+			"price":   1.5,
+			"ok":      true,
+			"created": created,
+			"address": map[string]interface{}{"city": "Berlin"},
+		}),
+		fakeEntity("Item", 2, map[string]interface{}{
+			"name":  "2023-01-01",
+			"n":     2,
+			"price": 2.0,
+			"ok":    false,
+		}),
+	}
+	out, _ := runTestExport(t, entities, map[string]interface{}{"format": "xlsx", "no-key": true})
+
+	sheets := readXLSX(t, []byte(out))
+	want := map[string][]map[string]interface{}{
+		"Item": {
+			{
+				"name":         "a & b",
+				"code":         "007",
+				"n":            1.0,
+				"big":          "1152921504606846976",
+				"price":        1.5,
+				"ok":           true,
+				"created":      created,
+				"address:city": "Berlin",
+			},
+			{
+				"name":  "2023-01-01",
+				"n":     2.0,
+				"price": 2.0,
+				"ok":    false,
+			},
+		},
+	}
+	if !reflect.DeepEqual(sheets, want) {
+		t.Errorf("workbook has %v, want %v", sheets, want)
+	}
+}